@@ -0,0 +1,303 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// accessLog writes one line per request to stdout. The logger serializes the
+// writes, so lines from concurrent requests don't interleave.
+var accessLog = log.New(os.Stdout, "", 0)
+
+// logFormat is "text" for the common log format-like lines, "json", or
+// "custom" when ACCESS_LOG_FORMAT is set.
+var logFormat string
+
+// accessLogFormat is a format string with $context variables, like API
+// Gateway's access log format.
+var accessLogFormat string
+
+type accessLogEntry struct {
+	Time             string  `json:"time"`
+	Host             string  `json:"host"`
+	Method           string  `json:"method"`
+	Path             string  `json:"path"`
+	Query            string  `json:"query"`
+	Protocol         string  `json:"protocol"`
+	Status           int     `json:"status"`
+	ResponseBytes    int64   `json:"responseBytes"`
+	DurationMs       float64 `json:"durationMs"`
+	InvokeDurationMs float64 `json:"invokeDurationMs"`
+	RequestID        string  `json:"requestId"`
+	LambdaHost       string  `json:"lambdaHost,omitempty"`
+	ErrorType        string  `json:"errorType,omitempty"`
+}
+
+// logRequestText writes the access log line for a request in the text format,
+// which is similar to the common log format:
+// host [date] "method path protocol" status bytes requestId lambdaHost
+// The status and the size are what was actually sent to the client, which
+// includes the errors generated by the gateway.
+func logRequestText(r *http.Request, inv *invocation, sw *statusWriter) {
+	requestID, lambdaHost := "-", "-"
+	if inv != nil {
+		requestID = inv.requestID
+		if inv.route != nil {
+			lambdaHost = inv.route.lambdaHost
+		}
+	}
+	accessLog.Printf("%s [%v] \"%s %s %s\" %d %d %s %s", r.Host, time.Now().Format("2006-01-02 15:04:05"), r.Method, r.URL.Path, r.Proto, sw.status, sw.written, requestID, lambdaHost)
+}
+
+// logRequestJSON writes the access log entry for a request in the json
+// format. inv is nil if the request was rejected before it got a request id.
+func logRequestJSON(r *http.Request, inv *invocation, sw *statusWriter, start time.Time) {
+	entry := accessLogEntry{
+		Time:          start.UTC().Format(time.RFC3339Nano),
+		Host:          r.Host,
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Query:         r.URL.RawQuery,
+		Protocol:      r.Proto,
+		Status:        sw.status,
+		ResponseBytes: sw.written,
+		DurationMs:    milliseconds(time.Since(start)),
+	}
+	if inv != nil {
+		entry.InvokeDurationMs = milliseconds(inv.invokeDuration)
+		entry.RequestID = inv.requestID
+		entry.ErrorType = inv.errorType
+		if inv.route != nil {
+			entry.LambdaHost = inv.route.lambdaHost
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding access log entry: %v", err)
+		return
+	}
+	accessLog.Print(string(line))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+var contextVariableRegexp = regexp.MustCompile(`\$context\.[A-Za-z0-9_.]*[A-Za-z0-9_]`)
+
+// logRequestCustom writes the access log entry for a request using
+// ACCESS_LOG_FORMAT. Unknown variables and empty values are written as "-",
+// just like API Gateway does.
+func logRequestCustom(r *http.Request, inv *invocation, sw *statusWriter, start time.Time) {
+	line := contextVariableRegexp.ReplaceAllStringFunc(accessLogFormat, func(variable string) string {
+		value := contextVariable(strings.TrimPrefix(variable, "$context."), r, inv, sw, start)
+		if value == "" {
+			return "-"
+		}
+		return value
+	})
+	accessLog.Print(line)
+}
+
+// contextVariable returns the value of a $context variable in the access log
+// format. The variables are listed in the README.
+func contextVariable(name string, r *http.Request, inv *invocation, sw *statusWriter, start time.Time) string {
+	switch name {
+	case "httpMethod":
+		return r.Method
+	case "path":
+		return "/" + stage + r.URL.Path
+	case "protocol":
+		return r.Proto
+	case "domainName":
+		return hostWithoutPort(r.Host)
+	case "stage":
+		return stage
+	case "apiId":
+		return apiID
+	case "accountId":
+		return accountID
+	case "requestTime":
+		return start.Format("02/Jan/2006:15:04:05 -0700")
+	case "requestTimeEpoch":
+		return fmt.Sprint(start.UnixNano() / int64(time.Millisecond))
+	case "status":
+		return fmt.Sprint(sw.status)
+	case "responseLength":
+		return fmt.Sprint(sw.written)
+	case "responseLatency":
+		return fmt.Sprint(time.Since(start).Milliseconds())
+	case "identity.sourceIp":
+		return sourceIP(r)
+	case "identity.userAgent":
+		return r.UserAgent()
+	}
+	if inv == nil {
+		return ""
+	}
+	switch name {
+	case "requestId", "extendedRequestId":
+		return inv.requestID
+	case "xrayTraceId":
+		return inv.traceID
+	case "resourcePath":
+		if res, _ := inv.config.matchResource(r.URL.EscapedPath()); res != nil {
+			return res.template
+		}
+		template, _, _ := proxyResource(r.URL.EscapedPath())
+		return template
+	case "integrationLatency", "integration.latency":
+		if inv.invokeDuration == 0 {
+			return ""
+		}
+		return fmt.Sprint(inv.invokeDuration.Milliseconds())
+	case "integrationErrorMessage", "integration.error":
+		return inv.errorType
+	case "error.message":
+		if inv.gatewayError != nil {
+			return inv.gatewayError.message
+		}
+	case "error.responseType":
+		if inv.gatewayError != nil {
+			return inv.gatewayError.responseType
+		}
+	case "identity.apiKey":
+		if inv.apiKey != nil {
+			return inv.apiKey.value
+		}
+	case "identity.apiKeyId":
+		if inv.apiKey != nil {
+			return inv.apiKey.id
+		}
+	case "identity.cognitoIdentityId":
+		return inv.cognitoIdentityID
+	case "authorizer.principalId":
+		if inv.authorizer != nil {
+			return fmt.Sprint(inv.authorizer["principalId"])
+		}
+	}
+	return ""
+}
+
+// logFile is an access log file that is rotated when it grows larger than
+// maxSize, keeping maxFiles rotated files (file.1 being the newest). Lines
+// are written to stderr if the file can't be written, so they aren't lost.
+type logFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	hup      chan os.Signal
+}
+
+// accessLogOutput is the file opened for ACCESS_LOG_FILE, which is closed by
+// Gateway.Close.
+var accessLogOutput *logFile
+
+func openLogFile(path string, maxSize int64, maxFiles int) (*logFile, error) {
+	f := &logFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	// Reopen the file on SIGHUP, after it was moved by an external tool
+	// like logrotate
+	f.hup = make(chan os.Signal, 1)
+	signal.Notify(f.hup, syscall.SIGHUP)
+	go func() {
+		for range f.hup {
+			f.mu.Lock()
+			f.file.Close()
+			if err := f.open(); err != nil {
+				log.Printf("Error reopening access log, writing to stderr: %v", err)
+			}
+			f.mu.Unlock()
+		}
+	}()
+	return f, nil
+}
+
+// close stops reopening the file on SIGHUP and closes it.
+func (f *logFile) close() {
+	signal.Stop(f.hup)
+	close(f.hup)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		f.file = nil
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		f.file = nil
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+// rotate renames file.1 to file.2 and so on, renames the file to file.1, and
+// opens a new file.
+func (f *logFile) rotate() error {
+	f.file.Close()
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	var err error
+	if f.maxFiles > 0 {
+		err = os.Rename(f.path, f.path+".1")
+	} else {
+		err = os.Remove(f.path)
+	}
+	if openErr := f.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+func (f *logFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			log.Printf("Error rotating access log: %v", err)
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return os.Stderr.Write(b)
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing access log, writing to stderr: %v", err)
+		return os.Stderr.Write(b[n:])
+	}
+	return n, nil
+}
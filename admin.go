@@ -0,0 +1,448 @@
+package gateway
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The admin API is served on a separate localhost listener, so it is never
+// reachable through the gateway itself.
+
+// adminStats counts requests for GET /stats. It is nil when the admin API is
+// disabled.
+var adminStats *requestStats
+
+// configMu serializes changes to the current config, which are made by the
+// config file watcher and by POST /routes.
+var configMu sync.Mutex
+
+// adminRoutes are the routes added with POST /routes. They override the
+// configured routes with the same prefix, also after the config is reloaded.
+var adminRoutes []*route
+
+// secretOptions are not shown by GET /config.
+var secretOptions = map[string]bool{
+	"API_KEYS":   true,
+	"JWT_SECRET": true,
+}
+
+// latencySamples is the number of recent invocations used for the latency
+// percentiles.
+const latencySamples = 1000
+
+type requestStats struct {
+	requests     atomic.Int64
+	byStatus     [6]atomic.Int64 // indexed by status / 100
+	invocations  atomic.Int64
+	invokeErrors atomic.Int64
+	lambdaErrors atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	// The phases of the requests that invoked a lambda, added up
+	phaseRequests int64
+	phaseTotals   requestPhases
+}
+
+func (s *requestStats) recordResponse(status int) {
+	s.requests.Add(1)
+	if status/100 < len(s.byStatus) {
+		s.byStatus[status/100].Add(1)
+	}
+}
+
+func (s *requestStats) recordInvoke(d time.Duration, err error) {
+	s.invocations.Add(1)
+	if _, ok := err.(*lambdaError); ok {
+		s.lambdaErrors.Add(1)
+	} else if err != nil {
+		s.invokeErrors.Add(1)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.latencies) < latencySamples {
+		s.latencies = append(s.latencies, d)
+	} else {
+		s.latencies[s.next] = d
+		s.next = (s.next + 1) % latencySamples
+	}
+}
+
+func (s *requestStats) recordPhases(p requestPhases) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phaseRequests++
+	s.phaseTotals.marshal += p.marshal
+	s.phaseTotals.dial += p.dial
+	s.phaseTotals.invoke += p.invoke
+	s.phaseTotals.write += p.write
+}
+
+// averagePhases returns the average time of each phase of the requests that
+// invoked a lambda, in milliseconds.
+func (s *requestStats) averagePhases() map[string]float64 {
+	s.mu.Lock()
+	n, totals := s.phaseRequests, s.phaseTotals
+	s.mu.Unlock()
+	average := func(d time.Duration) float64 {
+		if n == 0 {
+			return 0
+		}
+		return float64((d / time.Duration(n)).Microseconds()) / 1000
+	}
+	return map[string]float64{
+		"marshal": average(totals.marshal),
+		"dial":    average(totals.dial),
+		"invoke":  average(totals.invoke),
+		"write":   average(totals.write),
+	}
+}
+
+// percentiles returns the given percentiles of the recent invoke latencies,
+// in milliseconds.
+func (s *requestStats) percentiles(ps ...float64) []float64 {
+	s.mu.Lock()
+	sorted := append([]time.Duration(nil), s.latencies...)
+	s.mu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	result := make([]float64, len(ps))
+	if len(sorted) == 0 {
+		return result
+	}
+	for i, p := range ps {
+		d := sorted[int(p*float64(len(sorted)-1))]
+		result[i] = float64(d.Microseconds()) / 1000
+	}
+	return result
+}
+
+// debugVars are the counters published with expvar at /debug/vars on the
+// admin listener. They are nil unless DEBUG_ENDPOINTS is set.
+var debugVars *debugCounters
+
+type debugCounters struct {
+	requests     *expvar.Int
+	invokeErrors *expvar.Int
+	bytesProxied *expvar.Int
+}
+
+func newDebugVars() *debugCounters {
+	return &debugCounters{
+		requests:     expvar.NewInt("requests_served"),
+		invokeErrors: expvar.NewInt("invoke_errors"),
+		bytesProxied: expvar.NewInt("bytes_proxied"),
+	}
+}
+
+// statusWriter records the status code and the size of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// WriteString lets io.Copy write a string body without copying it to a
+// []byte first.
+func (w *statusWriter) WriteString(s string) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.WriteString(w.ResponseWriter, s)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController hijack the connection, e.g. for the
+// upgraded connections of proxy routes.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// overrideRoutes returns routes with the routes in overrides added, replacing
+// the routes with the same prefix. The overrides are copied, so that they can
+// be given a pool without affecting other configs.
+func overrideRoutes(routes []*route, overrides []*route) []*route {
+	for _, o := range overrides {
+		var merged []*route
+		for _, rt := range routes {
+			if rt.prefix != o.prefix {
+				merged = append(merged, rt)
+			}
+		}
+		rt := *o
+		routes = append(merged, &rt)
+	}
+	return routes
+}
+
+func serveAdmin(port int) {
+	// Listen on the loopback interface only, the admin API can change the
+	// gateway's configuration
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		log.Fatal("Admin listen: ", err)
+	}
+	fmt.Fprintf(os.Stderr, "Admin API listening on: %s\n", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", handleAdminConfig)
+	mux.HandleFunc("/stats", handleAdminStats)
+	mux.HandleFunc("/routes", handleAdminRoutes)
+	mux.HandleFunc("/loglevel", handleAdminLogLevel)
+	mux.HandleFunc("/schedules", handleAdminSchedules)
+	mux.HandleFunc("/usage", handleAdminUsage)
+	mux.HandleFunc("/chaos", handleAdminChaos)
+	if debugVars != nil {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", expvar.Handler())
+		fmt.Fprintf(os.Stderr, "Debug endpoints: http://%s/debug/pprof/ and http://%s/debug/vars\n", listener.Addr(), listener.Addr())
+	}
+	go func() {
+		log.Fatal("Admin serve: ", http.Serve(listener, protectAdmin(port, mux)))
+	}()
+}
+
+// protectAdmin rejects requests that aren't addressed to the loopback
+// interface, and the requests that change the gateway unless they have a JSON
+// body and don't come from another origin. Any web page that the developer
+// opens can send a POST to 127.0.0.1, but without JavaScript's permission to
+// read the response that can only be a simple request, which can't have
+// Content-Type: application/json, and browsers add the page's Origin header.
+// A page on a domain that it rebinds to 127.0.0.1 is on the same origin as
+// far as the browser is concerned, but its requests still carry its own
+// domain in the Host header.
+func protectAdmin(port int, next http.Handler) http.Handler {
+	hosts := map[string]bool{}
+	for _, host := range []string{"localhost", "127.0.0.1", "[::1]"} {
+		hosts[host] = true
+		hosts[fmt.Sprintf("%s:%d", host, port)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hosts[strings.ToLower(r.Host)] {
+			writeAdminError(w, http.StatusForbidden, "Host is not allowed")
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			writeAdminError(w, http.StatusForbidden, "Cross-origin requests are not allowed")
+			return
+		}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			writeAdminError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"message": message})
+}
+
+type adminRoute struct {
+	Prefix     string `json:"prefix,omitempty"`
+	Host       string `json:"host,omitempty"`
+	LambdaHost string `json:"lambdaHost"`
+	Strip      bool   `json:"strip,omitempty"`
+	APIKey     bool   `json:"apiKey,omitempty"`
+	Async      bool   `json:"async,omitempty"`
+}
+
+func adminRouteList(routes []*route) []adminRoute {
+	list := []adminRoute{}
+	for _, rt := range routes {
+		list = append(list, adminRoute{rt.prefix, rt.host, rt.lambdaHost, rt.stripPrefix, rt.requireAPIKey, rt.async})
+	}
+	return list
+}
+
+// handleAdminConfig returns the effective configuration: the settings from
+// flags, environment variables and the config file, and what was made of
+// them.
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	config := currentConfig.Load()
+	var resources []string
+	for _, res := range config.resources {
+		resources = append(resources, res.template)
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+		"settings":       config.settings,
+		"lambdaHost":     config.defaultRoute.lambdaHost,
+		"routes":         adminRouteList(config.routes),
+		"hostRoutes":     adminRouteList(config.hostRoutes),
+		"resources":      resources,
+		"stageVariables": config.stageVariables,
+		"debug":          debug.Load(),
+	})
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	responses := map[string]int64{}
+	for i := 1; i < len(adminStats.byStatus); i++ {
+		responses[fmt.Sprintf("%dxx", i)] = adminStats.byStatus[i].Load()
+	}
+	latency := adminStats.percentiles(0.5, 0.99)
+	stats := map[string]interface{}{
+		"requests":          adminStats.requests.Load(),
+		"inFlightRequests":  inFlightRequests.Load(),
+		"responses":         responses,
+		"invocations":       adminStats.invocations.Load(),
+		"invokeErrors":      adminStats.invokeErrors.Load(),
+		"lambdaErrors":      adminStats.lambdaErrors.Load(),
+		"recoveredPanics":   recoveredPanics.Load(),
+		"cancelledRequests": cancelledRequests.Load(),
+		"slowRequests":      slowRequests.Load(),
+		"concurrency": map[string]int64{
+			"limit":     int64(maxConcurrency),
+			"inFlight":  invocationsInFlight.Load(),
+			"throttles": throttles.Load(),
+		},
+		"invokeLatencyMs": map[string]float64{
+			"p50": latency[0],
+			"p99": latency[1],
+		},
+		"averagePhaseMs": adminStats.averagePhases(),
+	}
+	if config := currentConfig.Load(); len(config.defaultRoute.backends) > 0 {
+		backends := map[string]interface{}{}
+		for _, b := range config.defaultRoute.backends {
+			backends[b.lambdaHost] = map[string]interface{}{
+				"requests": b.pool.health.requests.Load(),
+				"healthy":  !b.pool.health.down.Load(),
+			}
+		}
+		stats["backends"] = backends
+	}
+	if circuitBreakerThreshold > 0 {
+		breakers := map[string]adminCircuitBreaker{}
+		pools.Lock()
+		for host, p := range pools.byHost {
+			breakers[host] = p.breaker.status()
+		}
+		pools.Unlock()
+		stats["circuitBreakers"] = breakers
+	}
+	writeAdminJSON(w, http.StatusOK, stats)
+}
+
+// handleAdminRoutes lists the routes, or adds a route in the same format as
+// ROUTES, e.g. {"route": "/api/*=localhost:8003;strip"}.
+func handleAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeAdminJSON(w, http.StatusOK, adminRouteList(currentConfig.Load().routes))
+		return
+	} else if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	var body struct {
+		Route string `json:"route"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err))
+		return
+	}
+	routes, err := parseRoutes(body.Route)
+	if err != nil || len(routes) != 1 {
+		writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("Invalid route %q (expected /prefix/*=host:port)", body.Route))
+		return
+	}
+	rt := routes[0]
+	if rt.requireAPIKey && apiKeys == nil {
+		writeAdminError(w, http.StatusBadRequest, "No API_KEYS or API_KEYS_FILE are configured")
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	adminRoutes = overrideRoutes(adminRoutes, routes)
+	config := *currentConfig.Load()
+	config.routes = overrideRoutes(config.routes, routes)
+	sortRoutes(config.routes)
+	for _, rt := range config.routes {
+		if rt.prefix == routes[0].prefix {
+			rt.pool = poolFor(rt.lambdaHost)
+		}
+	}
+	currentConfig.Store(&config)
+	log.Printf("Admin API added route: %s/* -> %s", rt.prefix, rt.lambdaHost)
+	writeAdminJSON(w, http.StatusOK, adminRouteList(config.routes))
+}
+
+// handleAdminLogLevel turns debug logging on or off, e.g. {"debug": true}.
+func handleAdminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var body struct {
+			Debug *bool `json:"debug"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Debug == nil {
+			writeAdminError(w, http.StatusBadRequest, `Invalid body (expected {"debug": true} or {"debug": false})`)
+			return
+		}
+		debug.Store(*body.Debug)
+		log.Printf("Admin API set debug logging to %v", *body.Debug)
+	} else if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]bool{"debug": debug.Load()})
+}
@@ -0,0 +1,60 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProtectAdmin(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		origin      string
+		host        string
+		want        int
+	}{
+		{"GET", "GET", "", "", "", http.StatusOK},
+		{"GET from another origin", "GET", "", "http://evil.example", "", http.StatusOK},
+		{"JSON", "POST", "application/json", "", "", http.StatusOK},
+		{"JSON with charset", "POST", "application/json; charset=utf-8", "", "", http.StatusOK},
+		{"JSON from the same origin", "POST", "application/json", "http://127.0.0.1:9000", "", http.StatusOK},
+		{"no Content-Type", "POST", "", "", "", http.StatusUnsupportedMediaType},
+		{"form", "POST", "application/x-www-form-urlencoded", "", "", http.StatusUnsupportedMediaType},
+		{"text", "POST", "text/plain", "", "", http.StatusUnsupportedMediaType},
+		{"simple request from a web page", "POST", "text/plain", "http://evil.example", "", http.StatusForbidden},
+		{"JSON from another origin", "POST", "application/json", "http://evil.example", "", http.StatusForbidden},
+		{"JSON from an opaque origin", "POST", "application/json", "null", "", http.StatusForbidden},
+		{"localhost", "POST", "application/json", "http://localhost:9000", "localhost:9000", http.StatusOK},
+		{"IPv6 loopback", "GET", "", "", "[::1]:9000", http.StatusOK},
+		{"without the port", "GET", "", "", "LOCALHOST", http.StatusOK},
+		{"GET with a forged Host", "GET", "", "", "evil.example", http.StatusForbidden},
+		{"GET from a rebound domain", "GET", "", "", "evil.example:9000", http.StatusForbidden},
+		{"JSON from a rebound domain", "POST", "application/json", "http://evil.example:9000", "evil.example:9000", http.StatusForbidden},
+		{"another port", "GET", "", "", "127.0.0.1:8080", http.StatusForbidden},
+	}
+	handler := protectAdmin(9000, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "http://127.0.0.1:9000/loglevel", strings.NewReader(`{"debug": true}`))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if test.host != "" {
+				r.Host = test.host
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("got %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// handleALBRequest builds an Application Load Balancer target group event,
+// invokes the lambda and converts its response into the proxy response that
+// is written to the client.
+func handleALBRequest(inv *invocation, r *http.Request, body []byte) (*events.APIGatewayProxyResponse, error) {
+	request := newALBRequest(r, body)
+
+	payload, err := marshalEvent(inv, request)
+	if err != nil {
+		return nil, err
+	}
+
+	responsePayload, err := invokeLambda(inv, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var response events.ALBTargetGroupResponse
+	err = unmarshalResponse(responsePayload, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	// Just like the ALB, only the header map matching the target group
+	// setting is used
+	proxyResponse := &events.APIGatewayProxyResponse{
+		StatusCode:      response.StatusCode,
+		Body:            response.Body,
+		IsBase64Encoded: response.IsBase64Encoded,
+	}
+	if albMultiValueHeaders {
+		proxyResponse.MultiValueHeaders = response.MultiValueHeaders
+	} else {
+		proxyResponse.Headers = response.Headers
+	}
+	return proxyResponse, nil
+}
+
+func newALBRequest(r *http.Request, body []byte) *events.ALBTargetGroupRequest {
+	request := &events.ALBTargetGroupRequest{
+		HTTPMethod: r.Method,
+		Path:       r.URL.Path,
+		RequestContext: events.ALBTargetGroupRequestContext{
+			ELB: events.ELBContext{
+				TargetGroupArn: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/local/0000000000000000",
+			},
+		},
+		Body:            string(body),
+		IsBase64Encoded: false,
+	}
+
+	// The ALB lowercases header names, and only populates the single-value or
+	// the multi-value maps depending on the target group setting
+	if albMultiValueHeaders {
+		request.MultiValueHeaders = map[string][]string{
+			"host": []string{r.Host},
+		}
+		request.MultiValueQueryStringParameters = map[string][]string{}
+	} else {
+		request.Headers = map[string]string{
+			"host": r.Host,
+		}
+		request.QueryStringParameters = map[string]string{}
+	}
+	for header, values := range r.Header {
+		if header == "Host" {
+			continue
+		}
+		header = strings.ToLower(header)
+		for _, value := range values {
+			if albMultiValueHeaders {
+				request.MultiValueHeaders[header] = append(request.MultiValueHeaders[header], value)
+			} else {
+				request.Headers[header] = value
+			}
+		}
+	}
+
+	// Unlike API Gateway, the ALB does not decode the query string, so the
+	// keys and values are passed on exactly as they were sent by the client
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			key, value = pair[:i], pair[i+1:]
+		}
+		if albMultiValueHeaders {
+			request.MultiValueQueryStringParameters[key] = append(request.MultiValueQueryStringParameters[key], value)
+		} else {
+			request.QueryStringParameters[key] = value
+		}
+	}
+
+	if isBinaryRequest(r, body) {
+		request.IsBase64Encoded = true
+		request.Body = base64.StdEncoding.EncodeToString(body)
+	}
+
+	return request
+}
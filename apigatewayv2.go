@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// handleV2Request builds an HTTP API (payload format 2.0) event, invokes the
+// lambda and converts its response into the proxy response that is written
+// to the client.
+func handleV2Request(inv *invocation, r *http.Request, body []byte) (*events.APIGatewayProxyResponse, error) {
+	request := newV2Request(inv, r, body)
+
+	payload, err := marshalEvent(inv, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return invokeV2Lambda(inv, payload)
+}
+
+// invokeV2Lambda invokes the lambda with a payload format 2.0 event and
+// converts its response into a proxy response. This is shared with Lambda
+// Function URLs, which use the same response format. Cookies are returned as
+// Set-Cookie headers.
+func invokeV2Lambda(inv *invocation, payload []byte) (*events.APIGatewayProxyResponse, error) {
+	responsePayload, err := invokeLambda(inv, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := parseV2Response(responsePayload)
+	if err != nil {
+		return nil, err
+	}
+
+	multiValueHeaders := response.MultiValueHeaders
+	if len(response.Cookies) > 0 {
+		multiValueHeaders = map[string][]string{}
+		for header, values := range response.MultiValueHeaders {
+			multiValueHeaders[header] = values
+		}
+		multiValueHeaders["Set-Cookie"] = append(multiValueHeaders["Set-Cookie"], response.Cookies...)
+	}
+	return &events.APIGatewayProxyResponse{
+		StatusCode:        response.StatusCode,
+		Headers:           response.Headers,
+		MultiValueHeaders: multiValueHeaders,
+		Body:              response.Body,
+		IsBase64Encoded:   response.IsBase64Encoded,
+	}, nil
+}
+
+func newV2Request(inv *invocation, r *http.Request, body []byte) *events.APIGatewayV2HTTPRequest {
+	now := time.Now()
+	domainName := hostWithoutPort(r.Host)
+
+	request := &events.APIGatewayV2HTTPRequest{
+		Version:        "2.0",
+		RouteKey:       "$default",
+		RawPath:        r.URL.EscapedPath(),
+		RawQueryString: r.URL.RawQuery,
+		Headers: map[string]string{
+			"host": r.Host,
+		},
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RouteKey:     "$default",
+			AccountID:    accountID,
+			Stage:        stage,
+			RequestID:    inv.requestID,
+			APIID:        apiID,
+			DomainName:   domainName,
+			DomainPrefix: strings.SplitN(domainName, ".", 2)[0],
+			Time:         now.Format("02/Jan/2006:15:04:05 -0700"),
+			TimeEpoch:    now.UnixNano() / int64(time.Millisecond),
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Protocol:  r.Proto,
+				SourceIP:  sourceIP(r),
+				UserAgent: r.UserAgent(),
+			},
+		},
+		StageVariables:  inv.stageVariables,
+		Body:            string(body),
+		IsBase64Encoded: false,
+	}
+
+	// HTTP APIs lowercase header names, join repeated headers with commas,
+	// and move cookies out of the headers into their own array
+	for header, values := range r.Header {
+		if header == "Host" {
+			continue
+		} else if header == "Cookie" {
+			for _, value := range values {
+				for _, cookie := range strings.Split(value, ";") {
+					if cookie = strings.TrimSpace(cookie); cookie != "" {
+						request.Cookies = append(request.Cookies, cookie)
+					}
+				}
+			}
+			continue
+		}
+		request.Headers[strings.ToLower(header)] = strings.Join(values, ",")
+	}
+	if res, params := inv.config.matchResource(r.URL.EscapedPath()); res != nil {
+		request.RouteKey = "ANY " + res.template
+		if inv.route.resource == res {
+			request.RouteKey = inv.route.method + " " + res.template
+		}
+		request.RequestContext.RouteKey = request.RouteKey
+		request.PathParameters = params
+	}
+	if query := parseQuery(r.URL.RawQuery); len(query) > 0 {
+		request.QueryStringParameters = map[string]string{}
+		for key, values := range query {
+			request.QueryStringParameters[key] = strings.Join(values, ",")
+		}
+	}
+	if inv.jwt != nil {
+		request.RequestContext.Authorizer = &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+			JWT: inv.jwt,
+		}
+	}
+	if isBinaryRequest(r, body) {
+		request.IsBase64Encoded = true
+		request.Body = base64.StdEncoding.EncodeToString(body)
+	}
+
+	return request
+}
+
+// parseV2Response decodes the lambda response the way HTTP APIs do. When the
+// payload does not contain a statusCode, API Gateway infers the response: a
+// 200 with a JSON content type whose body is the returned value (or the
+// string itself if the lambda returned a JSON string).
+func parseV2Response(payload []byte) (*events.APIGatewayV2HTTPResponse, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err == nil {
+		if _, ok := fields["statusCode"]; ok {
+			var response events.APIGatewayV2HTTPResponse
+			if err := json.Unmarshal(payload, &response); err != nil {
+				return nil, malformedResponse(payload, err.Error())
+			}
+			return &response, nil
+		}
+	}
+
+	if !json.Valid(payload) {
+		return nil, malformedResponse(payload, "response is not valid JSON")
+	}
+	body := string(payload)
+	var s string
+	if err := json.Unmarshal(payload, &s); err == nil {
+		body = s
+	}
+	return &events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: body,
+	}, nil
+}
@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestV2Event(t *testing.T) {
+	var event events.APIGatewayV2HTTPRequest
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusCreated,
+			Cookies:    []string{"a=1", "b=2"},
+			Body:       "created",
+		}, nil
+	})
+	handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("PAYLOAD_FORMAT", "2.0"))
+
+	req := httptest.NewRequest("POST", "/users/1?b=2&a=1", nil)
+	req.Header.Set("Cookie", "x=1; y=2")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if event.Version != "2.0" || event.RawPath != "/users/1" || event.RawQueryString != "b=2&a=1" {
+		t.Errorf("got version %q, rawPath %q, rawQueryString %q", event.Version, event.RawPath, event.RawQueryString)
+	}
+	if !reflect.DeepEqual(event.Cookies, []string{"x=1", "y=2"}) {
+		t.Errorf("got cookies %q, want [x=1 y=2]", event.Cookies)
+	}
+	if _, ok := event.Headers["cookie"]; ok {
+		t.Errorf("the cookies are also in the headers: %v", event.Headers)
+	}
+	if event.RequestContext.HTTP.Method != "POST" || event.RequestContext.HTTP.Path != "/users/1" {
+		t.Errorf("got requestContext.http %+v", event.RequestContext.HTTP)
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != "created" {
+		t.Errorf("got %d %q, want 201 \"created\"", w.Code, w.Body.String())
+	}
+	if cookies := w.Result().Header.Values("Set-Cookie"); !reflect.DeepEqual(cookies, []string{"a=1", "b=2"}) {
+		t.Errorf("got Set-Cookie %q, want [a=1 b=2]", cookies)
+	}
+}
+
+func TestV2ResponseInference(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"string", `"hello"`, 200, "application/json", "hello"},
+		{"object", `{"message":"hi"}`, 200, "application/json", `{"message":"hi"}`},
+		{"array", `[1,2]`, 200, "application/json", `[1,2]`},
+		{"number", `42`, 200, "application/json", `42`},
+		{"status code", `{"statusCode":404,"headers":{"Content-Type":"text/plain"},"body":"nope"}`, 404, "text/plain", "nope"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+				return json.RawMessage(test.payload), nil
+			})
+			handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("PAYLOAD_FORMAT", "2.0"))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != test.status || w.Header().Get("Content-Type") != test.contentType || w.Body.String() != test.body {
+				t.Errorf("got %d %q %q, want %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String(), test.status, test.contentType, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// apiKey is an accepted value for the x-api-key header. Keys loaded from a
+// file are identified by their name, other keys get an id derived from the
+// value.
+type apiKey struct {
+	id    string
+	value string
+	plan  *usagePlan
+}
+
+// apiKeys is indexed by key value. The default usage plan limits apply to
+// keys that don't have their own limits.
+var apiKeys map[string]*apiKey
+var apiKeyRequired bool
+var defaultRateLimit float64
+var defaultBurstLimit int
+var defaultQuota int
+
+var errForbidden = &gatewayError{"INVALID_API_KEY", http.StatusForbidden, "Forbidden"}
+
+// parseAPIKeys parses a comma-separated list of keys.
+func parseAPIKeys(s string) map[string]*apiKey {
+	keys := map[string]*apiKey{}
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		keys[value] = &apiKey{
+			id:    fmt.Sprintf("%x", sha256.Sum256([]byte(value)))[:10],
+			value: value,
+			plan:  newUsagePlan(defaultRateLimit, defaultBurstLimit, defaultQuota),
+		}
+	}
+	return keys
+}
+
+// loadAPIKeysFile reads a JSON object of key names and values, e.g.
+// {"mobile-app": "abc123"}. Instead of the value, a key can have an object
+// with its own usage plan limits, e.g. {"mobile-app": {"value": "abc123",
+// "rateLimit": 10, "burstLimit": 20, "quota": 1000}}.
+func loadAPIKeysFile(path string, keys map[string]*apiKey) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var named map[string]json.RawMessage
+	if err := json.Unmarshal(data, &named); err != nil {
+		return err
+	}
+	for name, raw := range named {
+		config := struct {
+			Value      string  `json:"value"`
+			RateLimit  float64 `json:"rateLimit"`
+			BurstLimit int     `json:"burstLimit"`
+			Quota      int     `json:"quota"`
+		}{
+			RateLimit:  defaultRateLimit,
+			BurstLimit: defaultBurstLimit,
+			Quota:      defaultQuota,
+		}
+		if err := json.Unmarshal(raw, &config.Value); err != nil {
+			if err := json.Unmarshal(raw, &config); err != nil {
+				return fmt.Errorf("invalid key %q: %v", name, err)
+			}
+		}
+		if config.Value == "" {
+			return fmt.Errorf("key %q has no value", name)
+		}
+		keys[config.Value] = &apiKey{
+			id:    name,
+			value: config.Value,
+			plan:  newUsagePlan(config.RateLimit, config.BurstLimit, config.Quota),
+		}
+	}
+	return nil
+}
+
+// checkAPIKey validates the x-api-key header if the route requires a key, and
+// applies the key's usage plan.
+// Valid keys are also passed to the lambda when the route doesn't require
+// one, like API Gateway does.
+func checkAPIKey(inv *invocation, r *http.Request) *gatewayError {
+	key := apiKeys[r.Header.Get("X-Api-Key")]
+	if key == nil && (apiKeyRequired || inv.route.requireAPIKey) {
+		return errForbidden
+	}
+	if key != nil {
+		if gwErr := key.plan.allow(); gwErr != nil {
+			return gwErr
+		}
+	}
+	inv.apiKey = key
+	return nil
+}
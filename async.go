@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// errAsyncInvocation is returned by invokeLambda when the invocation was
+// queued to run in the background, and the client gets a 202 right away.
+var errAsyncInvocation = errors.New("lambda invoked asynchronously")
+
+// asyncSlots limits how many asynchronous invocations run at the same time.
+// Invocations wait in the background for a free slot.
+var asyncSlots = make(chan struct{}, 10)
+
+// asyncMaxRetries is how many times a failed asynchronous invocation is
+// retried, like the maximum retry attempts of a function.
+var asyncMaxRetries = 2
+
+// asyncRetryDelay is the delay before the first retry, which doubles for
+// every retry. Lambda waits minutes, which is too long for local testing.
+const asyncRetryDelay = time.Second
+
+// asyncDLQDir is where invocations that failed every retry are written, like
+// a dead-letter queue. They are only logged when it is empty.
+var asyncDLQDir string
+
+// invokeAsync invokes the lambda in the background with the event that was
+// built for the request. The invocation is copied, since the request's
+// invocation is used by the access log when the request finishes.
+func invokeAsync(inv *invocation, payload []byte) {
+	bg := *inv
+	bg.invocationType = "RequestResponse"
+	bg.recording = nil
+	bg.ctx = nil
+	inv.invokeSpan = nil
+	go func() {
+		asyncSlots <- struct{}{}
+		defer func() { <-asyncSlots }()
+
+		var err error
+		delay := asyncRetryDelay
+		rt := bg.route
+		for attempt := 1; attempt <= asyncMaxRetries+1; attempt++ {
+			// Every attempt starts with the same lambda, if it failed over
+			bg.route = rt
+			if attempt > 1 {
+				time.Sleep(delay)
+				delay *= 2
+			}
+			if _, err = invokeLambda(&bg, payload); err == nil {
+				log.Printf("Async invocation succeeded (request id %s)", bg.requestID)
+				return
+			}
+			var lambdaErr *lambdaError
+			if errors.As(err, &lambdaErr) {
+				log.Printf("Async invocation failed (request id %s, attempt %d of %d): %v\n%s", bg.requestID, attempt, asyncMaxRetries+1, err, lambdaErr.stackTrace())
+			} else {
+				log.Printf("Async invocation failed (request id %s, attempt %d of %d): %v", bg.requestID, attempt, asyncMaxRetries+1, err)
+			}
+		}
+		if asyncDLQDir != "" {
+			if err := writeDeadLetter(&bg, payload, err); err != nil {
+				log.Printf("Error writing to ASYNC_DLQ_DIR: %v", err)
+			}
+		}
+	}()
+}
+
+// writeDeadLetter writes a failed invocation to the dead-letter directory,
+// with the same attributes as the messages that Lambda sends to a DLQ.
+func writeDeadLetter(inv *invocation, payload []byte, err error) error {
+	event := json.RawMessage(payload)
+	if !json.Valid(payload) {
+		event, _ = json.Marshal(string(payload))
+	}
+	data, _ := json.MarshalIndent(map[string]interface{}{
+		"requestId":    inv.requestID,
+		"time":         time.Now().UTC(),
+		"lambdaHost":   inv.route.lambdaHost,
+		"attempts":     asyncMaxRetries + 1,
+		"errorCode":    errorType(err),
+		"errorMessage": err.Error(),
+		"event":        event,
+	}, "", "  ")
+	path := filepath.Join(asyncDLQDir, fmt.Sprintf("%s-%s.json", time.Now().UTC().Format("20060102T150405Z"), inv.requestID))
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote failed async invocation to %s", path)
+	return nil
+}
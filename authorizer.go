@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The Lambda authorizer is invoked before the lambda, like a REST API's
+// custom authorizer. TOKEN authorizers receive the value of the identity
+// header, REQUEST authorizers receive the whole request.
+var authorizerRoute *route
+var authorizerType string
+var authorizerHeader string
+var authorizerTTL time.Duration
+
+var authorizerCache = struct {
+	sync.Mutex
+	entries map[string]authorizerCacheEntry
+}{entries: map[string]authorizerCacheEntry{}}
+
+// routeAuthorizer is a Lambda authorizer of a route imported from a template,
+// which is used instead of AUTHORIZER_HOST for that route.
+type routeAuthorizer struct {
+	route          *route
+	authorizerType string
+	header         string
+	ttl            time.Duration
+}
+
+// authorizerFor returns the route's authorizer, or the one configured with
+// AUTHORIZER_HOST, or nil if the request isn't authorized.
+func authorizerFor(rt *route) *routeAuthorizer {
+	if rt.authorizer != nil {
+		return rt.authorizer
+	} else if authorizerRoute != nil {
+		return &routeAuthorizer{authorizerRoute, authorizerType, authorizerHeader, authorizerTTL}
+	}
+	return nil
+}
+
+type authorizerCacheEntry struct {
+	response *authorizerResponse
+	expires  time.Time
+}
+
+// authorizerResponse is the authorizer's output. IAM policies allow Action and
+// Resource to be either a string or a list, so they can't be decoded into
+// events.APIGatewayCustomAuthorizerResponse.
+type authorizerResponse struct {
+	PrincipalID    string `json:"principalId"`
+	PolicyDocument struct {
+		Version   string            `json:"Version"`
+		Statement []policyStatement `json:"Statement"`
+	} `json:"policyDocument"`
+	Context            map[string]interface{} `json:"context"`
+	UsageIdentifierKey string                 `json:"usageIdentifierKey"`
+}
+
+type policyStatement struct {
+	Action   stringList `json:"Action"`
+	Effect   string     `json:"Effect"`
+	Resource stringList `json:"Resource"`
+}
+
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = []string{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+var (
+	errUnauthorized    = &gatewayError{"UNAUTHORIZED", http.StatusUnauthorized, "Unauthorized"}
+	errAccessDenied    = &gatewayError{"ACCESS_DENIED", http.StatusForbidden, "User is not authorized to access this resource"}
+	errExplicitDeny    = &gatewayError{"ACCESS_DENIED", http.StatusForbidden, "User is not authorized to access this resource with an explicit deny"}
+	errAuthorizerError = &gatewayError{"AUTHORIZER_CONFIGURATION_ERROR", http.StatusInternalServerError, ""}
+)
+
+// authorize invokes the authorizer (or uses its cached result) and evaluates
+// the returned policy against the request's method ARN. When the request is
+// allowed, the principal id and the authorizer context are stored in the
+// invocation so they end up in requestContext.authorizer.
+func authorize(inv *invocation, auth *routeAuthorizer, r *http.Request) *gatewayError {
+	identity := r.Header.Get(auth.header)
+	if identity == "" {
+		return errUnauthorized
+	}
+
+	request := newProxyRequest(inv, r, nil)
+	methodArn := fmt.Sprintf("arn:aws:execute-api:us-east-1:%s:%s/%s/%s%s", accountID, apiID, stage, r.Method, r.URL.Path)
+
+	// Results are cached for each authorizer, since they can have different
+	// policies for the same token
+	cacheKey := auth.route.lambdaHost + " " + identity
+	response := cachedAuthorizerResponse(cacheKey)
+	if response == nil {
+		var event interface{}
+		if auth.authorizerType == "REQUEST" {
+			event = &events.APIGatewayCustomAuthorizerRequestTypeRequest{
+				Type:                            "REQUEST",
+				MethodArn:                       methodArn,
+				Resource:                        request.Resource,
+				Path:                            request.Path,
+				HTTPMethod:                      request.HTTPMethod,
+				Headers:                         request.Headers,
+				MultiValueHeaders:               request.MultiValueHeaders,
+				QueryStringParameters:           request.QueryStringParameters,
+				MultiValueQueryStringParameters: request.MultiValueQueryStringParameters,
+				PathParameters:                  request.PathParameters,
+				StageVariables:                  request.StageVariables,
+				RequestContext: events.APIGatewayCustomAuthorizerRequestTypeRequestContext{
+					Path:         request.RequestContext.Path,
+					AccountID:    request.RequestContext.AccountID,
+					ResourceID:   request.RequestContext.ResourceID,
+					Stage:        request.RequestContext.Stage,
+					RequestID:    request.RequestContext.RequestID,
+					ResourcePath: request.RequestContext.ResourcePath,
+					HTTPMethod:   request.RequestContext.HTTPMethod,
+					APIID:        request.RequestContext.APIID,
+					Identity: events.APIGatewayCustomAuthorizerRequestTypeRequestIdentity{
+						SourceIP: request.RequestContext.Identity.SourceIP,
+					},
+				},
+			}
+		} else {
+			event = &events.APIGatewayCustomAuthorizerRequest{
+				Type:               "TOKEN",
+				AuthorizationToken: identity,
+				MethodArn:          methodArn,
+			}
+		}
+
+		var err error
+		response, err = invokeAuthorizer(inv, auth.route, event)
+		var lambdaErr *lambdaError
+		if errors.As(err, &lambdaErr) && lambdaErr.err.Message == "Unauthorized" {
+			// Authorizers reject missing or invalid tokens by failing with
+			// exactly this message
+			return errUnauthorized
+		} else if err != nil {
+			log.Printf("Error invoking authorizer (request id %s): %v", inv.requestID, err)
+			return errAuthorizerError
+		}
+		cacheAuthorizerResponse(cacheKey, response, auth.ttl)
+	}
+
+	switch evaluatePolicy(response.PolicyDocument.Statement, methodArn) {
+	case "Deny":
+		return errExplicitDeny
+	case "Allow":
+	default:
+		return errAccessDenied
+	}
+
+	inv.authorizer = map[string]interface{}{
+		"principalId": response.PrincipalID,
+	}
+	for key, value := range response.Context {
+		inv.authorizer[key] = value
+	}
+	return nil
+}
+
+func invokeAuthorizer(inv *invocation, authorizer *route, event interface{}) (*authorizerResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizerInv := *inv
+	authorizerInv.route = authorizer
+	responsePayload, err := invokeLambda(&authorizerInv, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var response authorizerResponse
+	if err := json.Unmarshal(responsePayload, &response); err != nil {
+		return nil, malformedResponse(responsePayload, err.Error())
+	}
+	return &response, nil
+}
+
+// evaluatePolicy returns "Deny" if a statement explicitly denies the method,
+// "Allow" if a statement allows it, and "" otherwise.
+func evaluatePolicy(statements []policyStatement, methodArn string) string {
+	result := ""
+	for _, statement := range statements {
+		if !matchesAny(statement.Action, "execute-api:Invoke") || !matchesAny(statement.Resource, methodArn) {
+			continue
+		}
+		if strings.EqualFold(statement.Effect, "Deny") {
+			return "Deny"
+		}
+		if strings.EqualFold(statement.Effect, "Allow") {
+			result = "Allow"
+		}
+	}
+	return result
+}
+
+// matchesAny reports whether s matches one of the IAM patterns, where * and ?
+// are wildcards.
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		// path.Match treats / as a separator and interprets [ and \, so
+		// replace those before matching
+		escape := strings.NewReplacer("/", "\x00", "[", "\x01", "\\", "\x02")
+		if ok, _ := path.Match(escape.Replace(pattern), escape.Replace(s)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func cachedAuthorizerResponse(key string) *authorizerResponse {
+	authorizerCache.Lock()
+	defer authorizerCache.Unlock()
+	entry, ok := authorizerCache.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(authorizerCache.entries, key)
+		return nil
+	}
+	return entry.response
+}
+
+func cacheAuthorizerResponse(key string, response *authorizerResponse, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	authorizerCache.Lock()
+	defer authorizerCache.Unlock()
+	authorizerCache.entries[key] = authorizerCacheEntry{
+		response: response,
+		expires:  time.Now().Add(ttl),
+	}
+}
@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/smithy-go"
+)
+
+// awsLambdaClient invokes deployed functions when BACKEND=aws. The lambda
+// hosts are function names or ARNs in that case.
+var awsLambdaClient *lambda.Client
+
+// awsQualifier is the version or alias of the functions that are invoked.
+var awsQualifier string
+
+// newAWSLambdaClient creates the Lambda client with the default credential
+// chain, optionally with another region or profile.
+func newAWSLambdaClient(region string, profile string) (*lambda.Client, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		return nil, fmt.Errorf("no region is configured, set AWS_REGION")
+	}
+	return lambda.NewFromConfig(cfg), nil
+}
+
+// awsCredentialsError is returned when the function can't be invoked with the
+// AWS credentials, because they are missing, expired or not allowed to invoke
+// it.
+type awsCredentialsError struct {
+	err error
+}
+
+func (e *awsCredentialsError) Error() string {
+	return fmt.Sprintf("error invoking the function with the AWS credentials: %v", e.err)
+}
+
+func (e *awsCredentialsError) Unwrap() error {
+	return e.err
+}
+
+// awsCredentialsErrorCodes are the error codes of the Invoke API that mean
+// the credentials can't be used.
+var awsCredentialsErrorCodes = map[string]bool{
+	"AccessDeniedException":       true,
+	"ExpiredTokenException":       true,
+	"InvalidSignatureException":   true,
+	"UnrecognizedClientException": true,
+}
+
+// invokeAWS invokes the deployed function with the Invoke API. The last 4 KB
+// of the function's log are logged, like the output of a lambda started with
+// --run.
+func (p *rpcPool) invokeAWS(ctx context.Context, request *messages.InvokeRequest, response *messages.InvokeResponse, deadline time.Time) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	input := &lambda.InvokeInput{
+		FunctionName: aws.String(p.host),
+		Payload:      request.Payload,
+		LogType:      types.LogTypeTail,
+	}
+	if awsQualifier != "" {
+		input.Qualifier = aws.String(awsQualifier)
+	}
+	if len(request.ClientContext) > 0 {
+		input.ClientContext = aws.String(base64.StdEncoding.EncodeToString(request.ClientContext))
+	}
+	output, err := awsLambdaClient.Invoke(ctx, input)
+	if err != nil {
+		return awsInvokeError(err)
+	}
+
+	if output.LogResult != nil {
+		if tail, err := base64.StdEncoding.DecodeString(*output.LogResult); err == nil {
+			for _, line := range strings.Split(strings.TrimRight(string(tail), "\n"), "\n") {
+				log.Printf("[%s] %s", p.host, line)
+			}
+		}
+	}
+	if output.FunctionError != nil {
+		response.Error = parseErrorPayload(output.Payload, *output.FunctionError)
+		return nil
+	}
+	response.Payload = output.Payload
+	return nil
+}
+
+// awsInvokeError converts the errors of the Invoke API to the errors of the
+// local lambdas where there is one, so they are handled the same way.
+func awsInvokeError(err error) error {
+	var apiErr smithy.APIError
+	var signingErr *v4.SigningError
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errDeadlineExceeded
+	} else if errors.Is(err, context.Canceled) {
+		return errClientCancelled
+	} else if errors.As(err, &apiErr) && apiErr.ErrorCode() == "TooManyRequestsException" {
+		return fmt.Errorf("%w: %v", errThrottled, err)
+	} else if errors.As(err, &apiErr) && awsCredentialsErrorCodes[apiErr.ErrorCode()] {
+		return &awsCredentialsError{err}
+	} else if errors.As(err, &signingErr) || strings.Contains(err.Error(), "get identity:") {
+		// The SDK doesn't have an error type for credentials that couldn't
+		// be loaded
+		return &awsCredentialsError{err}
+	}
+	return err
+}
+
+// pingAWS checks that the function can be invoked with a dry run, which
+// checks the credentials without running the function.
+func (p *rpcPool) pingAWS(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	input := &lambda.InvokeInput{
+		FunctionName:   aws.String(p.host),
+		InvocationType: types.InvocationTypeDryRun,
+	}
+	if awsQualifier != "" {
+		input.Qualifier = aws.String(awsQualifier)
+	}
+	if _, err := awsLambdaClient.Invoke(ctx, input); err != nil {
+		return awsInvokeError(err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// backendRecheckInterval is how often a lambda that is skipped by the
+// round-robin, because it couldn't be reached, is pinged to check if it is up
+// again.
+const backendRecheckInterval = 5 * time.Second
+
+// backendHealth tracks whether a lambda is used by the round-robin. It is
+// kept in the lambda's connection pool, so it survives config reloads.
+type backendHealth struct {
+	down      atomic.Bool
+	checking  atomic.Bool
+	nextCheck atomic.Int64
+	requests  atomic.Int64
+
+	// failedUntil is when a lambda that failed is used again instead of
+	// the fallback lambdas
+	failedUntil atomic.Int64
+}
+
+// newBalancedRoute returns the default route for a comma-separated list of
+// lambdas, which are used in turn. A single lambda is a plain route.
+func newBalancedRoute(lambdaHost string) *route {
+	hosts := strings.Split(lambdaHost, ",")
+	if len(hosts) == 1 {
+		return &route{lambdaHost: lambdaHost}
+	}
+	rt := &route{lambdaHost: lambdaHost, next: new(uint64)}
+	for _, host := range hosts {
+		rt.backends = append(rt.backends, &route{lambdaHost: strings.TrimSpace(host), balanced: true})
+	}
+	return rt
+}
+
+// pick returns the lambda that handles the next request, which is the route
+// itself unless it balances requests between several lambdas. Lambdas that
+// couldn't be reached are skipped, unless they are all down.
+func (rt *route) pick() *route {
+	if len(rt.backends) == 0 {
+		return rt
+	}
+	n := uint64(len(rt.backends))
+	start := atomic.AddUint64(rt.next, 1)
+	picked := rt.backends[start%n]
+	for i := uint64(0); i < n; i++ {
+		if b := rt.backends[(start+i)%n]; b.pool.health.available(b.pool) {
+			picked = b
+			break
+		}
+	}
+	picked.pool.health.requests.Add(1)
+	return picked
+}
+
+// available returns true if the lambda is up. When a lambda that is down is
+// due to be checked again, it is pinged in the background.
+func (h *backendHealth) available(p *rpcPool) bool {
+	if !h.down.Load() {
+		return true
+	}
+	if time.Now().UnixNano() >= h.nextCheck.Load() && h.checking.CompareAndSwap(false, true) {
+		go func() {
+			defer h.checking.Store(false)
+			if err := p.ping(healthCheckTimeout); err != nil {
+				h.nextCheck.Store(time.Now().Add(backendRecheckInterval).UnixNano())
+				return
+			}
+			h.down.Store(false)
+			log.Printf("Lambda at %s is up again, adding it back to the round-robin", p.host)
+		}()
+	}
+	return false
+}
+
+// markDown takes a lambda that couldn't be reached out of the round-robin.
+func (h *backendHealth) markDown(p *rpcPool) {
+	if h.down.CompareAndSwap(false, true) {
+		h.nextCheck.Store(time.Now().Add(backendRecheckInterval).UnixNano())
+		log.Printf("Lambda at %s is down, removing it from the round-robin", p.host)
+	}
+}
+
+// targets returns the routes that have their own lambda.
+func (rt *route) targets() []*route {
+	if len(rt.backends) > 0 {
+		return rt.backends
+	}
+	return []*route{rt}
+}
+
+// allRoutes returns every route with its own lambda in the config.
+func (c *reloadableConfig) allRoutes() []*route {
+	routes := append(c.defaultRoute.targets(), c.defaultRoute.fallbacks...)
+	for _, rt := range c.routes {
+		if rt.upstream == nil {
+			routes = append(routes, rt)
+		}
+	}
+	return append(append(routes, c.hostRoutes...), c.methodRoutes...)
+}
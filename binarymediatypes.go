@@ -0,0 +1,69 @@
+package gateway
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// multipartAsText passes multipart/form-data bodies as text, for handlers
+// that expect them that way.
+var multipartAsText bool
+
+// isBinaryRequest decides whether the request body should be base64-encoded
+// in the event. Like API Gateway, the request's Content-Type is matched
+// against the configured binary media types. If no binary media types are
+// configured, uploads (multipart/form-data and application/octet-stream) are
+// binary, and otherwise the body is inspected. Compressed bodies, e.g. with
+// Content-Encoding: gzip, are always binary.
+func isBinaryRequest(r *http.Request, body []byte) bool {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return true
+	}
+	contentType := r.Header.Get("Content-Type")
+	if len(binaryMediaTypes) == 0 || contentType == "" {
+		if matchesMediaType(contentType, []string{"multipart/form-data"}) {
+			return !multipartAsText
+		} else if matchesMediaType(contentType, []string{"application/octet-stream"}) {
+			return true
+		}
+		return IsBinary(string(body))
+	}
+	return matchesMediaType(contentType, binaryMediaTypes)
+}
+
+// matchesMediaType reports whether contentType matches one of the media
+// types, which may contain wildcards (e.g. image/* or */*).
+func matchesMediaType(contentType string, mediaTypes []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	typ, subtype := splitMediaType(mediaType)
+	for _, pattern := range mediaTypes {
+		patternType, patternSubtype := splitMediaType(pattern)
+		if (patternType == "*" || patternType == typ) && (patternSubtype == "*" || patternSubtype == subtype) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitMediaType(mediaType string) (string, string) {
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if i := strings.Index(mediaType, "/"); i >= 0 {
+		return mediaType[:i], mediaType[i+1:]
+	}
+	return mediaType, ""
+}
+
+// parseMediaTypes parses a comma-separated list of media types.
+func parseMediaTypes(s string) []string {
+	var mediaTypes []string
+	for _, mediaType := range strings.Split(s, ",") {
+		if mediaType = strings.TrimSpace(mediaType); mediaType != "" {
+			mediaTypes = append(mediaTypes, mediaType)
+		}
+	}
+	return mediaTypes
+}
@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestIsBinaryRequest(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	tests := []struct {
+		name             string
+		binaryMediaTypes string
+		contentType      string
+		body             string
+		want             bool
+	}{
+		{"*/* matches text", "*/*", "application/json", `{"a":1}`, true},
+		{"exact match", "image/png", "image/png", png, true},
+		{"exact match ignores parameters", "text/csv", "text/csv; charset=utf-8", "a,b", true},
+		{"exact match is case-insensitive", "image/png", "Image/PNG", png, true},
+		{"no match is text even for binary bodies", "image/png", "image/jpeg", png, false},
+		{"wildcard subtype", "image/*", "image/gif", "GIF89a", true},
+		{"wildcard doesn't match other types", "image/*", "application/json", `{"a":1}`, false},
+		{"one of several", "image/png, application/pdf", "application/pdf", "%PDF", true},
+		{"no Content-Type falls back to binary body", "image/png", "", png, true},
+		{"no Content-Type falls back to text body", "image/png", "", `{"a":"café"}`, false},
+		{"not configured sniffs binary body", "", "image/png", png, true},
+		{"not configured sniffs text body", "", "application/json", `{"a":"🙂"}`, false},
+		{"not configured multipart is binary", "", "multipart/form-data; boundary=x", "--x\r\n\r\ntext\r\n--x--", true},
+		{"not configured octet-stream is binary", "", "application/octet-stream", "text", true},
+		{"configured types override uploads", "image/png", "multipart/form-data; boundary=x", "--x--", false},
+	}
+	defer func(saved []string) { binaryMediaTypes = saved }(binaryMediaTypes)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			binaryMediaTypes = parseMediaTypes(test.binaryMediaTypes)
+			r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			if got := isBinaryRequest(r, []byte(test.body)); got != test.want {
+				t.Errorf("isBinaryRequest() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// startUploadLambda starts a lambda that parses a multipart/form-data event
+// and responds with the content of its file part.
+func startUploadLambda(t *testing.T, received chan<- events.APIGatewayProxyRequest) string {
+	return startTestLambda(t, func(payload []byte) (interface{}, error) {
+		var event events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		received <- event
+		body := []byte(event.Body)
+		if event.IsBase64Encoded {
+			var err error
+			if body, err = base64.StdEncoding.DecodeString(event.Body); err != nil {
+				return nil, err
+			}
+		}
+		_, params, err := mime.ParseMediaType(event.Headers["Content-Type"])
+		if err != nil {
+			return nil, err
+		}
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(1 << 20)
+		if err != nil {
+			return nil, err
+		}
+		file, err := form.File["file"][0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		return events.APIGatewayProxyResponse{
+			StatusCode:      http.StatusOK,
+			Headers:         map[string]string{"Content-Type": "image/png"},
+			Body:            base64.StdEncoding.EncodeToString(data),
+			IsBase64Encoded: true,
+		}, err
+	})
+}
+
+func TestMultipartUpload(t *testing.T) {
+	// A PNG header followed by every byte value
+	png := []byte("\x89PNG\r\n\x1a\n")
+	for i := 0; i < 256; i++ {
+		png = append(png, byte(i))
+	}
+	tests := []struct {
+		name   string
+		asText bool
+		file   []byte
+	}{
+		{"base64", false, png},
+		{"base64 text file", false, []byte("name,city\nJosé,Zürich\n")},
+		// Binary files would be mangled as text, since JSON strings are UTF-8
+		{"MULTIPART_AS_TEXT", true, []byte("name,city\nJosé,Zürich\n")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			mw.WriteField("name", "café")
+			part, _ := mw.CreateFormFile("file", "upload")
+			part.Write(test.file)
+			mw.Close()
+
+			received := make(chan events.APIGatewayProxyRequest, 1)
+			handler := newTestGateway(t, WithLambdaHost(startUploadLambda(t, received)), WithOption("MULTIPART_AS_TEXT", strconv.FormatBool(test.asText)))
+			r := httptest.NewRequest("POST", "/upload", bytes.NewReader(body.Bytes()))
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			event := <-received
+			if event.IsBase64Encoded == test.asText {
+				t.Errorf("got isBase64Encoded %v", event.IsBase64Encoded)
+			}
+			if got := event.Headers["Content-Type"]; got != mw.FormDataContentType() {
+				t.Errorf("got Content-Type %q, want %q with the boundary", got, mw.FormDataContentType())
+			}
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), test.file) {
+				t.Errorf("got %d %q, want the uploaded file", w.Code, w.Body.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chaosConfig injects faults into requests, to test how clients handle slow
+// and failing APIs. The rates are percentages of the requests.
+type chaosConfig struct {
+	latencyMin   time.Duration
+	latencyMax   time.Duration
+	errorRate    float64
+	truncateRate float64
+	resetRate    float64
+}
+
+// chaosOptions are the route options and the keys of chaosConfig.set.
+var chaosOptions = map[string]bool{
+	"latency":      true,
+	"errorrate":    true,
+	"truncaterate": true,
+	"resetrate":    true,
+}
+
+// chaos is the global chaos, from the CHAOS_* options or the admin API. It is
+// used for the routes without chaos options of their own. nil means no chaos.
+var chaos atomic.Pointer[chaosConfig]
+
+// chaosEnabled turns every chaos on or off, including the routes' chaos.
+var chaosEnabled atomic.Bool
+
+// chaosRand makes the chaos decisions. It is seeded with CHAOS_SEED, so that
+// the same requests, sent one at a time, get the same faults.
+var chaosRand struct {
+	sync.Mutex
+	*rand.Rand
+}
+
+// chaosErrors are the synthetic errors, one of which is returned at random.
+var chaosErrors = []*gatewayError{
+	{"DEFAULT_5XX", http.StatusBadGateway, "Internal server error"},
+	{"INTEGRATION_FAILURE", http.StatusServiceUnavailable, "Service Unavailable"},
+	{"INTEGRATION_TIMEOUT", http.StatusGatewayTimeout, "Endpoint request timed out"},
+}
+
+// chaosFault is what chaos does to the response of a request.
+type chaosFault int
+
+const (
+	chaosNoFault chaosFault = iota
+	chaosTruncate
+	chaosReset
+)
+
+func seedChaos(seed uint64) {
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	chaosRand.Rand = rand.New(rand.NewPCG(seed, seed))
+}
+
+// set sets one of the settings, e.g. "latency" to "200ms-2s" or "errorrate"
+// to "10".
+func (c *chaosConfig) set(key, value string) error {
+	if key == "latency" {
+		minValue, maxValue, isRange := strings.Cut(value, "-")
+		var err error
+		if c.latencyMin, err = time.ParseDuration(minValue); err != nil || c.latencyMin < 0 {
+			return errors.New("must be a duration, e.g. 200ms, or a range, e.g. 200ms-2s")
+		}
+		c.latencyMax = c.latencyMin
+		if isRange {
+			if c.latencyMax, err = time.ParseDuration(maxValue); err != nil || c.latencyMax < c.latencyMin {
+				return errors.New("must be a duration, e.g. 200ms, or a range, e.g. 200ms-2s")
+			}
+		}
+		return nil
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || rate < 0 || rate > 100 {
+		return errors.New("must be a percentage between 0 and 100")
+	}
+	switch key {
+	case "errorrate":
+		c.errorRate = rate
+	case "truncaterate":
+		c.truncateRate = rate
+	case "resetrate":
+		c.resetRate = rate
+	default:
+		return fmt.Errorf("unknown chaos option %q", key)
+	}
+	return nil
+}
+
+func (c *chaosConfig) String() string {
+	var parts []string
+	if c.latencyMax > 0 {
+		latency := c.latencyMin.String()
+		if c.latencyMax != c.latencyMin {
+			latency += "-" + c.latencyMax.String()
+		}
+		parts = append(parts, latency+" latency")
+	}
+	for _, rate := range []struct {
+		name  string
+		value float64
+	}{{"errors", c.errorRate}, {"truncated", c.truncateRate}, {"reset", c.resetRate}} {
+		if rate.value > 0 {
+			parts = append(parts, fmt.Sprintf("%v%% %s", rate.value, rate.name))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// chaosRoll returns true for percent percent of the calls.
+func chaosRoll(percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return chaosRand.Float64()*100 < percent
+}
+
+func chaosLatency(c *chaosConfig) time.Duration {
+	if c.latencyMax <= c.latencyMin {
+		return c.latencyMin
+	}
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return c.latencyMin + time.Duration(chaosRand.Int64N(int64(c.latencyMax-c.latencyMin)+1))
+}
+
+// injectChaos delays the request and decides which fault it gets, before the
+// lambda is invoked. It returns false if it responded with a synthetic
+// error, or the client went away during the delay.
+func injectChaos(w http.ResponseWriter, inv *invocation) bool {
+	if !chaosEnabled.Load() {
+		return true
+	}
+	c := inv.route.chaos
+	if c == nil {
+		c = chaos.Load()
+	}
+	if c == nil {
+		return true
+	}
+	if latency := chaosLatency(c); latency > 0 {
+		log.Printf("Chaos (request id %s): adding %v of latency", inv.requestID, latency)
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-inv.ctx.Done():
+			cancelledRequests.Add(1)
+			w.WriteHeader(statusClientClosedRequest)
+			return false
+		}
+	}
+	if chaosRoll(c.errorRate) {
+		chaosRand.Lock()
+		gwErr := chaosErrors[chaosRand.IntN(len(chaosErrors))]
+		chaosRand.Unlock()
+		log.Printf("Chaos (request id %s): responding with a %d", inv.requestID, gwErr.statusCode)
+		inv.errorType = "chaos"
+		gwErr.write(w, inv)
+		return false
+	}
+	if chaosRoll(c.resetRate) {
+		log.Printf("Chaos (request id %s): resetting the connection instead of responding", inv.requestID)
+		inv.chaosFault = chaosReset
+	} else if chaosRoll(c.truncateRate) {
+		log.Printf("Chaos (request id %s): truncating the response body", inv.requestID)
+		inv.chaosFault = chaosTruncate
+	}
+	return true
+}
+
+// resetConnection closes the client's connection without a response, with a
+// TCP reset when possible. HTTP/2 connections can't be hijacked, so only the
+// stream is reset.
+func resetConnection(w http.ResponseWriter) {
+	if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			conn = tlsConn.NetConn()
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+type adminChaos struct {
+	Enabled      *bool   `json:"enabled"`
+	Latency      string  `json:"latency"`
+	ErrorRate    float64 `json:"errorRate"`
+	TruncateRate float64 `json:"truncateRate"`
+	ResetRate    float64 `json:"resetRate"`
+}
+
+// handleAdminChaos shows or replaces the global chaos, e.g.
+// {"latency": "200ms-2s", "errorRate": 10}, or turns all chaos off with
+// {"enabled": false}.
+func handleAdminChaos(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var body adminChaos
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("Invalid body: %v", err))
+			return
+		}
+		c := &chaosConfig{}
+		settings := map[string]string{
+			"errorrate":    fmt.Sprint(body.ErrorRate),
+			"truncaterate": fmt.Sprint(body.TruncateRate),
+			"resetrate":    fmt.Sprint(body.ResetRate),
+		}
+		if body.Latency != "" {
+			settings["latency"] = body.Latency
+		}
+		for key, value := range settings {
+			if err := c.set(key, value); err != nil {
+				writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s: %v", key, err))
+				return
+			}
+		}
+		if body.Enabled != nil && !*body.Enabled {
+			chaosEnabled.Store(false)
+			log.Printf("Admin API turned chaos off")
+		} else {
+			chaos.Store(c)
+			chaosEnabled.Store(true)
+			log.Printf("Admin API set chaos: %v", c)
+		}
+	} else if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	enabled := chaosEnabled.Load()
+	current := adminChaos{Enabled: &enabled}
+	if c := chaos.Load(); c != nil {
+		if c.latencyMax > 0 {
+			current.Latency = c.latencyMin.String()
+			if c.latencyMax != c.latencyMin {
+				current.Latency += "-" + c.latencyMax.String()
+			}
+		}
+		current.ErrorRate, current.TruncateRate, current.ResetRate = c.errorRate, c.truncateRate, c.resetRate
+	}
+	writeAdminJSON(w, http.StatusOK, current)
+}
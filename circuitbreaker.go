@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// circuitBreakerThreshold is the number of consecutive connection failures
+// that open a lambda's circuit. Requests then fail right away, instead of
+// waiting for the dial to fail, until circuitBreakerCooldown has passed.
+// After that, one request is let through to probe the lambda, and the circuit
+// closes again if it could connect. 0 disables the circuit breaker.
+var circuitBreakerThreshold int
+var circuitBreakerCooldown = 10 * time.Second
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker tracks the connection failures of a lambda. Errors returned
+// by the handler don't count, since the lambda could be reached.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+}
+
+// circuitOpenError is returned by invokeLambda when the lambda's circuit is
+// open.
+type circuitOpenError struct {
+	lambdaHost string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", e.lambdaHost)
+}
+
+// allow returns an error if the circuit is open, or if it is half-open and
+// another request is already probing the lambda.
+func (b *circuitBreaker) allow(host string) error {
+	if circuitBreakerThreshold == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if wait := time.Until(b.openUntil); wait > 0 {
+			return &circuitOpenError{host, wait}
+		}
+		log.Printf("Circuit breaker for %s is half-open, probing the lambda", host)
+		b.state = circuitHalfOpen
+	case circuitHalfOpen:
+		return &circuitOpenError{host, time.Second}
+	}
+	return nil
+}
+
+// record updates the circuit with the outcome of an invocation.
+func (b *circuitBreaker) record(host string, err error) {
+	if circuitBreakerThreshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var dialErr *dialError
+	if !errors.As(err, &dialErr) {
+		if b.state == circuitHalfOpen || b.state == circuitOpen {
+			log.Printf("Circuit breaker for %s is closed, the lambda is reachable again", host)
+		}
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state != circuitOpen && b.failures >= circuitBreakerThreshold) {
+		log.Printf("Circuit breaker for %s is open after %d consecutive connection failures, failing requests for %v", host, b.failures, circuitBreakerCooldown)
+		b.state = circuitOpen
+		b.openUntil = time.Now().Add(circuitBreakerCooldown)
+	}
+}
+
+type adminCircuitBreaker struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenUntil           *time.Time `json:"openUntil,omitempty"`
+}
+
+func (b *circuitBreaker) status() adminCircuitBreaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := adminCircuitBreaker{State: b.state, ConsecutiveFailures: b.failures}
+	if s.State == "" {
+		s.State = circuitClosed
+	}
+	if b.state == circuitOpen {
+		openUntil := b.openUntil
+		s.OpenUntil = &openUntil
+	}
+	return s
+}
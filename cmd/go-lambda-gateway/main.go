@@ -0,0 +1,7 @@
+package main
+
+import gateway "github.com/stefansundin/go-lambda-gateway"
+
+func main() {
+	gateway.Main()
+}
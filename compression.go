@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// decompressRequests decompresses gzip request bodies before the event is
+// created. Otherwise they are base64-encoded in the event, like API Gateway
+// does. Routes can choose otherwise with ";decompress" and ";nodecompress".
+var decompressRequests bool
+
+var errDecompressedTooLarge = errors.New("decompressed body is too large")
+
+// compressResponses gzips the responses of clients that accept it, like
+// CloudFront does.
+var compressResponses bool
+
+// compressMinSize is the smallest body that is compressed.
+var compressMinSize int64
+
+// compressTypes are the media types that are compressed. Images and other
+// binary types are usually compressed already.
+var compressTypes []string
+
+var defaultCompressTypes = []string{
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/csv",
+	"text/javascript",
+	"text/xml",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/ld+json",
+	"application/manifest+json",
+	"image/svg+xml",
+}
+
+// compressible reports whether a response with the headers and a body of n
+// bytes is compressed for clients that accept gzip.
+func compressible(header http.Header, n int64) bool {
+	return n >= compressMinSize &&
+		header.Get("Content-Encoding") == "" &&
+		matchesMediaType(header.Get("Content-Type"), compressTypes)
+}
+
+// acceptsGzip reports whether the client accepts gzip, i.e. gzip, or else *,
+// is in Accept-Encoding without q=0.
+func acceptsGzip(r *http.Request) bool {
+	qualities := map[string]float64{}
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.ToLower(key) == "q" {
+					q, _ = strconv.ParseFloat(value, 64)
+				}
+			}
+			qualities[strings.ToLower(strings.TrimSpace(name))] = q
+		}
+	}
+	if q, ok := qualities["gzip"]; ok {
+		return q > 0
+	}
+	return qualities["*"] > 0
+}
+
+func gzipBody(body io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressesRequests reports whether the gateway decompresses the route's
+// request bodies.
+func (rt *route) decompressesRequests() bool {
+	if rt.noDecompress {
+		return false
+	}
+	return decompressRequests || rt.decompress
+}
+
+func isGzipRequest(r *http.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	return encoding == "gzip" || encoding == "x-gzip"
+}
+
+// gunzipBody decompresses a request body. It stops at limit bytes, so a small
+// body can't decompress to more than fits in an event.
+func gunzipBody(body []byte, limit int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := ioutil.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > limit {
+		return nil, errDecompressedTooLarge
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxConcurrency limits the concurrent invocations of each lambda, like
+// reserved concurrency. Invocations over the limit wait up to
+// maxConcurrencyWait for another one to finish, and are throttled after
+// that. 0 means no limit.
+var maxConcurrency int
+var maxConcurrencyWait time.Duration
+
+var concurrency = struct {
+	sync.Mutex
+	byHost map[string]chan struct{}
+}{byHost: map[string]chan struct{}{}}
+
+// invocationsInFlight and throttles are reported by GET /stats.
+var invocationsInFlight atomic.Int64
+var throttles atomic.Int64
+
+// errThrottled is returned by invokeLambda when the lambda is at its
+// concurrency limit.
+var errThrottled = errors.New("Rate Exceeded.")
+
+// acquireConcurrency reserves one of the lambda's concurrent invocations. The
+// returned function releases it.
+func acquireConcurrency(host string) (func(), error) {
+	if maxConcurrency == 0 {
+		invocationsInFlight.Add(1)
+		return func() { invocationsInFlight.Add(-1) }, nil
+	}
+	concurrency.Lock()
+	sem := concurrency.byHost[host]
+	if sem == nil {
+		sem = make(chan struct{}, maxConcurrency)
+		concurrency.byHost[host] = sem
+	}
+	concurrency.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	default:
+		if maxConcurrencyWait == 0 {
+			throttles.Add(1)
+			return nil, errThrottled
+		}
+		timer := time.NewTimer(maxConcurrencyWait)
+		defer timer.Stop()
+		select {
+		case sem <- struct{}{}:
+		case <-timer.C:
+			throttles.Add(1)
+			return nil, errThrottled
+		}
+	}
+	invocationsInFlight.Add(1)
+	return func() {
+		invocationsInFlight.Add(-1)
+		<-sem
+	}, nil
+}
+
+// writeThrottled responds like the Lambda Invoke API does when a function is
+// at its reserved concurrency.
+func writeThrottled(w http.ResponseWriter, inv *invocation) {
+	inv.gatewayError = &gatewayError{"THROTTLED", http.StatusTooManyRequests, errThrottled.Error()}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("x-amzn-ErrorType", "TooManyRequestsException")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(`{"Reason":"ReservedFunctionConcurrentInvocationLimitExceeded","Type":"User","message":"Rate Exceeded."}`))
+}
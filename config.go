@@ -0,0 +1,368 @@
+package gateway
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	runtimedebug "runtime/debug"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// version is set at build time with -ldflags
+// "-X github.com/stefansundin/go-lambda-gateway.version=...". Builds
+// with go install use the module version instead.
+var version = ""
+
+// option is a setting that can be configured with a command line flag, an
+// environment variable or the config file, in that order of precedence.
+type option struct {
+	env    string
+	flag   string
+	usage  string
+	isBool bool
+	value  string
+	set    bool
+}
+
+func (o *option) String() string {
+	return o.value
+}
+
+func (o *option) Set(s string) error {
+	if o.isBool {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("must be true or false")
+		}
+	}
+	o.value = s
+	o.set = true
+	return nil
+}
+
+func (o *option) IsBoolFlag() bool {
+	return o.isBool
+}
+
+var options = []*option{
+	{env: "CONFIG_FILE", flag: "config", usage: "YAML file with settings, reloaded when it changes"},
+	{env: "LAMBDA_HOST", usage: "address of the lambda's RPC server (default localhost:8001)"},
+	{env: "BACKEND", usage: "how lambdas are invoked: rpc, rie for the Runtime Interface Emulator, or aws (default rpc)"},
+	{env: "FUNCTION_NAME", usage: "name or ARN of the deployed function that is invoked with BACKEND=aws"},
+	{env: "FUNCTION_QUALIFIER", usage: "version or alias of the deployed function"},
+	{env: "AWS_REGION", usage: "region of the deployed function"},
+	{env: "AWS_PROFILE", usage: "profile with the credentials that are used to invoke the deployed function"},
+	{env: "LAMBDA_COMMAND", flag: "run", usage: "start the lambda with this command, e.g. ./my-lambda, and restart it when it exits"},
+	{env: "WATCH", usage: "build and start the lambda in these directories, and rebuild it when the source changes"},
+	{env: "WATCH_BUILD_COMMAND", usage: "command that builds the lambda started with --run (default go build -o <tmp> ./...)"},
+	{env: "LAMBDA_HOST_FALLBACK", usage: "lambdas that are used when LAMBDA_HOST fails, e.g. localhost:8003"},
+	{env: "LAMBDA_FAILOVER_INTERVAL", usage: "how long a lambda that failed is skipped (default 30s)"},
+	{env: "LAMBDA_FAILOVER_ON_ERROR", usage: "also fail over when the lambda returns an error", isBool: true},
+	{env: "ROUTES", usage: "path prefixes routed to other lambdas, e.g. /api/*=localhost:8003[;strip][;apikey][;async][;options|;nooptions][;decompress|;nodecompress][;maxpayload=bytes][;latency=200ms-2s][;errorrate=percent][;truncaterate=percent][;resetrate=percent], or /legacy/*=http://localhost:3000;proxy[;strip] to forward them to an HTTP server"},
+	{env: "HOST_ROUTES", usage: "host names routed to other lambdas, e.g. api.myapp.test=localhost:8003"},
+	{env: "RESOURCES", usage: "resource templates, e.g. /users/{userId}"},
+	{env: "SAM_TEMPLATE", flag: "sam-template", usage: "AWS SAM template whose Api and HttpApi events are routed to the functions' lambdas"},
+	{env: "SERVERLESS_CONFIG", flag: "serverless-config", usage: "serverless.yml whose http and httpApi events are routed to the functions' lambdas"},
+	{env: "OPENAPI_FILE", flag: "openapi", usage: "OpenAPI document whose operations are routed and validated like API Gateway"},
+	{env: "FUNCTION_PORTS_FILE", usage: "YAML or JSON file that maps the functions in a template to the ports of their lambdas"},
+	{env: "MAX_CONNECTIONS", usage: "maximum number of connections to each lambda (default 10)"},
+	{env: "LAMBDA_DIAL_RETRY", usage: "how long to retry connecting to the lambda, e.g. 30s"},
+	{env: "CIRCUIT_BREAKER_THRESHOLD", usage: "fail fast after this many consecutive connection failures"},
+	{env: "CIRCUIT_BREAKER_COOLDOWN", usage: "how long requests fail fast before the lambda is probed (default 10s)"},
+	{env: "AUTHORIZER_HOST", usage: "address of a Lambda authorizer's RPC server"},
+	{env: "AUTHORIZER_TYPE", usage: "TOKEN or REQUEST (default TOKEN)"},
+	{env: "AUTHORIZER_HEADER", usage: "header with the authorizer's identity (default Authorization)"},
+	{env: "AUTHORIZER_TTL", usage: "how long authorizer results are cached (default 300s)"},
+	{env: "FUNCTION_TIMEOUT", flag: "timeout", usage: "the lambda's timeout (default 30s)"},
+	{env: "INTEGRATION_TIMEOUT", usage: "how long the gateway waits for the lambda (default 29s)"},
+	{env: "EVENT_FORMAT", usage: "apigateway, alb, function-url or websocket (default apigateway)"},
+	{env: "PAYLOAD_FORMAT", usage: "API Gateway payload format, 1.0 or 2.0 (default 1.0)"},
+	{env: "WEBSOCKET_ROUTE_SELECTION", usage: "route selection expression of the WebSocket API (default $request.body.action)"},
+	{env: "WEBSOCKET_ROUTES", usage: "comma-separated route keys of the WebSocket API, other messages use $default"},
+	{env: "MOCKS_FILE", usage: "JSON file with mock integrations"},
+	{env: "INTEGRATIONS_FILE", usage: "JSON file with Lambda integrations and mapping templates"},
+	{env: "HOOKS_FILE", usage: "JSON file with request hooks (set-header, rewrite-path, basic-auth)"},
+	{env: "DECOMPRESS_REQUESTS", usage: "decompress gzip request bodies instead of passing them base64-encoded", isBool: true},
+	{env: "COMPRESS_RESPONSES", usage: "gzip the responses of clients that accept it", isBool: true},
+	{env: "COMPRESS_MIN_SIZE", usage: "smallest response body that is compressed, in bytes (default 1000)"},
+	{env: "COMPRESS_TYPES", usage: "media types that are compressed, e.g. text/*,application/json (default text and JSON types)"},
+	{env: "DEFAULT_CONTENT_TYPE", usage: "Content-Type of responses without one, or none to not detect it"},
+	{env: "OPTIONS_RESPONSE", usage: "answer OPTIONS requests with 204 without invoking the lambda", isBool: true},
+	{env: "OPTIONS_RESPONSE_HEADERS", usage: "JSON object with the headers of the OPTIONS responses, e.g. {\"Allow\": \"GET, POST\"}"},
+	{env: "GATEWAY_RESPONSES_FILE", usage: "JSON file with customized gateway responses"},
+	{env: "CORS_ALLOW_ORIGINS", usage: "origins allowed by CORS, enables CORS handling"},
+	{env: "CORS_ALLOW_METHODS", usage: "methods allowed by CORS"},
+	{env: "CORS_ALLOW_HEADERS", usage: "headers allowed by CORS"},
+	{env: "CORS_EXPOSE_HEADERS", usage: "headers exposed by CORS"},
+	{env: "CORS_ALLOW_CREDENTIALS", usage: "allow credentials in CORS requests", isBool: true},
+	{env: "CORS_MAX_AGE", usage: "how long browsers cache preflight responses, in seconds"},
+	{env: "DISABLE_CORS", usage: "disable CORS handling", isBool: true},
+	{env: "USAGE_PLAN_RATE_LIMIT", usage: "requests per second for each API key"},
+	{env: "USAGE_PLAN_BURST_LIMIT", usage: "burst limit for each API key"},
+	{env: "USAGE_PLAN_QUOTA", usage: "requests per day for each API key"},
+	{env: "API_KEYS", usage: "comma-separated list of API keys"},
+	{env: "API_KEYS_FILE", usage: "JSON file with API key names and values"},
+	{env: "API_KEY_REQUIRED", usage: "require an API key for every request", isBool: true},
+	{env: "JWT_ISSUER", usage: "issuer of accepted JWTs"},
+	{env: "JWT_AUDIENCE", usage: "comma-separated audiences of accepted JWTs"},
+	{env: "JWT_JWKS_URL", usage: "JWKS URL used to verify JWTs"},
+	{env: "JWT_SECRET", usage: "secret used to verify HMAC-signed JWTs"},
+	{env: "JWT_INSECURE", usage: "accept any JWT without validating it", isBool: true},
+	{env: "STAGE_PATH", usage: "serve the API under this stage path"},
+	{env: "STAGE_PATH_PASSTHROUGH", usage: "pass requests outside of the stage path to the lambda", isBool: true},
+	{env: "STAGE", usage: "stage name (default local, or $default for payload format 2.0)"},
+	{env: "ACCOUNT_ID", usage: "account id in the request context (default 123456789012)"},
+	{env: "API_ID", usage: "API id in the request context (default 1234567890)"},
+	{env: "DEBUG", flag: "verbose", usage: "log the events, the lambda responses and details about malformed responses", isBool: true},
+	{env: "DEBUG_BODY_LIMIT", usage: "bytes of the bodies logged with --verbose (default 1024)"},
+	{env: "DEBUG_REDACT_HEADERS", usage: "headers hidden in the events logged with --verbose, e.g. Authorization,Cookie"},
+	{env: "DEV_ERRORS", usage: "show lambda errors and stack traces in responses", isBool: true},
+	{env: "MAX_REQUEST_PAYLOAD", usage: "request payload limit in bytes (default 10485760)"},
+	{env: "MAX_RESPONSE_PAYLOAD", usage: "response payload limit in bytes (default 6291456)"},
+	{env: "BINARY_MEDIA_TYPES", usage: "comma-separated media types that are base64-encoded"},
+	{env: "PATH_NORMALIZATION", usage: "comma-separated changes to the request paths: strip-trailing-slash, collapse-duplicate-slashes, remove-dot-segments (default preserve-exact)"},
+	{env: "PROXY_BASE", usage: "the path of the greedy {proxy+} resource, e.g. /api for /api/{proxy+} (default /)"},
+	{env: "STATIC_DIR", usage: "serve the files in this directory, e.g. ./dist, for GET and HEAD requests that don't go to the lambda"},
+	{env: "STATIC_LAMBDA_PATHS", usage: "comma-separated path prefixes that always go to the lambda when STATIC_DIR is set, e.g. /api (default none, every path is tried in STATIC_DIR first)"},
+	{env: "STATIC_MISS", usage: "what happens to requests for files that aren't in STATIC_DIR: lambda, 404, or spa for index.html if the client accepts HTML and a 404 otherwise (default lambda)"},
+	{env: "DECODE_PATH", usage: "pass the decoded path in the events, e.g. /files/a/b instead of /files/a%2Fb", isBool: true},
+	{env: "MULTIPART_AS_TEXT", usage: "pass multipart/form-data bodies as text instead of base64", isBool: true},
+	{env: "TRUST_REQUEST_ID_HEADER", usage: "use the X-Request-Id header as the request id", isBool: true},
+	{env: "DISABLE_TRACE_ID", usage: "don't generate X-Amzn-Trace-Id headers", isBool: true},
+	{env: "HOST_OVERRIDE", usage: "host in the events, e.g. api.example.com (the request's host is in X-Forwarded-Host)"},
+	{env: "TRUST_FORWARDED_HEADERS", usage: "keep the client's X-Forwarded-Proto and X-Forwarded-Port headers", isBool: true},
+	{env: "HEADER_CASE", usage: "case of the header names in payload format 1.0 events: canonical, lowercase or preserve"},
+	{env: "HOP_BY_HOP_HEADERS", usage: "comma-separated headers to remove from requests and responses, in addition to the standard hop-by-hop headers"},
+	{env: "TRUSTED_PROXIES", usage: "comma-separated networks of proxies whose X-Forwarded-For is trusted"},
+	{env: "CLIENT_CONTEXT_FILE", usage: "JSON file with the client context"},
+	{env: "STAGE_VARIABLES_FILE", usage: "JSON file with stage variables"},
+	{env: "COGNITO_IDENTITY_FILE", usage: "JSON file with the requestContext.identity block"},
+	{env: "COGNITO_IDENTITY_ID", usage: "Cognito identity id"},
+	{env: "COGNITO_IDENTITY_POOL_ID", usage: "Cognito identity pool id"},
+	{env: "ALB_MULTI_VALUE_HEADERS", usage: "use multi-value headers in ALB events", isBool: true},
+	{env: "STREAM_RESPONSES", usage: "flush response bodies to the client in chunks", isBool: true},
+	{env: "STREAM_CHUNK_SIZE", usage: "chunk size for streamed responses in bytes (default 4096)"},
+	{env: "BIND_ADDR", flag: "addr", usage: "address to listen on, e.g. 127.0.0.1:8002"},
+	{env: "PORT", usage: "port to listen on, if --addr is not set (default 8002)"},
+	{env: "LISTEN_SOCKET", usage: "listen on this Unix socket instead"},
+	{env: "LISTEN_SOCKET_MODE", usage: "file mode of the Unix socket, e.g. 0660"},
+	{env: "WAIT_FOR_LAMBDA", usage: "wait for the lambdas to respond before listening", isBool: true},
+	{env: "WAIT_FOR_LAMBDA_TIMEOUT", usage: "how long to wait for the lambdas (default 30s)"},
+	{env: "GATEWAY_PATH_PREFIX", usage: "path prefix of the gateway's own endpoints (default /_gateway)"},
+	{env: "LOG_FORMAT", usage: "access log format, text or json (default text)"},
+	{env: "ACCESS_LOG_FORMAT", usage: "access log format with $context variables, e.g. $context.requestId"},
+	{env: "ACCESS_LOG_FILE", usage: "write the access log to this file instead of stdout"},
+	{env: "ACCESS_LOG_MAX_SIZE", usage: "rotate the access log file when it is larger than this many bytes"},
+	{env: "ACCESS_LOG_MAX_FILES", usage: "number of rotated access log files to keep (default 5)"},
+	{env: "RECORD_DIR", flag: "record", usage: "write the events and responses of every request to this directory"},
+	{env: "RECORD_MAX_BODY", usage: "don't record events and responses larger than this many bytes"},
+	{env: "RECORD_MAX_SIZE", usage: "stop recording when the recordings reach this many bytes"},
+	{env: "MAX_CONCURRENCY", usage: "maximum concurrent invocations of each lambda, like reserved concurrency"},
+	{env: "MAX_CONCURRENCY_WAIT", usage: "how long invocations over MAX_CONCURRENCY wait before they are throttled (default 0s)"},
+	{env: "ASYNC_CONCURRENCY", usage: "how many asynchronous invocations run at the same time (default 10)"},
+	{env: "ASYNC_MAX_RETRIES", usage: "how many times failed asynchronous invocations are retried (default 2)"},
+	{env: "ASYNC_DLQ_DIR", usage: "write asynchronous invocations that failed every retry to this directory"},
+	{env: "CHAOS_LATENCY", usage: "add this latency to every request, e.g. 500ms, or a random latency in a range, e.g. 200ms-2s"},
+	{env: "CHAOS_ERROR_RATE", usage: "percentage of requests that get a 502, 503 or 504 instead of invoking the lambda, e.g. 10"},
+	{env: "CHAOS_TRUNCATE_RATE", usage: "percentage of responses whose body is cut off halfway"},
+	{env: "CHAOS_RESET_RATE", usage: "percentage of requests whose connection is reset instead of getting the response"},
+	{env: "CHAOS_SEED", usage: "seed of the chaos decisions, to repeat them (default random, printed at startup)"},
+	{env: "SLOW_REQUEST_THRESHOLD", usage: "log the requests that take longer than this, e.g. 500ms, with the time spent marshalling the event, connecting to the lambda, invoking it and writing the response"},
+	{env: "METRICS", usage: "serve Prometheus metrics at /_gateway/metrics", isBool: true},
+	{env: "ADMIN_PORT", usage: "serve the admin API on this port on 127.0.0.1"},
+	{env: "DEBUG_ENDPOINTS", usage: "serve pprof and expvar on the admin listener", isBool: true},
+	{env: "READ_HEADER_TIMEOUT", usage: "how long clients have to send the request headers, 0 for no limit (default 10s)"},
+	{env: "READ_TIMEOUT", usage: "how long clients have to send the whole request, including the body, 0 for no limit (default 30s)"},
+	{env: "WRITE_TIMEOUT", usage: "how long a request can take from the end of its headers until the response is written, 0 for no limit (default 120s). It is raised to FUNCTION_TIMEOUT if it is shorter, so the responses of slow lambdas aren't cut off, and should be longer than INTEGRATION_TIMEOUT (default 29s) to leave time for the body"},
+	{env: "IDLE_TIMEOUT", usage: "how long idle keep-alive connections are kept open, 0 for no limit (default 60s)"},
+	{env: "SHUTDOWN_TIMEOUT", usage: "how long to wait for requests when shutting down (default 10s)"},
+	{env: "H2C", usage: "accept HTTP/2 without TLS from clients with prior knowledge, e.g. curl --http2-prior-knowledge", isBool: true},
+	{env: "TLS", usage: "set to self-signed to serve HTTPS with a generated certificate"},
+	{env: "TLS_SANS", usage: "additional host names for the self-signed certificate"},
+	{env: "CERT_FILE", usage: "TLS certificate file"},
+	{env: "KEY_FILE", usage: "TLS key file"},
+}
+
+var optionsByEnv = map[string]*option{}
+
+// validateConfig makes the gateway exit after the configuration is loaded.
+var validateConfig bool
+
+// fileValues and fileStageVariables are the settings from the config file.
+var fileValues map[string]string
+var fileStageVariables map[string]string
+
+// Flag names are derived from the environment variable names, e.g.
+// LAMBDA_HOST is --lambda-host. The options are indexed here rather than in
+// parseFlags, since New configures the gateway without parsing flags.
+func init() {
+	for _, o := range options {
+		if o.flag == "" {
+			o.flag = strings.ReplaceAll(strings.ToLower(o.env), "_", "-")
+		}
+		optionsByEnv[o.env] = o
+	}
+}
+
+// parseFlags registers a flag for every option and parses the command line.
+func parseFlags() {
+	for _, o := range options {
+		flag.Var(o, o.flag, o.usage)
+	}
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.BoolVar(&validateConfig, "validate-config", false, "check the configuration and exit")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("go-lambda-gateway %s\n", gatewayVersion())
+		os.Exit(0)
+	}
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected argument: %s\n\n", flag.Arg(0))
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: go-lambda-gateway [flags]\n       go-lambda-gateway invoke --event FILE [flags]\n       go-lambda-gateway replay [flags] DIR\n\n")
+	fmt.Fprintf(os.Stderr, "Every flag can also be set with the environment variable in parentheses.\nFlags take precedence over environment variables.\n\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "--" + f.Name
+		if o, ok := f.Value.(*option); ok {
+			if !o.isBool {
+				name += " value"
+			}
+			name += " (" + o.env + ")"
+		} else if f.Name == "stage-var" {
+			name += " key=value"
+		} else if f.Name == "function-port" {
+			name += " name=port"
+		} else if f.Name == "schedule" {
+			name += " expression"
+		}
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", name, f.Usage)
+	})
+}
+
+func gatewayVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := runtimedebug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// getenv returns the value of the option given to New, from the command
+// line, from the environment if the flag was not used, or else from the config
+// file.
+func getenv(env string) string {
+	if v, ok := optionValues[env]; ok {
+		return v
+	}
+	if o := optionsByEnv[env]; o != nil && o.set {
+		return o.value
+	}
+	if v, ok := os.LookupEnv(env); ok {
+		return v
+	}
+	return fileValues[env]
+}
+
+// getenvBool returns the value of a boolean option. Invalid values are an
+// error, so typos don't silently leave a feature disabled.
+func getenvBool(env string) (bool, error) {
+	v := getenv(env)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("Invalid %s: %s (must be true or false)", env, v)
+	}
+	return b, nil
+}
+
+// loadConfigFile reads a YAML config file. The keys are the names of the
+// flags or the environment variables, e.g. lambda-host, lambda_host or
+// LAMBDA_HOST. Lists are joined with commas, and stage_variables is a map.
+func loadConfigFile(path string) (map[string]string, map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	values := map[string]string{}
+	var stageVariables map[string]string
+	if len(doc.Content) == 0 {
+		return values, stageVariables, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("line %d: expected a map of settings", root.Line)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		env := strings.ToUpper(strings.ReplaceAll(key.Value, "-", "_"))
+		if env == "STAGE_VARIABLES" {
+			if value.Kind != yaml.MappingNode {
+				return nil, nil, fmt.Errorf("line %d: %s must be a map", value.Line, key.Value)
+			}
+			stageVariables = map[string]string{}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				if value.Content[j+1].Kind != yaml.ScalarNode {
+					return nil, nil, fmt.Errorf("line %d: %s.%s must be a string", value.Content[j+1].Line, key.Value, value.Content[j].Value)
+				}
+				stageVariables[value.Content[j].Value] = value.Content[j+1].Value
+			}
+			continue
+		}
+		o := optionByName(key.Value)
+		if o == nil || o.env == "CONFIG_FILE" {
+			return nil, nil, fmt.Errorf("line %d: unknown setting %s", key.Line, key.Value)
+		}
+		switch value.Kind {
+		case yaml.ScalarNode:
+			values[o.env] = value.Value
+		case yaml.SequenceNode:
+			var items []string
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, nil, fmt.Errorf("line %d: %s must be a list of strings", item.Line, key.Value)
+				}
+				items = append(items, item.Value)
+			}
+			values[o.env] = strings.Join(items, ",")
+		default:
+			return nil, nil, fmt.Errorf("line %d: %s must be a string or a list of strings", value.Line, key.Value)
+		}
+		if o.isBool {
+			if _, err := strconv.ParseBool(values[o.env]); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s must be true or false", value.Line, key.Value)
+			}
+		}
+	}
+	return values, stageVariables, nil
+}
+
+// optionByName finds an option by its flag name or environment variable name.
+func optionByName(name string) *option {
+	if o := optionsByEnv[strings.ToUpper(strings.ReplaceAll(name, "-", "_"))]; o != nil {
+		return o
+	}
+	for _, o := range options {
+		if o.flag == name || o.flag == strings.ReplaceAll(name, "_", "-") {
+			return o
+		}
+	}
+	return nil
+}
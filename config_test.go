@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestNewWithConfigFile(t *testing.T) {
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "from the config file"}, nil
+	})
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	config := "lambda-host: " + lambda + "\nDEV_ERRORS: true\nbinary_media_types:\n  - image/png\n  - application/pdf\n"
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestGateway(t, WithOption("CONFIG_FILE", path))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "from the config file" {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if !devErrors || len(binaryMediaTypes) != 2 {
+		t.Errorf("got DEV_ERRORS %v and BINARY_MEDIA_TYPES %q", devErrors, binaryMediaTypes)
+	}
+}
+
+func TestNewInvalidOption(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		config string
+		want   string
+	}{
+		{"boolean option", []Option{WithOption("DEBUG", "yes")}, "", "Invalid DEBUG: yes"},
+		{"boolean option in a nested setting", []Option{WithOption("CORS_ALLOW_ORIGINS", "*"), WithOption("CORS_ALLOW_CREDENTIALS", "maybe")}, "", "Invalid CORS_ALLOW_CREDENTIALS: maybe"},
+		{"boolean in the config file", nil, "debug: yes\n", "debug must be true or false"},
+		{"unknown setting in the config file", nil, "lambda-hots: 127.0.0.1:8001\n", "unknown setting lambda-hots"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			if test.config != "" {
+				path := filepath.Join(t.TempDir(), "gateway.yaml")
+				if err := os.WriteFile(path, []byte(test.config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				opts = append(opts, WithOption("CONFIG_FILE", path))
+			}
+			g, err := New(append(opts, WithLambdaHost("127.0.0.1:1"))...)
+			if err == nil {
+				g.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
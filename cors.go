@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsConfig is set when CORS is handled by the gateway, like an HTTP API with
+// a CORS configuration: preflight requests are answered without invoking the
+// lambda, and the CORS headers returned by the lambda are replaced by the
+// configured ones.
+type corsConfig struct {
+	allowOrigins     []string
+	allowMethods     string
+	allowHeaders     string
+	exposeHeaders    string
+	allowCredentials bool
+	maxAge           int
+}
+
+// cors returns the CORS configuration for the request: the configured one, or
+// the one of the route if it was imported from a template with CORS enabled.
+func (inv *invocation) cors() *corsConfig {
+	if inv.config.cors != nil {
+		return inv.config.cors
+	} else if inv.route != nil {
+		return inv.route.cors
+	}
+	return nil
+}
+
+// origin returns the value for Access-Control-Allow-Origin, or "" if the
+// origin is not allowed. A wildcard can't be used together with credentials,
+// so the origin is reflected instead.
+func (c *corsConfig) origin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range c.allowOrigins {
+		if allowed == "*" {
+			if c.allowCredentials {
+				return origin
+			}
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// setHeaders adds the CORS headers for the request's origin to the
+// response. It returns true if the request is a preflight request, which has
+// then been answered.
+func (c *corsConfig) setHeaders(w http.ResponseWriter, r *http.Request) bool {
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	origin := c.origin(r.Header.Get("Origin"))
+	if origin != "" {
+		header.Set("Access-Control-Allow-Origin", origin)
+		if c.allowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		if origin != "" && c.exposeHeaders != "" {
+			header.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+		}
+		return false
+	}
+
+	if origin != "" {
+		methods := c.allowMethods
+		if methods == "" || methods == "*" {
+			methods = r.Header.Get("Access-Control-Request-Method")
+		}
+		header.Set("Access-Control-Allow-Methods", methods)
+		headers := c.allowHeaders
+		if headers == "*" {
+			headers = r.Header.Get("Access-Control-Request-Headers")
+		}
+		if headers != "" {
+			header.Set("Access-Control-Allow-Headers", headers)
+		}
+		if c.maxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(c.maxAge))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// removeCORSHeaders removes the CORS headers from the lambda's response, since
+// they are set by the gateway.
+func removeCORSHeaders(headers map[string]string, multiValueHeaders map[string][]string) {
+	for key := range headers {
+		if strings.HasPrefix(strings.ToLower(key), "access-control-") {
+			delete(headers, key)
+		}
+	}
+	for key := range multiValueHeaders {
+		if strings.HasPrefix(strings.ToLower(key), "access-control-") {
+			delete(multiValueHeaders, key)
+		}
+	}
+}
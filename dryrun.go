@@ -0,0 +1,34 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errDryRun is returned by invokeLambda for a dry run when the event was
+// built and the lambda responds to a ping. The lambda is not invoked.
+var errDryRun = errors.New("dry run succeeded")
+
+// dryRunError is returned by invokeLambda for a dry run when the lambda
+// can't be reached.
+type dryRunError struct {
+	lambdaHost string
+	err        error
+}
+
+func (e *dryRunError) Error() string {
+	return fmt.Sprintf("lambda at %s is not reachable: %v", e.lambdaHost, e.err)
+}
+
+func (e *dryRunError) Unwrap() error {
+	return e.err
+}
+
+// dryRun checks that the lambda can be reached, by connecting to it and
+// calling Function.Ping, without invoking it.
+func dryRun(inv *invocation) error {
+	if err := inv.route.pool.ping(healthCheckTimeout); err != nil {
+		return &dryRunError{inv.route.lambdaHost, err}
+	}
+	return errDryRun
+}
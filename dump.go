@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// dumpBodyLimit is the number of bytes of the body that are included when
+// events and responses are dumped in debug mode.
+var dumpBodyLimit int
+
+// dumpRedactHeaders are the lowercase names of the headers whose values are
+// hidden when events and responses are dumped.
+var dumpRedactHeaders map[string]bool
+
+// dumpPayload logs an event or a response in debug mode, pretty-printed, with
+// the body truncated and the redacted headers hidden.
+func dumpPayload(label string, inv *invocation, payload []byte) {
+	if !debug.Load() {
+		return
+	}
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		log.Printf("%s (request id %s, not JSON):\n%s", label, inv.requestID, truncate(payload, dumpBodyLimit))
+		return
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		redactPayload(m)
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+	log.Printf("%s (request id %s):\n%s", label, inv.requestID, data)
+}
+
+func redactPayload(m map[string]interface{}) {
+	if body, ok := m["body"].(string); ok && len(body) > dumpBodyLimit {
+		m["body"] = fmt.Sprintf("%s... (%d more bytes)", body[:dumpBodyLimit], len(body)-dumpBodyLimit)
+	}
+	if headers, ok := m["headers"].(map[string]interface{}); ok {
+		for key := range headers {
+			if dumpRedactHeaders[strings.ToLower(key)] {
+				headers[key] = "(redacted)"
+			}
+		}
+	}
+	if headers, ok := m["multiValueHeaders"].(map[string]interface{}); ok {
+		for key := range headers {
+			if dumpRedactHeaders[strings.ToLower(key)] {
+				headers[key] = []string{"(redacted)"}
+			}
+		}
+	}
+	// Payload format 2.0 has the cookies in a separate field
+	if _, ok := m["cookies"]; ok && (dumpRedactHeaders["cookie"] || dumpRedactHeaders["set-cookie"]) {
+		m["cookies"] = []string{"(redacted)"}
+	}
+}
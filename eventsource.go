@@ -0,0 +1,241 @@
+package gateway
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// eventRegion is the region used in the ARNs of injected events.
+const eventRegion = "us-east-1"
+
+// handleEventSource invokes the default lambda with an event from a non-HTTP
+// event source, built around the request body. The envelope's fields can be
+// set with query parameters, e.g. ?queue_arn=..., or with headers, e.g.
+// X-Event-Queue-Arn. The lambda's response is returned as is, and errors are
+// returned like the Lambda Invoke API does.
+func handleEventSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	source := strings.TrimPrefix(r.URL.Path, gatewayPathPrefix+"/events/")
+	param := func(name string, defaultValue string) string {
+		if v := r.URL.Query().Get(name); v != "" {
+			return v
+		}
+		if v := r.Header.Get("X-Event-" + strings.ReplaceAll(name, "_", "-")); v != "" {
+			return v
+		}
+		return defaultValue
+	}
+
+	var event interface{}
+	switch source {
+	case "sqs":
+		event = newSQSEvent(body, param)
+	case "sns":
+		event = newSNSEvent(body, param)
+	case "s3":
+		event = newS3Event(body, param)
+	case "dynamodb":
+		event, err = newDynamoDBEvent(body, param)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown event source: %q (must be sqs, sns, s3 or dynamodb)", source), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	inv, err := newInvocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inv.route = inv.config.defaultRoute.pick()
+	w.Header()["x-amzn-RequestId"] = []string{inv.requestID}
+	response, err := invokeLambda(inv, payload)
+	if inv.span != nil {
+		inv.span.name = "POST " + gatewayPathPrefix + "/events/" + source
+		if err != nil {
+			inv.span.setError(err)
+		}
+		inv.span.finish()
+	}
+
+	var lambdaErr *lambdaError
+	if errors.As(err, &lambdaErr) {
+		log.Printf("Lambda returned an error (request id %s): %v\n%s", inv.requestID, err, lambdaErr.stackTrace())
+		var stackTrace []string
+		for _, frame := range lambdaErr.err.StackTrace {
+			stackTrace = append(stackTrace, fmt.Sprintf("%s:%d %s", frame.Path, frame.Line, frame.Label))
+		}
+		response, _ = json.Marshal(map[string]interface{}{
+			"errorMessage": lambdaErr.err.Message,
+			"errorType":    lambdaErr.err.Type,
+			"stackTrace":   stackTrace,
+		})
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+	} else if err != nil {
+		log.Printf("Error invoking lambda (request id %s): %v", inv.requestID, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func newSQSEvent(body []byte, param func(string, string) string) *events.SQSEvent {
+	sum := md5.Sum(body)
+	queueArn := param("queue_arn", fmt.Sprintf("arn:aws:sqs:%s:%s:local-queue", eventRegion, accountID))
+	attributes := map[string]string{
+		"ApproximateReceiveCount":          "1",
+		"SentTimestamp":                    fmt.Sprint(time.Now().UnixMilli()),
+		"SenderId":                         accountID,
+		"ApproximateFirstReceiveTimestamp": fmt.Sprint(time.Now().UnixMilli()),
+	}
+	if groupID := param("message_group_id", ""); groupID != "" {
+		attributes["MessageGroupId"] = groupID
+	}
+	return &events.SQSEvent{
+		Records: []events.SQSMessage{{
+			MessageId:         param("message_id", newUUID()),
+			ReceiptHandle:     newUUID(),
+			Body:              string(body),
+			Md5OfBody:         hex.EncodeToString(sum[:]),
+			Attributes:        attributes,
+			MessageAttributes: map[string]events.SQSMessageAttribute{},
+			EventSourceARN:    queueArn,
+			EventSource:       "aws:sqs",
+			AWSRegion:         eventRegion,
+		}},
+	}
+}
+
+func newSNSEvent(body []byte, param func(string, string) string) *events.SNSEvent {
+	topicArn := param("topic_arn", fmt.Sprintf("arn:aws:sns:%s:%s:local-topic", eventRegion, accountID))
+	return &events.SNSEvent{
+		Records: []events.SNSEventRecord{{
+			EventVersion:         "1.0",
+			EventSubscriptionArn: topicArn + ":" + newUUID(),
+			EventSource:          "aws:sns",
+			SNS: events.SNSEntity{
+				MessageID:         param("message_id", newUUID()),
+				Type:              "Notification",
+				TopicArn:          topicArn,
+				MessageAttributes: map[string]interface{}{},
+				SignatureVersion:  "1",
+				Timestamp:         time.Now().UTC(),
+				Message:           string(body),
+				Subject:           param("subject", ""),
+			},
+		}},
+	}
+}
+
+// newS3Event returns an event for an object. The body is the object's
+// content, which is only used for its size and ETag.
+func newS3Event(body []byte, param func(string, string) string) *events.S3Event {
+	sum := md5.Sum(body)
+	bucket := param("bucket", "local-bucket")
+	key := param("key", "object")
+	decodedKey, err := url.QueryUnescape(key)
+	if err != nil {
+		decodedKey = key
+	}
+	return &events.S3Event{
+		Records: []events.S3EventRecord{{
+			EventVersion:      "2.1",
+			EventSource:       "aws:s3",
+			AWSRegion:         eventRegion,
+			EventTime:         time.Now().UTC(),
+			EventName:         param("event_name", "ObjectCreated:Put"),
+			PrincipalID:       events.S3UserIdentity{PrincipalID: "AWS:" + accountID},
+			RequestParameters: events.S3RequestParameters{SourceIPAddress: "127.0.0.1"},
+			ResponseElements:  map[string]string{"x-amz-request-id": newUUID()},
+			S3: events.S3Entity{
+				SchemaVersion:   "1.0",
+				ConfigurationID: "local",
+				Bucket: events.S3Bucket{
+					Name:          bucket,
+					OwnerIdentity: events.S3UserIdentity{PrincipalID: accountID},
+					Arn:           "arn:aws:s3:::" + bucket,
+				},
+				Object: events.S3Object{
+					Key:           key,
+					Size:          int64(len(body)),
+					URLDecodedKey: decodedKey,
+					ETag:          hex.EncodeToString(sum[:]),
+					Sequencer:     fmt.Sprintf("%016X", time.Now().UnixNano()),
+				},
+			},
+		}},
+	}
+}
+
+// newDynamoDBEvent returns a stream event for an item. The body is the item
+// in the DynamoDB JSON format, e.g. {"id": {"S": "1"}}, which is the new
+// image, or the old image for REMOVE events.
+func newDynamoDBEvent(body []byte, param func(string, string) string) (*events.DynamoDBEvent, error) {
+	var item map[string]events.DynamoDBAttributeValue
+	if err := json.Unmarshal(body, &item); err != nil {
+		return nil, fmt.Errorf("The body must be an item in the DynamoDB JSON format: %v", err)
+	}
+	eventName := param("event_name", "INSERT")
+	if eventName != "INSERT" && eventName != "MODIFY" && eventName != "REMOVE" {
+		return nil, fmt.Errorf("Invalid event_name: %s (must be INSERT, MODIFY or REMOVE)", eventName)
+	}
+	keys := map[string]events.DynamoDBAttributeValue{}
+	for _, name := range strings.Split(param("keys", "id"), ",") {
+		if value, ok := item[strings.TrimSpace(name)]; ok {
+			keys[strings.TrimSpace(name)] = value
+		}
+	}
+	change := events.DynamoDBStreamRecord{
+		ApproximateCreationDateTime: events.SecondsEpochTime{Time: time.Now()},
+		Keys:                        keys,
+		SequenceNumber:              fmt.Sprint(time.Now().UnixNano()),
+		SizeBytes:                   int64(len(body)),
+		StreamViewType:              "NEW_AND_OLD_IMAGES",
+	}
+	if eventName == "REMOVE" {
+		change.OldImage = item
+	} else {
+		change.NewImage = item
+	}
+	table := param("table", "local-table")
+	return &events.DynamoDBEvent{
+		Records: []events.DynamoDBEventRecord{{
+			AWSRegion:      eventRegion,
+			Change:         change,
+			EventID:        strings.ReplaceAll(newUUID(), "-", ""),
+			EventName:      eventName,
+			EventSource:    "aws:dynamodb",
+			EventVersion:   "1.1",
+			EventSourceArn: fmt.Sprintf("arn:aws:dynamodb:%s:%s:table/%s/stream/%s", eventRegion, accountID, table, time.Now().UTC().Format("2006-01-02T15:04:05.000")),
+		}},
+	}, nil
+}
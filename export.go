@@ -0,0 +1,347 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// openAPILambdaHostExtension is the address of an operation's lambda in an
+// exported document, so the document can be imported again without a
+// --function-port for every lambda.
+const openAPILambdaHostExtension = "x-go-lambda-gateway-lambda-host"
+
+// openAPIValidatorNames are the request validators of an exported document,
+// by whether they validate the body and the parameters.
+var openAPIValidatorNames = map[[2]bool]string{
+	{true, true}:   "all",
+	{true, false}:  "body",
+	{false, true}:  "parameters",
+	{false, false}: "none",
+}
+
+var functionNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// exportOpenAPI describes the routes as an OpenAPI 3 document with the API
+// Gateway extensions, which can be imported again with --openapi. Host routes
+// can't be described and are left out.
+func exportOpenAPI(c *reloadableConfig) map[string]interface{} {
+	paths := map[string]interface{}{}
+	schemes := map[string]interface{}{}
+	schemas := map[string]interface{}{}
+
+	addOperation := func(template string, method string, rt *route, validator *requestValidator) {
+		item, _ := paths[template].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[template] = item
+		}
+		key := strings.ToLower(method)
+		if method == "ANY" {
+			key = "x-amazon-apigateway-any-method"
+		}
+		if item[key] != nil {
+			return
+		}
+
+		op := map[string]interface{}{
+			"responses": map[string]interface{}{
+				"default": map[string]interface{}{"description": "The lambda's response"},
+			},
+			"x-amazon-apigateway-integration": exportIntegration(rt),
+		}
+		if rt != c.defaultRoute {
+			op[openAPILambdaHostExtension] = rt.lambdaHost
+		}
+		var parameters []interface{}
+		mode := [2]bool{}
+		if validator != nil {
+			mode = [2]bool{validator.validateBody, validator.validateParameters}
+			for _, p := range validator.parameters {
+				parameters = append(parameters, exportParameter(p))
+			}
+			if validator.body != nil {
+				op["requestBody"] = map[string]interface{}{
+					"required": validator.bodyRequired,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": exportSchema(validator.body)},
+					},
+				}
+			}
+			for name, schema := range validator.doc.schemas() {
+				schemas[name] = exportSchema(schema)
+			}
+		}
+		// Path parameters have to be described, even if they aren't validated
+		for _, segment := range splitPath(template) {
+			if !strings.HasPrefix(segment, "{") {
+				continue
+			}
+			name := strings.TrimSuffix(strings.Trim(segment, "{}"), "+")
+			found := false
+			for _, p := range parameters {
+				p := p.(map[string]interface{})
+				if p["in"] == "path" && p["name"] == name {
+					found = true
+				}
+			}
+			if !found {
+				parameters = append(parameters, map[string]interface{}{
+					"name":     name,
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+		op["x-amazon-apigateway-request-validator"] = openAPIValidatorNames[mode]
+
+		var security []interface{}
+		if auth := authorizerFor(rt); auth != nil {
+			name := exportFunctionName(auth.route)
+			schemes[name] = exportAuthorizer(auth)
+			security = append(security, map[string]interface{}{name: []interface{}{}})
+		}
+		if apiKeys != nil && (apiKeyRequired || rt.requireAPIKey) {
+			schemes["api_key"] = map[string]interface{}{"type": "apiKey", "name": "x-api-key", "in": "header"}
+			security = append(security, map[string]interface{}{"api_key": []interface{}{}})
+		}
+		if jwtAuthorizer {
+			schemes["jwt"] = map[string]interface{}{
+				"type":  "oauth2",
+				"flows": map[string]interface{}{},
+				"x-amazon-apigateway-authorizer": map[string]interface{}{
+					"type":           "jwt",
+					"identitySource": "$request.header.Authorization",
+					"jwtConfiguration": map[string]interface{}{
+						"issuer":   jwtIssuer,
+						"audience": jwtAudience,
+					},
+				},
+			}
+			security = append(security, map[string]interface{}{"jwt": []interface{}{}})
+		}
+		if len(security) > 0 {
+			op["security"] = security
+		}
+		item[key] = op
+	}
+
+	// The most specific routes first, since an operation is only added once
+	for _, rt := range c.methodRoutes {
+		// Preflight routes are created again from x-amazon-apigateway-cors
+		if rt.method == http.MethodOptions && rt.cors != nil {
+			continue
+		}
+		addOperation(rt.resource.template, rt.method, rt, c.validatorFor(rt.method, rt.resource))
+	}
+	for _, v := range c.validators {
+		addOperation(v.resource.template, v.method, c.defaultRoute, v)
+	}
+	for _, res := range c.resources {
+		// Resources from RESOURCES, the imported ones already have operations
+		if paths[res.template] == nil {
+			addOperation(res.template, "ANY", c.defaultRoute, nil)
+		}
+	}
+	for _, rt := range c.routes {
+		addOperation(rt.prefix+"/{proxy+}", "ANY", rt, nil)
+	}
+	if proxyBase == "" {
+		addOperation("/", "ANY", c.defaultRoute, nil)
+	} else {
+		addOperation(proxyBase, "ANY", c.defaultRoute, nil)
+	}
+	addOperation(proxyBase+"/{proxy+}", "ANY", c.defaultRoute, nil)
+
+	validators := map[string]interface{}{}
+	for mode, name := range openAPIValidatorNames {
+		validators[name] = map[string]interface{}{
+			"validateRequestBody":       mode[0],
+			"validateRequestParameters": mode[1],
+		}
+	}
+	doc := map[string]interface{}{
+		"openapi": "3.0.1",
+		"info": map[string]interface{}{
+			"title":   "go-lambda-gateway",
+			"version": gatewayVersion(),
+		},
+		"paths":                                  paths,
+		"x-amazon-apigateway-request-validators": validators,
+		"x-amazon-apigateway-request-validator":  "none",
+	}
+	components := map[string]interface{}{}
+	if len(schemes) > 0 {
+		components["securitySchemes"] = schemes
+	}
+	if len(schemas) > 0 {
+		components["schemas"] = schemas
+	}
+	if len(components) > 0 {
+		doc["components"] = components
+	}
+	if len(binaryMediaTypes) > 0 {
+		doc["x-amazon-apigateway-binary-media-types"] = binaryMediaTypes
+	}
+	if cors := c.exportCORS(); cors != nil {
+		doc["x-amazon-apigateway-cors"] = cors
+	}
+	return doc
+}
+
+// handleOpenAPI serves the OpenAPI document of the current routes.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, exportOpenAPI(currentConfig.Load()))
+}
+
+// validatorFor returns the validator of an operation, or nil.
+func (c *reloadableConfig) validatorFor(method string, res *resource) *requestValidator {
+	for _, v := range c.validators {
+		if v.method == method && v.resource == res {
+			return v
+		}
+	}
+	return nil
+}
+
+// exportFunctionName returns the name of the function in the integration of a
+// lambda. Lambdas that aren't from a template are named after their address.
+func exportFunctionName(rt *route) string {
+	if rt.function != "" {
+		return rt.function
+	} else if lambdaBackend == "aws" {
+		return rt.lambdaHost
+	}
+	return strings.Trim(functionNameRegexp.ReplaceAllString(rt.lambdaHost, "-"), "-")
+}
+
+func exportFunctionURI(rt *route) string {
+	arn := exportFunctionName(rt)
+	if !strings.HasPrefix(arn, "arn:") {
+		arn = fmt.Sprintf("arn:aws:lambda:us-east-1:%s:function:%s", accountID, arn)
+	}
+	return fmt.Sprintf("arn:aws:apigateway:us-east-1:lambda:path/2015-03-31/functions/%s/invocations", arn)
+}
+
+func exportIntegration(rt *route) map[string]interface{} {
+	integ := map[string]interface{}{
+		"type":       "aws_proxy",
+		"httpMethod": "POST",
+		"uri":        exportFunctionURI(rt),
+	}
+	if eventFormat == "apigateway" {
+		integ["payloadFormatVersion"] = rt.eventPayloadFormat()
+	}
+	return integ
+}
+
+func exportAuthorizer(auth *routeAuthorizer) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                         "apiKey",
+		"name":                         auth.header,
+		"in":                           "header",
+		"x-amazon-apigateway-authtype": "custom",
+		"x-amazon-apigateway-authorizer": map[string]interface{}{
+			"type":                         strings.ToLower(auth.authorizerType),
+			"authorizerUri":                exportFunctionURI(auth.route),
+			"identitySource":               "method.request.header." + auth.header,
+			"authorizerResultTtlInSeconds": int(auth.ttl.Seconds()),
+		},
+		openAPILambdaHostExtension: auth.route.lambdaHost,
+	}
+}
+
+func exportParameter(p *openAPIParameter) map[string]interface{} {
+	param := map[string]interface{}{
+		"name":     p.name,
+		"in":       p.in,
+		"required": p.required || p.in == "path",
+	}
+	if p.schema != nil {
+		schema := exportSchema(p.schema).(map[string]interface{})
+		// Swagger 2 parameters are their own schema
+		for _, key := range []string{"name", "in", "required", "description"} {
+			delete(schema, key)
+		}
+		param["schema"] = schema
+	}
+	return param
+}
+
+// exportSchema copies a schema, with the references to Swagger 2 definitions
+// changed to the components of an OpenAPI 3 document.
+func exportSchema(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			if ref, ok := value.(string); ok && key == "$ref" && strings.HasPrefix(ref, "#/definitions/") {
+				value = "#/components/schemas/" + strings.TrimPrefix(ref, "#/definitions/")
+			}
+			m[key] = exportSchema(value)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = exportSchema(item)
+		}
+		return list
+	}
+	return v
+}
+
+// schemas returns the named schemas of the document.
+func (d *openAPIDocument) schemas() map[string]interface{} {
+	if d.swagger {
+		definitions, _ := d.doc["definitions"].(map[string]interface{})
+		return definitions
+	}
+	components, _ := d.doc["components"].(map[string]interface{})
+	schemas, _ := components["schemas"].(map[string]interface{})
+	return schemas
+}
+
+// exportCORS describes the CORS configuration like an HTTP API's. Without
+// CORS_ALLOW_ORIGINS, the CORS configuration of an imported route is used.
+func (c *reloadableConfig) exportCORS() map[string]interface{} {
+	cors := c.cors
+	if cors == nil {
+		for _, rt := range c.methodRoutes {
+			if rt.cors != nil {
+				cors = rt.cors
+				break
+			}
+		}
+	}
+	if cors == nil {
+		return nil
+	}
+	split := func(s string) []string {
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		sort.Strings(list)
+		return list
+	}
+	exported := map[string]interface{}{
+		"allowOrigins":     cors.allowOrigins,
+		"allowMethods":     split(cors.allowMethods),
+		"allowHeaders":     split(cors.allowHeaders),
+		"exposeHeaders":    split(cors.exposeHeaders),
+		"allowCredentials": cors.allowCredentials,
+	}
+	if cors.maxAge > 0 {
+		exported["maxAge"] = cors.maxAge
+	}
+	return exported
+}
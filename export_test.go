@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testOpenAPIDocument = `
+openapi: 3.0.1
+info:
+  title: users
+  version: "1"
+x-amazon-apigateway-request-validators:
+  all:
+    validateRequestBody: true
+    validateRequestParameters: true
+x-amazon-apigateway-request-validator: all
+paths:
+  /users/{id}:
+    get:
+      parameters:
+        - name: id
+          in: path
+          required: true
+          schema:
+            type: string
+        - name: fields
+          in: query
+          required: true
+          schema:
+            type: string
+      x-go-lambda-gateway-lambda-host: 127.0.0.1:9001
+      x-amazon-apigateway-integration:
+        type: aws_proxy
+        httpMethod: POST
+        uri: arn:aws:apigateway:us-east-1:lambda:path/2015-03-31/functions/arn:aws:lambda:us-east-1:123456789012:function:users/invocations
+  /orders:
+    post:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [item]
+              properties:
+                item:
+                  type: string
+`
+
+func TestExportOpenAPIRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original.yaml")
+	if err := os.WriteFile(original, []byte(testOpenAPIDocument), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := []Option{
+		WithLambdaHost("127.0.0.1:9000"),
+		WithBinaryMediaTypes("image/png"),
+		WithOption("CORS_ALLOW_ORIGINS", "https://example.com"),
+	}
+	g, err := New(append(options, WithOption("OPENAPI_FILE", original), WithOption("ROUTES", "/api/*=127.0.0.1:9002"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := exportOpenAPI(currentConfig.Load())
+	g.Close()
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "exported.json")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Importing the exported document gives the same routes, which are
+	// exported the same way again
+	newTestGateway(t, append(options, WithOption("OPENAPI_FILE", file))...)
+	reexported, err := json.Marshal(exportOpenAPI(currentConfig.Load()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, second interface{}
+	json.Unmarshal(data, &first)
+	json.Unmarshal(reexported, &second)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("the imported document was exported differently:\n%s\n%s", data, reexported)
+	}
+
+	for _, want := range []struct{ method, template, lambdaHost string }{
+		{"GET", "/users/{id}", "127.0.0.1:9001"},
+		{"ANY", "/api/{proxy+}", "127.0.0.1:9002"},
+	} {
+		found := false
+		for _, rt := range currentConfig.Load().methodRoutes {
+			if rt.method == want.method && rt.resource.template == want.template && rt.lambdaHost == want.lambdaHost {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("the imported document has no route for %s %s to %s", want.method, want.template, want.lambdaHost)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// failoverInterval is how long a lambda that failed is skipped in favor of
+// the fallback lambdas in LAMBDA_HOST_FALLBACK.
+var failoverInterval = 30 * time.Second
+
+// failoverOnError also fails over when the lambda returns an error, e.g. when
+// the handler panics, instead of only when the lambda can't be reached.
+var failoverOnError bool
+
+// parseFallbackRoutes parses the comma-separated list of fallback lambdas, in
+// the order they are tried.
+func parseFallbackRoutes(s string) []*route {
+	var fallbacks []*route
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			fallbacks = append(fallbacks, &route{lambdaHost: host})
+			fmt.Fprintf(os.Stderr, "Fallback lambda address: %s\n", host)
+		}
+	}
+	return fallbacks
+}
+
+// markFailed makes requests skip the lambda for failoverInterval.
+func (h *backendHealth) markFailed() {
+	h.failedUntil.Store(time.Now().Add(failoverInterval).UnixNano())
+}
+
+// failed returns true if the lambda failed within the last failoverInterval.
+func (h *backendHealth) failed() bool {
+	return time.Now().UnixNano() < h.failedUntil.Load()
+}
+
+// shouldFailOver returns true if the invocation should be retried with the
+// next lambda.
+func shouldFailOver(err error) bool {
+	var dialErr *dialError
+	var circuitErr *circuitOpenError
+	var lambdaErr *lambdaError
+	return errors.As(err, &dialErr) || errors.As(err, &circuitErr) || (failoverOnError && errors.As(err, &lambdaErr))
+}
+
+// invokeWithFailover invokes the lambda, and retries the same event with the
+// fallback lambdas if it can't be reached. Lambdas that failed recently are
+// skipped, unless there's no other lambda left to try.
+func invokeWithFailover(inv *invocation, payload []byte) ([]byte, error) {
+	candidates := append([]*route{inv.route}, inv.route.fallbacks...)
+	var err error
+	for i, rt := range candidates {
+		last := i == len(candidates)-1
+		if rt.pool.health.failed() && !last {
+			continue
+		}
+		inv.route = rt
+		inv.errorType = ""
+		var responsePayload []byte
+		responsePayload, err = invoke(inv, payload)
+		if err == nil || last || !shouldFailOver(err) {
+			return responsePayload, err
+		}
+		rt.pool.health.markFailed()
+		log.Printf("Lambda at %s failed (request id %s), using the fallback lambdas for %v: %v", rt.lambdaHost, inv.requestID, failoverInterval, err)
+	}
+	return nil, err
+}
@@ -0,0 +1,165 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// trustedProxies are the networks of the proxies in front of the gateway.
+// Their X-Forwarded-For headers are used to find the client's address.
+var trustedProxies []*net.IPNet
+
+// hostOverride replaces the host of the requests in the events, e.g. with the
+// custom domain of the API.
+var hostOverride string
+
+// trustForwardedHeaders keeps the client's X-Forwarded-Proto and
+// X-Forwarded-Port headers, e.g. when the gateway is behind a proxy that
+// terminates TLS.
+var trustForwardedHeaders bool
+
+// setForwardedHeaders adds the headers that API Gateway adds before the event
+// reaches the lambda. The client's address is appended to X-Forwarded-For,
+// and X-Forwarded-Proto and X-Forwarded-Port are the gateway's own.
+func setForwardedHeaders(r *http.Request) {
+	forwardedFor := remoteIP(r)
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		forwardedFor = strings.Join(values, ", ") + ", " + forwardedFor
+	}
+	r.Header.Set("X-Forwarded-For", forwardedFor)
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if !trustForwardedHeaders || r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if !trustForwardedHeaders || r.Header.Get("X-Forwarded-Port") == "" {
+		r.Header.Set("X-Forwarded-Port", listenerPort(r, proto))
+	}
+}
+
+// overrideHost returns a copy of the request with HOST_OVERRIDE as its host,
+// after routing. The real host is kept in X-Forwarded-Host.
+func overrideHost(r *http.Request) *http.Request {
+	if hostOverride == "" {
+		return r
+	}
+	if !trustForwardedHeaders || r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Host = hostOverride
+	return r2
+}
+
+// listenerPort returns the port of the listener that accepted the request.
+// Requests on a Unix socket use the default port of the protocol.
+func listenerPort(r *http.Request, proto string) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return strconv.Itoa(addr.Port)
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// parseTrustedProxies parses a comma-separated list of networks, e.g.
+// "10.0.0.0/8,127.0.0.1". An address without a prefix length is a single
+// host.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address of the connection's peer, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// sourceIP returns the IP address of the client. When the peer is a trusted
+// proxy, X-Forwarded-For is read from right to left, and the first address
+// that isn't a trusted proxy is the client's. X-Forwarded-For from other
+// peers is ignored, since anyone can send it.
+func sourceIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := forwardedIP(strings.TrimSpace(hops[i]))
+		if hop == "" {
+			// The address was mangled, and the ones before it can't be trusted
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// forwardedIP returns the address in an X-Forwarded-For entry, which may
+// have a port. It returns "" if the entry isn't an address.
+func forwardedIP(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
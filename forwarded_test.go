@@ -0,0 +1,122 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestSourceIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"no proxy", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed by an untrusted peer", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without X-Forwarded-For", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "198.51.100.1"},
+		{"spoofed entry before the client", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"multiple headers", "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"entry with a port", "10.0.0.1:1234", []string{"198.51.100.1:5678"}, "198.51.100.1"},
+		{"mangled entry", "10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"IPv6 peer", "[2001:db8::7]:1234", []string{"198.51.100.1"}, "2001:db8::7"},
+		{"IPv6 trusted proxy", "[fd00::1]:1234", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"IPv6 entry with brackets and a port", "[fd00::1]:1234", []string{"[2001:db8::7]:5678"}, "2001:db8::7"},
+		{"IPv6 entry is normalized", "[fd00::1]:1234", []string{"2001:DB8:0::7"}, "2001:db8::7"},
+	}
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := sourceIP(r); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []string
+		wantErr bool
+	}{
+		{s: "10.0.0.0/8", want: []string{"10.0.0.0/8"}},
+		{s: "127.0.0.1, ::1", want: []string{"127.0.0.1/32", "::1/128"}},
+		{s: "192.168.1.0/24,,fd00::/8", want: []string{"192.168.1.0/24", "fd00::/8"}},
+		{s: "localhost", wantErr: true},
+		{s: "10.0.0.0/33", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			networks, err := parseTrustedProxies(test.s)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			var got []string
+			for _, network := range networks {
+				got = append(got, network.String())
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("got %q, want %q", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedEvent(t *testing.T) {
+	var event events.APIGatewayProxyRequest
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		event = events.APIGatewayProxyRequest{}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("TRUSTED_PROXIES", "192.0.2.1"))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		sourceIP   string
+		forwarded  string
+	}{
+		{"trusted proxy", "192.0.2.1:1234", "198.51.100.1", "198.51.100.1, 192.0.2.1"},
+		{"untrusted peer", "203.0.113.7:1234", "203.0.113.7", "198.51.100.1, 203.0.113.7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			r.Header.Set("X-Forwarded-For", "198.51.100.1")
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if event.RequestContext.Identity.SourceIP != test.sourceIP {
+				t.Errorf("got sourceIp %q, want %q", event.RequestContext.Identity.SourceIP, test.sourceIP)
+			}
+			if got := event.Headers["X-Forwarded-For"]; got != test.forwarded {
+				t.Errorf("got X-Forwarded-For %q, want %q", got, test.forwarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// functionPortFlags are the lambdas of the functions in a template, from
+// repeated --function-port name=port flags. They take precedence over
+// FUNCTION_PORTS_FILE.
+var functionPortFlags = map[string]string{}
+
+// loadFunctionHosts returns the lambda of every function that is mapped with
+// a --function-port flag or in FUNCTION_PORTS_FILE, which is a YAML or JSON
+// object like {"UsersFunction": 8003}. A port is a lambda on localhost, and
+// anything else is used as the lambda's address.
+func loadFunctionHosts() (map[string]string, error) {
+	hosts := map[string]string{}
+	if portsFile := getenv("FUNCTION_PORTS_FILE"); portsFile != "" {
+		data, err := ioutil.ReadFile(portsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading FUNCTION_PORTS_FILE: %v", err)
+		}
+		var ports map[string]string
+		if err := yaml.Unmarshal(data, &ports); err != nil {
+			return nil, fmt.Errorf("Error parsing FUNCTION_PORTS_FILE: %v", err)
+		}
+		for name, port := range ports {
+			hosts[name] = functionHost(port)
+		}
+	}
+	for name, port := range functionPortFlags {
+		hosts[name] = functionHost(port)
+	}
+	return hosts, nil
+}
+
+func functionHost(port string) string {
+	if n, err := strconv.Atoi(port); err == nil && n > 0 && n <= 65535 {
+		return fmt.Sprintf("localhost:%d", n)
+	}
+	return port
+}
+
+// lookupFunctionHost finds the lambda of a function by its name, or by the
+// directory of its code, e.g. the CodeUri of a SAM function.
+func lookupFunctionHost(hosts map[string]string, name string, codeDir string) (string, bool) {
+	if host, ok := hosts[name]; ok {
+		return host, true
+	}
+	if codeDir != "" {
+		codeDir = path.Clean(strings.TrimPrefix(codeDir, "./"))
+		for key, host := range hosts {
+			if path.Clean(strings.TrimPrefix(key, "./")) == codeDir {
+				return host, true
+			}
+		}
+	}
+	return "", false
+}
+
+// addMethodRoutes adds the routes imported from a template. Their resources
+// are also used for the events, so path parameters are set even for requests
+// that are sent to another lambda.
+func (c *reloadableConfig) addMethodRoutes(routes []*route) {
+	for _, rt := range routes {
+		rt.resource = c.addResource(rt.resource)
+		c.methodRoutes = append(c.methodRoutes, rt)
+		var details []string
+		if rt.cors != nil {
+			details = append(details, "cors")
+		}
+		if rt.authorizer != nil {
+			details = append(details, "authorizer "+rt.authorizer.route.function)
+		}
+		fmt.Fprintf(os.Stderr, "Route: %s %s -> %s (%s)\n", rt.method, rt.resource.template, rt.lambdaHost, strings.Join(append([]string{rt.function}, details...), ", "))
+	}
+}
+
+// addResource adds a resource from a template, unless RESOURCES or another
+// template already has it, and returns the resource that is used.
+func (c *reloadableConfig) addResource(res *resource) *resource {
+	for _, existing := range c.resources {
+		if existing.template == res.template {
+			return existing
+		}
+	}
+	c.resources = append(c.resources, res)
+	return res
+}
@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// handleFunctionURLRequest builds a Lambda Function URL event, invokes the
+// lambda and converts its response into the proxy response that is written
+// to the client.
+func handleFunctionURLRequest(inv *invocation, r *http.Request, body []byte) (*events.APIGatewayProxyResponse, error) {
+	request := newFunctionURLRequest(inv, r, body)
+
+	payload, err := marshalEvent(inv, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return invokeV2Lambda(inv, payload)
+}
+
+// newFunctionURLRequest builds the event from the HTTP API one, since the two
+// only differ in their request context.
+func newFunctionURLRequest(inv *invocation, r *http.Request, body []byte) *events.LambdaFunctionURLRequest {
+	v2Request := newV2Request(inv, r, body)
+
+	return &events.LambdaFunctionURLRequest{
+		Version:               v2Request.Version,
+		RawPath:               v2Request.RawPath,
+		RawQueryString:        v2Request.RawQueryString,
+		Cookies:               v2Request.Cookies,
+		Headers:               v2Request.Headers,
+		QueryStringParameters: v2Request.QueryStringParameters,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			AccountID:    v2Request.RequestContext.AccountID,
+			RequestID:    v2Request.RequestContext.RequestID,
+			APIID:        v2Request.RequestContext.APIID,
+			DomainName:   v2Request.RequestContext.DomainName,
+			DomainPrefix: v2Request.RequestContext.DomainPrefix,
+			Time:         v2Request.RequestContext.Time,
+			TimeEpoch:    v2Request.RequestContext.TimeEpoch,
+			HTTP:         events.LambdaFunctionURLRequestContextHTTPDescription(v2Request.RequestContext.HTTP),
+		},
+		Body:            v2Request.Body,
+		IsBase64Encoded: v2Request.IsBase64Encoded,
+	}
+}
@@ -0,0 +1,195 @@
+// Package gateway runs go-lambda-gateway in-process, e.g. to serve a lambda
+// from an httptest.Server in integration tests:
+//
+//	gw, err := gateway.New(gateway.WithLambdaHost("localhost:8001"))
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer gw.Close()
+//	srv := httptest.NewServer(gw.Handler())
+//	defer srv.Close()
+//
+// The options not given to New are read from the same environment variables
+// as the go-lambda-gateway command.
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Gateway is a configured gateway. The configuration is stored in package
+// globals, so a process can only have one at a time, and it must be closed
+// before another one is created.
+type Gateway struct {
+	closed          atomic.Bool
+	configFile      string
+	addr            string
+	shutdownTimeout time.Duration
+	server          *http.Server
+	certFile        string
+	keyFile         string
+	adminPort       int
+}
+
+// An Option configures a Gateway. Options take precedence over the
+// environment variables and the config file.
+type Option func(s *settings)
+
+type settings struct {
+	values        map[string]string
+	requestHooks  []RequestHook
+	responseHooks []ResponseHook
+}
+
+// optionValues are the options given to New, by environment variable name.
+var optionValues map[string]string
+
+var gatewayCreated atomic.Bool
+
+// WithOption sets any option by the name of its environment variable, e.g.
+// WithOption("PAYLOAD_FORMAT", "2.0").
+func WithOption(env, value string) Option {
+	return func(s *settings) {
+		s.values[env] = value
+	}
+}
+
+// WithLambdaHost sets the address of the lambda (LAMBDA_HOST).
+func WithLambdaHost(host string) Option {
+	return WithOption("LAMBDA_HOST", host)
+}
+
+// WithTimeout sets the function timeout (FUNCTION_TIMEOUT).
+func WithTimeout(timeout time.Duration) Option {
+	return WithOption("FUNCTION_TIMEOUT", timeout.String())
+}
+
+// WithBinaryMediaTypes sets the media types that are base64 encoded
+// (BINARY_MEDIA_TYPES).
+func WithBinaryMediaTypes(mediaTypes ...string) Option {
+	return WithOption("BINARY_MEDIA_TYPES", strings.Join(mediaTypes, ","))
+}
+
+// WithEventFormat sets the format of the events, apigateway, alb,
+// function-url or websocket (EVENT_FORMAT).
+func WithEventFormat(format string) Option {
+	return WithOption("EVENT_FORMAT", format)
+}
+
+// WithRequestHook adds a hook that is called before the lambda is invoked.
+// Hooks are called in the order they are added.
+func WithRequestHook(hook RequestHook) Option {
+	return func(s *settings) {
+		s.requestHooks = append(s.requestHooks, hook)
+	}
+}
+
+// WithResponseHook adds a hook that is called before a response is written.
+func WithResponseHook(hook ResponseHook) Option {
+	return func(s *settings) {
+		s.responseHooks = append(s.responseHooks, hook)
+	}
+}
+
+// New configures the gateway. It returns an error if the configuration is
+// invalid, or if another gateway in the process hasn't been closed.
+func New(opts ...Option) (*Gateway, error) {
+	if !gatewayCreated.CompareAndSwap(false, true) {
+		return nil, errors.New("A gateway has already been created in this process, and it hasn't been closed")
+	}
+	s := &settings{values: map[string]string{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	optionValues = s.values
+	g, err := configure()
+	if err != nil {
+		releaseGlobals()
+		gatewayCreated.Store(false)
+		return nil, err
+	}
+	requestHooks, responseHooks = s.requestHooks, s.responseHooks
+	return g, nil
+}
+
+// Close stops the lambda started with LAMBDA_COMMAND, closes the connections
+// to the lambdas, the access log file and the static directory, and stops the
+// trace exporter, so that New can be called again. It doesn't stop a server
+// that is serving the gateway's Handler, which should be closed first.
+func (g *Gateway) Close() {
+	if g.closed.Swap(true) {
+		return
+	}
+	releaseGlobals()
+	gatewayCreated.Store(false)
+}
+
+// releaseGlobals closes what configure opened, including after it failed
+// half-way.
+func releaseGlobals() {
+	if childLambda != nil {
+		childLambda.stop()
+	}
+	pools.Lock()
+	for _, p := range pools.byHost {
+		p.closeIdle()
+	}
+	pools.byHost = map[string]*rpcPool{}
+	pools.Unlock()
+	if accessLogOutput != nil {
+		accessLog.SetOutput(os.Stdout)
+		accessLogOutput.close()
+		accessLogOutput = nil
+	}
+	if staticRoot != nil {
+		staticRoot.Close()
+		staticRoot = nil
+	}
+	if tracer != nil {
+		tracer.shutdown()
+		tracer = nil
+	}
+}
+
+// Handler returns the handler that serves the API and the gateway's own
+// endpoints.
+func (g *Gateway) Handler() http.Handler {
+	// The gateway doesn't use http.DefaultServeMux, since net/http/pprof and
+	// expvar register their handlers on it
+	mux := http.NewServeMux()
+	api := http.HandlerFunc(handleRequest)
+	if eventFormat == "websocket" {
+		api = func(w http.ResponseWriter, r *http.Request) {
+			if currentConfig.Load().matchRoute(r).upstream != nil {
+				handleRequest(w, r)
+				return
+			}
+			handleWebSocket(w, r)
+		}
+	}
+	mux.Handle("/", api)
+	mux.HandleFunc(gatewayPathPrefix+"/health", handleHealth)
+	mux.HandleFunc(gatewayPathPrefix+"/events/", handleEventSource)
+	mux.HandleFunc(gatewayPathPrefix+"/openapi.json", handleOpenAPI)
+	if gatewayMetrics != nil {
+		mux.HandleFunc(gatewayPathPrefix+"/metrics", handleMetrics)
+	}
+	// Requests to the API don't go through the mux, which would redirect
+	// paths like /users//1 and /a/../b that API Gateway passes on
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, gatewayPathPrefix+"/") {
+			mux.ServeHTTP(w, r)
+		} else {
+			api.ServeHTTP(w, r)
+		}
+	})
+	if headerCase == "preserve" {
+		handler = withRawHeaderNames(handler)
+	}
+	return handler
+}
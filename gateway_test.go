@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// newTestGateway configures a gateway for a test. The configuration is in
+// package globals, so the tests that use it can't run in parallel.
+func newTestGateway(t *testing.T, opts ...Option) http.Handler {
+	t.Helper()
+	g, err := New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	return g.Handler()
+}
+
+func TestNewAfterClose(t *testing.T) {
+	g, err := New(WithLambdaHost("127.0.0.1:1"), WithOption("AUTHORIZER_HOST", "127.0.0.1:2"), WithOption("MAX_CONCURRENCY", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(WithLambdaHost("127.0.0.1:1")); err == nil {
+		t.Fatal("created a second gateway while the first one was open")
+	}
+	g.Close()
+	// Closing it again doesn't close the next gateway
+	g.Close()
+
+	// A New call that fails doesn't leave its options behind either
+	if _, err := New(WithLambdaHost("127.0.0.1:1"), WithOption("CIRCUIT_BREAKER_THRESHOLD", "3"), WithOption("PORT", "x")); err == nil {
+		t.Fatal("got no error for PORT=x")
+	}
+	g, err = New(WithLambdaHost("127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if authorizerRoute != nil || maxConcurrency != 0 || circuitBreakerThreshold != 0 {
+		t.Errorf("got authorizer %v, max concurrency %d and circuit breaker threshold %d from the earlier gateways", authorizerRoute, maxConcurrency, circuitBreakerThreshold)
+	}
+	if _, err := New(WithLambdaHost("127.0.0.1:1")); err == nil {
+		t.Error("created a second gateway after the first one was closed twice")
+	}
+}
+
+// testFunction is the RPC service of a lambda for tests. Its handler gets
+// the events as JSON, so it can decode any event format.
+type testFunction struct {
+	handler func(event []byte) (interface{}, error)
+}
+
+func (f *testFunction) Ping(req *messages.PingRequest, response *messages.PingResponse) error {
+	return nil
+}
+
+func (f *testFunction) Invoke(req *messages.InvokeRequest, response *messages.InvokeResponse) error {
+	result, err := f.handler(req.Payload)
+	if err != nil {
+		response.Error = &messages.InvokeResponse_Error{Message: err.Error(), Type: "errorString"}
+		return nil
+	}
+	response.Payload, err = json.Marshal(result)
+	return err
+}
+
+// startTestLambda starts a lambda whose handler returns the response to each
+// event, and returns its address. A json.RawMessage is returned as it is.
+func startTestLambda(t *testing.T, handler func(event []byte) (interface{}, error)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Function", &testFunction{handler}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
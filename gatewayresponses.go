@@ -0,0 +1,178 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"text/template"
+)
+
+// gatewayError is an error response generated by the gateway itself rather
+// than by the lambda. The response can be customized per response type, like
+// API Gateway's gateway responses.
+type gatewayError struct {
+	responseType string
+	statusCode   int
+	message      string
+}
+
+// gatewayResponse is a customized gateway response. A status code of 0 keeps
+// the status code of the error.
+type gatewayResponse struct {
+	statusCode int
+	headers    map[string]string
+	template   *template.Template
+}
+
+// gatewayResponseTypes are the response types that can be customized, with
+// the x-amzn-ErrorType that API Gateway sends with them.
+var gatewayResponseTypes = map[string]string{
+	"DEFAULT_4XX":                    "",
+	"DEFAULT_5XX":                    "",
+	"ACCESS_DENIED":                  "AccessDeniedException",
+	"API_CONFIGURATION_ERROR":        "",
+	"AUTHORIZER_CONFIGURATION_ERROR": "AuthorizerConfigurationException",
+	"BAD_REQUEST_BODY":               "BadRequestException",
+	"BAD_REQUEST_PARAMETERS":         "BadRequestException",
+	"INTEGRATION_FAILURE":            "",
+	"INTEGRATION_TIMEOUT":            "",
+	"INVALID_API_KEY":                "ForbiddenException",
+	"QUOTA_EXCEEDED":                 "LimitExceededException",
+	"REQUEST_TOO_LARGE":              "RequestTooLargeException",
+	"RESOURCE_NOT_FOUND":             "NotFoundException",
+	"THROTTLED":                      "TooManyRequestsException",
+	"UNAUTHORIZED":                   "UnauthorizedException",
+}
+
+// The stock gateway responses. Note that API Gateway capitalizes "Message" in
+// its access denied responses.
+var (
+	defaultGatewayTemplate      = template.Must(template.New("default").Parse(`{"message":{{.context.error.messageString}}}`))
+	accessDeniedGatewayTemplate = template.Must(template.New("ACCESS_DENIED").Parse(`{"Message":{{.context.error.messageString}}}`))
+)
+
+// loadGatewayResponsesFile reads a JSON object of customized gateway
+// responses by response type, e.g. {"DEFAULT_4XX": {"headers":
+// {"Content-Type": "application/json"}, "template": "{\"error\":
+// {{.context.error.messageString}}, \"requestId\":
+// \"{{.context.requestId}}\"}"}}.
+func loadGatewayResponsesFile(path string) (map[string]*gatewayResponse, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]struct {
+		StatusCode int               `json:"statusCode"`
+		Headers    map[string]string `json:"headers"`
+		Template   string            `json:"template"`
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+
+	responses := map[string]*gatewayResponse{}
+	for responseType, config := range configs {
+		if _, ok := gatewayResponseTypes[responseType]; !ok {
+			return nil, fmt.Errorf("unknown response type %q", responseType)
+		}
+		response := &gatewayResponse{
+			statusCode: config.StatusCode,
+			headers:    config.Headers,
+		}
+		if config.Template != "" {
+			response.template, err = template.New(responseType).Option("missingkey=zero").Parse(config.Template)
+			if err != nil {
+				return nil, fmt.Errorf("invalid template for %s: %v", responseType, err)
+			}
+		}
+		responses[responseType] = response
+	}
+	return responses, nil
+}
+
+// write sends the gateway response for the error. A customized response for
+// the error's response type is used if there is one, otherwise the
+// customized DEFAULT_4XX or DEFAULT_5XX response, otherwise the stock
+// response. inv is nil if the request was rejected before it was assigned a
+// request id.
+func (e *gatewayError) write(w http.ResponseWriter, inv *invocation) {
+	statusCode := e.statusCode
+	tmpl := defaultGatewayTemplate
+	if e.responseType == "ACCESS_DENIED" {
+		tmpl = accessDeniedGatewayTemplate
+	}
+	var headers map[string]string
+	config := currentConfig.Load()
+	if inv != nil {
+		config = inv.config
+	}
+
+	defaultType := "DEFAULT_4XX"
+	if e.statusCode >= 500 {
+		defaultType = "DEFAULT_5XX"
+	}
+	if response := config.gatewayResponses[defaultType]; response != nil {
+		headers = response.headers
+		if response.template != nil {
+			tmpl = response.template
+		}
+	}
+	if response := config.gatewayResponses[e.responseType]; response != nil && e.responseType != defaultType {
+		if response.statusCode != 0 {
+			statusCode = response.statusCode
+		}
+		if response.headers != nil {
+			headers = response.headers
+		}
+		if response.template != nil {
+			tmpl = response.template
+		}
+	}
+
+	// messageString is the message as a quoted JSON string, or null
+	messageString := "null"
+	if e.message != "" {
+		data, _ := json.Marshal(e.message)
+		messageString = string(data)
+	}
+	context := map[string]interface{}{
+		"requestId": "",
+		"stage":     stage,
+		"error": map[string]string{
+			"message":       e.message,
+			"messageString": messageString,
+			"responseType":  e.responseType,
+		},
+	}
+	var stageVariables map[string]string
+	if inv != nil {
+		context["requestId"] = inv.requestID
+		stageVariables = inv.stageVariables
+		inv.gatewayError = e
+	}
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, map[string]interface{}{
+		"context":        context,
+		"stageVariables": stageVariables,
+	})
+	if err != nil {
+		log.Printf("Error rendering gateway response %s: %v", e.responseType, err)
+		body.Reset()
+		defaultGatewayTemplate.Execute(&body, map[string]interface{}{
+			"context": context,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if errorType := gatewayResponseTypes[e.responseType]; errorType != "" {
+		w.Header()["x-amzn-ErrorType"] = []string{errorType}
+	}
+	for key, value := range headers {
+		w.Header().Set(key, value)
+	}
+	w.WriteHeader(statusCode)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,224 @@
+// Package gatewaytest provides a fake lambda for tests, so a gateway can be
+// tested end to end without building and running a real lambda:
+//
+//	lambda := gatewaytest.NewFakeLambda(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+//		return events.APIGatewayProxyResponse{StatusCode: 200, Body: "Hello " + request.Path}, nil
+//	})
+//	defer lambda.Close()
+//	gw, err := gateway.New(gateway.WithLambdaHost(lambda.Addr))
+//
+// A HandlerFunc gets API Gateway REST API events. Lambdas for the other event
+// formats are created with NewFakeLambdaPayload, and decode the events
+// themselves, e.g. into an events.APIGatewayV2HTTPRequest.
+package gatewaytest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// A HandlerFunc handles the events of a fake lambda. An error is returned to
+// the gateway like the Go runtime does, with the error's type name. To choose
+// the type and the stack trace, return a messages.InvokeResponse_Error.
+// Panics are returned with their stack trace.
+type HandlerFunc func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// A PayloadHandlerFunc handles the events of a fake lambda as JSON, so it can
+// handle any event format. The result is encoded as JSON and returned to the
+// gateway. Errors and panics are returned like with a HandlerFunc.
+type PayloadHandlerFunc func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+// A FakeLambda is a lambda that listens on a local port with the RPC protocol
+// of the go1.x runtime, like a lambda started with _LAMBDA_SERVER_PORT.
+type FakeLambda struct {
+	// Addr is the host:port of the lambda, e.g. for LAMBDA_HOST.
+	Addr string
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewFakeLambda starts a fake lambda that invokes handler. It panics if it
+// can't listen, like httptest.NewServer.
+func NewFakeLambda(handler HandlerFunc) *FakeLambda {
+	return NewFakeLambdaPayload(func(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+		var request events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, err
+		}
+		return handler(ctx, request)
+	})
+}
+
+// NewFakeLambdaPayload starts a fake lambda that invokes handler with the
+// events as JSON.
+func NewFakeLambdaPayload(handler PayloadHandlerFunc) *FakeLambda {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("gatewaytest: failed to listen: %v", err))
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Function", &function{handler}); err != nil {
+		panic(fmt.Sprintf("gatewaytest: failed to register the function: %v", err))
+	}
+	f := &FakeLambda{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		conns:    map[net.Conn]bool{},
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			if f.closed {
+				f.mu.Unlock()
+				conn.Close()
+				return
+			}
+			f.conns[conn] = true
+			f.wg.Add(1)
+			f.mu.Unlock()
+			go func() {
+				defer f.wg.Done()
+				server.ServeConn(conn)
+				f.mu.Lock()
+				delete(f.conns, conn)
+				f.mu.Unlock()
+			}()
+		}
+	}()
+	return f
+}
+
+// Close stops the lambda and closes the gateway's connections to it, like
+// when a lambda exits. Invocations that are in flight fail.
+func (f *FakeLambda) Close() {
+	f.mu.Lock()
+	f.closed = true
+	f.listener.Close()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+// function is the RPC service of the go1.x runtime.
+type function struct {
+	handler PayloadHandlerFunc
+}
+
+func (fn *function) Ping(req *messages.PingRequest, response *messages.PingResponse) error {
+	*response = messages.PingResponse{}
+	return nil
+}
+
+func (fn *function) Invoke(req *messages.InvokeRequest, response *messages.InvokeResponse) error {
+	defer func() {
+		if v := recover(); v != nil {
+			response.Payload = nil
+			response.Error = &messages.InvokeResponse_Error{
+				Message:    fmt.Sprintf("%v", v),
+				Type:       errorType(v),
+				StackTrace: panicStack(),
+				ShouldExit: true,
+			}
+		}
+	}()
+
+	deadline := time.Unix(req.Deadline.Seconds, req.Deadline.Nanos)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	lc := &lambdacontext.LambdaContext{
+		AwsRequestID:       req.RequestId,
+		InvokedFunctionArn: req.InvokedFunctionArn,
+		Identity: lambdacontext.CognitoIdentity{
+			CognitoIdentityID:     req.CognitoIdentityId,
+			CognitoIdentityPoolID: req.CognitoIdentityPoolId,
+		},
+	}
+	if len(req.ClientContext) > 0 {
+		if err := json.Unmarshal(req.ClientContext, &lc.ClientContext); err != nil {
+			response.Error = invokeError(err)
+			return nil
+		}
+	}
+	ctx = lambdacontext.NewContext(ctx, lc)
+
+	result, err := fn.handler(ctx, req.Payload)
+	if err != nil {
+		response.Error = invokeError(err)
+		return nil
+	}
+	response.Payload, err = json.Marshal(result)
+	if err != nil {
+		response.Error = invokeError(err)
+	}
+	return nil
+}
+
+func invokeError(err error) *messages.InvokeResponse_Error {
+	var invokeErr messages.InvokeResponse_Error
+	if errors.As(err, &invokeErr) {
+		return &invokeErr
+	}
+	return &messages.InvokeResponse_Error{
+		Message: err.Error(),
+		Type:    errorType(err),
+	}
+}
+
+// errorType returns the name of the error's type, without the pointer.
+func errorType(v interface{}) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// panicStack returns the stack of the panicking goroutine, starting at the
+// function that panicked.
+func panicStack() []*messages.InvokeResponse_Error_StackFrame {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(4, pcs)
+	var stack []*messages.InvokeResponse_Error_StackFrame
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		label := frame.Function
+		if i := strings.LastIndex(label, "/"); i >= 0 {
+			label = label[i+1:]
+		}
+		stack = append(stack, &messages.InvokeResponse_Error_StackFrame{
+			Path:  frame.File,
+			Line:  int32(frame.Line),
+			Label: label,
+		})
+		if !more {
+			break
+		}
+	}
+	return stack
+}
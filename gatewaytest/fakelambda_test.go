@@ -0,0 +1,201 @@
+package gatewaytest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	gateway "github.com/stefansundin/go-lambda-gateway"
+)
+
+// echo is a lambda that responds with what it got.
+func echo(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	lc, _ := lambdacontext.FromContext(ctx)
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+			"X-Request-Id": lc.AwsRequestID,
+		},
+		Body: strings.Join([]string{request.HTTPMethod, request.Path, request.QueryStringParameters["q"], request.Headers["x-test"] + request.Headers["X-Test"], request.Body}, " "),
+	}, nil
+}
+
+// echoV2 is echo for HTTP API events with the 2.0 payload format.
+func echoV2(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var request events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	lc, _ := lambdacontext.FromContext(ctx)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+			"X-Request-Id": lc.AwsRequestID,
+		},
+		Body: strings.Join([]string{request.RequestContext.HTTP.Method, request.RawPath, request.QueryStringParameters["q"], request.Headers["x-test"], request.Body}, " "),
+	}, nil
+}
+
+// echoFunctionURL is echo for function URL events.
+func echoFunctionURL(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var request events.LambdaFunctionURLRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	lc, _ := lambdacontext.FromContext(ctx)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "text/plain",
+			"X-Request-Id": lc.AwsRequestID,
+		},
+		Body: strings.Join([]string{request.RequestContext.HTTP.Method, request.RawPath, request.QueryStringParameters["q"], request.Headers["x-test"], request.Body}, " "),
+	}, nil
+}
+
+// newRequest returns the request that the echo lambdas are tested with.
+func newRequest() *http.Request {
+	req := httptest.NewRequest("POST", "/users/1?q=search", strings.NewReader("hello"))
+	req.Header.Set("X-Test", "1")
+	return req
+}
+
+// serve sends the request to a gateway in front of the lambda. The gateway
+// and the lambda are closed when the test is done.
+func serve(t *testing.T, lambda *FakeLambda, req *http.Request, opts ...gateway.Option) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Cleanup(lambda.Close)
+	gw, err := gateway.New(append(opts, gateway.WithLambdaHost(lambda.Addr))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gw.Close)
+	w := httptest.NewRecorder()
+	gw.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestFakeLambda(t *testing.T) {
+	tests := []struct {
+		name   string
+		lambda func() *FakeLambda
+		opts   []gateway.Option
+	}{
+		{"v1", func() *FakeLambda { return NewFakeLambda(echo) }, nil},
+		{"v2", func() *FakeLambda { return NewFakeLambdaPayload(echoV2) }, []gateway.Option{gateway.WithOption("PAYLOAD_FORMAT", "2.0")}},
+		{"ALB", func() *FakeLambda { return NewFakeLambda(echo) }, []gateway.Option{gateway.WithEventFormat("alb")}},
+		{"function URL", func() *FakeLambda { return NewFakeLambdaPayload(echoFunctionURL) }, []gateway.Option{gateway.WithEventFormat("function-url")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(t, test.lambda(), newRequest(), test.opts...)
+			want := "POST /users/1 search 1 hello"
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/plain" || w.Body.String() != want {
+				t.Errorf("got %d %q %q, want 200 %q", w.Code, w.Header().Get("Content-Type"), w.Body.String(), want)
+			}
+			if w.Header().Get("X-Request-Id") == "" {
+				t.Error("the lambda context has no request id")
+			}
+		})
+	}
+}
+
+func TestFakeLambdaBinary(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0xff}
+	lambda := NewFakeLambda(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if !request.IsBase64Encoded {
+			return events.APIGatewayProxyResponse{}, errors.New("the body isn't base64 encoded")
+		}
+		if body, err := base64.StdEncoding.DecodeString(request.Body); err != nil || !bytes.Equal(body, png) {
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("got body %q", request.Body)
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode:      http.StatusOK,
+			Headers:         map[string]string{"Content-Type": "image/png"},
+			Body:            request.Body,
+			IsBase64Encoded: true,
+		}, nil
+	})
+	req := httptest.NewRequest("POST", "/images", bytes.NewReader(png))
+	req.Header.Set("Content-Type", "image/png")
+	w := serve(t, lambda, req, gateway.WithBinaryMediaTypes("image/png"))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), png) {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.Bytes(), png)
+	}
+}
+
+func TestFakeLambdaMultiValueHeaders(t *testing.T) {
+	lambda := NewFakeLambda(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			MultiValueHeaders: map[string][]string{
+				"Set-Cookie": {"a=1", "b=2"},
+			},
+			Body: strings.Join(request.MultiValueHeaders["X-Tag"], ",") + " " + strings.Join(request.MultiValueQueryStringParameters["tag"], ","),
+		}, nil
+	})
+	req := httptest.NewRequest("GET", "/items?tag=c&tag=d", nil)
+	req.Header.Add("X-Tag", "a")
+	req.Header.Add("X-Tag", "b")
+	w := serve(t, lambda, req)
+	if w.Code != http.StatusOK || w.Body.String() != "a,b c,d" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "a,b c,d")
+	}
+	if cookies := w.Header().Values("Set-Cookie"); !reflect.DeepEqual(cookies, []string{"a=1", "b=2"}) {
+		t.Errorf("got Set-Cookie %q, want both cookies", cookies)
+	}
+}
+
+func TestFakeLambdaTimeout(t *testing.T) {
+	release := make(chan struct{})
+	deadlines := make(chan time.Time, 1)
+	lambda := NewFakeLambda(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		deadline, _ := ctx.Deadline()
+		deadlines <- deadline
+		<-release
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	start := time.Now()
+	w := serve(t, lambda, newRequest(), gateway.WithTimeout(100*time.Millisecond))
+	close(release)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d %q, want 504", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for a lambda with a timeout of 100ms", elapsed)
+	}
+	if deadline := <-deadlines; deadline.IsZero() || deadline.After(start.Add(time.Second)) {
+		t.Errorf("got deadline %v in the lambda, want 100ms after %v", deadline, start)
+	}
+}
+
+func TestFakeLambdaError(t *testing.T) {
+	w := serve(t, NewFakeLambda(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{}, errors.New("boom")
+	}), newRequest())
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got %d %q, want 502", w.Code, w.Body.String())
+	}
+}
+
+func TestFakeLambdaPanic(t *testing.T) {
+	w := serve(t, NewFakeLambda(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		panic("boom")
+	}), newRequest())
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got %d %q, want 502", w.Code, w.Body.String())
+	}
+}
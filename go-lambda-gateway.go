@@ -1,69 +1,227 @@
-package main
+package gateway
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
-	"net/rpc"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda/messages"
 )
 
-var lambdaHost string
+var functionTimeout time.Duration
+var integrationTimeout time.Duration
+var eventFormat string
+var payloadFormat string
+var stage string
+var stagePath string
+var stagePathPassthrough bool
+var accountID string
+var apiID string
+var debug atomic.Bool
+var devErrors bool
+var maxRequestPayload int
+var maxResponsePayload int
+var binaryMediaTypes []string
+var trustRequestIDHeader bool
+var disableTraceID bool
+var staticClientContext []byte
+var staticIdentity events.APIGatewayRequestIdentity
+var albMultiValueHeaders bool
+var streamResponses bool
+var streamChunkSize int
+var defaultContentType string
+var decodePath bool
+var proxyBase string
+var inFlightRequests atomic.Int64
 
+// cancelledRequests counts the requests that the client cancelled while the
+// lambda was invoked. They are logged with nginx's 499 status.
+var cancelledRequests atomic.Int64
+
+const statusClientClosedRequest = 499
+
+// IsBinary reports whether s looks like binary data. Valid UTF-8 text is not
+// binary, unless it contains control characters other than \n, \r and \t.
 func IsBinary(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
 	for _, r := range s {
-		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
 			return true
 		}
 	}
 	return false
 }
 
-func invokeLambda(request *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
-	payload, err := json.Marshal(request)
+func invokeLambda(inv *invocation, payload []byte) ([]byte, error) {
+	if inv.invocationType == "Event" {
+		invokeAsync(inv, payload)
+		return nil, errAsyncInvocation
+	} else if inv.invocationType == "DryRun" {
+		return nil, dryRun(inv)
+	} else if len(inv.route.fallbacks) > 0 {
+		return invokeWithFailover(inv, payload)
+	}
+	return invoke(inv, payload)
+}
+
+// invoke invokes the lambda of the invocation's route.
+func invoke(inv *invocation, payload []byte) ([]byte, error) {
+	if childLambda != nil && inv.route.lambdaHost == childLambda.host {
+		if err := childLambda.waitForBuild(integrationTimeout); err != nil {
+			inv.errorType = errorType(err)
+			return nil, err
+		}
+	}
+	if err := inv.route.pool.breaker.allow(inv.route.lambdaHost); err != nil {
+		inv.errorType = errorType(err)
+		return nil, err
+	}
+	release, err := acquireConcurrency(inv.route.lambdaHost)
 	if err != nil {
+		log.Printf("Throttled invocation of %s (request id %s): %d invocations in flight", inv.route.lambdaHost, inv.requestID, maxConcurrency)
 		return nil, err
 	}
+	defer release()
 
+	// The lambda and the gateway use the same deadline, so the gateway stops
+	// waiting at the same time as the function's context is cancelled. Just
+	// like API Gateway, the gateway may give up earlier than that.
 	now := time.Now()
+	deadline := now.Add(functionTimeout)
+	wait := deadline
+	integrationDeadline := now.Add(integrationTimeout)
+	if integrationDeadline.Before(deadline) {
+		wait = integrationDeadline
+	}
 	invokeRequest := &messages.InvokeRequest{
 		Payload:      payload,
-		RequestId:    "0",
-		XAmznTraceId: "",
+		RequestId:    inv.requestID,
+		XAmznTraceId: inv.traceID,
 		Deadline: messages.InvokeRequest_Timestamp{
-			Seconds: int64(now.Unix()),
-			Nanos:   int64(now.Nanosecond()),
+			Seconds: int64(deadline.Unix()),
+			Nanos:   int64(deadline.Nanosecond()),
 		},
 		InvokedFunctionArn:    "",
-		CognitoIdentityId:     "",
-		CognitoIdentityPoolId: "",
-		ClientContext:         nil,
+		CognitoIdentityId:     inv.cognitoIdentityID,
+		CognitoIdentityPoolId: inv.cognitoIdentityPoolID,
+		ClientContext:         inv.clientContext,
+	}
+
+	// The invocation span was created with the event, so its traceparent
+	// could be added to the event headers
+	span := inv.invokeSpan
+	inv.invokeSpan = nil
+	if span == nil && inv.span != nil {
+		span = inv.span.child("invoke "+inv.route.lambdaHost, spanKindClient)
+	}
+	if span != nil {
+		span.start = now
+		span.attributes["lambda.host"] = inv.route.lambdaHost
+		span.attributes["lambda.request.size"] = len(payload)
+		defer span.finish()
 	}
 
-	client, err := rpc.Dial("tcp", lambdaHost)
+	dumpPayload("Event", inv, payload)
+	var invokeResponse messages.InvokeResponse
+	ctx := inv.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	dial, err := inv.route.pool.invoke(ctx, invokeRequest, &invokeResponse, wait)
+	inv.phases.dial += dial
+	inv.phases.invoke += time.Since(now) - dial
+	if err == nil && invokeResponse.Error != nil {
+		err = &lambdaError{invokeResponse.Error}
+	} else if err == nil {
+		dumpPayload("Response", inv, invokeResponse.Payload)
+	}
+	inv.route.pool.breaker.record(inv.route.lambdaHost, err)
+	var dialErr *dialError
+	if inv.route.balanced && errors.As(err, &dialErr) {
+		inv.route.pool.health.markDown(inv.route.pool)
+	}
+	if adminStats != nil {
+		adminStats.recordInvoke(time.Since(now), err)
+	}
+	if gatewayMetrics != nil {
+		gatewayMetrics.recordInvoke(inv, time.Since(now), err)
+	}
+	if recorder != nil {
+		recorder.recordInvocation(inv, payload, invokeResponse.Payload, time.Since(now), err)
+	}
+	inv.invokeDuration += time.Since(now)
+	if err != nil {
+		inv.errorType = errorType(err)
+	}
+	if debugVars != nil && err != nil {
+		debugVars.invokeErrors.Add(1)
+	}
+	if err == errDeadlineExceeded && wait == integrationDeadline {
+		err = errIntegrationTimeout
+	}
+	if span != nil && err != nil {
+		span.setError(err)
+	} else if span != nil {
+		span.attributes["lambda.response.size"] = len(invokeResponse.Payload)
+	}
 	if err != nil {
 		return nil, err
 	}
-	var invokeResponse messages.InvokeResponse
-	if err = client.Call("Function.Invoke", invokeRequest, &invokeResponse); err != nil {
+
+	if len(invokeResponse.Payload) > maxResponsePayload {
+		return nil, fmt.Errorf("%w: %d bytes (limit %d bytes)", errResponseTooLarge, len(invokeResponse.Payload), maxResponsePayload)
+	}
+
+	return invokeResponse.Payload, nil
+}
+
+// marshalEvent marshals the event that is sent to the lambda, and adds the
+// time it took to the request's phases.
+func marshalEvent(inv *invocation, event interface{}) ([]byte, error) {
+	start := time.Now()
+	payload, err := json.Marshal(event)
+	inv.phases.marshal += time.Since(start)
+	return payload, err
+}
+
+func invokeProxyLambda(inv *invocation, request *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+	payload, err := marshalEvent(inv, request)
+	if err != nil {
 		return nil, err
 	}
-	if invokeResponse.Error != nil {
-		return nil, errors.New(invokeResponse.Error.Message)
+
+	responsePayload, err := invokeLambda(inv, payload)
+	if err != nil {
+		return nil, err
 	}
 
 	var response events.APIGatewayProxyResponse
-	err = json.Unmarshal(invokeResponse.Payload, &response)
+	err = unmarshalResponse(responsePayload, &response)
 	if err != nil {
 		return nil, err
 	}
@@ -71,101 +229,1698 @@ func invokeLambda(request *events.APIGatewayProxyRequest) (*events.APIGatewayPro
 	return &response, nil
 }
 
+// errMalformedResponse is returned when the lambda response can't be turned
+// into an HTTP response. API Gateway responds with a 502 in that case.
+var errMalformedResponse = errors.New("malformed lambda response")
+
+// unmarshalResponse decodes a lambda response, which must be a JSON object
+// with a statusCode.
+func unmarshalResponse(payload []byte, response interface{}) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return malformedResponse(payload, "response is not a JSON object")
+	}
+	if _, ok := fields["statusCode"]; !ok {
+		return malformedResponse(payload, "response has no statusCode")
+	}
+	if err := json.Unmarshal(payload, response); err != nil {
+		return malformedResponse(payload, err.Error())
+	}
+	return nil
+}
+
+func malformedResponse(payload []byte, problem string) error {
+	debugf("Malformed lambda response: %s", truncate(payload, 1024))
+	return fmt.Errorf("%w: %s", errMalformedResponse, problem)
+}
+
+// validateResponse checks the parts of the response that can't be checked
+// while decoding it.
+func validateResponse(response *events.APIGatewayProxyResponse) error {
+	if response.StatusCode < 100 || response.StatusCode > 599 {
+		return fmt.Errorf("%w: invalid statusCode %d", errMalformedResponse, response.StatusCode)
+	}
+	if response.IsBase64Encoded {
+		decoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(response.Body))
+		if _, err := io.Copy(ioutil.Discard, decoder); err != nil {
+			return fmt.Errorf("%w: invalid base64 body: %v", errMalformedResponse, err)
+		}
+	}
+	return nil
+}
+
+func truncate(b []byte, n int) string {
+	if len(b) <= n {
+		return string(b)
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", b[:n], len(b)-n)
+}
+
+func debugf(format string, v ...interface{}) {
+	if debug.Load() {
+		log.Printf(format, v...)
+	}
+}
+
+// errIntegrationTimeout is returned when the lambda doesn't respond within
+// the integration timeout.
+var errIntegrationTimeout = errors.New("integration timed out")
+
+// errResponseTooLarge is returned when the lambda response is larger than
+// the response payload limit.
+var errResponseTooLarge = errors.New("lambda response payload is too large")
+
 func handleRequest(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	inFlightRequests.Add(1)
+	defer inFlightRequests.Add(-1)
+	var inv *invocation
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	defer func(r *http.Request) {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		if recorder != nil {
+			recorder.write(inv, sw.status, start)
+		}
+		if logFormat == "text" {
+			logRequestText(r, inv, sw)
+		} else if logFormat == "json" {
+			logRequestJSON(r, inv, sw, start)
+		} else if logFormat == "custom" {
+			logRequestCustom(r, inv, sw, start)
+		}
+		logSlowRequest(r, inv, time.Since(start))
+		if adminStats != nil {
+			adminStats.recordResponse(sw.status)
+			if inv != nil && inv.invokeDuration > 0 {
+				adminStats.recordPhases(inv.phases)
+			}
+		}
+		if debugVars != nil {
+			debugVars.requests.Add(1)
+			debugVars.bytesProxied.Add(sw.written)
+		}
+		if gatewayMetrics != nil {
+			gatewayMetrics.recordRequest(r, inv, sw.status, start)
+		}
+		if inv != nil && inv.span != nil {
+			inv.span.name = r.Method + " " + routeLabel(inv.route)
+			inv.span.attributes["http.response.status_code"] = sw.status
+			if sw.status >= 500 {
+				inv.span.failed = true
+			}
+			inv.span.finish()
+		}
+	}(r)
+	defer func() {
+		if v := recover(); v != nil {
+			handlePanic(sw, inv, v)
+		}
+	}()
+
+	// API Gateway and Function URLs return the request id to the client, the
+	// ALB doesn't. The header is set directly to keep API Gateway's casing.
+	inv, err := newInvocation(r)
 	if err != nil {
+		(&gatewayError{"BAD_REQUEST_PARAMETERS", http.StatusBadRequest, err.Error()}).write(w, nil)
+		return
+	}
+	inv.ctx = r.Context()
+	if serveStatic(w, r, inv) {
+		return
+	}
+	if rt := inv.config.matchRoute(r); rt.upstream != nil {
+		inv.route = rt
+		proxyRequest(w, r, inv)
+		return
+	}
+	if eventFormat != "alb" {
+		w.Header()["x-amzn-RequestId"] = []string{inv.requestID}
+	}
+	if inv.traceID != "" {
+		w.Header().Set("X-Amzn-Trace-Id", inv.traceID)
+	}
+	if inv.span != nil {
+		w.Header().Set("traceparent", inv.span.traceparent())
+	}
+	if recorder != nil {
+		inv.recording = newRecording(r, inv)
+	}
+
+	removeHopByHopHeaders(r.Header)
+	// Go's server answers Expect: 100-continue, and API Gateway doesn't
+	// forward it
+	r.Header.Del("Expect")
+	setForwardedHeaders(r)
+	r = normalizePath(r)
+	r, ok := stripStagePath(r)
+	if !ok && !stagePathPassthrough {
+		(&gatewayError{"RESOURCE_NOT_FOUND", http.StatusNotFound, "Not Found"}).write(w, inv)
+		return
+	}
+	matched := inv.config.matchRoute(r)
+	if matched == inv.config.defaultRoute && !inv.config.hasResource(r.URL.EscapedPath()) {
+		// Only the paths under PROXY_BASE reach the default route
+		(&gatewayError{"RESOURCE_NOT_FOUND", http.StatusNotFound, "Not Found"}).write(w, inv)
+		return
+	}
+	inv.route = matched.pick()
+
+	// Requests are rejected before their body is read when possible. Go's
+	// server only sends 100 Continue when the body is read, so clients that
+	// send Expect: 100-continue don't upload a body that isn't used.
+	limit := inv.route.requestPayloadLimit()
+	if r.ContentLength > int64(limit) {
+		log.Printf("Request body is too large: %d bytes (limit %d bytes)", r.ContentLength, limit)
+		(&gatewayError{"REQUEST_TOO_LARGE", http.StatusRequestEntityTooLarge, "Request Too Long"}).write(w, inv)
+		return
+	}
+
+	lambdaRequest := overrideHost(inv.route.strip(r))
+	if cors := inv.cors(); cors != nil && cors.setHeaders(w, r) {
+		return
+	}
+	if r.Method == http.MethodOptions && inv.route.answersOptions() {
+		inv.route = optionsRoute
+		response := newOptionsResponse()
+		if err := runResponseHooks(r, response); err != nil {
+			err.(*hookPanicError).write(w, inv)
+			return
+		}
+		writeResponse(w, r, inv, response)
+		return
+	}
+	if auth := authorizerFor(inv.route); auth != nil {
+		if gwErr := authorize(inv, auth, lambdaRequest); gwErr != nil {
+			gwErr.write(w, inv)
+			return
+		}
+	}
+	if apiKeys != nil {
+		if gwErr := checkAPIKey(inv, lambdaRequest); gwErr != nil {
+			gwErr.write(w, inv)
+			return
+		}
+	}
+	if jwtAuthorizer {
+		if err := authorizeJWT(inv, lambdaRequest); err != nil {
+			log.Printf("Rejected JWT (request id %s): %v", inv.requestID, err)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"invalid_token\" error_description=%q", err.Error()))
+			errUnauthorized.write(w, inv)
+			return
+		}
+	}
+
+	// The body can't be larger than the payload, so a huge upload is
+	// rejected before it is read into memory
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		log.Printf("Request body is too large (limit %d bytes)", limit)
+		(&gatewayError{"REQUEST_TOO_LARGE", http.StatusRequestEntityTooLarge, "Request Too Long"}).write(w, inv)
+		return
+	} else if err != nil {
 		log.Printf("Error reading body: %v", err)
-		http.Error(w, "Error reading body", http.StatusBadRequest)
+		(&gatewayError{"BAD_REQUEST_BODY", http.StatusBadRequest, "Error reading body"}).write(w, inv)
+		return
+	}
+
+	if debugVars != nil {
+		debugVars.bytesProxied.Add(int64(len(body)))
+	}
+
+	// Binary bodies are base64-encoded in the event, which is what counts
+	// towards the limit
+	payloadSize := len(body)
+	if isBinaryRequest(r, body) {
+		payloadSize = base64.StdEncoding.EncodedLen(len(body))
+		if gatewayMetrics != nil {
+			gatewayMetrics.base64Requests.inc()
+		}
+	}
+	if payloadSize > limit {
+		log.Printf("Request payload is too large: %d bytes (limit %d bytes)", payloadSize, limit)
+		(&gatewayError{"REQUEST_TOO_LARGE", http.StatusRequestEntityTooLarge, "Request Too Long"}).write(w, inv)
+		return
+	}
+
+	if inv.route.decompressesRequests() && isGzipRequest(lambdaRequest) {
+		body, err = gunzipBody(body, limit)
+		if err == nil && isBinaryRequest(lambdaRequest, body) && base64.StdEncoding.EncodedLen(len(body)) > limit {
+			err = errDecompressedTooLarge
+		}
+		if err == errDecompressedTooLarge {
+			log.Printf("Request payload is too large after decompression (limit %d bytes)", limit)
+			(&gatewayError{"REQUEST_TOO_LARGE", http.StatusRequestEntityTooLarge, "Request Too Long"}).write(w, inv)
+			return
+		} else if err != nil {
+			log.Printf("Error decompressing body (request id %s): %v", inv.requestID, err)
+			(&gatewayError{"BAD_REQUEST_BODY", http.StatusBadRequest, "Error decompressing body"}).write(w, inv)
+			return
+		}
+		lambdaRequest.Header.Del("Content-Encoding")
+		lambdaRequest.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if v := inv.config.matchValidator(r); v != nil {
+		if gwErr, err := v.validate(r, body); gwErr != nil {
+			log.Printf("Request validation failed (request id %s): %s %s: %v", inv.requestID, r.Method, v.resource.template, err)
+			gwErr.write(w, inv)
+			return
+		}
+	}
+
+	if inv.config.mocks != nil {
+		response, err := inv.config.matchMock(r)
+		if err != nil {
+			log.Printf("Error rendering mock response: %v", err)
+			(&gatewayError{"API_CONFIGURATION_ERROR", http.StatusInternalServerError, "Internal server error"}).write(w, inv)
+			return
+		}
+		if response != nil {
+			inv.route = mockRoute
+			if err := runResponseHooks(r, response); err != nil {
+				err.(*hookPanicError).write(w, inv)
+				return
+			}
+			writeResponse(w, r, inv, response)
+			return
+		}
+	}
+
+	// Like the Lambda Invoke API, X-Amz-Invocation-Type: Event invokes the
+	// lambda asynchronously, and DryRun only checks that it can be invoked
+	switch inv.invocationType = r.Header.Get("X-Amz-Invocation-Type"); inv.invocationType {
+	case "Event", "DryRun", "RequestResponse":
+	case "":
+		if inv.route.async {
+			inv.invocationType = "Event"
+		}
+	default:
+		(&gatewayError{"BAD_REQUEST_PARAMETERS", http.StatusBadRequest, fmt.Sprintf("Invalid X-Amz-Invocation-Type: %s", inv.invocationType)}).write(w, inv)
+		return
+	}
+
+	if !injectChaos(w, inv) {
+		return
+	}
+
+	// The lambda's spans join the trace as children of the invocation span
+	if inv.span != nil {
+		inv.invokeSpan = inv.span.child("invoke "+inv.route.lambdaHost, spanKindClient)
+		lambdaRequest.Header.Set("traceparent", inv.invokeSpan.traceparent())
+	}
+
+	var response *events.APIGatewayProxyResponse
+	if eventFormat == "alb" {
+		response, err = handleALBRequest(inv, lambdaRequest, body)
+	} else if eventFormat == "function-url" {
+		response, err = handleFunctionURLRequest(inv, lambdaRequest, body)
+	} else if inv.route.eventPayloadFormat() == "2.0" {
+		response, err = handleV2Request(inv, lambdaRequest, body)
+	} else if integ := inv.config.matchIntegration(lambdaRequest); integ != nil {
+		response, err = handleIntegrationRequest(inv, integ, lambdaRequest, body)
+	} else {
+		response, err = handleProxyRequest(inv, lambdaRequest, body)
+	}
+	if err == nil {
+		err = validateResponse(response)
+	}
+	if err == nil {
+		err = runResponseHooks(r, response)
+	}
+	var dialErr *dialError
+	var lambdaErr *lambdaError
+	var dryRunErr *dryRunError
+	var circuitErr *circuitOpenError
+	var buildErr *buildError
+	var credentialsErr *awsCredentialsError
+	var hookErr *hookPanicError
+	if errors.Is(err, errAsyncInvocation) {
+		w.Header()["x-amzn-RequestId"] = []string{inv.requestID}
+		w.WriteHeader(http.StatusAccepted)
 		return
+	} else if errors.Is(err, errClientCancelled) {
+		// Nothing can be sent to the client, the status is for the logs
+		cancelledRequests.Add(1)
+		log.Printf("Client cancelled the request after %v (request id %s)", time.Since(start).Round(time.Millisecond), inv.requestID)
+		w.WriteHeader(statusClientClosedRequest)
+		return
+	} else if errors.Is(err, errThrottled) {
+		writeThrottled(w, inv)
+		return
+	} else if errors.Is(err, errDryRun) {
+		w.Header()["x-amzn-RequestId"] = []string{inv.requestID}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if errors.As(err, &dryRunErr) {
+		log.Printf("Dry run failed (request id %s): %v", inv.requestID, err)
+		(&gatewayError{"INTEGRATION_FAILURE", http.StatusBadGateway, err.Error()}).write(w, inv)
+		return
+	} else if errors.As(err, &lambdaErr) {
+		log.Printf("Lambda returned an error (request id %s): %v\n%s", inv.requestID, err, lambdaErr.stackTrace())
+		if devErrors {
+			writeDevError(w, r, lambdaErr)
+		} else {
+			(&gatewayError{"DEFAULT_5XX", http.StatusBadGateway, "Internal server error"}).write(w, inv)
+		}
+		return
+	} else if errors.As(err, &circuitErr) {
+		log.Printf("Error invoking lambda (request id %s): %v", inv.requestID, err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(circuitErr.retryAfter.Seconds()))))
+		(&gatewayError{"INTEGRATION_FAILURE", http.StatusServiceUnavailable, "Lambda is not available"}).write(w, inv)
+		return
+	} else if errors.As(err, &credentialsErr) {
+		log.Printf("Error invoking lambda (request id %s): %v", inv.requestID, err)
+		(&gatewayError{"INTEGRATION_FAILURE", http.StatusBadGateway, "Invalid AWS credentials"}).write(w, inv)
+		return
+	} else if errors.As(err, &hookErr) {
+		hookErr.write(w, inv)
+		return
+	} else if errors.As(err, &buildErr) {
+		buildErr.write(w)
+		return
+	} else if errors.As(err, &dialErr) {
+		log.Printf("Error invoking lambda (request id %s): %v", inv.requestID, err)
+		w.Header().Set("Retry-After", "1")
+		(&gatewayError{"INTEGRATION_FAILURE", http.StatusServiceUnavailable, "Lambda is not available"}).write(w, inv)
+		return
+	} else if errors.Is(err, errMalformedResponse) || errors.Is(err, errResponseTooLarge) {
+		log.Printf("Error invoking lambda (request id %s): %v", inv.requestID, err)
+		(&gatewayError{"DEFAULT_5XX", http.StatusBadGateway, "Internal server error"}).write(w, inv)
+		return
+	} else if errors.Is(err, errIntegrationTimeout) {
+		log.Printf("Abandoned lambda invocation after %v (request id %s)", integrationTimeout, inv.requestID)
+		(&gatewayError{"INTEGRATION_TIMEOUT", http.StatusGatewayTimeout, "Endpoint request timed out"}).write(w, inv)
+		return
+	} else if errors.Is(err, errDeadlineExceeded) {
+		log.Printf("Error invoking lambda (request id %s): %v", inv.requestID, err)
+		(&gatewayError{"INTEGRATION_TIMEOUT", http.StatusGatewayTimeout, "Lambda timed out"}).write(w, inv)
+		return
+	} else if err != nil {
+		log.Printf("Error invoking lambda (request id %s): %v", inv.requestID, err)
+		(&gatewayError{"INTEGRATION_FAILURE", http.StatusInternalServerError, "Error invoking lambda"}).write(w, inv)
+		return
+	}
+
+	writeResponse(w, r, inv, response)
+}
+
+func handleProxyRequest(inv *invocation, r *http.Request, body []byte) (*events.APIGatewayProxyResponse, error) {
+	request := newProxyRequest(inv, r, body)
+	if response, err := runRequestHooks(inv, r, request); response != nil || err != nil {
+		return response, err
 	}
+	return invokeProxyLambda(inv, request)
+}
 
+func newProxyRequest(inv *invocation, r *http.Request, body []byte) *events.APIGatewayProxyRequest {
+	hostHeader := eventHeaderName(r, "Host", 0)
 	request := &events.APIGatewayProxyRequest{
 		Resource:   "/",
-		Path:       r.URL.Path,
+		Path:       eventPath(r),
 		HTTPMethod: r.Method,
 		Headers: map[string]string{
-			"Host": r.Host,
+			hostHeader: r.Host,
 		},
 		MultiValueHeaders: map[string][]string{
-			"Host": []string{r.Host},
+			hostHeader: []string{r.Host},
 		},
 		QueryStringParameters:           map[string]string{},
 		MultiValueQueryStringParameters: map[string][]string{},
 		PathParameters:                  nil,
-		StageVariables:                  nil,
-		RequestContext:                  events.APIGatewayProxyRequestContext{},
+		StageVariables:                  inv.stageVariables,
+		RequestContext:                  newProxyRequestContext(inv, r),
 		Body:                            string(body),
 		IsBase64Encoded:                 false,
 	}
-	if r.URL.Path != "/" {
-		request.Resource = "/{proxy+}"
-		request.PathParameters = map[string]string{
-			"proxy": r.URL.Path[1:],
-		}
+	if res, params := inv.config.matchResource(r.URL.EscapedPath()); res != nil {
+		request.Resource = res.template
+		request.PathParameters = params
+	} else if template, params, ok := proxyResource(eventPath(r)); ok {
+		request.Resource = template
+		request.PathParameters = params
 	}
+	request.RequestContext.ResourcePath = request.Resource
 	for header, values := range r.Header {
-		for _, value := range values {
-			request.Headers[header] = value
-			request.MultiValueHeaders[header] = append(request.MultiValueHeaders[header], value)
+		// The host is r.Host. Requests that weren't read by the server, e.g.
+		// ones that are passed to the handler in tests, can also have a Host
+		// header, which would be a second entry
+		if header == "Host" {
+			continue
+		}
+		for i, value := range values {
+			name := eventHeaderName(r, header, i)
+			request.Headers[name] = value
+			request.MultiValueHeaders[name] = append(request.MultiValueHeaders[name], value)
 		}
 	}
-	for key, values := range r.URL.Query() {
+	for key, values := range parseQuery(r.URL.RawQuery) {
 		for _, value := range values {
 			request.QueryStringParameters[key] = value
 			request.MultiValueQueryStringParameters[key] = append(request.MultiValueQueryStringParameters[key], value)
 		}
 	}
-	if IsBinary(request.Body) {
+	if isBinaryRequest(r, body) {
 		request.IsBase64Encoded = true
 		request.Body = base64.StdEncoding.EncodeToString(body)
 	}
 
-	response, err := invokeLambda(request)
-	if err != nil {
-		log.Printf("Error invoking lambda: %v", err)
-		http.Error(w, "Error invoking lambda", http.StatusInternalServerError)
+	return request
+}
+
+func newProxyRequestContext(inv *invocation, r *http.Request) events.APIGatewayProxyRequestContext {
+	now := time.Now()
+	domainName := hostWithoutPort(r.Host)
+	identity := staticIdentity
+	identity.SourceIP = sourceIP(r)
+	identity.UserAgent = r.UserAgent()
+	identity.CognitoIdentityID = inv.cognitoIdentityID
+	identity.CognitoIdentityPoolID = inv.cognitoIdentityPoolID
+	if inv.apiKey != nil {
+		identity.APIKey = inv.apiKey.value
+		identity.APIKeyID = inv.apiKey.id
+	}
+	return events.APIGatewayProxyRequestContext{
+		AccountID:        accountID,
+		ResourceID:       "local",
+		Stage:            stage,
+		DomainName:       domainName,
+		DomainPrefix:     strings.SplitN(domainName, ".", 2)[0],
+		RequestID:        inv.requestID,
+		Protocol:         r.Proto,
+		Identity:         identity,
+		Authorizer:       inv.authorizer,
+		Path:             "/" + stage + eventPath(r),
+		HTTPMethod:       r.Method,
+		RequestTime:      now.Format("02/Jan/2006:15:04:05 -0700"),
+		RequestTimeEpoch: now.UnixNano() / int64(time.Millisecond),
+		APIID:            apiID,
+	}
+}
+
+// eventPath returns the path in the event. Like API Gateway, it is the path
+// as it was sent, e.g. /files/a%2Fb, unless DECODE_PATH is set.
+func eventPath(r *http.Request) string {
+	if decodePath {
+		return r.URL.Path
+	}
+	return r.URL.EscapedPath()
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func writeResponse(w http.ResponseWriter, r *http.Request, inv *invocation, response *events.APIGatewayProxyResponse) {
+	start := time.Now()
+	defer func() { inv.phases.write += time.Since(start) }()
+	if inv.chaosFault == chaosReset {
+		inv.errorType = "chaos"
+		resetConnection(w)
+	}
+	if inv.cors() != nil {
+		removeCORSHeaders(response.Headers, response.MultiValueHeaders)
+	}
+	mergeResponseHeaders(w.Header(), response.Headers, response.MultiValueHeaders)
+	// A lambda can't choose how the response is sent to the client
+	removeHopByHopHeaders(w.Header())
+	if _, ok := w.Header()["Content-Type"]; !ok && defaultContentType != "" && response.Body != "" {
+		if defaultContentType == "none" {
+			// A nil value stops net/http from sniffing the content type
+			w.Header()["Content-Type"] = nil
+		} else {
+			w.Header().Set("Content-Type", defaultContentType)
+		}
+		debugf("Response without a Content-Type (request id %s): %s %s, using %s", inv.requestID, r.Method, r.URL.Path, defaultContentType)
+	}
+
+	// RFC 7230 doesn't allow a body in these responses
+	if response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusNotModified {
+		if response.Body != "" {
+			debugf("Dropped the body of a %d response (request id %s)", response.StatusCode, inv.requestID)
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(response.StatusCode)
+		return
+	}
+
+	// Decode base64 bodies while writing them, so we don't hold a second copy
+	// of the body in memory
+	var body io.Reader = strings.NewReader(response.Body)
+	if response.IsBase64Encoded {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	// The lambda gets HEAD requests as they are, but the body of the response
+	// is dropped. The Content-Length and Content-Type are the ones a GET
+	// would have.
+	if r.Method == http.MethodHead {
+		sniff := make([]byte, 512)
+		n, _ := io.ReadFull(body, sniff)
+		rest, err := io.Copy(ioutil.Discard, body)
+		if _, ok := w.Header()["Content-Type"]; !ok && n > 0 {
+			w.Header().Set("Content-Type", http.DetectContentType(sniff[:n]))
+		}
+		if w.Header().Get("Content-Length") == "" && err == nil && n > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(int64(n)+rest, 10))
+		}
+		w.WriteHeader(response.StatusCode)
 		return
 	}
-	// fmt.Printf("Response: %v\n", response)
 
-	for header, value := range response.Headers {
-		w.Header().Set(header, value)
+	// The whole body is known, so the response doesn't have to be chunked
+	n, ok := responseBodyLength(response)
+	if v := w.Header().Get("Content-Length"); ok && v != "" && v != strconv.FormatInt(n, 10) {
+		log.Printf("Lambda response has Content-Length %s, but the body is %d bytes (request id %s)", v, n, inv.requestID)
+	}
+	if compressResponses && ok && compressible(w.Header(), n) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			compressed, err := gzipBody(body)
+			if err != nil {
+				log.Printf("Error compressing response body (request id %s): %v", inv.requestID, err)
+				(&gatewayError{"DEFAULT_5XX", http.StatusBadGateway, "Internal server error"}).write(w, inv)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			body, n = bytes.NewReader(compressed), int64(len(compressed))
+		}
+	}
+	if ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
 	}
 	w.WriteHeader(response.StatusCode)
-	if response.IsBase64Encoded {
-		bytes, err := base64.StdEncoding.DecodeString(response.Body)
-		if err != nil {
-			log.Printf("Error base64-decoding response body: %v", err)
-			http.Error(w, "Error base64-decoding response body", http.StatusInternalServerError)
-			return
+	if inv.chaosFault == chaosTruncate && ok {
+		// The client gets the full Content-Length, but only half the body
+		inv.errorType = "chaos"
+		writeBody(w, io.LimitReader(body, n/2))
+		http.NewResponseController(w).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	if err := writeBody(w, body); err != nil {
+		log.Printf("Error writing response body: %v", err)
+	}
+}
+
+// responseBodyLength returns the length of the body after it is decoded. It
+// returns false for malformed base64, whose length isn't known until it is
+// decoded.
+func responseBodyLength(response *events.APIGatewayProxyResponse) (int64, bool) {
+	if !response.IsBase64Encoded {
+		return int64(len(response.Body)), true
+	}
+	// The decoder skips newlines
+	n := len(response.Body) - strings.Count(response.Body, "\n") - strings.Count(response.Body, "\r")
+	end := strings.TrimRight(response.Body, "\r\n")
+	padding := len(end) - len(strings.TrimRight(end, "="))
+	if n%4 != 0 || padding > 2 {
+		return 0, false
+	}
+	return int64(n/4*3 - padding), true
+}
+
+// mergeResponseHeaders adds the lambda's response headers to header. Just like
+// API Gateway, the values from headers and multiValueHeaders are combined,
+// and a value that is present in both maps is only sent once. Header names
+// are case-insensitive, so "set-cookie" and "Set-Cookie" are the same header.
+func mergeResponseHeaders(header http.Header, headers map[string]string, multiValueHeaders map[string][]string) {
+	for key, values := range multiValueHeaders {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	for key, value := range headers {
+		if !containsString(header.Values(key), value) {
+			header.Add(key, value)
 		}
-		w.Write(bytes)
-	} else {
-		fmt.Fprintf(w, response.Body)
 	}
+}
 
-	// Log something similar to the common log format
-	// host [date] request status bytes
-	fmt.Printf("%s [%v] \"%s %s\" %v\n", r.Host, time.Now().Format("2006-01-02 15:04:05"), r.Method, r.URL.Path, len(response.Body))
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
 }
 
-func main() {
-	lambdaHost = os.Getenv("LAMBDA_HOST")
-	if lambdaHost == "" {
-		lambdaHost = "localhost:8001"
+// writeBody copies the body to the client. In streaming mode the body is
+// written in chunks and flushed after each one, so clients receive data
+// incrementally (e.g. Server-Sent Events).
+func writeBody(w http.ResponseWriter, body io.Reader) error {
+	flusher, ok := w.(http.Flusher)
+	if !streamResponses || !ok {
+		_, err := io.Copy(w, body)
+		return err
 	}
-	fmt.Fprintf(os.Stderr, "Lambda address: %s\n", lambdaHost)
 
-	port, _ := strconv.Atoi(os.Getenv("PORT"))
-	if port == 0 {
-		port = 8002
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 	}
-	fmt.Fprintf(os.Stderr, "Listening on port: %d\n", port)
-	fmt.Fprintln(os.Stderr)
+}
 
-	http.HandleFunc("/", handleRequest)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+// Main runs the go-lambda-gateway command with the command line arguments.
+func Main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "invoke":
+			os.Exit(runInvoke(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
+	// Stage variables can be passed as repeated --stage-var key=value flags
+	flag.Func("stage-var", "set a stage variable (key=value, can be repeated)", func(s string) error {
+		key, value, ok := strings.Cut(s, "=")
+		if !ok || key == "" {
+			return errors.New("must be key=value")
+		}
+		stageVarFlags[key] = value
+		return nil
+	})
+	// The lambdas of the functions in a template can be passed as repeated
+	// --function-port name=port flags
+	flag.Func("function-port", "set the port or address of a function's lambda (name=port, can be repeated)", func(s string) error {
+		name, port, ok := strings.Cut(s, "=")
+		if !ok || name == "" || port == "" {
+			return errors.New("must be name=port")
+		}
+		functionPortFlags[name] = port
+		return nil
+	})
+	exportOpenAPIFlag := flag.Bool("export-openapi", false, "print an OpenAPI document of the routes and exit")
+	flag.Func("schedule", "invoke the lambda on a schedule, e.g. rate(5 minutes) or every=30s (can be repeated)", func(s string) error {
+		scheduleFlags = append(scheduleFlags, s)
+		return nil
+	})
+	parseFlags()
+
+	g, err := configure()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *exportOpenAPIFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(exportOpenAPI(currentConfig.Load())); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if validateConfig {
+		fmt.Fprintf(os.Stderr, "Configuration is valid\n")
+		os.Exit(0)
+	}
+
+	if lambdaWatcher != nil {
+		lambdaWatcher.rebuild()
+		go lambdaWatcher.watch()
+	} else if childLambda != nil {
+		go childLambda.run()
+		if err := childLambda.waitReady(childReadyTimeout); err != nil {
+			log.Print(err)
+		}
+	}
+
+	// Test harnesses can start the gateway together with the lambda, and
+	// only get a listening gateway once the lambda is up
+	waitForLambda, err := getenvBool("WAIT_FOR_LAMBDA")
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal(err)
 	}
+	if waitForLambda {
+		timeout := 30 * time.Second
+		if v := getenv("WAIT_FOR_LAMBDA_TIMEOUT"); v != "" {
+			timeout, err = time.ParseDuration(v)
+			if err != nil || timeout <= 0 {
+				log.Fatalf("Invalid WAIT_FOR_LAMBDA_TIMEOUT: %s", v)
+			}
+		}
+		if err := waitForLambdas(currentConfig.Load(), timeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Listen before serving so that the actual port is known when port 0 is used
+	var listener net.Listener
+	if socketPath := getenv("LISTEN_SOCKET"); socketPath != "" {
+		listener, err = listenUnix(socketPath, getenv("LISTEN_SOCKET_MODE"))
+	} else {
+		listener, err = net.Listen("tcp", g.addr)
+	}
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	if headerCase == "preserve" {
+		listener = headerCaseListener{listener}
+	}
+	fmt.Fprintf(os.Stderr, "Listening on: %s\n", listener.Addr())
+	if g.adminPort != 0 {
+		serveAdmin(g.adminPort)
+	}
+	fmt.Fprintln(os.Stderr)
+
+	if g.configFile != "" {
+		go watchConfigFile(g.configFile)
+	}
+	for _, sch := range schedules {
+		go sch.run()
+	}
+
+	server := g.server
+	server.Handler = g.Handler()
+	go func() {
+		var err error
+		if server.TLSConfig != nil || g.certFile != "" {
+			err = server.ServeTLS(listener, g.certFile, g.keyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal("Serve: ", err)
+		}
+	}()
+
+	// Stop accepting new requests on SIGINT/SIGTERM, and give the in-flight
+	// requests some time to finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	draining := inFlightRequests.Load()
+	log.Printf("Received %v, draining %d in-flight requests (timeout %v)", sig, draining, g.shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown timed out with %d requests still in flight", inFlightRequests.Load())
+		if childLambda != nil {
+			childLambda.stop()
+		}
+		os.Exit(1)
+	}
+	if childLambda != nil {
+		childLambda.stop()
+	}
+	if tracer != nil {
+		tracer.shutdown()
+	}
+	log.Printf("Drained %d requests, exiting", draining)
+}
+
+// resetGlobals sets the globals that configure only sets when their option is
+// present back to their defaults, so nothing is left over from a gateway that
+// was closed, or from a New call that failed.
+func resetGlobals() {
+	fileValues, fileStageVariables = nil, nil
+	lambdaBackend = "rpc"
+	awsLambdaClient, awsQualifier = nil, ""
+	authorizerRoute = nil
+	authorizerType, authorizerHeader, authorizerTTL = "", "", 0
+	authorizerCache.Lock()
+	authorizerCache.entries = map[string]authorizerCacheEntry{}
+	authorizerCache.Unlock()
+	dialRetry = 0
+	circuitBreakerThreshold, circuitBreakerCooldown = 0, 10*time.Second
+	failoverInterval = 30 * time.Second
+	payloadFormat = ""
+	websocketRouteSelection, websocketRoutes = nil, nil
+	defaultRateLimit, defaultBurstLimit, defaultQuota = 0, 0, 0
+	apiKeys = nil
+	jwtAudience, jwtSecret = nil, nil
+	jwks.Lock()
+	jwks.keys, jwks.fetched = nil, time.Time{}
+	jwks.Unlock()
+	staticLambdaPaths, staticMiss = nil, "lambda"
+	trustedProxies = nil
+	staticClientContext = nil
+	staticIdentity = events.APIGatewayRequestIdentity{}
+	albMultiValueHeaders = false
+	streamChunkSize = 0
+	childLambda, lambdaWatcher = nil, nil
+	gatewayMetrics = nil
+	recorder = nil
+	asyncSlots, asyncMaxRetries = make(chan struct{}, 10), 2
+	maxConcurrency, maxConcurrencyWait = 0, 0
+	concurrency.Lock()
+	concurrency.byHost = map[string]chan struct{}{}
+	concurrency.Unlock()
+	schedules = nil
+	adminStats, debugVars, adminRoutes = nil, nil, nil
+	requestHooks, responseHooks = nil, nil
+}
+
+// configure loads the configuration from the flags, the environment and the
+// config file into the package's globals, and prints the banner.
+func configure() (*Gateway, error) {
+	var err error
+	g := &Gateway{}
+	resetGlobals()
+	g.configFile = getenv("CONFIG_FILE")
+	if g.configFile != "" {
+		fileValues, fileStageVariables, err = loadConfigFile(g.configFile)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config file %s: %v", g.configFile, err)
+		}
+		fmt.Fprintf(os.Stderr, "Config file: %s\n", g.configFile)
+	}
+
+	if v := getenv("BACKEND"); v != "" {
+		if v != "rpc" && v != "rie" && v != "aws" {
+			return nil, fmt.Errorf("Unsupported BACKEND: %s (must be rpc, rie or aws)", v)
+		}
+		lambdaBackend = v
+		fmt.Fprintf(os.Stderr, "Backend: %s\n", lambdaBackend)
+	}
+	if lambdaBackend == "aws" {
+		if getenv("FUNCTION_NAME") == "" {
+			return nil, fmt.Errorf("BACKEND=aws requires FUNCTION_NAME")
+		}
+		awsLambdaClient, err = newAWSLambdaClient(getenv("AWS_REGION"), getenv("AWS_PROFILE"))
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring the AWS SDK: %v", err)
+		}
+		awsQualifier = getenv("FUNCTION_QUALIFIER")
+		if awsQualifier != "" {
+			fmt.Fprintf(os.Stderr, "Function qualifier: %s\n", awsQualifier)
+		}
+	}
+
+	if v := getenv("AUTHORIZER_HOST"); v != "" {
+		authorizerRoute = &route{
+			lambdaHost: v,
+		}
+		fmt.Fprintf(os.Stderr, "Authorizer address: %s\n", v)
+	}
+
+	maxConnections = 10
+	if v := getenv("MAX_CONNECTIONS"); v != "" {
+		var err error
+		maxConnections, err = strconv.Atoi(v)
+		if err != nil || maxConnections <= 0 {
+			return nil, fmt.Errorf("Invalid MAX_CONNECTIONS: %s", v)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Max lambda connections: %d\n", maxConnections)
+
+	if v := getenv("LAMBDA_DIAL_RETRY"); v != "" {
+		var err error
+		dialRetry, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid LAMBDA_DIAL_RETRY: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Retrying lambda connections for: %v\n", dialRetry)
+	}
+
+	if v := getenv("CIRCUIT_BREAKER_THRESHOLD"); v != "" {
+		var err error
+		circuitBreakerThreshold, err = strconv.Atoi(v)
+		if err != nil || circuitBreakerThreshold < 0 {
+			return nil, fmt.Errorf("Invalid CIRCUIT_BREAKER_THRESHOLD: %s", v)
+		}
+		if v := getenv("CIRCUIT_BREAKER_COOLDOWN"); v != "" {
+			circuitBreakerCooldown, err = time.ParseDuration(v)
+			if err != nil || circuitBreakerCooldown <= 0 {
+				return nil, fmt.Errorf("Invalid CIRCUIT_BREAKER_COOLDOWN: %s", v)
+			}
+		}
+		if circuitBreakerThreshold > 0 {
+			fmt.Fprintf(os.Stderr, "Circuit breaker: open after %d connection failures, for %v\n", circuitBreakerThreshold, circuitBreakerCooldown)
+		}
+	}
+
+	if v := getenv("LAMBDA_FAILOVER_INTERVAL"); v != "" {
+		var err error
+		failoverInterval, err = time.ParseDuration(v)
+		if err != nil || failoverInterval < 0 {
+			return nil, fmt.Errorf("Invalid LAMBDA_FAILOVER_INTERVAL: %s", v)
+		}
+	}
+	failoverOnError, err = getenvBool("LAMBDA_FAILOVER_ON_ERROR")
+	if err != nil {
+		return nil, err
+	}
+
+	if authorizerRoute != nil {
+		authorizerRoute.pool = poolFor(authorizerRoute.lambdaHost)
+	}
+
+	functionTimeout = 30 * time.Second
+	if v := getenv("FUNCTION_TIMEOUT"); v != "" {
+		var err error
+		functionTimeout, err = time.ParseDuration(v)
+		if err != nil || functionTimeout <= 0 {
+			return nil, fmt.Errorf("Invalid FUNCTION_TIMEOUT: %s", v)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Function timeout: %v\n", functionTimeout)
+
+	integrationTimeout = 29 * time.Second
+	if v := getenv("INTEGRATION_TIMEOUT"); v != "" {
+		var err error
+		integrationTimeout, err = time.ParseDuration(v)
+		if err != nil || integrationTimeout <= 0 {
+			return nil, fmt.Errorf("Invalid INTEGRATION_TIMEOUT: %s", v)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Integration timeout: %v\n", integrationTimeout)
+
+	eventFormat = getenv("EVENT_FORMAT")
+	if eventFormat == "" {
+		eventFormat = "apigateway"
+	}
+	if eventFormat != "apigateway" && eventFormat != "alb" && eventFormat != "function-url" && eventFormat != "websocket" {
+		return nil, fmt.Errorf("Unsupported EVENT_FORMAT: %s (must be apigateway, alb, function-url or websocket)", eventFormat)
+	}
+	fmt.Fprintf(os.Stderr, "Event format: %s\n", eventFormat)
+
+	if eventFormat == "apigateway" {
+		payloadFormat = getenv("PAYLOAD_FORMAT")
+		if payloadFormat == "" {
+			payloadFormat = "1.0"
+		}
+		if payloadFormat != "1.0" && payloadFormat != "2.0" {
+			return nil, fmt.Errorf("Unsupported PAYLOAD_FORMAT: %s (must be 1.0 or 2.0)", payloadFormat)
+		}
+		fmt.Fprintf(os.Stderr, "Payload format: %s\n", payloadFormat)
+	}
+
+	if eventFormat == "websocket" {
+		expression := getenv("WEBSOCKET_ROUTE_SELECTION")
+		if expression == "" {
+			expression = "$request.body.action"
+		}
+		websocketRouteSelection, err = parseRouteSelection(expression)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid WEBSOCKET_ROUTE_SELECTION: %s (%v)", expression, err)
+		}
+		fmt.Fprintf(os.Stderr, "Route selection expression: %s\n", expression)
+		if v := getenv("WEBSOCKET_ROUTES"); v != "" {
+			websocketRoutes = map[string]bool{}
+			for _, key := range strings.Split(v, ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					websocketRoutes[key] = true
+				}
+			}
+			fmt.Fprintf(os.Stderr, "WebSocket routes: %s\n", v)
+		}
+	}
+
+	if authorizerRoute != nil {
+		if eventFormat != "apigateway" || payloadFormat != "1.0" {
+			return nil, fmt.Errorf("AUTHORIZER_HOST is only supported with EVENT_FORMAT=apigateway and PAYLOAD_FORMAT=1.0")
+		}
+		authorizerType = strings.ToUpper(getenv("AUTHORIZER_TYPE"))
+		if authorizerType == "" {
+			authorizerType = "TOKEN"
+		} else if authorizerType != "TOKEN" && authorizerType != "REQUEST" {
+			return nil, fmt.Errorf("Invalid AUTHORIZER_TYPE: %s (must be TOKEN or REQUEST)", authorizerType)
+		}
+		authorizerHeader = getenv("AUTHORIZER_HEADER")
+		if authorizerHeader == "" {
+			authorizerHeader = "Authorization"
+		}
+		authorizerTTL = 300 * time.Second
+		if v := getenv("AUTHORIZER_TTL"); v != "" {
+			var err error
+			authorizerTTL, err = time.ParseDuration(v)
+			if err != nil || authorizerTTL < 0 {
+				return nil, fmt.Errorf("Invalid AUTHORIZER_TTL: %s", v)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Authorizer: %s (identity source %s, cached for %v)\n", authorizerType, authorizerHeader, authorizerTTL)
+	}
+
+	// API keys are checked when any keys are configured, even if they are
+	// only required on some routes
+	if v := getenv("USAGE_PLAN_RATE_LIMIT"); v != "" {
+		var err error
+		defaultRateLimit, err = strconv.ParseFloat(v, 64)
+		if err != nil || defaultRateLimit < 0 {
+			return nil, fmt.Errorf("Invalid USAGE_PLAN_RATE_LIMIT: %s", v)
+		}
+	}
+	if v := getenv("USAGE_PLAN_BURST_LIMIT"); v != "" {
+		var err error
+		defaultBurstLimit, err = strconv.Atoi(v)
+		if err != nil || defaultBurstLimit < 0 {
+			return nil, fmt.Errorf("Invalid USAGE_PLAN_BURST_LIMIT: %s", v)
+		}
+	}
+	if v := getenv("USAGE_PLAN_QUOTA"); v != "" {
+		var err error
+		defaultQuota, err = strconv.Atoi(v)
+		if err != nil || defaultQuota < 0 {
+			return nil, fmt.Errorf("Invalid USAGE_PLAN_QUOTA: %s", v)
+		}
+	}
+	if v := getenv("API_KEYS"); v != "" {
+		apiKeys = parseAPIKeys(v)
+	}
+	if apiKeysFile := getenv("API_KEYS_FILE"); apiKeysFile != "" {
+		if apiKeys == nil {
+			apiKeys = map[string]*apiKey{}
+		}
+		if err := loadAPIKeysFile(apiKeysFile, apiKeys); err != nil {
+			return nil, fmt.Errorf("Error reading API_KEYS_FILE: %v", err)
+		}
+	}
+	apiKeyRequired, err = getenvBool("API_KEY_REQUIRED")
+	if err != nil {
+		return nil, err
+	}
+	if apiKeys != nil {
+		if eventFormat != "apigateway" || payloadFormat != "1.0" {
+			return nil, fmt.Errorf("API keys are only supported with EVENT_FORMAT=apigateway and PAYLOAD_FORMAT=1.0")
+		}
+		fmt.Fprintf(os.Stderr, "API keys: %d\n", len(apiKeys))
+	} else if apiKeyRequired {
+		return nil, fmt.Errorf("API_KEY_REQUIRED is set, but no API_KEYS or API_KEYS_FILE are configured")
+	}
+
+	jwtIssuer = getenv("JWT_ISSUER")
+	if v := getenv("JWT_AUDIENCE"); v != "" {
+		jwtAudience = strings.Split(v, ",")
+	}
+	jwtJWKSURL = getenv("JWT_JWKS_URL")
+	if v := getenv("JWT_SECRET"); v != "" {
+		jwtSecret = []byte(v)
+	}
+	jwtInsecure, err = getenvBool("JWT_INSECURE")
+	if err != nil {
+		return nil, err
+	}
+	jwtAuthorizer = jwtJWKSURL != "" || jwtSecret != nil || jwtInsecure
+	if jwtAuthorizer {
+		if eventFormat != "apigateway" || payloadFormat != "2.0" {
+			return nil, fmt.Errorf("The JWT authorizer is only supported with EVENT_FORMAT=apigateway and PAYLOAD_FORMAT=2.0")
+		}
+		if jwtInsecure {
+			fmt.Fprintf(os.Stderr, "JWT authorizer: insecure (tokens are not validated)\n")
+		} else {
+			fmt.Fprintf(os.Stderr, "JWT authorizer: issuer %q, audience %q\n", jwtIssuer, jwtAudience)
+		}
+	}
+
+	// When the API is served under a stage path, the stage name is the first
+	// path segment
+	stagePath = strings.Trim(getenv("STAGE_PATH"), "/")
+	if strings.Contains(stagePath, "/") {
+		return nil, fmt.Errorf("Invalid STAGE_PATH: %s (must be a single path segment)", stagePath)
+	}
+	stagePathPassthrough, err = getenvBool("STAGE_PATH_PASSTHROUGH")
+	if err != nil {
+		return nil, err
+	}
+	if stagePath != "" {
+		fmt.Fprintf(os.Stderr, "Stage path: /%s\n", stagePath)
+	}
+
+	// HTTP APIs use the $default stage unless another one is configured
+	stage = getenv("STAGE")
+	if stage == "" && stagePath != "" {
+		stage = stagePath
+	} else if stage == "" && payloadFormat == "2.0" {
+		stage = "$default"
+	} else if stage == "" {
+		stage = "local"
+	}
+	accountID = getenv("ACCOUNT_ID")
+	if accountID == "" {
+		accountID = "123456789012"
+	}
+	apiID = getenv("API_ID")
+	if apiID == "" {
+		apiID = "1234567890"
+	}
+
+	enableDebug, err := getenvBool("DEBUG")
+	if err != nil {
+		return nil, err
+	}
+	debug.Store(enableDebug)
+	dumpBodyLimit = 1024
+	if v := getenv("DEBUG_BODY_LIMIT"); v != "" {
+		var err error
+		dumpBodyLimit, err = strconv.Atoi(v)
+		if err != nil || dumpBodyLimit < 0 {
+			return nil, fmt.Errorf("Invalid DEBUG_BODY_LIMIT: %s", v)
+		}
+	}
+	dumpRedactHeaders = map[string]bool{}
+	for _, name := range strings.Split(getenv("DEBUG_REDACT_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			dumpRedactHeaders[strings.ToLower(name)] = true
+		}
+	}
+	devErrors, err = getenvBool("DEV_ERRORS")
+	if err != nil {
+		return nil, err
+	}
+
+	maxRequestPayload = 10 * 1024 * 1024
+	if v := getenv("MAX_REQUEST_PAYLOAD"); v != "" {
+		var err error
+		maxRequestPayload, err = strconv.Atoi(v)
+		if err != nil || maxRequestPayload <= 0 {
+			return nil, fmt.Errorf("Invalid MAX_REQUEST_PAYLOAD: %s", v)
+		}
+	}
+	maxResponsePayload = 6 * 1024 * 1024
+	if v := getenv("MAX_RESPONSE_PAYLOAD"); v != "" {
+		var err error
+		maxResponsePayload, err = strconv.Atoi(v)
+		if err != nil || maxResponsePayload <= 0 {
+			return nil, fmt.Errorf("Invalid MAX_RESPONSE_PAYLOAD: %s", v)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Payload limits: %d bytes (request), %d bytes (response)\n", maxRequestPayload, maxResponsePayload)
+
+	decodePath, err = getenvBool("DECODE_PATH")
+	if err != nil {
+		return nil, err
+	}
+	if err := parsePathNormalization(getenv("PATH_NORMALIZATION")); err != nil {
+		return nil, fmt.Errorf("Invalid PATH_NORMALIZATION: %v", err)
+	} else if v := getenv("PATH_NORMALIZATION"); v != "" {
+		fmt.Fprintf(os.Stderr, "Path normalization: %s\n", v)
+	}
+	proxyBase = ""
+	if v := getenv("PROXY_BASE"); v != "" {
+		if !strings.HasPrefix(v, "/") || strings.ContainsAny(v, "{}?#") {
+			return nil, fmt.Errorf("Invalid PROXY_BASE: %s", v)
+		}
+		if proxyBase = strings.TrimRight(v, "/"); proxyBase != "" {
+			fmt.Fprintf(os.Stderr, "Proxy base: %s\n", proxyBase)
+		}
+	}
+	if staticRoot != nil {
+		staticRoot.Close()
+		staticRoot = nil
+	}
+	if v := getenv("STATIC_DIR"); v != "" {
+		var err error
+		staticRoot, err = os.OpenRoot(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid STATIC_DIR: %v", err)
+		}
+		staticLambdaPaths, err = parseStaticLambdaPaths(getenv("STATIC_LAMBDA_PATHS"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid STATIC_LAMBDA_PATHS: %v", err)
+		}
+		staticMiss = "lambda"
+		if v := getenv("STATIC_MISS"); v == "404" || v == "lambda" || v == "spa" {
+			staticMiss = v
+		} else if v != "" {
+			return nil, fmt.Errorf("Invalid STATIC_MISS: %s (must be lambda, 404 or spa)", v)
+		}
+		fmt.Fprintf(os.Stderr, "Static files: %s (misses: %s)\n", v, staticMiss)
+		if len(staticLambdaPaths) > 0 {
+			fmt.Fprintf(os.Stderr, "Lambda paths: %s\n", strings.Join(staticLambdaPaths, ", "))
+		}
+	}
+	slowRequestThreshold = 0
+	if v := getenv("SLOW_REQUEST_THRESHOLD"); v != "" {
+		var err error
+		slowRequestThreshold, err = time.ParseDuration(v)
+		if err != nil || slowRequestThreshold < 0 {
+			return nil, fmt.Errorf("Invalid SLOW_REQUEST_THRESHOLD: %s", v)
+		}
+		if slowRequestThreshold > 0 {
+			fmt.Fprintf(os.Stderr, "Slow request threshold: %v\n", slowRequestThreshold)
+		}
+	}
+	chaosSeed := rand.Uint64()
+	if v := getenv("CHAOS_SEED"); v != "" {
+		var err error
+		if chaosSeed, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid CHAOS_SEED: %v", err)
+		}
+	}
+	seedChaos(chaosSeed)
+	globalChaos := &chaosConfig{}
+	for _, setting := range []struct{ env, key string }{
+		{"CHAOS_LATENCY", "latency"},
+		{"CHAOS_ERROR_RATE", "errorrate"},
+		{"CHAOS_TRUNCATE_RATE", "truncaterate"},
+		{"CHAOS_RESET_RATE", "resetrate"},
+	} {
+		if v := getenv(setting.env); v != "" {
+			if err := globalChaos.set(setting.key, v); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %v", setting.env, err)
+			}
+		}
+	}
+	chaos.Store(nil)
+	if *globalChaos != (chaosConfig{}) {
+		chaos.Store(globalChaos)
+		fmt.Fprintf(os.Stderr, "Chaos: %v (seed %d)\n", globalChaos, chaosSeed)
+	}
+	chaosEnabled.Store(true)
+	multipartAsText, err = getenvBool("MULTIPART_AS_TEXT")
+	if err != nil {
+		return nil, err
+	}
+	binaryMediaTypes = parseMediaTypes(getenv("BINARY_MEDIA_TYPES"))
+	if len(binaryMediaTypes) > 0 {
+		fmt.Fprintf(os.Stderr, "Binary media types: %s\n", strings.Join(binaryMediaTypes, ", "))
+	}
+
+	trustRequestIDHeader, err = getenvBool("TRUST_REQUEST_ID_HEADER")
+	if err != nil {
+		return nil, err
+	}
+	trustForwardedHeaders, err = getenvBool("TRUST_FORWARDED_HEADERS")
+	if err != nil {
+		return nil, err
+	}
+	if hostOverride = getenv("HOST_OVERRIDE"); hostOverride != "" {
+		fmt.Fprintf(os.Stderr, "Host override: %s\n", hostOverride)
+	}
+	if v := getenv("TRUSTED_PROXIES"); v != "" {
+		trustedProxies, err = parseTrustedProxies(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Trusted proxies: %s\n", v)
+	}
+	disableTraceID, err = getenvBool("DISABLE_TRACE_ID")
+	if err != nil {
+		return nil, err
+	}
+	headerCase = "canonical"
+	if v := getenv("HEADER_CASE"); v != "" {
+		if v != "canonical" && v != "lowercase" && v != "preserve" {
+			return nil, fmt.Errorf("Unsupported HEADER_CASE: %s (must be canonical, lowercase or preserve)", v)
+		}
+		headerCase = v
+		fmt.Fprintf(os.Stderr, "Header case: %s\n", headerCase)
+	}
+	if defaultContentType = getenv("DEFAULT_CONTENT_TYPE"); defaultContentType != "" {
+		if _, _, err := mime.ParseMediaType(defaultContentType); err != nil && defaultContentType != "none" {
+			return nil, fmt.Errorf("Invalid DEFAULT_CONTENT_TYPE: %s", defaultContentType)
+		}
+		fmt.Fprintf(os.Stderr, "Default Content-Type: %s\n", defaultContentType)
+	}
+	decompressRequests, err = getenvBool("DECOMPRESS_REQUESTS")
+	if err != nil {
+		return nil, err
+	}
+	if decompressRequests {
+		fmt.Fprintf(os.Stderr, "Gzip request bodies: decompressed\n")
+	}
+	compressResponses, err = getenvBool("COMPRESS_RESPONSES")
+	if err != nil {
+		return nil, err
+	}
+	compressMinSize = 1000
+	if v := getenv("COMPRESS_MIN_SIZE"); v != "" {
+		compressMinSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || compressMinSize < 0 {
+			return nil, fmt.Errorf("Invalid COMPRESS_MIN_SIZE: %s", v)
+		}
+	}
+	compressTypes = defaultCompressTypes
+	if v := getenv("COMPRESS_TYPES"); v != "" {
+		compressTypes = parseMediaTypes(v)
+	}
+	if compressResponses {
+		fmt.Fprintf(os.Stderr, "Compression: gzip (at least %d bytes)\n", compressMinSize)
+	}
+	optionsResponse, err = getenvBool("OPTIONS_RESPONSE")
+	if err != nil {
+		return nil, err
+	}
+	optionsResponseHeaders = nil
+	if v := getenv("OPTIONS_RESPONSE_HEADERS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &optionsResponseHeaders); err != nil {
+			return nil, fmt.Errorf("Invalid OPTIONS_RESPONSE_HEADERS: %v", err)
+		}
+	}
+	if optionsResponse {
+		fmt.Fprintf(os.Stderr, "OPTIONS requests: answered with 204\n")
+	}
+	hopByHopHeaders = append([]string{}, defaultHopByHopHeaders...)
+	if v := getenv("HOP_BY_HOP_HEADERS"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hopByHopHeaders = append(hopByHopHeaders, http.CanonicalHeaderKey(name))
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Additional hop-by-hop headers: %s\n", v)
+	}
+
+	if clientContextFile := getenv("CLIENT_CONTEXT_FILE"); clientContextFile != "" {
+		var err error
+		staticClientContext, err = ioutil.ReadFile(clientContextFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CLIENT_CONTEXT_FILE: %v", err)
+		}
+		if !json.Valid(staticClientContext) {
+			return nil, fmt.Errorf("CLIENT_CONTEXT_FILE does not contain valid JSON: %s", clientContextFile)
+		}
+		fmt.Fprintf(os.Stderr, "Client context: %s\n", clientContextFile)
+	}
+
+	if identityFile := getenv("COGNITO_IDENTITY_FILE"); identityFile != "" {
+		data, err := ioutil.ReadFile(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading COGNITO_IDENTITY_FILE: %v", err)
+		}
+		if err := json.Unmarshal(data, &staticIdentity); err != nil {
+			return nil, fmt.Errorf("Error parsing COGNITO_IDENTITY_FILE: %v", err)
+		}
+	}
+	if v := getenv("COGNITO_IDENTITY_ID"); v != "" {
+		staticIdentity.CognitoIdentityID = v
+	}
+	if v := getenv("COGNITO_IDENTITY_POOL_ID"); v != "" {
+		staticIdentity.CognitoIdentityPoolID = v
+	}
+	if staticIdentity.CognitoIdentityID != "" {
+		fmt.Fprintf(os.Stderr, "Cognito identity: %s\n", staticIdentity.CognitoIdentityID)
+	}
+
+	if eventFormat == "alb" {
+		albMultiValueHeaders, err = getenvBool("ALB_MULTI_VALUE_HEADERS")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Multi-value headers: %v\n", albMultiValueHeaders)
+	}
+
+	streamResponses, err = getenvBool("STREAM_RESPONSES")
+	if err != nil {
+		return nil, err
+	}
+	if streamResponses {
+		streamChunkSize = 4096
+		if v := getenv("STREAM_CHUNK_SIZE"); v != "" {
+			var err error
+			streamChunkSize, err = strconv.Atoi(v)
+			if err != nil || streamChunkSize <= 0 {
+				return nil, fmt.Errorf("Invalid STREAM_CHUNK_SIZE: %s", v)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Streaming responses in chunks of: %d bytes\n", streamChunkSize)
+	}
+
+	// The lambda started with --run listens on the port in LAMBDA_HOST
+	if v := getenv("LAMBDA_COMMAND"); v != "" {
+		childLambda, err = newLambdaProcess(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid LAMBDA_COMMAND: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Lambda command: %s\n", v)
+	}
+	if v := getenv("WATCH"); v != "" {
+		lambdaWatcher, err = newSourceWatcher(v, getenv("WATCH_BUILD_COMMAND"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid WATCH: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Watching: %s\n", strings.Join(lambdaWatcher.dirs, ", "))
+	}
+
+	// Routes, mocks, CORS and stage variables are reloaded when the config
+	// file changes
+	config, err := loadReloadableConfig()
+	if err != nil {
+		return nil, err
+	}
+	currentConfig.Store(config)
+
+	g.addr = getenv("BIND_ADDR")
+	if g.addr == "" {
+		port := 8002
+		if v := getenv("PORT"); v != "" {
+			var err error
+			port, err = strconv.Atoi(v)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("Invalid PORT: %s", v)
+			}
+		}
+		g.addr = fmt.Sprintf(":%d", port)
+	}
+	if _, port, err := net.SplitHostPort(g.addr); err != nil {
+		return nil, fmt.Errorf("Invalid BIND_ADDR: %v", err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return nil, fmt.Errorf("Invalid BIND_ADDR: invalid port %q", port)
+	}
+
+	g.shutdownTimeout = 10 * time.Second
+	if v := getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		var err error
+		g.shutdownTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SHUTDOWN_TIMEOUT: %v", err)
+		}
+	}
+
+	// A stalled client only ties up its connection until these timeouts
+	g.server = &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      120 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	for _, t := range []struct {
+		env     string
+		timeout *time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", &g.server.ReadHeaderTimeout},
+		{"READ_TIMEOUT", &g.server.ReadTimeout},
+		{"WRITE_TIMEOUT", &g.server.WriteTimeout},
+		{"IDLE_TIMEOUT", &g.server.IdleTimeout},
+	} {
+		if v := getenv(t.env); v != "" {
+			timeout, err := time.ParseDuration(v)
+			if err != nil || timeout < 0 {
+				return nil, fmt.Errorf("Invalid %s: %s", t.env, v)
+			}
+			*t.timeout = timeout
+		}
+	}
+	// The write timeout starts before the lambda is invoked, so it must not
+	// be shorter than the lambda's timeout
+	if g.server.WriteTimeout != 0 && g.server.WriteTimeout < functionTimeout {
+		g.server.WriteTimeout = functionTimeout
+	}
+	fmt.Fprintf(os.Stderr, "Server timeouts: %v (read header), %v (read), %v (write), %v (idle)\n", g.server.ReadHeaderTimeout, g.server.ReadTimeout, g.server.WriteTimeout, g.server.IdleTimeout)
+	g.certFile = getenv("CERT_FILE")
+	g.keyFile = getenv("KEY_FILE")
+	tlsMode := getenv("TLS")
+	if tlsMode == "self-signed" {
+		cert, err := generateSelfSignedCertificate(strings.Split(getenv("TLS_SANS"), ","))
+		if err != nil {
+			return nil, fmt.Errorf("Error generating self-signed certificate: %v", err)
+		}
+		g.server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		fmt.Fprintf(os.Stderr, "TLS: self-signed certificate\n")
+		fmt.Fprintf(os.Stderr, "Certificate fingerprint (SHA-256): %s\n", certificateFingerprint(cert))
+	} else if tlsMode != "" {
+		return nil, fmt.Errorf("Unsupported TLS: %s (must be self-signed, or set CERT_FILE and KEY_FILE)", tlsMode)
+	} else if g.certFile != "" || g.keyFile != "" {
+		if g.certFile == "" || g.keyFile == "" {
+			return nil, errors.New("Both CERT_FILE and KEY_FILE must be set")
+		}
+		fmt.Fprintf(os.Stderr, "TLS: %s\n", g.certFile)
+	}
+	// HTTP/2 is enabled with TLS by net/http
+	enableH2C, err := getenvBool("H2C")
+	if err != nil {
+		return nil, err
+	}
+	if enableH2C {
+		if g.server.TLSConfig != nil || g.certFile != "" {
+			return nil, errors.New("H2C can't be used with TLS, which supports HTTP/2")
+		}
+		g.server.Protocols = new(http.Protocols)
+		g.server.Protocols.SetHTTP1(true)
+		g.server.Protocols.SetUnencryptedHTTP2(true)
+		fmt.Fprintf(os.Stderr, "HTTP/2 without TLS (h2c): enabled\n")
+	}
+	if headerCase == "preserve" {
+		if g.server.TLSConfig != nil || g.certFile != "" {
+			return nil, errors.New("HEADER_CASE=preserve can't be used with TLS")
+		}
+		g.server.ConnContext = headerCaseConnContext
+	}
+
+	// The gateway's own endpoints are served under this prefix, which can be
+	// changed if it collides with the application's routes
+	gatewayPathPrefix = "/_gateway"
+	if v := getenv("GATEWAY_PATH_PREFIX"); v != "" {
+		gatewayPathPrefix = "/" + strings.Trim(v, "/")
+		if gatewayPathPrefix == "/" {
+			return nil, fmt.Errorf("Invalid GATEWAY_PATH_PREFIX: %s", v)
+		}
+	}
+
+	enableMetrics, err := getenvBool("METRICS")
+	if err != nil {
+		return nil, err
+	}
+	if enableMetrics {
+		gatewayMetrics = newMetrics()
+		fmt.Fprintf(os.Stderr, "Metrics: %s/metrics\n", gatewayPathPrefix)
+	}
+
+	// Tracing is configured with the standard OpenTelemetry variables
+	tracer, err = newOTLPExporter()
+	if err != nil {
+		return nil, err
+	}
+	if tracer != nil {
+		fmt.Fprintf(os.Stderr, "Exporting traces to: %s\n", tracer.endpoint)
+	}
+
+	logFormat = getenv("LOG_FORMAT")
+	if logFormat == "" {
+		logFormat = "text"
+	} else if logFormat != "text" && logFormat != "json" {
+		return nil, fmt.Errorf("Unsupported LOG_FORMAT: %s (must be text or json)", logFormat)
+	}
+	if accessLogFormat = getenv("ACCESS_LOG_FORMAT"); accessLogFormat != "" {
+		if getenv("LOG_FORMAT") != "" {
+			return nil, fmt.Errorf("LOG_FORMAT and ACCESS_LOG_FORMAT can't be used together")
+		}
+		logFormat = "custom"
+	}
+	if accessLogFile := getenv("ACCESS_LOG_FILE"); accessLogFile != "" {
+		var maxSize int64
+		if v := getenv("ACCESS_LOG_MAX_SIZE"); v != "" {
+			maxSize, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || maxSize < 0 {
+				return nil, fmt.Errorf("Invalid ACCESS_LOG_MAX_SIZE: %s", v)
+			}
+		}
+		maxFiles := 5
+		if v := getenv("ACCESS_LOG_MAX_FILES"); v != "" {
+			maxFiles, err = strconv.Atoi(v)
+			if err != nil || maxFiles < 0 {
+				return nil, fmt.Errorf("Invalid ACCESS_LOG_MAX_FILES: %s", v)
+			}
+		}
+		f, err := openLogFile(accessLogFile, maxSize, maxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening ACCESS_LOG_FILE: %v", err)
+		}
+		accessLog.SetOutput(f)
+		accessLogOutput = f
+		if maxSize > 0 {
+			fmt.Fprintf(os.Stderr, "Access log: %s (rotated at %d bytes, keeping %d files)\n", accessLogFile, maxSize, maxFiles)
+		} else {
+			fmt.Fprintf(os.Stderr, "Access log: %s\n", accessLogFile)
+		}
+	}
+
+	if dir := getenv("RECORD_DIR"); dir != "" {
+		maxBody := 0
+		if v := getenv("RECORD_MAX_BODY"); v != "" {
+			maxBody, err = strconv.Atoi(v)
+			if err != nil || maxBody < 0 {
+				return nil, fmt.Errorf("Invalid RECORD_MAX_BODY: %s", v)
+			}
+		}
+		var maxSize int64
+		if v := getenv("RECORD_MAX_SIZE"); v != "" {
+			maxSize, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || maxSize < 0 {
+				return nil, fmt.Errorf("Invalid RECORD_MAX_SIZE: %s", v)
+			}
+		}
+		recorder, err = newTrafficRecorder(dir, maxBody, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating RECORD_DIR: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Recording traffic to: %s\n", dir)
+	}
+
+	if v := getenv("ASYNC_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("Invalid ASYNC_CONCURRENCY: %s", v)
+		}
+		asyncSlots = make(chan struct{}, n)
+	}
+	if v := getenv("ASYNC_MAX_RETRIES"); v != "" {
+		asyncMaxRetries, err = strconv.Atoi(v)
+		if err != nil || asyncMaxRetries < 0 {
+			return nil, fmt.Errorf("Invalid ASYNC_MAX_RETRIES: %s", v)
+		}
+	}
+	if asyncDLQDir = getenv("ASYNC_DLQ_DIR"); asyncDLQDir != "" {
+		if err := os.MkdirAll(asyncDLQDir, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating ASYNC_DLQ_DIR: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Async dead-letter directory: %s\n", asyncDLQDir)
+	}
+
+	if v := getenv("MAX_CONCURRENCY"); v != "" {
+		maxConcurrency, err = strconv.Atoi(v)
+		if err != nil || maxConcurrency < 0 {
+			return nil, fmt.Errorf("Invalid MAX_CONCURRENCY: %s", v)
+		}
+		if v := getenv("MAX_CONCURRENCY_WAIT"); v != "" {
+			maxConcurrencyWait, err = time.ParseDuration(v)
+			if err != nil || maxConcurrencyWait < 0 {
+				return nil, fmt.Errorf("Invalid MAX_CONCURRENCY_WAIT: %s", v)
+			}
+		}
+		if maxConcurrency > 0 {
+			fmt.Fprintf(os.Stderr, "Max concurrency: %d per lambda (waiting up to %v)\n", maxConcurrency, maxConcurrencyWait)
+		}
+	}
+
+	for i, v := range scheduleFlags {
+		sch, err := parseSchedule(v, i+1)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --schedule %q: %v", v, err)
+		}
+		schedules = append(schedules, sch)
+		fmt.Fprintf(os.Stderr, "Schedule %s: %s\n", sch.name, sch.expression)
+	}
+
+	// The admin API is disabled unless a port is configured
+	if v := getenv("ADMIN_PORT"); v != "" {
+		g.adminPort, err = strconv.Atoi(v)
+		if err != nil || g.adminPort <= 0 || g.adminPort > 65535 {
+			return nil, fmt.Errorf("Invalid ADMIN_PORT: %s", v)
+		}
+		adminStats = &requestStats{}
+	}
+	debugEndpoints, err := getenvBool("DEBUG_ENDPOINTS")
+	if err != nil {
+		return nil, err
+	}
+	if debugEndpoints {
+		if g.adminPort == 0 {
+			return nil, fmt.Errorf("DEBUG_ENDPOINTS requires ADMIN_PORT, the debug endpoints are only served on the admin listener")
+		}
+		debugVars = newDebugVars()
+	}
+
+	return g, nil
 }
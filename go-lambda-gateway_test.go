@@ -0,0 +1,514 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+func TestProxyEvent(t *testing.T) {
+	var event events.APIGatewayProxyRequest
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       "hello " + event.Path,
+		}, nil
+	})
+	handler := newTestGateway(t, WithLambdaHost(lambda))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/users/1?a=1", nil))
+
+	if event.HTTPMethod != "PUT" || event.Path != "/users/1" || event.QueryStringParameters["a"] != "1" {
+		t.Errorf("got method %q, path %q, query %v", event.HTTPMethod, event.Path, event.QueryStringParameters)
+	}
+	if requestID := w.Header()["x-amzn-RequestId"]; event.RequestContext.RequestID == "" || len(requestID) != 1 || requestID[0] != event.RequestContext.RequestID {
+		t.Errorf("got request id %q, the response has %q", event.RequestContext.RequestID, requestID)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "hello /users/1" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+func TestMergeResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name              string
+		headers           map[string]string
+		multiValueHeaders map[string][]string
+		key               string
+		want              []string
+	}{
+		{
+			name:              "duplicate Set-Cookie",
+			headers:           map[string]string{"Set-Cookie": "b=2"},
+			multiValueHeaders: map[string][]string{"Set-Cookie": {"a=1", "b=2"}},
+			key:               "Set-Cookie",
+			want:              []string{"a=1", "b=2"},
+		},
+		{
+			name:              "combined",
+			headers:           map[string]string{"Set-Cookie": "c=3"},
+			multiValueHeaders: map[string][]string{"Set-Cookie": {"a=1", "b=2"}},
+			key:               "Set-Cookie",
+			want:              []string{"a=1", "b=2", "c=3"},
+		},
+		{
+			name:              "mixed case duplicate",
+			headers:           map[string]string{"Set-Cookie": "a=1"},
+			multiValueHeaders: map[string][]string{"set-cookie": {"a=1"}},
+			key:               "Set-Cookie",
+			want:              []string{"a=1"},
+		},
+		{
+			name:              "mixed case combined",
+			headers:           map[string]string{"x-custom": "1"},
+			multiValueHeaders: map[string][]string{"X-CUSTOM": {"2"}},
+			key:               "X-Custom",
+			want:              []string{"2", "1"},
+		},
+		{
+			name:              "only in multiValueHeaders",
+			multiValueHeaders: map[string][]string{"X-Multi": {"1", "2"}},
+			key:               "X-Multi",
+			want:              []string{"1", "2"},
+		},
+		{
+			name:    "only in headers",
+			headers: map[string]string{"X-Single": "1"},
+			key:     "X-Single",
+			want:    []string{"1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			mergeResponseHeaders(header, test.headers, test.multiValueHeaders)
+			if got := header.Values(test.key); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %s %q, want %q", test.key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMultiValueSetCookie(t *testing.T) {
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		return events.APIGatewayProxyResponse{
+			StatusCode:        http.StatusOK,
+			MultiValueHeaders: map[string][]string{"Set-Cookie": {"a=1; Path=/", "b=2; HttpOnly"}},
+		}, nil
+	})
+	handler := newTestGateway(t, WithLambdaHost(lambda))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got, want := w.Result().Header.Values("Set-Cookie"), []string{"a=1; Path=/", "b=2; HttpOnly"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Set-Cookie %q, want %q", got, want)
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"ASCII", `{"name":"cafe"}`, false},
+		{"UTF-8", `{"name":"café"}`, false},
+		{"Japanese", "こんにちは世界", false},
+		{"emoji", "🙂👍", false},
+		{"UTF-8 with BOM", "\ufeff{\"name\":\"café\"}", false},
+		{"whitespace", "a\tb\r\nc\n", false},
+		{"empty", "", false},
+		{"latin-1", "caf\xe9", true},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", true},
+		{"gzip", "\x1f\x8b\x08\x00\x00\x00\x00\x00", true},
+		{"NUL", "a\x00b", true},
+		{"control character", "a\x1bb", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsBinary(test.s); got != test.want {
+				t.Errorf("IsBinary(%q) = %v, want %v", test.s, got, test.want)
+			}
+		})
+	}
+}
+
+// deadlineFunction is a lambda that records the deadline of the invocation.
+type deadlineFunction struct {
+	deadline chan messages.InvokeRequest_Timestamp
+}
+
+func (f *deadlineFunction) Invoke(req *messages.InvokeRequest, response *messages.InvokeResponse) error {
+	f.deadline <- req.Deadline
+	response.Payload = []byte(`{"statusCode":200}`)
+	return nil
+}
+
+func TestInvocationDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	fn := &deadlineFunction{deadline: make(chan messages.InvokeRequest_Timestamp, 1)}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Function", fn); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+	handler := newTestGateway(t, WithLambdaHost(listener.Addr().String()), WithTimeout(45*time.Second))
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	ts := <-fn.deadline
+	deadline := time.Unix(ts.Seconds, ts.Nanos)
+	if want := start.Add(45 * time.Second); deadline.Before(want) || deadline.After(want.Add(time.Second)) {
+		t.Errorf("got deadline %v after the request, want 45s", deadline.Sub(start))
+	}
+	if ts.Nanos < 0 || ts.Nanos >= int64(time.Second) {
+		t.Errorf("got %d nanos, want less than a second", ts.Nanos)
+	}
+}
+
+func TestIntegrationTimeout(t *testing.T) {
+	var calls atomic.Int64
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		if calls.Add(1) == 1 {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "ok"}, nil
+	})
+	handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("INTEGRATION_TIMEOUT", "100ms"), WithOption("MAX_CONNECTIONS", "1"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusGatewayTimeout || w.Header().Get("Content-Type") != "application/json" || w.Body.String() != `{"message":"Endpoint request timed out"}` {
+		t.Errorf("got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	// The connection of the abandoned invocation isn't reused
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("the next request got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestHeadRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		response      events.APIGatewayProxyResponse
+		status        int
+		contentType   string
+		contentLength string
+	}{
+		{
+			name:     "empty body",
+			response: events.APIGatewayProxyResponse{StatusCode: http.StatusNoContent},
+			status:   http.StatusNoContent,
+		},
+		{
+			name:          "body",
+			response:      events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: map[string]string{"Content-Type": "application/json"}, Body: `{"hello":"world"}`},
+			status:        http.StatusOK,
+			contentType:   "application/json",
+			contentLength: "17",
+		},
+		{
+			name:          "sniffed Content-Type",
+			response:      events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "<html><body>hi</body></html>"},
+			status:        http.StatusOK,
+			contentType:   "text/html; charset=utf-8",
+			contentLength: "28",
+		},
+		{
+			name:          "base64 body",
+			response:      events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: map[string]string{"Content-Type": "image/png"}, Body: "iVBORw0KGgo=", IsBase64Encoded: true},
+			status:        http.StatusOK,
+			contentType:   "image/png",
+			contentLength: "8",
+		},
+		{
+			name:          "Content-Length from the lambda",
+			response:      events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: map[string]string{"Content-Type": "text/plain", "Content-Length": "1000"}},
+			status:        http.StatusOK,
+			contentType:   "text/plain",
+			contentLength: "1000",
+		},
+		{
+			name:          "error status",
+			response:      events.APIGatewayProxyResponse{StatusCode: http.StatusNotFound, Headers: map[string]string{"Content-Type": "text/plain"}, Body: "not found"},
+			status:        http.StatusNotFound,
+			contentType:   "text/plain",
+			contentLength: "9",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var method string
+			lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+				var event events.APIGatewayProxyRequest
+				if err := json.Unmarshal(payload, &event); err != nil {
+					return nil, err
+				}
+				method = event.HTTPMethod
+				return test.response, nil
+			})
+			server := httptest.NewServer(newTestGateway(t, WithLambdaHost(lambda)))
+			defer server.Close()
+
+			resp, err := http.Head(server.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if method != "HEAD" {
+				t.Errorf("the lambda got %q, want HEAD", method)
+			}
+			if resp.StatusCode != test.status || resp.Header.Get("Content-Type") != test.contentType || resp.Header.Get("Content-Length") != test.contentLength {
+				t.Errorf("got %d, Content-Type %q, Content-Length %q, want %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("Content-Length"), test.status, test.contentType, test.contentLength)
+			}
+		})
+	}
+
+	// The body isn't written even if the handler is called directly
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: "hello"}, nil
+	})
+	w := httptest.NewRecorder()
+	newTestGateway(t, WithLambdaHost(lambda)).ServeHTTP(w, httptest.NewRequest("HEAD", "/", nil))
+	if w.Body.Len() != 0 || w.Header().Get("Content-Length") != "5" {
+		t.Errorf("got body %q, Content-Length %q", w.Body.String(), w.Header().Get("Content-Length"))
+	}
+}
+
+// formatVerbs is a response body that fmt would mangle if it were used as a
+// format string.
+const formatVerbs = ".a{width:100%!important} %s %d %v %% %!s(MISSING) %[1]s %"
+
+func TestBodyWithFormatVerbs(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		response events.APIGatewayProxyResponse
+		logLine  string
+	}{
+		{"text log", nil, events.APIGatewayProxyResponse{StatusCode: 200, Body: formatVerbs}, " 200 " + strconv.Itoa(len(formatVerbs)) + " "},
+		{"json log", []Option{WithOption("LOG_FORMAT", "json")}, events.APIGatewayProxyResponse{StatusCode: 200, Body: formatVerbs}, `"responseBytes":` + strconv.Itoa(len(formatVerbs))},
+		{"custom log", []Option{WithOption("ACCESS_LOG_FORMAT", "%s %d $context.status $context.responseLength")}, events.APIGatewayProxyResponse{StatusCode: 200, Body: formatVerbs}, "%s %d 200 " + strconv.Itoa(len(formatVerbs))},
+		{"base64", nil, events.APIGatewayProxyResponse{StatusCode: 200, Body: base64.StdEncoding.EncodeToString([]byte(formatVerbs)), IsBase64Encoded: true}, " 200 " + strconv.Itoa(len(formatVerbs)) + " "},
+		{"streaming", []Option{WithOption("STREAM_RESPONSES", "true")}, events.APIGatewayProxyResponse{StatusCode: 200, Body: formatVerbs}, " 200 " + strconv.Itoa(len(formatVerbs)) + " "},
+	}
+	var log bytes.Buffer
+	accessLog.SetOutput(&log)
+	defer accessLog.SetOutput(os.Stdout)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+				return test.response, nil
+			})
+			handler := newTestGateway(t, append(test.opts, WithLambdaHost(lambda))...)
+			log.Reset()
+
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/style.css")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body bytes.Buffer
+			body.ReadFrom(resp.Body)
+			resp.Body.Close()
+			// The request is logged after the response is sent
+			server.Close()
+			if body.String() != formatVerbs {
+				t.Errorf("got body %q, want %q", body.String(), formatVerbs)
+			}
+			if !strings.Contains(log.String(), test.logLine) {
+				t.Errorf("got access log %q, want it to contain %q", log.String(), test.logLine)
+			}
+		})
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that drops the body, so the
+// benchmark only counts the gateway's allocations.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteString(s string) (int, error) {
+	return len(s), nil
+}
+
+func BenchmarkWriteResponse5MB(b *testing.B) {
+	body := strings.Repeat("0123456789abcdef%s%d", 5<<20/20)
+	for _, test := range []struct {
+		name     string
+		response events.APIGatewayProxyResponse
+	}{
+		{"text", events.APIGatewayProxyResponse{StatusCode: 200, Body: body}},
+		{"base64", events.APIGatewayProxyResponse{StatusCode: 200, Body: base64.StdEncoding.EncodeToString([]byte(body)), IsBase64Encoded: true}},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			r := httptest.NewRequest("GET", "/", nil)
+			inv := &invocation{config: &reloadableConfig{}}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				response := test.response
+				sw := &statusWriter{ResponseWriter: &discardResponseWriter{header: http.Header{}}}
+				writeResponse(sw, r, inv, &response)
+				if sw.written != int64(len(body)) {
+					b.Fatalf("wrote %d bytes, want %d", sw.written, len(body))
+				}
+			}
+		})
+	}
+}
+
+// trackingReader records whether the body of a request was read.
+type trackingReader struct {
+	r    io.Reader
+	read atomic.Bool
+}
+
+func (r *trackingReader) Read(p []byte) (int, error) {
+	r.read.Store(true)
+	return r.r.Read(p)
+}
+
+func TestExpectContinue(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		header http.Header
+		status int
+	}{
+		{"accepted", nil, http.Header{}, http.StatusOK},
+		{"too large", []Option{WithOption("MAX_REQUEST_PAYLOAD", "4")}, http.Header{}, http.StatusRequestEntityTooLarge},
+		{"missing API key", []Option{WithOption("API_KEYS", "secret"), WithOption("API_KEY_REQUIRED", "true")}, http.Header{}, http.StatusForbidden},
+		{"API key", []Option{WithOption("API_KEYS", "secret"), WithOption("API_KEY_REQUIRED", "true")}, http.Header{"X-Api-Key": {"secret"}}, http.StatusOK},
+		{"missing JWT", []Option{WithOption("PAYLOAD_FORMAT", "2.0"), WithOption("JWT_SECRET", "secret")}, http.Header{}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var event events.APIGatewayProxyRequest
+			lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+				if err := json.Unmarshal(payload, &event); err != nil {
+					return nil, err
+				}
+				return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: event.Body}, nil
+			})
+			server := httptest.NewServer(newTestGateway(t, append(test.opts, WithLambdaHost(lambda))...))
+			defer server.Close()
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+			defer client.CloseIdleConnections()
+
+			body := &trackingReader{r: strings.NewReader("hello")}
+			req, err := http.NewRequest("POST", server.URL+"/upload", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.ContentLength = 5
+			req.Header = test.header
+			req.Header.Set("Expect", "100-continue")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Fatalf("got %d %q, want %d", resp.StatusCode, respBody, test.status)
+			}
+			if test.status != http.StatusOK {
+				// The client got the response instead of 100 Continue
+				if body.read.Load() {
+					t.Error("the body was sent for a rejected request")
+				}
+				return
+			}
+			if string(respBody) != "hello" {
+				t.Errorf("the lambda got body %q", respBody)
+			}
+			if _, ok := event.Headers["Expect"]; ok {
+				t.Errorf("the event has the Expect header: %v", event.Headers)
+			}
+		})
+	}
+}
+
+func TestEventPath(t *testing.T) {
+	tests := []struct {
+		target     string
+		decodePath bool
+		path       string
+		proxy      string
+	}{
+		{"/files/a%2Fb", false, "/files/a%2Fb", "files/a%2Fb"},
+		{"/files/a%2Fb", true, "/files/a/b", "files/a/b"},
+		{"/search%3Fq=1?q=2", false, "/search%3Fq=1", "search%3Fq=1"},
+		{"/search%3Fq=1?q=2", true, "/search?q=1", "search?q=1"},
+		{"/caf%C3%A9", false, "/caf%C3%A9", "caf%C3%A9"},
+		{"/caf%C3%A9", true, "/café", "café"},
+		{"/caf%c3%a9", false, "/caf%c3%a9", "caf%c3%a9"},
+		{"/a%20b/c", false, "/a%20b/c", "a%20b/c"},
+		{"/a%20b/c", true, "/a b/c", "a b/c"},
+		{"/plain/path", false, "/plain/path", "plain/path"},
+	}
+	var event events.APIGatewayProxyRequest
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		event = events.APIGatewayProxyRequest{}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s DECODE_PATH=%v", test.target, test.decodePath), func(t *testing.T) {
+			handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("DECODE_PATH", strconv.FormatBool(test.decodePath)))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.target, nil))
+			if event.Path != test.path || event.PathParameters["proxy"] != test.proxy {
+				t.Errorf("got path %q and proxy %q, want %q and %q", event.Path, event.PathParameters["proxy"], test.path, test.proxy)
+			}
+			if want := "/" + event.RequestContext.Stage + test.path; event.RequestContext.Path != want {
+				t.Errorf("got requestContext.path %q, want %q", event.RequestContext.Path, want)
+			}
+		})
+	}
+
+	// Path parameters that aren't greedy are always decoded
+	t.Run("resource", func(t *testing.T) {
+		handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("RESOURCES", "/files/{key}/{rest+}"))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/files/a%2Fb/c%2Fd/e", nil))
+		if want := map[string]string{"key": "a/b", "rest": "c%2Fd/e"}; !reflect.DeepEqual(event.PathParameters, want) || event.Resource != "/files/{key}/{rest+}" {
+			t.Errorf("got resource %q and path parameters %q, want %q", event.Resource, event.PathParameters, want)
+		}
+	})
+}
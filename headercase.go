@@ -0,0 +1,167 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// headerCase is how header names are written in the payload format 1.0
+// event: canonical (Content-Type), lowercase (content-type), like HTTP APIs,
+// or preserve, as the client sent them.
+var headerCase = "canonical"
+
+// maxPendingHeaderBlocks is how many requests of a connection are recorded
+// before they are handled, e.g. with pipelining.
+const maxPendingHeaderBlocks = 8
+
+var requestLineRegexp = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/\d\.\d$`)
+
+type headerCaseConnKey struct{}
+type rawHeaderNamesKey struct{}
+
+// headerCaseListener records the header names of the requests as they were
+// sent, since net/http canonicalizes them. It only sees plain HTTP/1.
+type headerCaseListener struct {
+	net.Listener
+}
+
+func (l headerCaseListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &headerCaseConn{Conn: conn}, nil
+}
+
+type headerCaseConn struct {
+	net.Conn
+	mu       sync.Mutex
+	line     []byte
+	overflow bool
+	block    *headerBlock
+	blocks   []*headerBlock
+}
+
+// A headerBlock is the header names of a request, by canonical name, in the
+// order of the values.
+type headerBlock struct {
+	requestLine string
+	names       map[string][]string
+}
+
+func (c *headerCaseConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.record(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *headerCaseConn) record(data []byte) {
+	for len(data) > 0 {
+		i := strings.IndexByte(string(data), '\n')
+		if i < 0 {
+			c.appendLine(data)
+			return
+		}
+		c.appendLine(data[:i])
+		data = data[i+1:]
+		if !c.overflow {
+			c.recordLine(strings.TrimSuffix(string(c.line), "\r"))
+		}
+		c.line = c.line[:0]
+		c.overflow = false
+	}
+}
+
+func (c *headerCaseConn) appendLine(data []byte) {
+	if len(c.line)+len(data) > http.DefaultMaxHeaderBytes {
+		c.overflow = true
+		return
+	}
+	c.line = append(c.line, data...)
+}
+
+// recordLine records a line of the request. Body lines are only recorded if
+// they look like a request line, and the request lines are compared with the
+// request in take, so a body can't mix up the requests.
+func (c *headerCaseConn) recordLine(line string) {
+	if requestLineRegexp.MatchString(line) {
+		c.block = &headerBlock{requestLine: line, names: map[string][]string{}}
+		return
+	} else if c.block == nil {
+		return
+	}
+	if line == "" {
+		c.blocks = append(c.blocks, c.block)
+		if len(c.blocks) > maxPendingHeaderBlocks {
+			c.blocks = c.blocks[1:]
+		}
+		c.block = nil
+		return
+	}
+	if i := strings.IndexByte(line, ':'); i > 0 {
+		name := line[:i]
+		key := http.CanonicalHeaderKey(name)
+		c.block.names[key] = append(c.block.names[key], name)
+	}
+}
+
+// take returns the header names of the request, and forgets the requests
+// that came before it.
+func (c *headerCaseConn) take(r *http.Request) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	requestLine := r.Method + " " + r.RequestURI + " " + r.Proto
+	for i, block := range c.blocks {
+		if block.requestLine == requestLine {
+			c.blocks = c.blocks[i+1:]
+			return block.names
+		}
+	}
+	return nil
+}
+
+// headerCaseConnContext makes the connection available to
+// withRawHeaderNames.
+func headerCaseConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if c, ok := conn.(*headerCaseConn); ok {
+		return context.WithValue(ctx, headerCaseConnKey{}, c)
+	}
+	return ctx
+}
+
+// withRawHeaderNames adds the header names that were recorded by
+// headerCaseListener to the request's context.
+func withRawHeaderNames(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(headerCaseConnKey{}).(*headerCaseConn); ok {
+			if names := c.take(r); names != nil {
+				r = r.WithContext(context.WithValue(r.Context(), rawHeaderNamesKey{}, names))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// eventHeaderName returns the name of the i-th value of a header in the
+// event. Headers that the client didn't send, e.g. X-Amzn-Trace-Id, are
+// canonical when the case is preserved.
+func eventHeaderName(r *http.Request, header string, i int) string {
+	switch headerCase {
+	case "lowercase":
+		return strings.ToLower(header)
+	case "preserve":
+		names, _ := r.Context().Value(rawHeaderNamesKey{}).(map[string][]string)
+		if i < len(names[header]) {
+			return names[header][i]
+		} else if len(names[header]) > 0 {
+			return names[header][0]
+		}
+	}
+	return header
+}
@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// startHeaderLambda starts a lambda that sends the headers of the event
+// back as the response body.
+func startHeaderLambda(t *testing.T) string {
+	return startTestLambda(t, func(payload []byte) (interface{}, error) {
+		var event events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		for _, name := range []string{"Host", "X-Amzn-Trace-Id", "X-Forwarded-For", "X-Forwarded-Port", "X-Forwarded-Proto"} {
+			for _, key := range []string{name, strings.ToLower(name)} {
+				delete(event.Headers, key)
+				delete(event.MultiValueHeaders, key)
+			}
+		}
+		body, err := json.Marshal(map[string]interface{}{"headers": event.Headers, "multiValueHeaders": event.MultiValueHeaders})
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: string(body)}, err
+	})
+}
+
+type eventHeaders struct {
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+}
+
+func TestHeaderCase(t *testing.T) {
+	tests := []struct {
+		headerCase string
+		want       eventHeaders
+	}{
+		{
+			headerCase: "canonical",
+			want: eventHeaders{
+				Headers:           map[string]string{"X-Test": "b", "Content-Type": "text/plain"},
+				MultiValueHeaders: map[string][]string{"X-Test": {"a", "b"}, "Content-Type": {"text/plain"}},
+			},
+		},
+		{
+			headerCase: "lowercase",
+			want: eventHeaders{
+				Headers:           map[string]string{"x-test": "b", "content-type": "text/plain"},
+				MultiValueHeaders: map[string][]string{"x-test": {"a", "b"}, "content-type": {"text/plain"}},
+			},
+		},
+		{
+			// Without the names from the connection, the case can't be
+			// preserved and the names are canonical
+			headerCase: "preserve",
+			want: eventHeaders{
+				Headers:           map[string]string{"X-Test": "b", "Content-Type": "text/plain"},
+				MultiValueHeaders: map[string][]string{"X-Test": {"a", "b"}, "Content-Type": {"text/plain"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.headerCase, func(t *testing.T) {
+			handler := newTestGateway(t, WithLambdaHost(startHeaderLambda(t)), WithOption("HEADER_CASE", test.headerCase))
+			r := httptest.NewRequest("POST", "/", strings.NewReader("hi"))
+			r.Header.Set("Content-Type", "text/plain")
+			r.Header["X-Test"] = []string{"a", "b"}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			var got eventHeaders
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("%v: %s", err, w.Body.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHeaderCasePreserve(t *testing.T) {
+	handler := newTestGateway(t, WithLambdaHost(startHeaderLambda(t)), WithOption("HEADER_CASE", "preserve"))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler, ConnContext: headerCaseConnContext}
+	go server.Serve(headerCaseListener{listener})
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Both requests are sent at once, so their names are recorded before the
+	// first one is handled. The body of the first one looks like a request.
+	_, err = io.WriteString(conn, "POST /one HTTP/1.1\r\nHost: example.com\r\nx-test: a\r\nX-TEST: b\r\ncontent-type: text/plain\r\nContent-Length: 38\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nX-Test: spoofed\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nHost: example.com\r\nX-Test: c\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, want := range []eventHeaders{
+		{
+			Headers:           map[string]string{"x-test": "a", "X-TEST": "b", "content-type": "text/plain", "Content-Length": "38"},
+			MultiValueHeaders: map[string][]string{"x-test": {"a"}, "X-TEST": {"b"}, "content-type": {"text/plain"}, "Content-Length": {"38"}},
+		},
+		{
+			Headers:           map[string]string{"X-Test": "c"},
+			MultiValueHeaders: map[string][]string{"X-Test": {"c"}},
+		},
+	} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var got eventHeaders
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("%v: %s", err, body)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// gatewayPathPrefix is the path prefix of the gateway's own endpoints, which
+// are handled without invoking the lambda.
+var gatewayPathPrefix string
+
+// healthCheckTimeout is how long the health check waits for each lambda.
+const healthCheckTimeout = 2 * time.Second
+
+// handleHealth pings every lambda in the config. It responds with 503 if any
+// of them can't be reached, so it can be used as a container health check.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig.Load()
+	status := http.StatusOK
+	health := map[string]interface{}{
+		"gateway": "ok",
+		"lambda":  "ok",
+	}
+	lambdas := map[string]string{}
+	for _, rt := range config.allRoutes() {
+		if _, ok := lambdas[rt.lambdaHost]; ok {
+			continue
+		}
+		if err := rt.pool.ping(healthCheckTimeout); err != nil {
+			lambdas[rt.lambdaHost] = err.Error()
+			health["lambda"] = "error"
+			status = http.StatusServiceUnavailable
+		} else {
+			lambdas[rt.lambdaHost] = "ok"
+		}
+	}
+	health["lambdas"] = lambdas
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(health)
+}
+
+// waitForLambdas pings every lambda in the config, and the authorizer, until
+// they all respond. It returns an error if they don't respond before the
+// timeout.
+func waitForLambdas(config *reloadableConfig, timeout time.Duration) error {
+	routes := config.allRoutes()
+	if authorizerRoute != nil {
+		routes = append(routes, authorizerRoute)
+	}
+	deadline := time.Now().Add(timeout)
+	waited := map[string]bool{}
+	for _, rt := range routes {
+		if waited[rt.lambdaHost] {
+			continue
+		}
+		waited[rt.lambdaHost] = true
+		for attempt := 1; ; attempt++ {
+			err := rt.pool.ping(healthCheckTimeout)
+			if err == nil {
+				log.Printf("Lambda at %s is ready", rt.lambdaHost)
+				break
+			}
+			if time.Now().Add(time.Second).After(deadline) {
+				return fmt.Errorf("lambda at %s did not respond within %v: %v", rt.lambdaHost, timeout, err)
+			}
+			log.Printf("Waiting for lambda at %s (attempt %d): %v", rt.lambdaHost, attempt, err)
+			time.Sleep(time.Second)
+		}
+	}
+	return nil
+}
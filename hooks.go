@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	runtimedebug "runtime/debug"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// A RequestHook is called with the request and its payload format 1.0 event
+// before the lambda is invoked. It can change the event, or return a response
+// that is sent instead of invoking the lambda.
+type RequestHook func(r *http.Request, event *events.APIGatewayProxyRequest) *events.APIGatewayProxyResponse
+
+// A ResponseHook is called with every response before it is written, and can
+// change it.
+type ResponseHook func(r *http.Request, response *events.APIGatewayProxyResponse)
+
+// requestHooks and responseHooks are the hooks given to New. They are called
+// after the hooks from HOOKS_FILE.
+var requestHooks []RequestHook
+var responseHooks []ResponseHook
+
+// hookPanicError is returned when a hook panics. The client gets a 502, just
+// like when the lambda fails.
+type hookPanicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *hookPanicError) Error() string {
+	return fmt.Sprintf("hook panicked: %v", e.value)
+}
+
+func (e *hookPanicError) write(w http.ResponseWriter, inv *invocation) {
+	log.Printf("Hook panicked (request id %s): %v\n%s", inv.requestID, e.value, e.stack)
+	(&gatewayError{"DEFAULT_5XX", http.StatusBadGateway, "Internal server error"}).write(w, inv)
+}
+
+// runRequestHooks calls the request hooks until one of them returns a
+// response.
+func runRequestHooks(inv *invocation, r *http.Request, event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+	for _, hooks := range [][]RequestHook{inv.config.requestHooks, requestHooks} {
+		for _, hook := range hooks {
+			response, err := callRequestHook(hook, r, event)
+			if response != nil || err != nil {
+				return response, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func callRequestHook(hook RequestHook, r *http.Request, event *events.APIGatewayProxyRequest) (response *events.APIGatewayProxyResponse, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &hookPanicError{v, runtimedebug.Stack()}
+		}
+	}()
+	return hook(r, event), nil
+}
+
+func runResponseHooks(r *http.Request, response *events.APIGatewayProxyResponse) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &hookPanicError{v, runtimedebug.Stack()}
+		}
+	}()
+	for _, hook := range responseHooks {
+		hook(r, response)
+	}
+	return nil
+}
+
+// loadHooksFile reads a JSON array of built-in request hooks, e.g.
+// [{"type": "set-header", "name": "X-User", "value": "alice"},
+// {"type": "rewrite-path", "from": "/legacy", "to": "/v2"},
+// {"type": "basic-auth", "username": "dev", "password": "secret"}].
+func loadHooksFile(path string) ([]RequestHook, []string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var configs []struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Value    string `json:"value"`
+		From     string `json:"from"`
+		To       string `json:"to"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Realm    string `json:"realm"`
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, nil, err
+	}
+
+	var hooks []RequestHook
+	var descriptions []string
+	for i, config := range configs {
+		switch config.Type {
+		case "set-header":
+			if config.Name == "" {
+				return nil, nil, fmt.Errorf("hook %d has no name", i+1)
+			}
+			hooks = append(hooks, setHeaderHook(config.Name, config.Value))
+			descriptions = append(descriptions, fmt.Sprintf("set-header %s", config.Name))
+		case "rewrite-path":
+			if !strings.HasPrefix(config.From, "/") || !strings.HasPrefix(config.To, "/") {
+				return nil, nil, fmt.Errorf("hook %d must rewrite a path starting with / to a path starting with /", i+1)
+			}
+			hooks = append(hooks, rewritePathHook(config.From, config.To))
+			descriptions = append(descriptions, fmt.Sprintf("rewrite-path %s -> %s", config.From, config.To))
+		case "basic-auth":
+			if config.Username == "" {
+				return nil, nil, fmt.Errorf("hook %d has no username", i+1)
+			}
+			if config.Realm == "" {
+				config.Realm = "go-lambda-gateway"
+			}
+			hooks = append(hooks, basicAuthHook(config.Username, config.Password, config.Realm))
+			descriptions = append(descriptions, fmt.Sprintf("basic-auth %s", config.Username))
+		default:
+			return nil, nil, fmt.Errorf("hook %d has an unsupported type %q (must be set-header, rewrite-path or basic-auth)", i+1, config.Type)
+		}
+	}
+	return hooks, descriptions, nil
+}
+
+// setHeaderHook sets a header in the event, replacing the client's value.
+func setHeaderHook(name, value string) RequestHook {
+	return func(r *http.Request, event *events.APIGatewayProxyRequest) *events.APIGatewayProxyResponse {
+		for key := range event.Headers {
+			if strings.EqualFold(key, name) {
+				delete(event.Headers, key)
+				delete(event.MultiValueHeaders, key)
+			}
+		}
+		event.Headers[name] = value
+		event.MultiValueHeaders[name] = []string{value}
+		return nil
+	}
+}
+
+// rewritePathHook replaces a path prefix in the event. The route and the
+// resource are still chosen with the original path.
+func rewritePathHook(from, to string) RequestHook {
+	from = strings.TrimSuffix(from, "/")
+	return func(r *http.Request, event *events.APIGatewayProxyRequest) *events.APIGatewayProxyResponse {
+		rest := strings.TrimPrefix(event.Path, from)
+		if from != "" && (rest == event.Path || rest != "" && !strings.HasPrefix(rest, "/")) {
+			return nil
+		}
+		path := strings.TrimSuffix(to, "/") + rest
+		if path == "" {
+			path = "/"
+		}
+		event.Path = path
+		event.RequestContext.Path = "/" + stage + path
+		if strings.HasSuffix(event.Resource, "/{proxy+}") {
+			if template, params, ok := proxyResource(path); ok {
+				event.Resource, event.PathParameters = template, params
+				event.RequestContext.ResourcePath = template
+			}
+		}
+		return nil
+	}
+}
+
+// basicAuthHook responds with a 401 unless the request has the credentials.
+func basicAuthHook(username, password, realm string) RequestHook {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	return func(r *http.Request, event *events.APIGatewayProxyRequest) *events.APIGatewayProxyResponse {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1 {
+			return nil
+		}
+		return &events.APIGatewayProxyResponse{
+			StatusCode: http.StatusUnauthorized,
+			Headers: map[string]string{
+				"Content-Type":     "application/json",
+				"WWW-Authenticate": fmt.Sprintf("Basic realm=%q", realm),
+			},
+			Body: `{"message":"Unauthorized"}`,
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultHopByHopHeaders are the headers of a single connection, which API
+// Gateway doesn't forward to the lambda or to the client.
+var defaultHopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// hopByHopHeaders are the default hop-by-hop headers and the ones from
+// HOP_BY_HOP_HEADERS.
+var hopByHopHeaders = defaultHopByHopHeaders
+
+// removeHopByHopHeaders removes the hop-by-hop headers, and the headers that
+// are named in the Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
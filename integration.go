@@ -0,0 +1,360 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// integration is a route that uses a Lambda (non-proxy) integration: the event
+// is built from the request with a request template, and the HTTP response is
+// built from the lambda's result with a response template. Lambda errors are
+// mapped to responses by matching their errorMessage against the selection
+// patterns, like integration responses in API Gateway.
+//
+// The templates are Go text/templates rather than VTL. See README.md for the
+// helpers that are available.
+type integration struct {
+	method          string
+	resource        *resource
+	requestTemplate *template.Template
+	responses       []*integrationResponse
+	defaultResponse *integrationResponse
+}
+
+type integrationResponse struct {
+	pattern    *regexp.Regexp
+	statusCode int
+	headers    map[string]string
+	template   *template.Template
+}
+
+// loadIntegrationsFile reads a JSON array of integrations, e.g.
+// [{"method": "POST", "path": "/users/{id}", "requestTemplate": "...",
+// "responseTemplate": "...", "responses": [{"pattern": ".*not found.*",
+// "statusCode": 404, "template": "..."}]}].
+func loadIntegrationsFile(path string) ([]*integration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	type responseConfig struct {
+		Pattern    string            `json:"pattern"`
+		StatusCode int               `json:"statusCode"`
+		Headers    map[string]string `json:"headers"`
+		Template   string            `json:"template"`
+	}
+	var configs []struct {
+		Method           string            `json:"method"`
+		Path             string            `json:"path"`
+		RequestTemplate  string            `json:"requestTemplate"`
+		ResponseTemplate string            `json:"responseTemplate"`
+		Headers          map[string]string `json:"headers"`
+		Responses        []responseConfig  `json:"responses"`
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+
+	parseResponse := func(name string, config responseConfig) (*integrationResponse, error) {
+		response := &integrationResponse{
+			statusCode: config.StatusCode,
+			headers:    config.Headers,
+		}
+		if response.statusCode == 0 {
+			response.statusCode = http.StatusOK
+		}
+		if config.Pattern != "" {
+			// Selection patterns have to match the whole error message
+			response.pattern, err = regexp.Compile(`^(?s:` + config.Pattern + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern for %s: %v", name, err)
+			}
+		}
+		if config.Template != "" {
+			response.template, err = parseIntegrationTemplate(name, config.Template)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return response, nil
+	}
+
+	var parsed []*integration
+	for _, config := range configs {
+		resources, err := parseResources(config.Path)
+		if err != nil {
+			return nil, err
+		}
+		if len(resources) != 1 {
+			return nil, fmt.Errorf("invalid integration path %q", config.Path)
+		}
+		integ := &integration{
+			method:   strings.ToUpper(config.Method),
+			resource: resources[0],
+		}
+		if integ.method == "" {
+			integ.method = "ANY"
+		}
+		if config.RequestTemplate != "" {
+			integ.requestTemplate, err = parseIntegrationTemplate(config.Path, config.RequestTemplate)
+			if err != nil {
+				return nil, err
+			}
+		}
+		integ.defaultResponse, err = parseResponse(config.Path, responseConfig{
+			Headers:  config.Headers,
+			Template: config.ResponseTemplate,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, responseConfig := range config.Responses {
+			response, err := parseResponse(config.Path, responseConfig)
+			if err != nil {
+				return nil, err
+			}
+			if response.pattern == nil {
+				return nil, fmt.Errorf("integration response for %s has no pattern", config.Path)
+			}
+			integ.responses = append(integ.responses, response)
+		}
+		parsed = append(parsed, integ)
+	}
+	return parsed, nil
+}
+
+func parseIntegrationTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(templateFuncs(nil, nil)).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template for %s: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// matchIntegration returns the integration for the request, or nil if the
+// request uses the proxy integration.
+func (c *reloadableConfig) matchIntegration(r *http.Request) *integration {
+	for _, integ := range c.integrations {
+		if integ.method != "ANY" && integ.method != r.Method {
+			continue
+		}
+		if _, _, ok := integ.resource.match(r.URL.EscapedPath()); ok {
+			return integ
+		}
+	}
+	return nil
+}
+
+func handleIntegrationRequest(inv *invocation, integ *integration, r *http.Request, body []byte) (*events.APIGatewayProxyResponse, error) {
+	params, _, _ := integ.resource.match(r.URL.EscapedPath())
+	request := newProxyRequest(inv, r, body)
+	request.Resource = integ.resource.template
+	request.PathParameters = params
+	request.RequestContext.ResourcePath = integ.resource.template
+	if response, err := runRequestHooks(inv, r, request); response != nil || err != nil {
+		return response, err
+	}
+
+	// Without a request template, the body is passed through as is
+	payload := body
+	if integ.requestTemplate != nil {
+		var err error
+		payload, err = executeIntegrationTemplate(integ.requestTemplate, request, body)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering request template: %v", err)
+		}
+	}
+	if len(bytes.TrimSpace(payload)) == 0 {
+		payload = []byte("{}")
+	}
+
+	responsePayload, err := invokeLambda(inv, payload)
+	response := integ.defaultResponse
+	var lambdaErr *lambdaError
+	if errors.As(err, &lambdaErr) {
+		// Errors that don't match a pattern use the default response, just
+		// like in API Gateway
+		for _, errorResponse := range integ.responses {
+			if errorResponse.pattern.MatchString(lambdaErr.err.Message) {
+				response = errorResponse
+				break
+			}
+		}
+		responsePayload, _ = json.Marshal(map[string]interface{}{
+			"errorMessage": lambdaErr.err.Message,
+			"errorType":    lambdaErr.err.Type,
+		})
+	} else if err != nil {
+		return nil, err
+	}
+
+	responseBody := responsePayload
+	if response.template != nil {
+		responseBody, err = executeIntegrationTemplate(response.template, request, responsePayload)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering response template: %v", err)
+		}
+	}
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+	for key, value := range response.headers {
+		headers[key] = value
+	}
+	return &events.APIGatewayProxyResponse{
+		StatusCode: response.statusCode,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+func executeIntegrationTemplate(tmpl *template.Template, request *events.APIGatewayProxyRequest, input []byte) ([]byte, error) {
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Funcs(templateFuncs(request, input))
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"body":           string(input),
+		"path":           request.PathParameters,
+		"query":          request.QueryStringParameters,
+		"header":         request.Headers,
+		"stageVariables": request.StageVariables,
+		"context":        request.RequestContext,
+	})
+	return buf.Bytes(), err
+}
+
+// templateFuncs returns the helpers that correspond to VTL's $input and $util
+// variables. input is the request body in request templates, and the lambda's
+// result in response templates.
+func templateFuncs(request *events.APIGatewayProxyRequest, input []byte) template.FuncMap {
+	var parsed interface{}
+	if input != nil {
+		json.Unmarshal(input, &parsed)
+	}
+	return template.FuncMap{
+		// inputJSON "$.user.name" is $input.json('$.user.name')
+		"inputJSON": func(path string) (string, error) {
+			v, err := evalJSONPath(parsed, path)
+			if err != nil {
+				return "", err
+			}
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+		// inputPath "$.items" is $input.path('$.items')
+		"inputPath": func(path string) (interface{}, error) {
+			return evalJSONPath(parsed, path)
+		},
+		// inputParams "name" is $input.params('name'), which looks in the path
+		// parameters, the query string and the headers, in that order
+		"inputParams": func(name string) string {
+			if request == nil {
+				return ""
+			}
+			if v, ok := request.PathParameters[name]; ok {
+				return v
+			}
+			if v, ok := request.QueryStringParameters[name]; ok {
+				return v
+			}
+			for key, v := range request.Headers {
+				if strings.EqualFold(key, name) {
+					return v
+				}
+			}
+			return ""
+		},
+		"escapeJavaScript": escapeJavaScript,
+		"urlEncode":        url.QueryEscape,
+		"urlDecode":        url.QueryUnescape,
+		"base64Encode": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"base64Decode": func(s string) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(s)
+			return string(data), err
+		},
+		"parseJSON": func(s string) (interface{}, error) {
+			var v interface{}
+			err := json.Unmarshal([]byte(s), &v)
+			return v, err
+		},
+		"toJSON": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}
+}
+
+// escapeJavaScript is $util.escapeJavaScript, which escapes the string so it
+// can be used inside a JSON string.
+func escapeJavaScript(s string) string {
+	data, _ := json.Marshal(s)
+	return strings.ReplaceAll(string(data[1:len(data)-1]), "'", `\'`)
+}
+
+// evalJSONPath evaluates the subset of JSONPath that is commonly used in
+// mapping templates: $, .key, ['key'] and [index].
+func evalJSONPath(v interface{}, path string) (interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid JSONPath %q", path)
+	}
+	rest := path[1:]
+	for rest != "" {
+		var key string
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key, rest = rest[1:end+1], rest[end+1:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			key, rest = rest[2:end], rest[end+2:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			rest = rest[end+1:]
+			list, ok := v.([]interface{})
+			if !ok || index < 0 || index >= len(list) {
+				return nil, nil
+			}
+			v = list[index]
+			continue
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q", path)
+		}
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		v = object[key]
+	}
+	return v, nil
+}
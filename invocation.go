@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// invocation holds the values that identify a single request as it passes
+// through the gateway. They are sent to the lambda alongside the event.
+type invocation struct {
+	requestID             string
+	traceID               string
+	clientContext         []byte
+	cognitoIdentityID     string
+	cognitoIdentityPoolID string
+	stageVariables        map[string]string
+	authorizer            map[string]interface{}
+	apiKey                *apiKey
+	jwt                   *events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription
+	config                *reloadableConfig
+	route                 *route
+	span                  *span
+	invokeSpan            *span
+	invokeDuration        time.Duration
+	phases                requestPhases
+	errorType             string
+	gatewayError          *gatewayError
+	recording             *recording
+	invocationType        string
+	chaosFault            chaosFault
+
+	// ctx is the request's context, so that the gateway stops waiting for
+	// the lambda when the client goes away. It is nil for invocations that
+	// aren't made for a client, like async invocations.
+	ctx context.Context
+}
+
+// newInvocation assigns the request a request id and a trace id. A trace id
+// that is generated here is also added to the request headers, since API
+// Gateway adds the X-Amzn-Trace-Id header before the event reaches the
+// lambda. An error is returned if the request has an invalid client context.
+func newInvocation(r *http.Request) (*invocation, error) {
+	// The request uses the config that is current when it arrives, even if
+	// the config is reloaded while it is in flight
+	config := currentConfig.Load()
+
+	requestID := ""
+	if trustRequestIDHeader {
+		requestID = r.Header.Get("X-Request-Id")
+	}
+	if requestID == "" {
+		requestID = newUUID()
+	}
+
+	// A generated X-Ray trace id uses the same id as the OpenTelemetry trace
+	var span *span
+	if tracer != nil {
+		span = startServerSpan(r)
+	}
+	traceID := r.Header.Get("X-Amzn-Trace-Id")
+	if traceID == "" && !disableTraceID {
+		if span != nil {
+			traceID = span.xrayTraceID()
+		} else {
+			traceID = newTraceID()
+		}
+		r.Header.Set("X-Amzn-Trace-Id", traceID)
+	}
+
+	clientContext := staticClientContext
+	if header := r.Header.Get("X-Amz-Client-Context"); header != "" {
+		var err error
+		clientContext, err = base64.StdEncoding.DecodeString(header)
+		if err != nil {
+			return nil, errors.New("X-Amz-Client-Context must be base64-encoded")
+		}
+		if !json.Valid(clientContext) {
+			return nil, errors.New("X-Amz-Client-Context must be base64-encoded JSON")
+		}
+	}
+
+	// The configured Cognito identity can be overridden per request
+	cognitoIdentityID := staticIdentity.CognitoIdentityID
+	if header := r.Header.Get("X-Local-Cognito-Identity-Id"); header != "" {
+		cognitoIdentityID = header
+	}
+	cognitoIdentityPoolID := staticIdentity.CognitoIdentityPoolID
+	if header := r.Header.Get("X-Local-Cognito-Identity-Pool-Id"); header != "" {
+		cognitoIdentityPoolID = header
+	}
+
+	// Stage variables can be set or overridden per request with
+	// X-Local-Stage-Var: key=value headers
+	stageVariables := config.stageVariables
+	if values := r.Header.Values("X-Local-Stage-Var"); len(values) > 0 {
+		stageVariables = map[string]string{}
+		for key, value := range config.stageVariables {
+			stageVariables[key] = value
+		}
+		for _, header := range values {
+			key, value, ok := strings.Cut(header, "=")
+			if !ok || key == "" {
+				return nil, errors.New("X-Local-Stage-Var must be key=value")
+			}
+			stageVariables[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	return &invocation{
+		requestID:             requestID,
+		traceID:               traceID,
+		clientContext:         clientContext,
+		cognitoIdentityID:     cognitoIdentityID,
+		cognitoIdentityPoolID: cognitoIdentityPoolID,
+		stageVariables:        stageVariables,
+		config:                config,
+		span:                  span,
+	}, nil
+}
+
+// newTraceID returns an X-Ray trace id in the format used by the
+// X-Amzn-Trace-Id header: the epoch time in hex followed by 96 random bits.
+func newTraceID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("Root=1-%08x-%x", time.Now().Unix(), b)
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
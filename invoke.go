@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// runInvoke implements the invoke subcommand, which sends an event file to
+// the lambda as is and prints the response. It returns the exit code: 1 if
+// the lambda returned an error or couldn't be invoked.
+func runInvoke(args []string) int {
+	fs := flag.NewFlagSet("invoke", flag.ExitOnError)
+	eventFile := fs.String("event", "", "file with the event to send, or - to read it from stdin")
+	lambdaHost := fs.String("lambda-host", "", "address of the lambda's RPC server (default $LAMBDA_HOST or localhost:8001)")
+	timeout := fs.Duration("timeout", 30*time.Second, "the lambda's timeout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-lambda-gateway invoke --event FILE [flags]\n\n")
+		fmt.Fprintf(os.Stderr, "Invokes the lambda with the event in FILE and prints the response.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *eventFile == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	if *lambdaHost == "" {
+		*lambdaHost = os.Getenv("LAMBDA_HOST")
+		if *lambdaHost == "" {
+			*lambdaHost = "localhost:8001"
+		}
+	}
+
+	var event []byte
+	var err error
+	if *eventFile == "-" {
+		event, err = io.ReadAll(os.Stdin)
+	} else {
+		event, err = os.ReadFile(*eventFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading the event: %v\n", err)
+		return 2
+	}
+
+	deadline := time.Now().Add(*timeout)
+	invokeRequest := &messages.InvokeRequest{
+		Payload:   event,
+		RequestId: newUUID(),
+		Deadline: messages.InvokeRequest_Timestamp{
+			Seconds: deadline.Unix(),
+			Nanos:   int64(deadline.Nanosecond()),
+		},
+	}
+	var invokeResponse messages.InvokeResponse
+	_, err = newRPCPool(*lambdaHost, 1, 0).invoke(context.Background(), invokeRequest, &invokeResponse, deadline)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error invoking the lambda: %v\n", err)
+		return 1
+	}
+	if invokeResponse.Error != nil {
+		e := &lambdaError{invokeResponse.Error}
+		fmt.Fprintf(os.Stderr, "%s\n%s", e, e.stackTrace())
+		return 1
+	}
+
+	var out bytes.Buffer
+	if json.Indent(&out, invokeResponse.Payload, "", "  ") != nil {
+		out.Reset()
+		out.Write(invokeResponse.Payload)
+	}
+	fmt.Println(out.String())
+	return 0
+}
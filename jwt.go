@@ -0,0 +1,302 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The JWT authorizer validates bearer tokens like HTTP APIs' built-in JWT
+// authorizer. Tokens are verified with the keys from jwtJWKSURL, or with
+// jwtSecret for HMAC-signed tokens. In insecure mode, the claims are decoded
+// without any validation.
+var jwtAuthorizer bool
+var jwtIssuer string
+var jwtAudience []string
+var jwtJWKSURL string
+var jwtSecret []byte
+var jwtInsecure bool
+
+var jwks = struct {
+	sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}{}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// authorizeJWT validates the bearer token in the Authorization header and
+// stores its claims and scopes in the invocation.
+func authorizeJWT(inv *invocation, r *http.Request) error {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return errors.New("missing Authorization header")
+	}
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = token[7:]
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("token is not a JWT")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid token header: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("invalid token claims: %v", err)
+	}
+
+	if !jwtInsecure {
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return errors.New("invalid token signature")
+		}
+		if err := verifyJWTSignature(header, parts[0]+"."+parts[1], signature); err != nil {
+			return err
+		}
+		if err := validateJWTClaims(claims); err != nil {
+			return err
+		}
+	}
+
+	inv.jwt = &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+		Claims: map[string]string{},
+	}
+	for key, value := range claims {
+		inv.jwt.Claims[key] = jwtClaimString(value)
+	}
+	// Scopes are read from the scope claim, or from scp which some identity
+	// providers use instead
+	if scope, ok := claims["scope"].(string); ok {
+		inv.jwt.Scopes = strings.Fields(scope)
+	} else if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			inv.jwt.Scopes = append(inv.jwt.Scopes, jwtClaimString(s))
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtClaimString formats a claim value the way HTTP APIs pass it to the
+// lambda. Arrays become space-separated lists in square brackets.
+func jwtClaimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = jwtClaimString(item)
+		}
+		return "[" + strings.Join(values, " ") + "]"
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
+
+func verifyJWTSignature(header jwtHeader, signed string, signature []byte) error {
+	cryptoHash, ok := map[string]crypto.Hash{
+		"256": crypto.SHA256,
+		"384": crypto.SHA384,
+		"512": crypto.SHA512,
+	}[strings.TrimLeft(header.Alg, "HRESP")]
+	if !ok || len(header.Alg) != 5 {
+		return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	if strings.HasPrefix(header.Alg, "HS") {
+		if jwtSecret == nil {
+			return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+		}
+		mac := hmac.New(cryptoHash.New, jwtSecret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+
+	if jwtJWKSURL == "" {
+		return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	key, err := jwksKey(header.Kid)
+	if err != nil {
+		return err
+	}
+	h := cryptoHash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(header.Alg, "RS") {
+			err = rsa.VerifyPKCS1v15(key, cryptoHash, digest, signature)
+		} else if strings.HasPrefix(header.Alg, "PS") {
+			err = rsa.VerifyPSS(key, cryptoHash, digest, signature, nil)
+		} else {
+			err = errors.New("algorithm does not match key")
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(header.Alg, "ES") || len(signature) != 2*size {
+			err = errors.New("algorithm does not match key")
+		} else if !ecdsa.Verify(key, digest, new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			err = errors.New("verification failed")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid token signature: %v", err)
+	}
+	return nil
+}
+
+func validateJWTClaims(claims map[string]interface{}) error {
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); !ok {
+		return errors.New("token has no exp claim")
+	} else if now >= exp {
+		return errors.New("the token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return errors.New("the token is not valid yet")
+	}
+	if jwtIssuer != "" && claims["iss"] != jwtIssuer {
+		return errors.New("the token has an invalid issuer")
+	}
+
+	// Like HTTP APIs, the audience is matched against the aud claim, or the
+	// client_id claim if the token has no aud claim
+	if len(jwtAudience) > 0 {
+		var audiences []interface{}
+		switch aud := claims["aud"].(type) {
+		case string:
+			audiences = []interface{}{aud}
+		case []interface{}:
+			audiences = aud
+		case nil:
+			audiences = []interface{}{claims["client_id"]}
+		}
+		for _, aud := range audiences {
+			for _, allowed := range jwtAudience {
+				if aud == allowed {
+					return nil
+				}
+			}
+		}
+		return errors.New("the token has an invalid audience")
+	}
+	return nil
+}
+
+// jwksKey returns the public key with the key id. The keys are fetched the
+// first time they are needed, and fetched again (at most every 30 seconds)
+// when a token is signed with an unknown key.
+func jwksKey(kid string) (crypto.PublicKey, error) {
+	jwks.Lock()
+	defer jwks.Unlock()
+	if key, ok := jwks.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(jwks.fetched) < 30*time.Second {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keys, err := fetchJWKS(jwtJWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %v", err)
+	}
+	jwks.keys = keys
+	jwks.fetched = time.Now()
+	if key, ok := jwks.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			curve := map[string]elliptic.Curve{
+				"P-256": elliptic.P256(),
+				"P-384": elliptic.P384(),
+				"P-521": elliptic.P521(),
+			}[k.Crv]
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
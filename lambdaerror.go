@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// lambdaError is returned when the lambda handler returned an error (or
+// panicked).
+type lambdaError struct {
+	err *messages.InvokeResponse_Error
+}
+
+func (e *lambdaError) Error() string {
+	return fmt.Sprintf("%s: %s", e.err.Type, e.err.Message)
+}
+
+// errorType classifies an invocation error for logs and traces. Errors
+// returned by the lambda use their errorType.
+func errorType(err error) string {
+	var lambdaErr *lambdaError
+	var dialErr *dialError
+	var circuitErr *circuitOpenError
+	var buildErr *buildError
+	var credentialsErr *awsCredentialsError
+	if errors.As(err, &lambdaErr) {
+		return lambdaErr.err.Type
+	} else if errors.As(err, &dialErr) {
+		return "dial_error"
+	} else if errors.As(err, &circuitErr) {
+		return "circuit_open"
+	} else if errors.As(err, &buildErr) {
+		return "build_failed"
+	} else if errors.As(err, &credentialsErr) {
+		return "aws_credentials"
+	} else if errors.Is(err, errThrottled) {
+		return "throttled"
+	} else if errors.Is(err, errDeadlineExceeded) || errors.Is(err, errIntegrationTimeout) {
+		return "timeout"
+	} else if errors.Is(err, errClientCancelled) {
+		return "client_cancelled"
+	}
+	return "_OTHER"
+}
+
+// stackTrace formats the stack frames, one per line.
+func (e *lambdaError) stackTrace() string {
+	var b strings.Builder
+	for _, frame := range e.err.StackTrace {
+		if frame.Path == "" {
+			// Runtimes other than Go only have a line of text
+			fmt.Fprintf(&b, "\t%s\n", frame.Label)
+		} else {
+			fmt.Fprintf(&b, "\t%s:%d %s\n", frame.Path, frame.Line, frame.Label)
+		}
+	}
+	return b.String()
+}
+
+var devErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Type}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>{{.Type}}</h1>
+<p>{{.Message}}</p>
+{{if .StackTrace}}<pre>{{range .StackTrace}}{{.Path}}:{{.Line}} {{.Label}}
+{{end}}</pre>{{end}}
+</body>
+</html>
+`))
+
+// writeDevError writes a response describing the lambda error, as HTML for
+// browsers and as JSON otherwise.
+func writeDevError(w http.ResponseWriter, r *http.Request, e *lambdaError) {
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		devErrorTemplate.Execute(w, e.err)
+		return
+	}
+
+	body, _ := json.MarshalIndent(e.err, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write(body)
+}
@@ -0,0 +1,220 @@
+package gateway
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gatewayMetrics collects the metrics served at /_gateway/metrics in the
+// Prometheus text format. It is nil when METRICS is not set, so the gateway
+// doesn't collect anything in that case.
+var gatewayMetrics *metrics
+
+// latencyBuckets are the upper bounds of the latency histograms, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metrics struct {
+	requests        *metricVec
+	requestDuration *metricVec
+	invokeDuration  *metricVec
+	base64Requests  *metricVec
+	lambdaErrors    *metricVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		requests:        newMetricVec("lambda_gateway_requests_total", "counter", "Requests handled by the gateway.", "method", "route", "status"),
+		requestDuration: newMetricVec("lambda_gateway_request_duration_seconds", "histogram", "Time to handle a request, from receiving it to writing the response.", "route"),
+		invokeDuration:  newMetricVec("lambda_gateway_invoke_duration_seconds", "histogram", "Time spent invoking the lambda.", "lambda_host"),
+		base64Requests:  newMetricVec("lambda_gateway_base64_requests_total", "counter", "Requests with a binary body that was base64-encoded in the event."),
+		lambdaErrors:    newMetricVec("lambda_gateway_lambda_errors_total", "counter", "Errors returned by the lambda, by error type.", "error_type"),
+	}
+	// Metrics without labels are reported from the start
+	m.base64Requests.get(nil)
+	return m
+}
+
+// metricVec is a metric with a series for every combination of label values.
+type metricVec struct {
+	name   string
+	typ    string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // counters
+	buckets     []uint64 // histograms, not cumulative
+	sum         float64
+	count       uint64
+}
+
+func newMetricVec(name string, typ string, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		typ:    typ,
+		help:   help,
+		labels: labels,
+		series: map[string]*series{},
+	}
+}
+
+func (m *metricVec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &series{labelValues: labelValues}
+		if m.typ == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value++
+}
+
+func (m *metricVec) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+			continue
+		}
+		bucketLabels := append(append([]string{}, m.labels...), "le")
+		bucketValues := append(append([]string{}, s.labelValues...), "")
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += s.buckets[i]
+			bucketValues[len(bucketValues)-1] = formatFloat(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(bucketLabels, bucketValues), cumulative)
+		}
+		bucketValues[len(bucketValues)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(bucketLabels, bucketValues), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// routeLabel identifies the route that handled a request in the metrics.
+func routeLabel(rt *route) string {
+	if rt == nil {
+		return ""
+	} else if rt == mockRoute {
+		return "mock"
+	} else if rt == staticRoute {
+		return "static"
+	} else if rt.resource != nil {
+		return rt.method + " " + rt.resource.template
+	} else if rt.host != "" {
+		return rt.host
+	} else if rt.prefix == "" {
+		return "/"
+	}
+	return rt.prefix + "/*"
+}
+
+func (m *metrics) recordRequest(r *http.Request, inv *invocation, status int, start time.Time) {
+	var rt *route
+	if inv != nil {
+		rt = inv.route
+	}
+	m.requests.inc(r.Method, routeLabel(rt), strconv.Itoa(status))
+	m.requestDuration.observe(time.Since(start).Seconds(), routeLabel(rt))
+}
+
+func (m *metrics) recordInvoke(inv *invocation, d time.Duration, err error) {
+	m.invokeDuration.observe(d.Seconds(), inv.route.lambdaHost)
+	if lambdaErr, ok := err.(*lambdaError); ok {
+		m.lambdaErrors.inc(lambdaErr.err.Type)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	gatewayMetrics.requests.write(w)
+	gatewayMetrics.requestDuration.write(w)
+	gatewayMetrics.invokeDuration.write(w)
+	gatewayMetrics.base64Requests.write(w)
+	gatewayMetrics.lambdaErrors.write(w)
+
+	fmt.Fprintf(w, "# HELP lambda_gateway_in_flight_requests Requests that are being handled.\n# TYPE lambda_gateway_in_flight_requests gauge\n")
+	fmt.Fprintf(w, "lambda_gateway_in_flight_requests %d\n", inFlightRequests.Load())
+
+	fmt.Fprintf(w, "# HELP lambda_gateway_recovered_panics_total Requests that panicked in the gateway.\n# TYPE lambda_gateway_recovered_panics_total counter\n")
+	fmt.Fprintf(w, "lambda_gateway_recovered_panics_total %d\n", recoveredPanics.Load())
+
+	fmt.Fprintf(w, "# HELP lambda_gateway_cancelled_requests_total Requests that the client cancelled while the lambda was invoked.\n# TYPE lambda_gateway_cancelled_requests_total counter\n")
+	fmt.Fprintf(w, "lambda_gateway_cancelled_requests_total %d\n", cancelledRequests.Load())
+
+	fmt.Fprintf(w, "# HELP lambda_gateway_rpc_connections Connections to the lambda, by state.\n# TYPE lambda_gateway_rpc_connections gauge\n")
+	pools.Lock()
+	hosts := make([]string, 0, len(pools.byHost))
+	for host := range pools.byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		p := pools.byHost[host]
+		fmt.Fprintf(w, "lambda_gateway_rpc_connections%s %d\n", formatLabels([]string{"lambda_host", "state"}, []string{host, "busy"}), len(p.slots))
+		fmt.Fprintf(w, "lambda_gateway_rpc_connections%s %d\n", formatLabels([]string{"lambda_host", "state"}, []string{host, "idle"}), len(p.idle))
+	}
+	pools.Unlock()
+}
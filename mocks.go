@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// mock is a route that is answered by the gateway without invoking a lambda,
+// like a MOCK integration. The body is a text/template that can use the path
+// parameters, query string parameters and headers of the request, e.g.
+// {"version": "{{.query.v}}", "id": "{{.path.id}}"}.
+type mock struct {
+	method     string
+	resource   *resource
+	statusCode int
+	headers    map[string]string
+	body       *template.Template
+}
+
+// mockRoute is used in the access log for requests answered by a mock.
+var mockRoute = &route{
+	lambdaHost: "mock",
+}
+
+// loadMocksFile reads a JSON array of mocks, e.g. [{"method": "GET", "path":
+// "/ping", "statusCode": 200, "headers": {"Content-Type": "application/json"},
+// "body": "{\"ok\": true}"}]. The method defaults to ANY and the status code
+// to 200.
+func loadMocksFile(path string) ([]*mock, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []struct {
+		Method     string            `json:"method"`
+		Path       string            `json:"path"`
+		StatusCode int               `json:"statusCode"`
+		Headers    map[string]string `json:"headers"`
+		Body       string            `json:"body"`
+	}
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+
+	var parsed []*mock
+	for _, config := range configs {
+		resources, err := parseResources(config.Path)
+		if err != nil {
+			return nil, err
+		}
+		if len(resources) != 1 {
+			return nil, fmt.Errorf("invalid mock path %q", config.Path)
+		}
+		body, err := template.New(config.Path).Option("missingkey=zero").Parse(config.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body for mock %s: %v", config.Path, err)
+		}
+		m := &mock{
+			method:     strings.ToUpper(config.Method),
+			resource:   resources[0],
+			statusCode: config.StatusCode,
+			headers:    config.Headers,
+			body:       body,
+		}
+		if m.method == "" {
+			m.method = "ANY"
+		}
+		if m.statusCode == 0 {
+			m.statusCode = http.StatusOK
+		}
+		parsed = append(parsed, m)
+	}
+	return parsed, nil
+}
+
+// matchMock returns the mock response for the request, or nil if there is no
+// matching mock. Mocks are matched in the order they are defined.
+func (c *reloadableConfig) matchMock(r *http.Request) (*events.APIGatewayProxyResponse, error) {
+	for _, m := range c.mocks {
+		if m.method != "ANY" && m.method != r.Method {
+			continue
+		}
+		params, _, ok := m.resource.match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+
+		query := map[string]string{}
+		for key, values := range parseQuery(r.URL.RawQuery) {
+			query[key] = values[len(values)-1]
+		}
+		header := map[string]string{}
+		for key := range r.Header {
+			header[key] = r.Header.Get(key)
+		}
+		var body bytes.Buffer
+		err := m.body.Execute(&body, map[string]interface{}{
+			"path":   params,
+			"query":  query,
+			"header": header,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &events.APIGatewayProxyResponse{
+			StatusCode: m.statusCode,
+			Headers:    m.headers,
+			Body:       body.String(),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,374 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPIMethods are the operations of a path item, with the method of the
+// route they become.
+var openAPIMethods = map[string]string{
+	"get":                            "GET",
+	"put":                            "PUT",
+	"post":                           "POST",
+	"delete":                         "DELETE",
+	"options":                        "OPTIONS",
+	"head":                           "HEAD",
+	"patch":                          "PATCH",
+	"x-amazon-apigateway-any-method": "ANY",
+}
+
+// openAPIFunctionRegexp extracts the function name from the uri of a Lambda
+// integration, e.g. arn:aws:apigateway:us-east-1:lambda:path/2015-03-31/functions/arn:aws:lambda:us-east-1:123456789012:function:users/invocations.
+var openAPIFunctionRegexp = regexp.MustCompile(`:function:([^:/]+)`)
+
+// openAPIDocument is an OpenAPI 3 or Swagger 2 document, in YAML or JSON.
+type openAPIDocument struct {
+	doc     map[string]interface{}
+	swagger bool
+}
+
+// openAPIImport is what is imported from an OpenAPI document.
+type openAPIImport struct {
+	routes     []*route
+	validators []*requestValidator
+	cors       *corsConfig
+}
+
+// loadOpenAPIDocument imports the operations of an OpenAPI document. Every
+// operation gets a request validator. Operations with a Lambda integration
+// whose function has a --function-port also become routes, the other ones
+// are sent to LAMBDA_HOST.
+func loadOpenAPIDocument(path string, hosts map[string]string) (*openAPIImport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &openAPIDocument{}
+	if err := yaml.Unmarshal(data, &d.doc); err != nil {
+		return nil, err
+	}
+	_, d.swagger = d.doc["swagger"]
+	imported := &openAPIImport{
+		cors: d.parseCORS(),
+	}
+	authorizers := map[string]*routeAuthorizer{}
+
+	// Like API Gateway, the validators are named and picked for the whole
+	// document or for each operation. Documents without validators are
+	// validated completely.
+	validatorModes := map[string][2]bool{}
+	defaultMode := [2]bool{true, true}
+	if validators, ok := d.doc["x-amazon-apigateway-request-validators"].(map[string]interface{}); ok {
+		defaultMode = [2]bool{}
+		for name, v := range validators {
+			v, _ := v.(map[string]interface{})
+			validateBody, _ := v["validateRequestBody"].(bool)
+			validateParameters, _ := v["validateRequestParameters"].(bool)
+			validatorModes[name] = [2]bool{validateBody, validateParameters}
+		}
+	}
+	modeFor := func(v interface{}) ([2]bool, error) {
+		name, _ := v.(string)
+		mode, ok := validatorModes[name]
+		if !ok {
+			return mode, fmt.Errorf("unknown request validator %q", name)
+		}
+		return mode, nil
+	}
+	if v, ok := d.doc["x-amazon-apigateway-request-validator"]; ok {
+		if defaultMode, err = modeFor(v); err != nil {
+			return nil, err
+		}
+	}
+
+	paths, _ := d.doc["paths"].(map[string]interface{})
+	var templates []string
+	for template := range paths {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+
+	for _, template := range templates {
+		item, _ := paths[template].(map[string]interface{})
+		res, err := newResource(template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %s: %v", template, err)
+		}
+		var keys []string
+		for key := range item {
+			if openAPIMethods[key] != "" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			op, _ := item[key].(map[string]interface{})
+			method := openAPIMethods[key]
+
+			mode := defaultMode
+			if v, ok := op["x-amazon-apigateway-request-validator"]; ok {
+				if mode, err = modeFor(v); err != nil {
+					return nil, fmt.Errorf("%s %s: %v", method, template, err)
+				}
+			}
+			v := &requestValidator{
+				method:             method,
+				resource:           res,
+				doc:                d,
+				validateBody:       mode[0],
+				validateParameters: mode[1],
+			}
+			if err := d.parseParameters(v, item["parameters"], op["parameters"]); err != nil {
+				return nil, fmt.Errorf("%s %s: %v", method, template, err)
+			}
+			if body, ok := op["requestBody"]; ok {
+				d.parseRequestBody(v, body)
+			}
+			imported.validators = append(imported.validators, v)
+
+			if rt := d.integrationRoute(op, method, template, hosts); rt != nil {
+				rt.resource = res
+				if err := d.parseSecurity(rt, op, hosts, authorizers); err != nil {
+					return nil, fmt.Errorf("%s %s: %v", method, template, err)
+				}
+				imported.routes = append(imported.routes, rt)
+			}
+		}
+	}
+	return imported, nil
+}
+
+// parseSecurity sets the Lambda authorizer and the API key requirement of
+// an operation. The operation's security requirements override the
+// document's.
+func (d *openAPIDocument) parseSecurity(rt *route, op map[string]interface{}, hosts map[string]string, authorizers map[string]*routeAuthorizer) error {
+	security, ok := op["security"].([]interface{})
+	if !ok {
+		security, _ = d.doc["security"].([]interface{})
+	}
+	var schemes map[string]interface{}
+	if d.swagger {
+		schemes, _ = d.doc["securityDefinitions"].(map[string]interface{})
+	} else {
+		components, _ := d.doc["components"].(map[string]interface{})
+		schemes, _ = components["securitySchemes"].(map[string]interface{})
+	}
+	for _, requirement := range security {
+		requirement, _ := requirement.(map[string]interface{})
+		for name := range requirement {
+			scheme, _ := d.resolve(schemes[name]).(map[string]interface{})
+			authorizer, isAuthorizer := scheme["x-amazon-apigateway-authorizer"].(map[string]interface{})
+			if !isAuthorizer {
+				if scheme["type"] == "apiKey" && strings.EqualFold(fmt.Sprint(scheme["name"]), "x-api-key") {
+					rt.requireAPIKey = true
+				}
+				continue
+			}
+			if authorizers[name] != nil {
+				rt.authorizer = authorizers[name]
+				continue
+			}
+			authorizerType := strings.ToUpper(fmt.Sprint(authorizer["type"]))
+			if authorizerType != "TOKEN" && authorizerType != "REQUEST" {
+				fmt.Fprintf(os.Stderr, "Note: the %s authorizer %s is not imported\n", strings.ToLower(authorizerType), name)
+				continue
+			}
+			auth := &routeAuthorizer{
+				authorizerType: authorizerType,
+				header:         "Authorization",
+				ttl:            300 * time.Second,
+			}
+			if source, ok := authorizer["identitySource"].(string); ok && strings.HasPrefix(source, "method.request.header.") {
+				auth.header = strings.TrimPrefix(strings.Split(source, ",")[0], "method.request.header.")
+			}
+			if ttl, ok := authorizer["authorizerResultTtlInSeconds"].(int); ok {
+				auth.ttl = time.Duration(ttl) * time.Second
+			}
+			uri, _ := authorizer["authorizerUri"].(string)
+			function := name
+			if m := openAPIFunctionRegexp.FindStringSubmatch(uri); m != nil {
+				function = m[1]
+			}
+			host, ok := lookupFunctionHost(hosts, function, "")
+			if !ok {
+				host, ok = scheme[openAPILambdaHostExtension].(string)
+			}
+			if !ok {
+				return fmt.Errorf("no --function-port for the authorizer %s", function)
+			}
+			auth.route = &route{lambdaHost: host, function: function}
+			authorizers[name] = auth
+			rt.authorizer = auth
+		}
+	}
+	return nil
+}
+
+// parseCORS returns the CORS configuration of an HTTP API, which is used
+// unless CORS_ALLOW_ORIGINS is set.
+func (d *openAPIDocument) parseCORS() *corsConfig {
+	v, ok := d.doc["x-amazon-apigateway-cors"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	cors := &corsConfig{
+		allowOrigins:  stringsOf(v["allowOrigins"]),
+		allowMethods:  strings.Join(stringsOf(v["allowMethods"]), ","),
+		allowHeaders:  strings.Join(stringsOf(v["allowHeaders"]), ","),
+		exposeHeaders: strings.Join(stringsOf(v["exposeHeaders"]), ","),
+	}
+	cors.allowCredentials, _ = v["allowCredentials"].(bool)
+	cors.maxAge, _ = v["maxAge"].(int)
+	return cors
+}
+
+// integrationRoute returns the route of an operation with a Lambda proxy
+// integration, or nil if its requests go to LAMBDA_HOST.
+func (d *openAPIDocument) integrationRoute(op map[string]interface{}, method string, template string, hosts map[string]string) *route {
+	integ, ok := op["x-amazon-apigateway-integration"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if t, _ := integ["type"].(string); !strings.EqualFold(t, "aws_proxy") {
+		fmt.Fprintf(os.Stderr, "Note: the %s integration of %s %s is not supported, its requests go to LAMBDA_HOST\n", t, method, template)
+		return nil
+	}
+	uri, _ := integ["uri"].(string)
+	if sub, ok := integ["uri"].(map[string]interface{}); ok {
+		uri, _ = sub["Fn::Sub"].(string)
+	}
+	m := openAPIFunctionRegexp.FindStringSubmatch(uri)
+	if m == nil {
+		return nil
+	}
+	host, ok := lookupFunctionHost(hosts, m[1], "")
+	if !ok {
+		// Documents exported by the gateway have the lambda's address
+		if host, ok = op[openAPILambdaHostExtension].(string); !ok {
+			return nil
+		}
+	}
+	rt := &route{
+		method:     method,
+		lambdaHost: host,
+		function:   m[1],
+	}
+	if v, ok := integ["payloadFormatVersion"].(string); ok && eventFormat == "apigateway" {
+		rt.payloadFormat = v
+	}
+	return rt
+}
+
+// parseParameters adds the parameters of the path item and the operation,
+// which override the path item's parameters with the same name and location.
+func (d *openAPIDocument) parseParameters(v *requestValidator, lists ...interface{}) error {
+	byKey := map[string]int{}
+	for _, list := range lists {
+		list, _ := list.([]interface{})
+		for _, p := range list {
+			p, ok := d.resolve(p).(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := p["name"].(string)
+			in, _ := p["in"].(string)
+			if in == "body" {
+				// Swagger 2 describes the body as a parameter
+				v.body, _ = p["schema"].(map[string]interface{})
+				v.bodyRequired, _ = p["required"].(bool)
+				continue
+			}
+			if in != "path" && in != "query" && in != "header" {
+				continue
+			}
+			param := &openAPIParameter{name: name, in: in}
+			param.required, _ = p["required"].(bool)
+			if schema, ok := p["schema"].(map[string]interface{}); ok {
+				param.schema = schema
+			} else if d.swagger {
+				// Swagger 2 parameters are their own schema
+				param.schema = p
+			}
+			if i, ok := byKey[in+" "+name]; ok {
+				v.parameters[i] = param
+			} else {
+				byKey[in+" "+name] = len(v.parameters)
+				v.parameters = append(v.parameters, param)
+			}
+		}
+	}
+	for _, p := range v.parameters {
+		if p.in == "path" {
+			found := false
+			for _, segment := range v.resource.segments {
+				if segment == "{"+p.name+"}" || segment == "{"+p.name+"+}" {
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("path parameter %s is not in the path", p.name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseRequestBody uses the JSON schema of an OpenAPI 3 request body.
+func (d *openAPIDocument) parseRequestBody(v *requestValidator, body interface{}) {
+	b, ok := d.resolve(body).(map[string]interface{})
+	if !ok {
+		return
+	}
+	v.bodyRequired, _ = b["required"].(bool)
+	content, _ := b["content"].(map[string]interface{})
+	var mediaTypes []string
+	for mediaType := range content {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	for _, mediaType := range mediaTypes {
+		if isJSONMediaType(mediaType) {
+			m, _ := content[mediaType].(map[string]interface{})
+			v.body, _ = m["schema"].(map[string]interface{})
+			return
+		}
+	}
+}
+
+func isJSONMediaType(mediaType string) bool {
+	mediaType = strings.ToLower(strings.TrimSpace(strings.Split(mediaType, ";")[0]))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// resolve follows a local $ref, e.g. #/components/schemas/User.
+func (d *openAPIDocument) resolve(v interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#/") {
+			return v
+		}
+		var target interface{} = d.doc
+		for _, key := range strings.Split(ref[2:], "/") {
+			key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+			obj, ok := target.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			target = obj[key]
+		}
+		v = target
+	}
+	return v
+}
@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// optionsResponse answers OPTIONS requests with a 204 instead of invoking
+// the lambda, like a MOCK integration. Routes can choose otherwise with
+// ";options" and ";nooptions".
+var optionsResponse bool
+
+// optionsResponseHeaders are the headers of the OPTIONS responses.
+var optionsResponseHeaders map[string]string
+
+// optionsRoute is used in the access log for OPTIONS requests that are
+// answered by the gateway.
+var optionsRoute = &route{
+	lambdaHost: "options",
+}
+
+// answersOptions reports whether the gateway answers the route's OPTIONS
+// requests.
+func (rt *route) answersOptions() bool {
+	if rt.forwardOptions {
+		return false
+	}
+	return optionsResponse || rt.answerOptions
+}
+
+func newOptionsResponse() *events.APIGatewayProxyResponse {
+	headers := map[string]string{}
+	for key, value := range optionsResponseHeaders {
+		headers[key] = value
+	}
+	return &events.APIGatewayProxyResponse{
+		StatusCode: http.StatusNoContent,
+		Headers:    headers,
+	}
+}
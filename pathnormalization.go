@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pathNormalization is how the request paths are changed before they are
+// routed. Like API Gateway, paths are passed on exactly as they were sent by
+// default, so /users and /users/ are different paths.
+var pathNormalization struct {
+	stripTrailingSlash       bool
+	collapseDuplicateSlashes bool
+	removeDotSegments        bool
+}
+
+// parsePathNormalization parses a comma-separated list of normalizations:
+// preserve-exact, strip-trailing-slash, collapse-duplicate-slashes and
+// remove-dot-segments.
+func parsePathNormalization(s string) error {
+	pathNormalization.stripTrailingSlash = false
+	pathNormalization.collapseDuplicateSlashes = false
+	pathNormalization.removeDotSegments = false
+	for _, item := range strings.Split(s, ",") {
+		switch strings.TrimSpace(item) {
+		case "", "preserve-exact":
+		case "strip-trailing-slash":
+			pathNormalization.stripTrailingSlash = true
+		case "collapse-duplicate-slashes":
+			pathNormalization.collapseDuplicateSlashes = true
+		case "remove-dot-segments":
+			pathNormalization.removeDotSegments = true
+		default:
+			return fmt.Errorf("unsupported normalization %q (must be preserve-exact, strip-trailing-slash, collapse-duplicate-slashes or remove-dot-segments)", item)
+		}
+	}
+	return nil
+}
+
+// normalizePath returns the request with its path normalized. The escaped
+// path is normalized, so escaped slashes are kept.
+func normalizePath(r *http.Request) *http.Request {
+	n := pathNormalization
+	if !n.stripTrailingSlash && !n.collapseDuplicateSlashes && !n.removeDotSegments {
+		return r
+	}
+	escapedPath := r.URL.EscapedPath()
+	segments := strings.Split(escapedPath, "/")[1:]
+	var normalized []string
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch {
+		case segment == "" && n.collapseDuplicateSlashes && !last:
+			continue
+		case segment == "." && n.removeDotSegments:
+			if last {
+				normalized = append(normalized, "")
+			}
+			continue
+		case segment == ".." && n.removeDotSegments:
+			if len(normalized) > 0 {
+				normalized = normalized[:len(normalized)-1]
+			}
+			if last {
+				normalized = append(normalized, "")
+			}
+			continue
+		}
+		normalized = append(normalized, segment)
+	}
+	path := "/" + strings.Join(normalized, "/")
+	if n.stripTrailingSlash && path != "/" {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	if path == escapedPath {
+		return r
+	}
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return r
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = unescaped
+	u.RawPath = path
+	r2.URL = &u
+	return r2
+}
@@ -0,0 +1,56 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// parseUpstream parses the URL of a route's upstream server, e.g.
+// http://localhost:3000.
+func parseUpstream(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http:// or https:// URL", s)
+	}
+	return u, nil
+}
+
+// proxyRequest forwards the request to the route's upstream server as it was
+// received, without invoking a lambda. Bodies are streamed in both
+// directions, and upgraded connections, e.g. WebSockets, are passed through.
+func proxyRequest(w http.ResponseWriter, r *http.Request, inv *invocation) {
+	upstream := inv.route.upstream
+	if r.Header.Get("Upgrade") != "" {
+		// The upgraded connection is long-lived, so the server's timeouts
+		// don't apply to it
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, context.Canceled) {
+				cancelledRequests.Add(1)
+				w.WriteHeader(statusClientClosedRequest)
+				return
+			}
+			log.Printf("Error proxying to %s (request id %s): %v", upstream, inv.requestID, err)
+			inv.errorType = "proxy_error"
+			(&gatewayError{"INTEGRATION_FAILURE", http.StatusBadGateway, "Bad Gateway"}).write(w, inv)
+		},
+	}
+	proxy.ServeHTTP(w, inv.route.strip(r))
+}
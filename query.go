@@ -0,0 +1,31 @@
+package gateway
+
+import (
+	"net/url"
+	"strings"
+)
+
+// parseQuery parses a query string like API Gateway does. Unlike
+// url.ParseQuery, keys and values with a semicolon are kept, + is not a
+// space, and a malformed escape is passed on as it was sent. Keys without a
+// value, e.g. ?flag, have an empty value. The values of a key are in the
+// order they were sent.
+func parseQuery(rawQuery string) url.Values {
+	query := url.Values{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		key, value = unescapeQuery(key), unescapeQuery(value)
+		query[key] = append(query[key], value)
+	}
+	return query
+}
+
+func unescapeQuery(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		rawQuery string
+		want     url.Values
+	}{
+		{"", url.Values{}},
+		{"a=1", url.Values{"a": {"1"}}},
+		{"a=1&a=2&flag&b=x%2Cy", url.Values{"a": {"1", "2"}, "flag": {""}, "b": {"x,y"}}},
+		{"a=2&a=1", url.Values{"a": {"2", "1"}}},
+		{"flag=", url.Values{"flag": {""}}},
+		{"a=1;b=2", url.Values{"a": {"1;b=2"}}},
+		{"q=a+b", url.Values{"q": {"a+b"}}},
+		{"q=a%20b", url.Values{"q": {"a b"}}},
+		{"q=caf%C3%A9", url.Values{"q": {"café"}}},
+		{"q=100%", url.Values{"q": {"100%"}}},
+		{"q=%zz&r=%41", url.Values{"q": {"%zz"}, "r": {"A"}}},
+		{"a=b=c", url.Values{"a": {"b=c"}}},
+		{"a%5B%5D=1&a%5B%5D=2", url.Values{"a[]": {"1", "2"}}},
+		{"&&a=1&", url.Values{"a": {"1"}}},
+		{"=1", url.Values{"": {"1"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.rawQuery, func(t *testing.T) {
+			if got := parseQuery(test.rawQuery); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseQuery(%q) = %q, want %q", test.rawQuery, got, test.want)
+			}
+		})
+	}
+}
+
+func TestQueryEvent(t *testing.T) {
+	var payload []byte
+	lambda := startTestLambda(t, func(event []byte) (interface{}, error) {
+		payload = event
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	const rawQuery = "a=1&a=2&flag&b=x%2Cy"
+
+	t.Run("1.0", func(t *testing.T) {
+		handler := newTestGateway(t, WithLambdaHost(lambda))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+rawQuery, nil))
+		var event events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{"a": "2", "flag": "", "b": "x,y"}; !reflect.DeepEqual(event.QueryStringParameters, want) {
+			t.Errorf("got queryStringParameters %q, want %q", event.QueryStringParameters, want)
+		}
+		if want := map[string][]string{"a": {"1", "2"}, "flag": {""}, "b": {"x,y"}}; !reflect.DeepEqual(event.MultiValueQueryStringParameters, want) {
+			t.Errorf("got multiValueQueryStringParameters %q, want %q", event.MultiValueQueryStringParameters, want)
+		}
+	})
+
+	t.Run("2.0", func(t *testing.T) {
+		handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("PAYLOAD_FORMAT", "2.0"))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?"+rawQuery, nil))
+		var event events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		// Repeated keys are joined with commas, so they can't be told apart
+		// from an escaped comma
+		if want := map[string]string{"a": "1,2", "flag": "", "b": "x,y"}; !reflect.DeepEqual(event.QueryStringParameters, want) {
+			t.Errorf("got queryStringParameters %q, want %q", event.QueryStringParameters, want)
+		}
+		if event.RawQueryString != rawQuery {
+			t.Errorf("got rawQueryString %q, want %q", event.RawQueryString, rawQuery)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recorder writes the events sent to the lambda and its responses to a
+// directory, one file per request, so they can be inspected or replayed. It
+// is nil unless --record is set. Errors are logged, and never fail the
+// request.
+var recorder *trafficRecorder
+
+type trafficRecorder struct {
+	dir     string
+	maxBody int   // payloads larger than this are not recorded, 0 for no limit
+	maxSize int64 // recording stops when the files reach this size, 0 for no limit
+	written atomic.Int64
+	full    sync.Once
+}
+
+// recording is the file written for a request.
+type recording struct {
+	Time        time.Time             `json:"time"`
+	RequestID   string                `json:"requestId"`
+	Request     recordedRequest       `json:"request"`
+	Status      int                   `json:"status"`
+	DurationMs  float64               `json:"durationMs"`
+	Invocations []*recordedInvocation `json:"invocations"`
+}
+
+type recordedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	RemoteAddr string      `json:"remoteAddr"`
+	Headers    http.Header `json:"headers"`
+}
+
+// recordedInvocation is an invocation of the lambda. A request can invoke
+// more than one lambda, e.g. an authorizer before the lambda itself.
+type recordedInvocation struct {
+	LambdaHost      string          `json:"lambdaHost"`
+	Event           json.RawMessage `json:"event,omitempty"`
+	EventSkipped    bool            `json:"eventSkipped,omitempty"`
+	Response        json.RawMessage `json:"response,omitempty"`
+	ResponseSkipped bool            `json:"responseSkipped,omitempty"`
+	DurationMs      float64         `json:"durationMs"`
+	Error           string          `json:"error,omitempty"`
+	ErrorType       string          `json:"errorType,omitempty"`
+}
+
+func newTrafficRecorder(dir string, maxBody int, maxSize int64) (*trafficRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &trafficRecorder{
+		dir:     dir,
+		maxBody: maxBody,
+		maxSize: maxSize,
+	}, nil
+}
+
+// recordPayload returns the payload as JSON. Payloads that aren't JSON are
+// recorded as a string.
+func (rec *trafficRecorder) recordPayload(payload []byte) (json.RawMessage, bool) {
+	if rec.maxBody > 0 && len(payload) > rec.maxBody {
+		return nil, true
+	}
+	if json.Valid(payload) {
+		return json.RawMessage(payload), false
+	}
+	data, _ := json.Marshal(string(payload))
+	return data, false
+}
+
+func (rec *trafficRecorder) recordInvocation(inv *invocation, payload []byte, response []byte, d time.Duration, err error) {
+	if inv.recording == nil {
+		return
+	}
+	ri := &recordedInvocation{
+		LambdaHost: inv.route.lambdaHost,
+		DurationMs: milliseconds(d),
+	}
+	ri.Event, ri.EventSkipped = rec.recordPayload(payload)
+	if err != nil {
+		ri.Error = err.Error()
+		ri.ErrorType = errorType(err)
+	} else {
+		ri.Response, ri.ResponseSkipped = rec.recordPayload(response)
+	}
+	inv.recording.Invocations = append(inv.recording.Invocations, ri)
+}
+
+// write writes the recording of a request that invoked a lambda.
+func (rec *trafficRecorder) write(inv *invocation, status int, start time.Time) {
+	if inv == nil || inv.recording == nil || len(inv.recording.Invocations) == 0 {
+		return
+	}
+	inv.recording.Status = status
+	inv.recording.DurationMs = milliseconds(time.Since(start))
+	data, err := json.MarshalIndent(inv.recording, "", "  ")
+	if err != nil {
+		log.Printf("Error recording request %s: %v", inv.requestID, err)
+		return
+	}
+	if rec.maxSize > 0 && rec.written.Add(int64(len(data))) > rec.maxSize {
+		rec.full.Do(func() {
+			log.Printf("Stopped recording, the recordings in %s reached RECORD_MAX_SIZE", rec.dir)
+		})
+		return
+	}
+	name := fmt.Sprintf("%s-%s.json", start.UTC().Format("20060102T150405.000000000Z"), inv.requestID)
+	if err := os.WriteFile(filepath.Join(rec.dir, name), data, 0644); err != nil {
+		log.Printf("Error recording request %s: %v", inv.requestID, err)
+	}
+}
+
+func newRecording(r *http.Request, inv *invocation) *recording {
+	return &recording{
+		Time:      time.Now(),
+		RequestID: inv.requestID,
+		Request: recordedRequest{
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			Headers:    r.Header.Clone(),
+		},
+	}
+}
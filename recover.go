@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"log"
+	"net/http"
+	runtimedebug "runtime/debug"
+	"sync/atomic"
+)
+
+// recoveredPanics counts the requests that panicked, reported by GET /stats.
+var recoveredPanics atomic.Int64
+
+// invocationHeaders are the headers set for every request before the lambda
+// is invoked. They are kept in the response to a request that panicked.
+var invocationHeaders = []string{"x-amzn-RequestId", "X-Amzn-Trace-Id", "Traceparent"}
+
+// handlePanic handles a panic recovered while handling a request, so that it
+// only fails that request. The client gets a 502, or, if the response was
+// already started, the connection is closed. http.ErrAbortHandler is panicked
+// again.
+func handlePanic(w *statusWriter, inv *invocation, v interface{}) {
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	recoveredPanics.Add(1)
+	requestID := ""
+	if inv != nil {
+		requestID = inv.requestID
+	}
+	log.Printf("Panic while handling the request (request id %s): %v\n%s", requestID, v, runtimedebug.Stack())
+	if w.status != 0 {
+		panic(http.ErrAbortHandler)
+	}
+	header := w.Header()
+	kept := http.Header{}
+	for _, key := range invocationHeaders {
+		if values, ok := header[key]; ok {
+			kept[key] = values
+		}
+	}
+	for key := range header {
+		delete(header, key)
+	}
+	for key, values := range kept {
+		header[key] = values
+	}
+	(&gatewayError{"DEFAULT_5XX", http.StatusBadGateway, "Internal server error"}).write(w, inv)
+}
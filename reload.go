@@ -0,0 +1,330 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// reloadableConfig holds the settings that are applied again when the config
+// file changes. Each request uses the config that was current when it
+// arrived, so reloading doesn't affect requests that are in flight.
+type reloadableConfig struct {
+	routes           []*route // sorted by prefix length, longest first
+	hostRoutes       []*route
+	methodRoutes     []*route
+	validators       []*requestValidator
+	defaultRoute     *route
+	resources        []*resource
+	mocks            []*mock
+	integrations     []*integration
+	requestHooks     []RequestHook
+	gatewayResponses map[string]*gatewayResponse
+	stageVariables   map[string]string
+	cors             *corsConfig
+	settings         map[string]string
+}
+
+var currentConfig atomic.Pointer[reloadableConfig]
+
+// reloadableOptions are the options in reloadableConfig. Changes to other
+// options in the config file require a restart.
+var reloadableOptions = map[string]bool{
+	"LAMBDA_HOST":            true,
+	"LAMBDA_HOST_FALLBACK":   true,
+	"FUNCTION_NAME":          true,
+	"ROUTES":                 true,
+	"HOST_ROUTES":            true,
+	"RESOURCES":              true,
+	"SAM_TEMPLATE":           true,
+	"SERVERLESS_CONFIG":      true,
+	"OPENAPI_FILE":           true,
+	"FUNCTION_PORTS_FILE":    true,
+	"MOCKS_FILE":             true,
+	"INTEGRATIONS_FILE":      true,
+	"HOOKS_FILE":             true,
+	"GATEWAY_RESPONSES_FILE": true,
+	"STAGE_VARIABLES":        true,
+	"STAGE_VARIABLES_FILE":   true,
+	"CORS_ALLOW_ORIGINS":     true,
+	"CORS_ALLOW_METHODS":     true,
+	"CORS_ALLOW_HEADERS":     true,
+	"CORS_EXPOSE_HEADERS":    true,
+	"CORS_ALLOW_CREDENTIALS": true,
+	"CORS_MAX_AGE":           true,
+	"DISABLE_CORS":           true,
+}
+
+// stageVarFlags are the stage variables from --stage-var flags, which take
+// precedence over the config file and STAGE_VARIABLES_FILE.
+var stageVarFlags = map[string]string{}
+
+// loadReloadableConfig reads the reloadable settings. It is called at startup
+// and whenever the config file changes.
+func loadReloadableConfig() (*reloadableConfig, error) {
+	c := &reloadableConfig{
+		settings: map[string]string{},
+	}
+	for _, o := range options {
+		if v := getenv(o.env); v != "" && secretOptions[o.env] {
+			c.settings[o.env] = "(hidden)"
+		} else if v != "" {
+			c.settings[o.env] = v
+		}
+	}
+
+	// With BACKEND=aws, the default lambda is the deployed function
+	lambdaHost := getenv("LAMBDA_HOST")
+	if lambdaBackend == "aws" {
+		lambdaHost = getenv("FUNCTION_NAME")
+	} else if lambdaHost == "" {
+		lambdaHost = "localhost:8001"
+	}
+	if lambdaBackend == "aws" {
+		fmt.Fprintf(os.Stderr, "Function: %s\n", lambdaHost)
+	} else if strings.Contains(lambdaHost, ",") {
+		fmt.Fprintf(os.Stderr, "Lambda addresses (round-robin): %s\n", lambdaHost)
+	} else {
+		fmt.Fprintf(os.Stderr, "Lambda address: %s\n", lambdaHost)
+	}
+
+	var err error
+	c.routes, err = parseRoutes(getenv("ROUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ROUTES: %v", err)
+	}
+	c.routes = overrideRoutes(c.routes, adminRoutes)
+	sortRoutes(c.routes)
+	for _, rt := range c.routes {
+		strip := ""
+		if rt.stripPrefix {
+			strip = " (stripped)"
+		}
+		if rt.upstream != nil {
+			strip += " (proxy)"
+		}
+		if rt.chaos != nil {
+			strip += fmt.Sprintf(" (chaos: %v)", rt.chaos)
+		}
+		fmt.Fprintf(os.Stderr, "Route: %s/* -> %s%s\n", rt.prefix, rt.lambdaHost, strip)
+		if rt.requireAPIKey && apiKeys == nil {
+			return nil, fmt.Errorf("Route %s/* requires an API key, but no API_KEYS or API_KEYS_FILE are configured", rt.prefix)
+		}
+	}
+	c.resources, err = parseResources(getenv("RESOURCES"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RESOURCES: %v", err)
+	}
+	for _, res := range c.resources {
+		fmt.Fprintf(os.Stderr, "Resource: %s\n", res.template)
+	}
+
+	c.hostRoutes, err = parseHostRoutes(getenv("HOST_ROUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid HOST_ROUTES: %v", err)
+	}
+	for _, rt := range c.hostRoutes {
+		fmt.Fprintf(os.Stderr, "Host route: %s -> %s\n", rt.host, rt.lambdaHost)
+	}
+	var openAPICORS *corsConfig
+	samTemplate, serverlessConfig, openAPIFile := getenv("SAM_TEMPLATE"), getenv("SERVERLESS_CONFIG"), getenv("OPENAPI_FILE")
+	if samTemplate != "" || serverlessConfig != "" || openAPIFile != "" {
+		hosts, err := loadFunctionHosts()
+		if err != nil {
+			return nil, err
+		}
+		if samTemplate != "" {
+			routes, err := loadSAMTemplate(samTemplate, hosts)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading SAM_TEMPLATE: %v", err)
+			}
+			c.addMethodRoutes(routes)
+		}
+		if serverlessConfig != "" {
+			routes, err := loadServerlessConfig(serverlessConfig, hosts)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading SERVERLESS_CONFIG: %v", err)
+			}
+			c.addMethodRoutes(routes)
+		}
+		if openAPIFile != "" {
+			imported, err := loadOpenAPIDocument(openAPIFile, hosts)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading OPENAPI_FILE: %v", err)
+			}
+			c.addMethodRoutes(imported.routes)
+			c.addValidators(imported.validators)
+			openAPICORS = imported.cors
+		}
+	}
+	c.defaultRoute = newBalancedRoute(lambdaHost)
+	if fallbacks := parseFallbackRoutes(getenv("LAMBDA_HOST_FALLBACK")); len(fallbacks) > 0 {
+		for _, rt := range c.defaultRoute.targets() {
+			rt.fallbacks = fallbacks
+		}
+		c.defaultRoute.fallbacks = fallbacks
+	}
+	for _, rt := range c.allRoutes() {
+		rt.pool = poolFor(rt.lambdaHost)
+		if rt.authorizer != nil {
+			rt.authorizer.route.pool = poolFor(rt.authorizer.route.lambdaHost)
+		}
+	}
+	c.defaultRoute.pool = c.defaultRoute.targets()[0].pool
+
+	if mocksFile := getenv("MOCKS_FILE"); mocksFile != "" {
+		c.mocks, err = loadMocksFile(mocksFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading MOCKS_FILE: %v", err)
+		}
+		for _, m := range c.mocks {
+			fmt.Fprintf(os.Stderr, "Mock: %s %s -> %d\n", m.method, m.resource.template, m.statusCode)
+		}
+	}
+
+	if integrationsFile := getenv("INTEGRATIONS_FILE"); integrationsFile != "" {
+		if eventFormat != "apigateway" || payloadFormat != "1.0" {
+			return nil, fmt.Errorf("INTEGRATIONS_FILE is only supported with EVENT_FORMAT=apigateway and PAYLOAD_FORMAT=1.0")
+		}
+		c.integrations, err = loadIntegrationsFile(integrationsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading INTEGRATIONS_FILE: %v", err)
+		}
+		for _, integ := range c.integrations {
+			fmt.Fprintf(os.Stderr, "Lambda integration: %s %s\n", integ.method, integ.resource.template)
+		}
+	}
+
+	if hooksFile := getenv("HOOKS_FILE"); hooksFile != "" {
+		if eventFormat != "apigateway" || payloadFormat != "1.0" {
+			return nil, fmt.Errorf("HOOKS_FILE is only supported with EVENT_FORMAT=apigateway and PAYLOAD_FORMAT=1.0")
+		}
+		var descriptions []string
+		c.requestHooks, descriptions, err = loadHooksFile(hooksFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading HOOKS_FILE: %v", err)
+		}
+		for _, description := range descriptions {
+			fmt.Fprintf(os.Stderr, "Hook: %s\n", description)
+		}
+	}
+
+	if gatewayResponsesFile := getenv("GATEWAY_RESPONSES_FILE"); gatewayResponsesFile != "" {
+		c.gatewayResponses, err = loadGatewayResponsesFile(gatewayResponsesFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading GATEWAY_RESPONSES_FILE: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Gateway responses: %s\n", gatewayResponsesFile)
+	}
+
+	// CORS is left to the lambda unless allowed origins are configured
+	disableCORS, err := getenvBool("DISABLE_CORS")
+	if err != nil {
+		return nil, err
+	}
+	if v := getenv("CORS_ALLOW_ORIGINS"); v != "" && !disableCORS {
+		c.cors = &corsConfig{
+			allowMethods:  getenv("CORS_ALLOW_METHODS"),
+			allowHeaders:  getenv("CORS_ALLOW_HEADERS"),
+			exposeHeaders: getenv("CORS_EXPOSE_HEADERS"),
+		}
+		for _, origin := range strings.Split(v, ",") {
+			c.cors.allowOrigins = append(c.cors.allowOrigins, strings.TrimSpace(origin))
+		}
+		c.cors.allowCredentials, err = getenvBool("CORS_ALLOW_CREDENTIALS")
+		if err != nil {
+			return nil, err
+		}
+		if v := getenv("CORS_MAX_AGE"); v != "" {
+			c.cors.maxAge, err = strconv.Atoi(v)
+			if err != nil || c.cors.maxAge < 0 {
+				return nil, fmt.Errorf("Invalid CORS_MAX_AGE: %s", v)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "CORS allowed origins: %s\n", strings.Join(c.cors.allowOrigins, ", "))
+	}
+	if c.cors == nil && openAPICORS != nil && !disableCORS {
+		c.cors = openAPICORS
+		fmt.Fprintf(os.Stderr, "CORS allowed origins: %s (from OPENAPI_FILE)\n", strings.Join(c.cors.allowOrigins, ", "))
+	}
+
+	// Stage variables from the config file are overridden by
+	// STAGE_VARIABLES_FILE, which is overridden by --stage-var flags
+	for key, value := range fileStageVariables {
+		if c.stageVariables == nil {
+			c.stageVariables = map[string]string{}
+		}
+		c.stageVariables[key] = value
+	}
+	if stageVariablesFile := getenv("STAGE_VARIABLES_FILE"); stageVariablesFile != "" {
+		data, err := ioutil.ReadFile(stageVariablesFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading STAGE_VARIABLES_FILE: %v", err)
+		}
+		if err := json.Unmarshal(data, &c.stageVariables); err != nil {
+			return nil, fmt.Errorf("Error parsing STAGE_VARIABLES_FILE: %v", err)
+		}
+	}
+	for key, value := range stageVarFlags {
+		if c.stageVariables == nil {
+			c.stageVariables = map[string]string{}
+		}
+		c.stageVariables[key] = value
+	}
+	for key, value := range c.stageVariables {
+		fmt.Fprintf(os.Stderr, "Stage variable: %s=%s\n", key, value)
+	}
+
+	return c, nil
+}
+
+// watchConfigFile polls the config file and reloads the configuration when it
+// changes. If the new configuration is invalid, the gateway keeps using the
+// previous one.
+func watchConfigFile(path string) {
+	stat, _ := os.Stat(path)
+	for range time.Tick(time.Second) {
+		newStat, err := os.Stat(path)
+		if err != nil || (stat != nil && newStat.ModTime().Equal(stat.ModTime()) && newStat.Size() == stat.Size()) {
+			continue
+		}
+		stat = newStat
+
+		values, stageVariables, err := loadConfigFile(path)
+		if err != nil {
+			log.Printf("Invalid config file %s: %v (keeping the previous configuration)", path, err)
+			continue
+		}
+		// Settings that can't be reloaded keep their previous values, so that
+		// they don't take effect halfway
+		oldValues, oldStageVariables := fileValues, fileStageVariables
+		for _, o := range options {
+			if !reloadableOptions[o.env] && values[o.env] != oldValues[o.env] {
+				log.Printf("%s changed, restart the gateway to apply it", o.env)
+				if v, ok := oldValues[o.env]; ok {
+					values[o.env] = v
+				} else {
+					delete(values, o.env)
+				}
+			}
+		}
+
+		configMu.Lock()
+		fileValues, fileStageVariables = values, stageVariables
+		log.Printf("Reloading config file %s", path)
+		c, err := loadReloadableConfig()
+		if err != nil {
+			log.Printf("%v (keeping the previous configuration)", err)
+			fileValues, fileStageVariables = oldValues, oldStageVariables
+		} else {
+			currentConfig.Store(c)
+		}
+		configMu.Unlock()
+	}
+}
@@ -0,0 +1,282 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// replayResult is the outcome of replaying one recorded request.
+type replayResult struct {
+	recording *recording
+	skipped   string
+	diffs     []string
+}
+
+// runReplay implements the replay subcommand, which invokes the lambda with
+// the events recorded with --record and compares the responses with the
+// recorded ones. It returns the exit code: 1 if any response differs.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	lambdaHost := fs.String("lambda-host", "", "send every event to this lambda instead of the recorded one")
+	pathFilter := fs.String("path", "", "only replay requests with a matching path, e.g. /users/*")
+	methodFilter := fs.String("method", "", "only replay requests with one of these methods, e.g. GET,POST")
+	workers := fs.Int("workers", 1, "number of requests replayed in parallel")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for each invocation")
+	var ignoreHeaders []string
+	fs.Func("ignore-header", "don't compare this response header (can be repeated)", func(s string) error {
+		ignoreHeaders = append(ignoreHeaders, strings.ToLower(s))
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: go-lambda-gateway replay [flags] DIR\n\n")
+		fmt.Fprintf(os.Stderr, "Invokes the lambda with the events recorded with --record DIR, and reports\nthe responses that differ from the recorded ones.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *workers <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	files, err := filepath.Glob(filepath.Join(fs.Arg(0), "*.json"))
+	if err != nil || len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "No recordings found in %s\n", fs.Arg(0))
+		return 2
+	}
+	sort.Strings(files)
+
+	var recordings []*recording
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", file, err)
+			return 2
+		}
+		var rec recording
+		if err := json.Unmarshal(data, &rec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing %s: %v\n", file, err)
+			return 2
+		}
+		if *methodFilter != "" && !containsString(strings.Split(strings.ToUpper(*methodFilter), ","), rec.Request.Method) {
+			continue
+		}
+		if *pathFilter != "" {
+			u, err := url.Parse(rec.Request.URL)
+			if err != nil {
+				continue
+			}
+			if ok, _ := path.Match(*pathFilter, u.Path); !ok {
+				continue
+			}
+		}
+		recordings = append(recordings, &rec)
+	}
+
+	// Pools are created for every lambda host used in the recordings
+	pools := map[string]*rpcPool{}
+	poolFor := func(host string) *rpcPool {
+		if *lambdaHost != "" {
+			host = *lambdaHost
+		}
+		if pools[host] == nil {
+			pools[host] = newRPCPool(host, *workers, 0)
+		}
+		return pools[host]
+	}
+	for _, rec := range recordings {
+		for _, ri := range rec.Invocations {
+			poolFor(ri.LambdaHost)
+		}
+	}
+
+	results := make([]*replayResult, len(recordings))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = replay(recordings[i], poolFor, *timeout, ignoreHeaders)
+			}
+		}()
+	}
+	for i := range recordings {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	differ, skipped := 0, 0
+	for _, result := range results {
+		rec := result.recording
+		if result.skipped != "" {
+			skipped++
+			fmt.Printf("SKIP %s %s (%s): %s\n", rec.Request.Method, rec.Request.URL, rec.RequestID, result.skipped)
+		} else if len(result.diffs) > 0 {
+			differ++
+			fmt.Printf("DIFF %s %s (%s)\n", rec.Request.Method, rec.Request.URL, rec.RequestID)
+			for _, diff := range result.diffs {
+				fmt.Printf("     %s\n", diff)
+			}
+		} else {
+			fmt.Printf("OK   %s %s (%s)\n", rec.Request.Method, rec.Request.URL, rec.RequestID)
+		}
+	}
+	fmt.Printf("\n%d replayed, %d differ, %d skipped\n", len(results)-skipped, differ, skipped)
+	if differ > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replay invokes the lambda with each of the request's recorded events.
+func replay(rec *recording, poolFor func(string) *rpcPool, timeout time.Duration, ignoreHeaders []string) *replayResult {
+	result := &replayResult{recording: rec}
+	for i, ri := range rec.Invocations {
+		if ri.EventSkipped {
+			result.skipped = "the event was too large to be recorded"
+			return result
+		}
+		prefix := ""
+		if len(rec.Invocations) > 1 {
+			prefix = fmt.Sprintf("invocation %d: ", i+1)
+		}
+
+		// Recordings are indented, and payloads that aren't JSON are recorded
+		// as a string
+		var event []byte
+		var s string
+		if err := json.Unmarshal(ri.Event, &s); err == nil {
+			event = []byte(s)
+		} else {
+			var buf bytes.Buffer
+			json.Compact(&buf, ri.Event)
+			event = buf.Bytes()
+		}
+		deadline := time.Now().Add(timeout)
+		invokeRequest := &messages.InvokeRequest{
+			Payload:   event,
+			RequestId: newUUID(),
+			Deadline: messages.InvokeRequest_Timestamp{
+				Seconds: deadline.Unix(),
+				Nanos:   int64(deadline.Nanosecond()),
+			},
+		}
+		var invokeResponse messages.InvokeResponse
+		_, err := poolFor(ri.LambdaHost).invoke(context.Background(), invokeRequest, &invokeResponse, deadline)
+		if err == nil && invokeResponse.Error != nil {
+			err = &lambdaError{invokeResponse.Error}
+		}
+
+		errType := ""
+		if err != nil {
+			errType = errorType(err)
+		}
+		if errType != ri.ErrorType {
+			result.diffs = append(result.diffs, fmt.Sprintf("%serror: %q -> %q (%v)", prefix, ri.ErrorType, errType, err))
+			continue
+		}
+		if err != nil || ri.ResponseSkipped {
+			continue
+		}
+		fresh, _ := (&trafficRecorder{}).recordPayload(invokeResponse.Payload)
+		for _, diff := range diffResponses(ri.Response, fresh, ignoreHeaders) {
+			result.diffs = append(result.diffs, prefix+diff)
+		}
+	}
+	return result
+}
+
+// replayedResponse is the part of a proxy response that is compared.
+type replayedResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// diffResponses compares the status code, the headers and the body of two
+// responses. Responses that aren't proxy responses, e.g. from an authorizer,
+// are compared as a whole.
+func diffResponses(recorded, fresh json.RawMessage, ignoreHeaders []string) []string {
+	var a, b replayedResponse
+	if json.Unmarshal(recorded, &a) != nil || json.Unmarshal(fresh, &b) != nil || a.StatusCode == 0 {
+		if ha, hb := sha256.Sum256(recorded), sha256.Sum256(fresh); ha != hb {
+			return []string{fmt.Sprintf("response sha256: %x -> %x", ha[:8], hb[:8])}
+		}
+		return nil
+	}
+
+	var diffs []string
+	if a.StatusCode != b.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status: %d -> %d", a.StatusCode, b.StatusCode))
+	}
+	headersA, headersB := replayedHeaders(a), replayedHeaders(b)
+	var names []string
+	for name := range headersA {
+		names = append(names, name)
+	}
+	for name := range headersB {
+		if _, ok := headersA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if containsString(ignoreHeaders, name) {
+			continue
+		}
+		if headersA[name] != headersB[name] {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q -> %q", name, headersA[name], headersB[name]))
+		}
+	}
+	if ha, hb := replayedBodyHash(a), replayedBodyHash(b); ha != hb {
+		diffs = append(diffs, fmt.Sprintf("body sha256: %x -> %x", ha[:8], hb[:8]))
+	}
+	return diffs
+}
+
+// replayedHeaders combines headers and multiValueHeaders like the gateway
+// does, with lowercase names.
+func replayedHeaders(r replayedResponse) map[string]string {
+	values := map[string][]string{}
+	for key, vs := range r.MultiValueHeaders {
+		values[strings.ToLower(key)] = append(values[strings.ToLower(key)], vs...)
+	}
+	for key, v := range r.Headers {
+		if !containsString(values[strings.ToLower(key)], v) {
+			values[strings.ToLower(key)] = append(values[strings.ToLower(key)], v)
+		}
+	}
+	headers := map[string]string{}
+	for key, vs := range values {
+		headers[key] = strings.Join(vs, ", ")
+	}
+	return headers
+}
+
+func replayedBodyHash(r replayedResponse) [32]byte {
+	if r.IsBase64Encoded {
+		if body, err := base64.StdEncoding.DecodeString(r.Body); err == nil {
+			return sha256.Sum256(body)
+		}
+	}
+	return sha256.Sum256([]byte(r.Body))
+}
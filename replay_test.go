@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func echoLambda(t *testing.T, prefix string) string {
+	return startTestLambda(t, func(payload []byte) (interface{}, error) {
+		var event events.APIGatewayProxyRequest
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode:        http.StatusCreated,
+			Headers:           map[string]string{"Content-Type": "text/plain"},
+			MultiValueHeaders: map[string][]string{"Set-Cookie": {"a=1", "b=2"}},
+			Body:              prefix + event.HTTPMethod + " " + event.Path + " " + event.Body,
+		}, nil
+	})
+}
+
+func TestRecordReplayRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	lambda := echoLambda(t, "")
+	handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("RECORD_DIR", dir))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/items?a=1", strings.NewReader(`{"name":"café"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 1 {
+		t.Fatalf("got %d recordings, want 1", len(files))
+	}
+
+	// The same lambda gives an identical response
+	if code := runReplay([]string{dir}); code != 0 {
+		t.Errorf("replaying against the same lambda exited with %d, want 0", code)
+	}
+	// A lambda that responds differently is reported
+	changed := echoLambda(t, "changed ")
+	if code := runReplay([]string{"--lambda-host", changed, dir}); code != 1 {
+		t.Errorf("replaying against a changed lambda exited with %d, want 1", code)
+	}
+}
@@ -0,0 +1,154 @@
+package gateway
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// resource is a route template like API Gateway's resources, e.g.
+// /users/{userId}/orders/{orderId} or /files/{path+}.
+type resource struct {
+	template string
+	segments []string
+}
+
+// parseResources parses a comma-separated list of resource templates.
+func parseResources(s string) ([]*resource, error) {
+	var parsed []*resource
+	for _, template := range strings.Split(s, ",") {
+		template = strings.TrimSpace(template)
+		if template == "" {
+			continue
+		}
+		res, err := newResource(template)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, res)
+	}
+	return parsed, nil
+}
+
+func newResource(template string) (*resource, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("invalid resource %q (must start with /)", template)
+	}
+	res := &resource{
+		template: template,
+		segments: splitPath(template),
+	}
+	for i, segment := range res.segments {
+		if strings.HasSuffix(segment, "+}") && i != len(res.segments)-1 {
+			return nil, fmt.Errorf("invalid resource %q (greedy parameters must be last)", template)
+		}
+	}
+	return res, nil
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// match matches the escaped path against the template. It returns the
+// URL-decoded path parameters, and a score for each segment that is used to
+// pick the most specific resource.
+func (res *resource) match(escapedPath string) (map[string]string, []int, bool) {
+	segments := splitPath(escapedPath)
+	params := map[string]string{}
+	var score []int
+	for i, templateSegment := range res.segments {
+		if strings.HasPrefix(templateSegment, "{") && strings.HasSuffix(templateSegment, "+}") {
+			if i >= len(segments) {
+				return nil, nil, false
+			}
+			// Greedy parameters are passed as they were sent, so an escaped
+			// slash isn't mixed up with the separators
+			value := strings.Join(segments[i:], "/")
+			if decodePath {
+				unescaped, err := url.PathUnescape(value)
+				if err != nil {
+					return nil, nil, false
+				}
+				value = unescaped
+			}
+			params[templateSegment[1:len(templateSegment)-2]] = value
+			return params, append(score, 0), true
+		}
+		if i >= len(segments) {
+			return nil, nil, false
+		}
+		if strings.HasPrefix(templateSegment, "{") && strings.HasSuffix(templateSegment, "}") {
+			value, err := url.PathUnescape(segments[i])
+			if err != nil {
+				return nil, nil, false
+			}
+			params[templateSegment[1:len(templateSegment)-1]] = value
+			score = append(score, 1)
+			continue
+		}
+		if templateSegment != segments[i] {
+			return nil, nil, false
+		}
+		score = append(score, 2)
+	}
+	if len(segments) != len(res.segments) {
+		return nil, nil, false
+	}
+	return params, score, true
+}
+
+// matchResource finds the resource for the path. Like API Gateway, exact
+// segments take precedence over path parameters, which take precedence over
+// greedy path parameters.
+func (c *reloadableConfig) matchResource(escapedPath string) (*resource, map[string]string) {
+	var best *resource
+	var bestParams map[string]string
+	var bestScore []int
+	for _, res := range c.resources {
+		params, score, ok := res.match(escapedPath)
+		if ok && (best == nil || compareScores(score, bestScore) > 0) {
+			best, bestParams, bestScore = res, params, score
+		}
+	}
+	if len(bestParams) == 0 {
+		bestParams = nil
+	}
+	return best, bestParams
+}
+
+// hasResource reports whether a request for the path has a resource, either
+// one that matches it or the greedy resource.
+func (c *reloadableConfig) hasResource(escapedPath string) bool {
+	if _, _, ok := proxyResource(escapedPath); ok {
+		return true
+	}
+	res, _ := c.matchResource(escapedPath)
+	return res != nil
+}
+
+// proxyResource returns the greedy resource for a path that doesn't match a
+// resource, like a {proxy+} resource under PROXY_BASE, or at the root if it
+// isn't set. The path is outside of the resource if ok is false.
+func proxyResource(path string) (template string, params map[string]string, ok bool) {
+	if path == proxyBase || proxyBase == "" && path == "/" {
+		return path, nil, true
+	}
+	if rest, found := strings.CutPrefix(path, proxyBase+"/"); found {
+		return proxyBase + "/{proxy+}", map[string]string{"proxy": rest}, true
+	}
+	return "", nil, false
+}
+
+func compareScores(a, b []int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] - b[i]
+		}
+	}
+	return len(a) - len(b)
+}
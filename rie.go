@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// lambdaBackend is how the gateway invokes lambdas: rpc for the Go runtime's
+// RPC server, rie for the Lambda Runtime Interface Emulator, which other
+// runtimes use in containers, or aws for functions deployed to AWS.
+var lambdaBackend = "rpc"
+
+// rieInvokePath is the path of the Invoke API served by the Runtime Interface
+// Emulator.
+const rieInvokePath = "/2015-03-31/functions/function/invocations"
+
+// rieURL returns the URL of the Invoke API for a lambda that is invoked with
+// the Runtime Interface Emulator, or "" if it uses RPC. Lambdas given as an
+// http:// or https:// URL always use the emulator, so they can be mixed with
+// Go lambdas in ROUTES.
+func rieURL(host string) string {
+	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		if u, err := url.Parse(host); err == nil && (u.Path == "" || u.Path == "/") {
+			return strings.TrimSuffix(host, "/") + rieInvokePath
+		}
+		return host
+	} else if lambdaBackend == "rie" {
+		return "http://" + host + rieInvokePath
+	}
+	return ""
+}
+
+// invoke invokes the lambda with the RPC protocol, the emulator's HTTP API or
+// the AWS Invoke API. Errors returned by the lambda are in the response in
+// every case. The gateway stops waiting for the response when ctx is done.
+// It returns how long it took to get a connection to the lambda, including
+// the wait for a free one, which isn't known for the AWS Invoke API.
+func (p *rpcPool) invoke(ctx context.Context, request *messages.InvokeRequest, response *messages.InvokeResponse, deadline time.Time) (time.Duration, error) {
+	if p.rieURL != "" {
+		var dial time.Duration
+		start := time.Now()
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) { dial = time.Since(start) },
+		})
+		err := p.invokeRIE(ctx, request, response, deadline)
+		return dial, err
+	} else if p.aws {
+		return 0, p.invokeAWS(ctx, request, response, deadline)
+	}
+	return p.call(ctx, "Function.Invoke", request, response, deadline)
+}
+
+// invokeRIE sends the event to the emulator. Responses with the
+// X-Amz-Function-Error header or a status other than 200 are errors returned
+// by the lambda.
+func (p *rpcPool) invokeRIE(ctx context.Context, request *messages.InvokeRequest, response *messages.InvokeResponse, deadline time.Time) error {
+	if err := p.acquireSlot(ctx, deadline); err != nil {
+		return err
+	}
+	defer func() { <-p.slots }()
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", p.rieURL, bytes.NewReader(request.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(request.ClientContext) > 0 {
+		req.Header.Set("X-Amz-Client-Context", base64.StdEncoding.EncodeToString(request.ClientContext))
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errDeadlineExceeded
+		} else if errors.Is(err, context.Canceled) {
+			return errClientCancelled
+		} else if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return &dialError{err}
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(resp.Body)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errDeadlineExceeded
+	} else if errors.Is(err, context.Canceled) {
+		return errClientCancelled
+	} else if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("X-Amz-Function-Error") == "" {
+		response.Payload = payload
+		return nil
+	}
+	response.Error = rieError(resp, payload)
+	return nil
+}
+
+// rieError converts an error response from the emulator.
+func rieError(resp *http.Response, payload []byte) *messages.InvokeResponse_Error {
+	errorType := resp.Header.Get("X-Amz-Function-Error")
+	if errorType == "" {
+		errorType = fmt.Sprintf("HTTP%d", resp.StatusCode)
+	}
+	invokeErr := parseErrorPayload(payload, errorType)
+	if invokeErr.Message == "" {
+		invokeErr.Message = resp.Status
+	}
+	return invokeErr
+}
+
+// parseErrorPayload converts an error payload from the Invoke API, which is
+// also what the emulator returns. The stack traces of runtimes other than Go
+// are lists of lines. Payloads that aren't JSON are used as the message, and
+// errorType is used when the payload doesn't have one.
+func parseErrorPayload(payload []byte, errorType string) *messages.InvokeResponse_Error {
+	var body struct {
+		ErrorMessage string          `json:"errorMessage"`
+		ErrorType    string          `json:"errorType"`
+		StackTrace   json.RawMessage `json:"stackTrace"`
+	}
+	invokeErr := &messages.InvokeResponse_Error{}
+	if json.Unmarshal(payload, &body) == nil && (body.ErrorMessage != "" || body.ErrorType != "") {
+		invokeErr.Message = body.ErrorMessage
+		invokeErr.Type = body.ErrorType
+		var lines []string
+		if json.Unmarshal(body.StackTrace, &lines) == nil {
+			for _, line := range lines {
+				invokeErr.StackTrace = append(invokeErr.StackTrace, &messages.InvokeResponse_Error_StackFrame{Label: strings.TrimSpace(line)})
+			}
+		} else {
+			json.Unmarshal(body.StackTrace, &invokeErr.StackTrace)
+		}
+	} else {
+		invokeErr.Message = strings.TrimSpace(string(payload))
+	}
+	if invokeErr.Type == "" {
+		invokeErr.Type = errorType
+	}
+	return invokeErr
+}
+
+// rieHost returns the host and port of the emulator's URL.
+func rieHost(rieURL string) string {
+	u, err := url.Parse(rieURL)
+	if err != nil {
+		return rieURL
+	}
+	if u.Port() == "" && u.Scheme == "https" {
+		return u.Host + ":443"
+	} else if u.Port() == "" {
+		return u.Host + ":80"
+	}
+	return u.Host
+}
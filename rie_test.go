@@ -0,0 +1,44 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+func TestRIEWaitForConnection(t *testing.T) {
+	emulator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"statusCode":200}`))
+	}))
+	defer emulator.Close()
+	p := newRPCPool(emulator.URL, 1, 0)
+
+	var response messages.InvokeResponse
+	request := &messages.InvokeRequest{Payload: []byte("{}")}
+	if _, err := p.invoke(context.Background(), request, &response, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection is busy
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	start := time.Now()
+	_, err := p.invoke(context.Background(), request, &response, time.Now().Add(100*time.Millisecond))
+	if err != errDeadlineExceeded {
+		t.Errorf("got %v, want %v", err, errDeadlineExceeded)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for the deadline of 100ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = p.invoke(ctx, request, &response, time.Now().Add(time.Minute))
+	if err != errClientCancelled {
+		t.Errorf("got %v, want %v", err, errClientCancelled)
+	}
+}
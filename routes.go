@@ -0,0 +1,288 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// route sends requests to a lambda. Path routes match requests whose path
+// starts with prefix, host routes match requests by their Host header. The
+// default route matches every request.
+type route struct {
+	prefix        string
+	host          string
+	lambdaHost    string
+	stripPrefix   bool
+	requireAPIKey bool
+	async         bool
+	// OPTIONS requests are answered by the gateway, or always forwarded
+	answerOptions  bool
+	forwardOptions bool
+	// Gzip request bodies are decompressed, or always passed as they are
+	decompress   bool
+	noDecompress bool
+	// Overrides MAX_REQUEST_PAYLOAD, e.g. with the ALB's 1 MB
+	maxRequestPayload int
+	pool              *rpcPool
+	// Proxy routes forward requests to an HTTP server instead of a lambda
+	upstream *url.URL
+
+	// The default route can balance requests between several lambdas
+	backends []*route
+	next     *uint64
+	balanced bool
+
+	// Lambdas that are tried in order when the default route's lambda fails
+	fallbacks []*route
+
+	// Routes imported from a template match a method and a resource, and
+	// can use another payload format than PAYLOAD_FORMAT
+	method        string
+	resource      *resource
+	function      string
+	payloadFormat string
+	cors          *corsConfig
+	authorizer    *routeAuthorizer
+
+	// Overrides the global chaos, e.g. to slow down a single route
+	chaos *chaosConfig
+}
+
+// parseRoutes parses a comma-separated list of routes in the form
+// "/prefix/*=host:port", optionally followed by ";strip" to remove the prefix
+// from the path sent to the lambda, ";apikey" to require an API key,
+// ";async" to invoke the lambda asynchronously, ";options" or ";nooptions"
+// to answer OPTIONS requests in the gateway or not, ";decompress" or
+// ";nodecompress" to decompress gzip request bodies or not,
+// ";maxpayload=1048576" to limit the size of the requests, ";latency=",
+// ";errorrate=", ";truncaterate=" and ";resetrate=" to inject chaos like the
+// CHAOS_* options, and ";proxy" to forward the requests to the HTTP server at
+// the URL instead, e.g. "/legacy/*=http://localhost:3000;proxy".
+func parseRoutes(s string) ([]*route, error) {
+	var parsed []*route
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid route %q (expected /prefix/*=host:port)", entry)
+		}
+		prefix, target := entry[:i], entry[i+1:]
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid route %q (the prefix must start with /)", entry)
+		}
+		prefix = strings.TrimSuffix(strings.TrimSuffix(prefix, "*"), "/")
+
+		r := &route{
+			prefix: prefix,
+		}
+		options := strings.Split(target, ";")
+		r.lambdaHost = options[0]
+		for _, option := range options[1:] {
+			if v, ok := strings.CutPrefix(option, "maxpayload="); ok {
+				n, err := strconv.Atoi(v)
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("invalid route %q (invalid maxpayload %q)", entry, v)
+				}
+				r.maxRequestPayload = n
+				continue
+			}
+			if key, v, ok := strings.Cut(option, "="); ok && chaosOptions[key] {
+				if r.chaos == nil {
+					r.chaos = &chaosConfig{}
+				}
+				if err := r.chaos.set(key, v); err != nil {
+					return nil, fmt.Errorf("invalid route %q (invalid %s %q: %v)", entry, key, v, err)
+				}
+				continue
+			}
+			switch option {
+			case "strip":
+				r.stripPrefix = true
+			case "apikey":
+				r.requireAPIKey = true
+			case "async":
+				r.async = true
+			case "options":
+				r.answerOptions = true
+			case "nooptions":
+				r.forwardOptions = true
+			case "decompress":
+				r.decompress = true
+			case "nodecompress":
+				r.noDecompress = true
+			case "proxy":
+				upstream, err := parseUpstream(r.lambdaHost)
+				if err != nil {
+					return nil, fmt.Errorf("invalid route %q (%v)", entry, err)
+				}
+				r.upstream = upstream
+			default:
+				return nil, fmt.Errorf("invalid route %q (unknown option %q)", entry, option)
+			}
+		}
+		if r.lambdaHost == "" {
+			return nil, fmt.Errorf("invalid route %q (missing lambda host)", entry)
+		}
+		// The other options are for the lambda's events
+		if r.upstream != nil && (r.requireAPIKey || r.async || r.answerOptions || r.forwardOptions || r.decompress || r.noDecompress || r.maxRequestPayload > 0 || r.chaos != nil) {
+			return nil, fmt.Errorf("invalid route %q (proxy routes only support ;strip)", entry)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// requestPayloadLimit returns the largest request payload of the route.
+func (rt *route) requestPayloadLimit() int {
+	if rt.maxRequestPayload > 0 {
+		return rt.maxRequestPayload
+	}
+	return maxRequestPayload
+}
+
+// sortRoutes orders the routes for longest-prefix matching.
+func sortRoutes(routes []*route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+}
+
+// parseHostRoutes parses a comma-separated list of host routes in the form
+// "host=host:port". The host may start with a wildcard (e.g.
+// "*.admin.myapp.test") to match all of its subdomains.
+func parseHostRoutes(s string) ([]*route, error) {
+	var parsed []*route
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 || i == 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("invalid host route %q (expected host=host:port)", entry)
+		}
+		parsed = append(parsed, &route{
+			host:       strings.ToLower(entry[:i]),
+			lambdaHost: entry[i+1:],
+		})
+	}
+	return parsed, nil
+}
+
+// matches reports whether the path is the prefix itself or below it.
+func (rt *route) matches(path string) bool {
+	return path == rt.prefix || strings.HasPrefix(path, rt.prefix+"/")
+}
+
+func (rt *route) matchesHost(host string) bool {
+	if strings.HasPrefix(rt.host, "*.") {
+		return strings.HasSuffix(host, rt.host[1:])
+	}
+	return host == rt.host
+}
+
+// matchMethodRoute finds the imported route for the request's method and
+// path. Like API Gateway, the most specific resource is used, and a route for
+// the method takes precedence over an ANY route for the same resource.
+func (c *reloadableConfig) matchMethodRoute(r *http.Request) *route {
+	var best *route
+	var bestScore []int
+	for _, rt := range c.methodRoutes {
+		if rt.method != "ANY" && rt.method != r.Method {
+			continue
+		}
+		_, score, ok := rt.resource.match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		if best == nil || compareScores(score, bestScore) > 0 || (compareScores(score, bestScore) == 0 && best.method == "ANY") {
+			best, bestScore = rt, score
+		}
+	}
+	return best
+}
+
+// eventPayloadFormat returns the payload format of the route's events.
+func (rt *route) eventPayloadFormat() string {
+	if rt.payloadFormat != "" {
+		return rt.payloadFormat
+	}
+	return payloadFormat
+}
+
+// matchRoute picks the route for the request. Routes imported from a template
+// take precedence over path routes, which take precedence over host routes,
+// and the default route is used when nothing matches.
+func (c *reloadableConfig) matchRoute(r *http.Request) *route {
+	if rt := c.matchMethodRoute(r); rt != nil {
+		return rt
+	}
+	for _, rt := range c.routes {
+		if rt.matches(r.URL.Path) {
+			return rt
+		}
+	}
+	host := strings.ToLower(hostWithoutPort(r.Host))
+	for _, rt := range c.hostRoutes {
+		if rt.matchesHost(host) {
+			return rt
+		}
+	}
+	return c.defaultRoute
+}
+
+// strip returns a copy of the request with the route's prefix removed from
+// the path.
+func (rt *route) strip(r *http.Request) *http.Request {
+	if !rt.stripPrefix {
+		return r
+	}
+	path := strings.TrimPrefix(r.URL.Path, rt.prefix)
+	if path == "" {
+		path = "/"
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	if rawPath := strings.TrimPrefix(r.URL.RawPath, rt.prefix); rawPath != r.URL.RawPath && strings.HasPrefix(rawPath, "/") {
+		u.RawPath = rawPath
+	}
+	r2.URL = &u
+	return r2
+}
+
+// stripStagePath removes the STAGE_PATH prefix from the request path, like API
+// Gateway does before passing the request to the integration. It returns false
+// if the request is outside of the stage.
+func stripStagePath(r *http.Request) (*http.Request, bool) {
+	if stagePath == "" {
+		return r, true
+	}
+	prefix := "/" + stagePath
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		return r, false
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	if path == "" {
+		path = "/"
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	if strings.HasPrefix(r.URL.RawPath, prefix) {
+		u.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+	}
+	r2.URL = &u
+	return r2, true
+}
@@ -0,0 +1,299 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// rpcPool keeps connections to the lambda open between requests, so we don't
+// have to dial it for every request. Each connection is used by one request
+// at a time, and at most maxConnections are open at once. Requests that
+// arrive when all connections are busy wait for one to be returned.
+type rpcPool struct {
+	host      string
+	dialRetry time.Duration
+	idle      chan *rpc.Client
+	slots     chan struct{}
+	breaker   circuitBreaker
+	health    backendHealth
+
+	// Lambdas behind the Runtime Interface Emulator are invoked over HTTP
+	rieURL     string
+	httpClient *http.Client
+
+	// Deployed functions are invoked with the AWS SDK, and host is the
+	// function name
+	aws bool
+}
+
+// dialError is returned when the lambda could not be reached at all, which
+// usually means that it hasn't been started yet.
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return fmt.Sprintf("error connecting to lambda: %v", e.err)
+}
+
+func (e *dialError) Unwrap() error {
+	return e.err
+}
+
+// Routes to the same lambda share connections. Pools are created when a lambda
+// is first used in the config, and kept when the config is reloaded.
+var maxConnections int
+var dialRetry time.Duration
+var pools = struct {
+	sync.Mutex
+	byHost map[string]*rpcPool
+}{byHost: map[string]*rpcPool{}}
+
+// poolFor returns the connection pool for the lambda.
+func poolFor(host string) *rpcPool {
+	pools.Lock()
+	defer pools.Unlock()
+	if pools.byHost[host] == nil {
+		pools.byHost[host] = newRPCPool(host, maxConnections, dialRetry)
+	}
+	return pools.byHost[host]
+}
+
+func newRPCPool(host string, maxConnections int, dialRetry time.Duration) *rpcPool {
+	p := &rpcPool{
+		host:      host,
+		dialRetry: dialRetry,
+		idle:      make(chan *rpc.Client, maxConnections),
+		slots:     make(chan struct{}, maxConnections),
+		rieURL:    rieURL(host),
+		aws:       lambdaBackend == "aws" && !strings.Contains(host, "://"),
+	}
+	if p.rieURL != "" {
+		p.httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: maxConnections,
+			},
+		}
+	}
+	return p
+}
+
+// acquireSlot waits for one of the maxConnections slots to be free. Like
+// callUntil, it stops waiting when the deadline passes or ctx is done.
+func (p *rpcPool) acquireSlot(ctx context.Context, deadline time.Time) error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errDeadlineExceeded
+	case <-ctx.Done():
+		return errClientCancelled
+	}
+}
+
+// get returns an idle connection, or dials a new one if there is none (or if
+// fresh is set). When all connections are busy, it waits for one until the
+// deadline or until ctx is done.
+func (p *rpcPool) get(ctx context.Context, deadline time.Time, fresh bool) (*rpc.Client, error) {
+	if err := p.acquireSlot(ctx, deadline); err != nil {
+		return nil, err
+	}
+	if !fresh {
+		select {
+		case client := <-p.idle:
+			return client, nil
+		default:
+		}
+	}
+	client, err := p.dial(ctx, deadline)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return client, nil
+}
+
+// dial connects to the lambda. If the lambda is not accepting connections
+// yet, the dial is retried with exponential backoff for up to dialRetry, but
+// like acquireSlot it gives up when the deadline passes or ctx is done, so a
+// request that is already over doesn't hold on to its slot.
+func (p *rpcPool) dial(ctx context.Context, deadline time.Time) (*rpc.Client, error) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	retryUntil := time.Now().Add(p.dialRetry)
+	backoff := 50 * time.Millisecond
+	var dialer net.Dialer
+	for attempt := 1; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, "tcp", p.host)
+		if err == nil {
+			return rpc.NewClient(conn), nil
+		}
+		if ctx.Err() != nil {
+			return nil, dialContextError(ctx)
+		}
+		if time.Now().Add(backoff).After(retryUntil) {
+			return nil, &dialError{err}
+		}
+		log.Printf("Error connecting to lambda (attempt %d), retrying in %v: %v", attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, dialContextError(ctx)
+		}
+		backoff *= 2
+		if backoff > 2*time.Second {
+			backoff = 2 * time.Second
+		}
+	}
+}
+
+// dialContextError returns the error for a dial that was cut short because
+// the deadline passed or the client went away.
+func dialContextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errDeadlineExceeded
+	}
+	return errClientCancelled
+}
+
+// put returns a healthy connection to the pool.
+func (p *rpcPool) put(client *rpc.Client) {
+	select {
+	case p.idle <- client:
+	default:
+		client.Close()
+	}
+	<-p.slots
+}
+
+// closeIdle closes the connections that aren't in use by a request.
+func (p *rpcPool) closeIdle() {
+	for {
+		select {
+		case client := <-p.idle:
+			client.Close()
+		default:
+			return
+		}
+	}
+}
+
+// discard closes a broken connection and frees its slot.
+func (p *rpcPool) discard(client *rpc.Client) {
+	client.Close()
+	<-p.slots
+}
+
+// call performs an RPC call on a pooled connection, waiting for the response
+// until the deadline. If the connection was already shut down, which happens
+// when the lambda process was restarted, it is replaced with a new connection
+// and the call is made again. net/rpc returns rpc.ErrShutdown without sending
+// anything in that case, so it is safe to retry. Other errors, like a
+// connection that is closed while the call is in flight, are not retried,
+// since the lambda may have received the event already. It returns how long
+// it took to get the connections.
+func (p *rpcPool) call(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, deadline time.Time) (time.Duration, error) {
+	start := time.Now()
+	client, err := p.get(ctx, deadline, false)
+	dial := time.Since(start)
+	if err != nil {
+		return dial, err
+	}
+	err = callUntil(ctx, client, serviceMethod, args, reply, deadline)
+	if err == rpc.ErrShutdown {
+		log.Printf("Connection to lambda was closed, reconnecting to %s", p.host)
+		p.discard(client)
+		start = time.Now()
+		client, err = p.get(ctx, deadline, true)
+		dial += time.Since(start)
+		if err != nil {
+			return dial, err
+		}
+		err = callUntil(ctx, client, serviceMethod, args, reply, deadline)
+	}
+
+	// Errors returned by the lambda's RPC server leave the connection usable,
+	// anything else means it is broken. This includes timeouts and cancelled
+	// requests, since the response would arrive on the connection later.
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		p.discard(client)
+	} else {
+		p.put(client)
+	}
+	return dial, err
+}
+
+// ping checks that the lambda is up by calling Function.Ping on a new
+// connection. Unlike call, it doesn't retry the dial, so health checks fail
+// fast while the lambda is down. The emulator has no ping, so it only checks
+// that the emulator accepts connections.
+func (p *rpcPool) ping(timeout time.Duration) error {
+	if p.aws {
+		err := p.pingAWS(timeout)
+		if err != nil {
+			p.health.markFailed()
+		}
+		return err
+	} else if p.rieURL != "" {
+		conn, err := net.DialTimeout("tcp", rieHost(p.rieURL), timeout)
+		if err != nil {
+			p.health.markFailed()
+			return &dialError{err}
+		}
+		return conn.Close()
+	}
+	conn, err := net.DialTimeout("tcp", p.host, timeout)
+	if err != nil {
+		p.health.markFailed()
+		return &dialError{err}
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	err = callUntil(context.Background(), client, "Function.Ping", &messages.PingRequest{}, &messages.PingResponse{}, time.Now().Add(timeout))
+	if err != nil {
+		p.health.markFailed()
+	}
+	return err
+}
+
+// errDeadlineExceeded is returned when the lambda doesn't respond before the
+// deadline.
+var errDeadlineExceeded = errors.New("lambda did not respond before the deadline")
+
+// errClientCancelled is returned when the client went away before the lambda
+// responded.
+var errClientCancelled = errors.New("client cancelled the request")
+
+func callUntil(ctx context.Context, client *rpc.Client, serviceMethod string, args interface{}, reply interface{}, deadline time.Time) error {
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return errDeadlineExceeded
+	case <-ctx.Done():
+		return errClientCancelled
+	}
+}
@@ -0,0 +1,255 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+)
+
+// countingLambda is a lambda that counts the connections it accepts, and can
+// close them like a lambda that is restarted.
+type countingLambda struct {
+	addr     string
+	accepted atomic.Int64
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+func startCountingLambda(t *testing.T) *countingLambda {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := rpc.NewServer()
+	err = server.RegisterName("Function", &testFunction{func(event []byte) (interface{}, error) {
+		time.Sleep(time.Millisecond)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &countingLambda{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			l.accepted.Add(1)
+			l.mu.Lock()
+			l.conns = append(l.conns, conn)
+			l.mu.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	return l
+}
+
+// restart closes the connections to the lambda.
+func (l *countingLambda) restart() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func testInvoke(p *rpcPool) error {
+	var response messages.InvokeResponse
+	_, err := p.invoke(context.Background(), &messages.InvokeRequest{Payload: []byte("{}")}, &response, time.Now().Add(5*time.Second))
+	return err
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	lambda := startCountingLambda(t)
+	handler := newTestGateway(t, WithLambdaHost(lambda.addr), WithOption("MAX_CONNECTIONS", "4"))
+
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+				if w.Code != http.StatusOK {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := failed.Load(); n > 0 {
+		t.Errorf("%d requests failed", n)
+	}
+	if n := lambda.accepted.Load(); n > 4 {
+		t.Errorf("1000 requests opened %d connections, want at most 4", n)
+	}
+}
+
+func TestPoolRedialsAfterRestart(t *testing.T) {
+	lambda := startCountingLambda(t)
+	p := newRPCPool(lambda.addr, 1, 0)
+	if err := testInvoke(p); err != nil {
+		t.Fatal(err)
+	}
+
+	lambda.restart()
+	// Give the client time to notice that the connection was closed
+	time.Sleep(50 * time.Millisecond)
+	if err := testInvoke(p); err != nil {
+		t.Fatalf("invocation after the restart failed: %v", err)
+	}
+	if n := lambda.accepted.Load(); n != 2 {
+		t.Errorf("got %d connections, want 2", n)
+	}
+}
+
+func TestPoolDoesNotRetryInFlightCalls(t *testing.T) {
+	// The lambda crashes after it receives the event
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted atomic.Int64
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Read(make([]byte, 4096))
+			conn.Close()
+		}
+	}()
+
+	p := newRPCPool(listener.Addr().String(), 1, 0)
+	if err := testInvoke(p); err == nil {
+		t.Fatal("the invocation succeeded")
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("the event was sent %d times, want 1", n)
+	}
+}
+
+func TestPoolWaitForConnection(t *testing.T) {
+	lambda := startCountingLambda(t)
+	p := newRPCPool(lambda.addr, 1, 0)
+	var response messages.InvokeResponse
+	request := &messages.InvokeRequest{Payload: []byte("{}")}
+
+	// Every connection is busy
+	p.slots <- struct{}{}
+
+	start := time.Now()
+	_, err := p.invoke(context.Background(), request, &response, time.Now().Add(100*time.Millisecond))
+	if err != errDeadlineExceeded {
+		t.Errorf("got %v, want %v", err, errDeadlineExceeded)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for the deadline of 100ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = p.invoke(ctx, request, &response, time.Now().Add(time.Minute))
+	if err != errClientCancelled {
+		t.Errorf("got %v, want %v", err, errClientCancelled)
+	}
+
+	// The request gets the connection when it is freed in time
+	time.AfterFunc(50*time.Millisecond, func() { <-p.slots })
+	if _, err := p.invoke(context.Background(), request, &response, time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("got %v after the connection was freed", err)
+	}
+}
+
+func TestIntegrationTimeoutWaitingForConnection(t *testing.T) {
+	release := make(chan struct{})
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		<-release
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("MAX_CONNECTIONS", "1"), WithOption("INTEGRATION_TIMEOUT", "200ms"))
+
+	// The first request holds the only connection until it times out
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	close(release)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d %q, want 504", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for a connection with an integration timeout of 200ms", elapsed)
+	}
+}
+
+// closedAddr returns an address that nothing listens on.
+func closedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func TestPoolStopsDialRetry(t *testing.T) {
+	p := newRPCPool(closedAddr(t), 1, time.Minute)
+	var response messages.InvokeResponse
+	request := &messages.InvokeRequest{Payload: []byte("{}")}
+
+	start := time.Now()
+	_, err := p.invoke(context.Background(), request, &response, time.Now().Add(200*time.Millisecond))
+	if err != errDeadlineExceeded {
+		t.Errorf("got %v, want %v", err, errDeadlineExceeded)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retried the dial for %v with a deadline of 200ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = p.invoke(ctx, request, &response, time.Now().Add(time.Minute))
+	if err != errClientCancelled {
+		t.Errorf("got %v, want %v", err, errClientCancelled)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retried the dial for %v after the client went away", elapsed)
+	}
+
+	// Neither request kept the slot
+	if len(p.slots) != 0 {
+		t.Errorf("%d slots are still taken", len(p.slots))
+	}
+}
+
+func TestIntegrationTimeoutWhileDialing(t *testing.T) {
+	handler := newTestGateway(t, WithLambdaHost(closedAddr(t)), WithOption("LAMBDA_DIAL_RETRY", "30s"), WithOption("INTEGRATION_TIMEOUT", "200ms"))
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d %q, want 504", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retried the dial for %v with an integration timeout of 200ms", elapsed)
+	}
+}
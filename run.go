@@ -0,0 +1,235 @@
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// childLambda is the lambda started with --run, or nil if the lambda is
+// started separately.
+var childLambda *lambdaProcess
+
+const (
+	// childStopTimeout is how long the lambda gets to exit after SIGTERM
+	// before it is killed.
+	childStopTimeout = 5 * time.Second
+
+	// childReadyTimeout is how long the gateway waits for the lambda to
+	// accept connections before it starts serving anyway.
+	childReadyTimeout = 30 * time.Second
+)
+
+// lambdaProcess runs the lambda as a child process, and restarts it with
+// backoff when it exits.
+type lambdaProcess struct {
+	args    []string
+	host    string
+	name    string
+	tempDir string // removed when the lambda is stopped
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	stopping   bool
+	restarting bool
+
+	// Requests wait for hold to be closed while the lambda is rebuilt, and
+	// get the build output when the build failed
+	hold     chan struct{}
+	buildErr *buildError
+}
+
+// newLambdaProcess prepares the command from --run. The lambda listens on the
+// port in LAMBDA_HOST, or on a free port that LAMBDA_HOST is set to.
+func newLambdaProcess(command string) (*lambdaProcess, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	host := getenv("LAMBDA_HOST")
+	if strings.Contains(host, ",") {
+		return nil, fmt.Errorf("LAMBDA_HOST must be a single address")
+	} else if host == "" {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return nil, err
+		}
+		host = fmt.Sprintf("localhost:%d", l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+		os.Setenv("LAMBDA_HOST", host)
+	} else if _, _, err := net.SplitHostPort(host); err != nil {
+		return nil, fmt.Errorf("invalid LAMBDA_HOST: %v", err)
+	}
+	return &lambdaProcess{
+		args: args,
+		host: host,
+		name: filepath.Base(args[0]),
+	}, nil
+}
+
+// run starts the lambda and restarts it whenever it exits, until stop is
+// called. The backoff is reset when the lambda ran for a while.
+func (p *lambdaProcess) run() {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		var status string
+		if err := p.start(); err != nil {
+			status = err.Error()
+		} else {
+			<-p.exited
+			status = p.cmd.ProcessState.String()
+		}
+		p.mu.Lock()
+		stopping, restarting := p.stopping, p.restarting
+		p.restarting = false
+		p.mu.Unlock()
+		if stopping {
+			return
+		} else if restarting {
+			backoff = time.Second
+			continue
+		}
+		if time.Since(started) > 10*time.Second {
+			backoff = time.Second
+		}
+		log.Printf("Lambda %s exited (%s), restarting in %v", p.name, status, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// start starts the lambda with _LAMBDA_SERVER_PORT set, like the Lambda
+// runtime does. Its output is logged with the command name as a prefix.
+func (p *lambdaProcess) start() error {
+	_, port, _ := net.SplitHostPort(p.host)
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	cmd.Env = append(os.Environ(), "_LAMBDA_SERVER_PORT="+port)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return fmt.Errorf("stopping")
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started lambda %s (pid %d) on port %s", p.name, cmd.Process.Pid, port)
+	p.cmd = cmd
+	p.exited = make(chan struct{})
+	var output sync.WaitGroup
+	output.Add(2)
+	go p.logOutput(stdout, &output)
+	go p.logOutput(stderr, &output)
+	go func(exited chan struct{}) {
+		// The output has to be read before Wait closes the pipes
+		output.Wait()
+		cmd.Wait()
+		close(exited)
+	}(p.exited)
+	return nil
+}
+
+func (p *lambdaProcess) logOutput(r io.Reader, done *sync.WaitGroup) {
+	defer done.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		log.Printf("[%s] %s", p.name, scanner.Text())
+	}
+}
+
+// waitReady waits for the lambda to accept connections.
+func (p *lambdaProcess) waitReady(timeout time.Duration) error {
+	pool := poolFor(p.host)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := pool.ping(healthCheckTimeout)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("lambda %s did not accept connections within %v: %v", p.name, timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stop stops the lambda for good.
+func (p *lambdaProcess) stop() {
+	p.mu.Lock()
+	p.stopping = true
+	cmd, exited := p.cmd, p.exited
+	p.mu.Unlock()
+	p.terminate(cmd, exited)
+	if p.tempDir != "" {
+		os.RemoveAll(p.tempDir)
+	}
+}
+
+func (p *lambdaProcess) isStopping() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopping
+}
+
+// restart stops the lambda, which is started again right away by run. A
+// lambda that isn't running is started by run after its backoff.
+func (p *lambdaProcess) restart() {
+	p.mu.Lock()
+	cmd, exited := p.cmd, p.exited
+	if cmd != nil {
+		select {
+		case <-exited:
+		default:
+			p.restarting = true
+		}
+	}
+	p.mu.Unlock()
+	p.terminate(cmd, exited)
+}
+
+// terminate sends SIGTERM to the lambda, and kills it if it doesn't exit
+// within childStopTimeout.
+func (p *lambdaProcess) terminate(cmd *exec.Cmd, exited chan struct{}) {
+	if cmd == nil {
+		return
+	}
+	select {
+	case <-exited:
+		return
+	default:
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+		log.Printf("Lambda %s stopped", p.name)
+	case <-time.After(childStopTimeout):
+		log.Printf("Lambda %s did not exit within %v, killing it", p.name, childStopTimeout)
+		cmd.Process.Kill()
+		<-exited
+	}
+}
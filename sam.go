@@ -0,0 +1,231 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// samTemplate is the part of an AWS SAM template that describes the API.
+// Values that can use intrinsic functions are kept as nodes.
+type samTemplate struct {
+	Parameters map[string]struct {
+		Default yaml.Node `yaml:"Default"`
+	} `yaml:"Parameters"`
+	Globals struct {
+		Function struct {
+			CodeUri yaml.Node `yaml:"CodeUri"`
+		} `yaml:"Function"`
+		HttpApi struct {
+			PayloadFormatVersion yaml.Node `yaml:"PayloadFormatVersion"`
+		} `yaml:"HttpApi"`
+	} `yaml:"Globals"`
+	Resources map[string]struct {
+		Type       string `yaml:"Type"`
+		Properties struct {
+			CodeUri yaml.Node `yaml:"CodeUri"`
+			Events  map[string]struct {
+				Type       string `yaml:"Type"`
+				Properties struct {
+					Path                 yaml.Node `yaml:"Path"`
+					Method               yaml.Node `yaml:"Method"`
+					PayloadFormatVersion yaml.Node `yaml:"PayloadFormatVersion"`
+				} `yaml:"Properties"`
+			} `yaml:"Events"`
+		} `yaml:"Properties"`
+	} `yaml:"Resources"`
+}
+
+// loadSAMTemplate imports the Api and HttpApi events of the functions in a SAM
+// template as routes. Events that can't be imported, e.g. because the
+// function has no lambda or the path uses a parameter without a default, are
+// reported and skipped.
+func loadSAMTemplate(path string, hosts map[string]string) ([]*route, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tmpl samTemplate
+	if err := yaml.Unmarshal(data, &tmpl); err != nil {
+		return nil, err
+	}
+	refs := map[string]string{
+		"AWS::AccountId": accountID,
+		"AWS::Partition": "aws",
+		"AWS::Region":    "us-east-1",
+		"AWS::URLSuffix": "amazonaws.com",
+	}
+	if region := getenv("AWS_REGION"); region != "" {
+		refs["AWS::Region"] = region
+	}
+	for name, param := range tmpl.Parameters {
+		if param.Default.Kind == 0 {
+			continue
+		}
+		if v, ok := resolveIntrinsic(&param.Default, refs); ok {
+			refs[name] = v
+		}
+	}
+	defaultHttpApiFormat, ok := resolveIntrinsic(&tmpl.Globals.HttpApi.PayloadFormatVersion, refs)
+	if !ok || defaultHttpApiFormat == "" {
+		defaultHttpApiFormat = "2.0"
+	}
+	globalCodeURI, _ := resolveIntrinsic(&tmpl.Globals.Function.CodeUri, refs)
+
+	// Map iteration order is random, and the routes are printed at startup
+	var names []string
+	for name := range tmpl.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var routes []*route
+	for _, name := range names {
+		fn := tmpl.Resources[name]
+		if fn.Type != "AWS::Serverless::Function" {
+			continue
+		}
+		codeURI, ok := resolveIntrinsic(&fn.Properties.CodeUri, refs)
+		if !ok || codeURI == "" {
+			codeURI = globalCodeURI
+		}
+		host, hasHost := lookupFunctionHost(hosts, name, codeURI)
+
+		var eventNames []string
+		for eventName := range fn.Properties.Events {
+			eventNames = append(eventNames, eventName)
+		}
+		sort.Strings(eventNames)
+		for _, eventName := range eventNames {
+			event := fn.Properties.Events[eventName]
+			if event.Type != "Api" && event.Type != "HttpApi" {
+				continue
+			}
+			skip := func(reason string) {
+				fmt.Fprintf(os.Stderr, "Skipped SAM event %s of %s: %s\n", eventName, name, reason)
+			}
+			if !hasHost {
+				skip(fmt.Sprintf("no --function-port for %s", name))
+				continue
+			}
+
+			rt := &route{
+				lambdaHost:    host,
+				function:      name,
+				payloadFormat: "1.0",
+			}
+			eventPath, ok := resolveIntrinsic(&event.Properties.Path, refs)
+			if !ok {
+				skip("can't resolve Path")
+				continue
+			}
+			method, ok := resolveIntrinsic(&event.Properties.Method, refs)
+			if !ok {
+				skip("can't resolve Method")
+				continue
+			}
+			if event.Type == "HttpApi" {
+				rt.payloadFormat = defaultHttpApiFormat
+				if v, ok := resolveIntrinsic(&event.Properties.PayloadFormatVersion, refs); ok && v != "" {
+					rt.payloadFormat = v
+				}
+				// An HttpApi event without a path is the $default route
+				if eventPath == "" || eventPath == "$default" {
+					eventPath = "/{proxy+}"
+				}
+			}
+			rt.method = strings.ToUpper(method)
+			if rt.method == "" {
+				rt.method = "ANY"
+			}
+			if rt.payloadFormat != "1.0" && rt.payloadFormat != "2.0" {
+				skip(fmt.Sprintf("unsupported PayloadFormatVersion %s", rt.payloadFormat))
+				continue
+			}
+			if eventFormat != "apigateway" {
+				rt.payloadFormat = ""
+			}
+			rt.resource, err = newResource(eventPath)
+			if err != nil {
+				skip(err.Error())
+				continue
+			}
+			routes = append(routes, rt)
+		}
+	}
+	return routes, nil
+}
+
+var subVariableRegexp = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// resolveIntrinsic resolves a value that can use the Ref and Fn::Sub intrinsic
+// functions, in the short (!Ref) or long ({"Ref": ...}) form, with the
+// parameters' defaults and the pseudo parameters. It returns false for other
+// intrinsic functions and unknown references. A missing value is "".
+func resolveIntrinsic(node *yaml.Node, refs map[string]string) (string, bool) {
+	switch {
+	case node.Kind == 0:
+		return "", true
+	case node.Kind == yaml.ScalarNode && node.Tag == "!Ref":
+		v, ok := refs[node.Value]
+		return v, ok
+	case node.Kind == yaml.ScalarNode && node.Tag == "!Sub":
+		return substitute(node.Value, refs, nil)
+	case node.Kind == yaml.SequenceNode && node.Tag == "!Sub" && len(node.Content) == 2:
+		return substituteWithVariables(node.Content[0], node.Content[1], refs)
+	case node.Kind == yaml.ScalarNode && !strings.HasPrefix(node.Tag, "!") || node.Tag == "!!str":
+		return node.Value, true
+	case node.Kind == yaml.MappingNode && len(node.Content) == 2:
+		key, value := node.Content[0].Value, node.Content[1]
+		if key == "Ref" && value.Kind == yaml.ScalarNode {
+			v, ok := refs[value.Value]
+			return v, ok
+		} else if key == "Fn::Sub" && value.Kind == yaml.ScalarNode {
+			return substitute(value.Value, refs, nil)
+		} else if key == "Fn::Sub" && value.Kind == yaml.SequenceNode && len(value.Content) == 2 {
+			return substituteWithVariables(value.Content[0], value.Content[1], refs)
+		}
+	}
+	return "", false
+}
+
+func substituteWithVariables(s *yaml.Node, variables *yaml.Node, refs map[string]string) (string, bool) {
+	if variables.Kind != yaml.MappingNode {
+		return "", false
+	}
+	vars := map[string]string{}
+	for i := 0; i+1 < len(variables.Content); i += 2 {
+		v, ok := resolveIntrinsic(variables.Content[i+1], refs)
+		if !ok {
+			return "", false
+		}
+		vars[variables.Content[i].Value] = v
+	}
+	return substitute(s.Value, refs, vars)
+}
+
+// substitute replaces the ${Name} variables of Fn::Sub. ${!Literal} is
+// written as ${Literal}.
+func substitute(s string, refs map[string]string, vars map[string]string) (string, bool) {
+	ok := true
+	result := subVariableRegexp.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[2 : len(m)-1]
+		if strings.HasPrefix(name, "!") {
+			return "${" + name[1:] + "}"
+		}
+		if v, found := vars[name]; found {
+			return v
+		}
+		if v, found := refs[name]; found {
+			return v
+		}
+		ok = false
+		return m
+	})
+	return result, ok
+}
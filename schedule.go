@@ -0,0 +1,424 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// scheduleFlags are the values of the --schedule flags.
+var scheduleFlags []string
+
+// schedules invoke the default lambda with a scheduled EventBridge event.
+var schedules []*schedule
+
+// schedule is a --schedule flag, e.g.
+// "cron(0 9 * * ? *);name=daily;detail=detail.json;jitter=10s". The
+// expression is cron(...) or rate(...) like in EventBridge, a standard
+// five-field cron expression, or every=30s.
+type schedule struct {
+	name       string
+	expression string
+	every      time.Duration
+	cron       *cronSchedule
+	detail     json.RawMessage
+	jitter     time.Duration
+
+	mu        sync.Mutex
+	paused    bool
+	next      time.Time
+	lastRun   time.Time
+	lastError string
+	runs      int
+}
+
+func parseSchedule(s string, n int) (*schedule, error) {
+	parts := strings.Split(s, ";")
+	sch := &schedule{
+		name:       fmt.Sprintf("schedule-%d", n),
+		expression: strings.TrimSpace(parts[0]),
+		detail:     json.RawMessage("{}"),
+	}
+	var err error
+	switch expr := sch.expression; {
+	case strings.HasPrefix(expr, "every="):
+		sch.every, err = time.ParseDuration(strings.TrimPrefix(expr, "every="))
+		if err == nil && sch.every <= 0 {
+			err = errors.New("the interval must be positive")
+		}
+	case strings.HasPrefix(expr, "rate(") && strings.HasSuffix(expr, ")"):
+		sch.every, err = parseRate(expr[5 : len(expr)-1])
+	case strings.HasPrefix(expr, "cron(") && strings.HasSuffix(expr, ")"):
+		sch.cron, err = parseCron(expr[5:len(expr)-1], true)
+	default:
+		sch.cron, err = parseCron(expr, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "name":
+			sch.name = value
+		case "detail":
+			data, err := ioutil.ReadFile(value)
+			if err != nil {
+				return nil, err
+			}
+			if !json.Valid(data) {
+				return nil, fmt.Errorf("%s is not valid JSON", value)
+			}
+			sch.detail = data
+		case "jitter":
+			sch.jitter, err = time.ParseDuration(value)
+			if err != nil || sch.jitter < 0 {
+				return nil, fmt.Errorf("invalid jitter: %s", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown setting: %s (expected name, detail or jitter)", key)
+		}
+	}
+	return sch, nil
+}
+
+// parseRate parses the value of an EventBridge rate expression, e.g.
+// "5 minutes".
+func parseRate(s string) (time.Duration, error) {
+	value, unit, _ := strings.Cut(strings.TrimSpace(s), " ")
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate: %s", s)
+	}
+	switch strings.TrimSuffix(unit, "s") {
+	case "minute":
+		return time.Duration(n) * time.Minute, nil
+	case "hour":
+		return time.Duration(n) * time.Hour, nil
+	case "day":
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid rate unit: %s (must be minutes, hours or days)", unit)
+}
+
+// cronSchedule is a parsed cron expression. The fields are bit sets of the
+// allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	years                         map[int]bool // nil allows any year
+	domAny, dowAny                bool
+	location                      *time.Location
+}
+
+var monthNames = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+var dayNames = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// parseCron parses an EventBridge cron expression, with six fields and a day
+// of week from 1 (Sunday) to 7, in UTC, or a standard cron expression, with
+// five fields and a day of week from 0 (Sunday) to 7, in local time.
+func parseCron(s string, eventBridge bool) (*cronSchedule, error) {
+	fields := strings.Fields(s)
+	c := &cronSchedule{location: time.Local}
+	dowMin, dowMax := 0, 7
+	if eventBridge {
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("cron expression %q must have 6 fields", s)
+		}
+		c.location = time.UTC
+		dowMin = 1
+	} else if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", s)
+	}
+
+	var values []int
+	var err error
+	if values, _, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	c.minute = cronBits(values, 0)
+	if values, _, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	c.hour = cronBits(values, 0)
+	if values, c.domAny, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	c.dom = cronBits(values, 0)
+	if values, _, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, err
+	}
+	c.month = cronBits(values, 0)
+	if values, c.dowAny, err = parseCronField(fields[4], dowMin, dowMax, dayNames); err != nil {
+		return nil, err
+	}
+	// The bit set uses 0 for Sunday like time.Weekday, which is 1 in
+	// EventBridge and 0 or 7 in standard cron
+	if eventBridge {
+		c.dow = cronBits(values, 1)
+	} else {
+		c.dow = cronBits(values, 0) | cronBits(values, 7)
+	}
+	if eventBridge && fields[5] != "*" && fields[5] != "?" {
+		if values, _, err = parseCronField(fields[5], 1970, 2199, nil); err != nil {
+			return nil, err
+		}
+		c.years = map[int]bool{}
+		for _, year := range values {
+			c.years[year] = true
+		}
+	}
+	return c, nil
+}
+
+// cronBits returns a bit set with bit v-offset set for every value v. Values
+// that don't fit in the bit set are ignored.
+func cronBits(values []int, offset int) uint64 {
+	var bitset uint64
+	for _, v := range values {
+		if v >= offset && v-offset < 64 {
+			bitset |= 1 << (v - offset)
+		}
+	}
+	return bitset
+}
+
+// parseCronField returns the values allowed by a field with lists, ranges,
+// steps and names, e.g. "MON-FRI" or "*/15". any is set for * and ?.
+func parseCronField(field string, min int, max int, names []string) (values []int, any bool, err error) {
+	if field == "*" || field == "?" {
+		any = true
+	}
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				if names[0] == "SUN" {
+					return i + min, nil
+				}
+				return i + 1, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value %q in cron field %q", s, field)
+		}
+		return n, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		lo, hi := min, max
+		if rangePart != "*" && rangePart != "?" {
+			a, b, isRange := strings.Cut(rangePart, "-")
+			if lo, err = value(a); err != nil {
+				return nil, false, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(b); err != nil {
+					return nil, false, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		step := 1
+		if hasStep {
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return nil, false, fmt.Errorf("invalid step in cron field %q", field)
+			}
+		}
+		if lo > hi {
+			return nil, false, fmt.Errorf("invalid range in cron field %q", field)
+		}
+		for i := lo; i <= hi; i += step {
+			values = append(values, i)
+		}
+	}
+	return values, any, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<t.Weekday()) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	// Like cron, a day matches either field when both are restricted
+	return dom || dow
+}
+
+// nextAfter returns the first time after t that matches the expression, or
+// the zero time if there is none.
+func (c *cronSchedule) nextAfter(t time.Time) time.Time {
+	t = t.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	for t.Year() < 2200 {
+		if c.years != nil && !c.years[t.Year()] {
+			t = time.Date(t.Year()+1, 1, 1, 0, 0, 0, 0, c.location)
+		} else if c.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+		} else if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+		} else if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+		} else if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (sch *schedule) nextAfter(t time.Time) time.Time {
+	if sch.cron != nil {
+		return sch.cron.nextAfter(t)
+	}
+	return t.Add(sch.every)
+}
+
+// run invokes the lambda every time the schedule fires, until the gateway
+// exits. Paused schedules keep their timer, but don't invoke the lambda.
+func (sch *schedule) run() {
+	next := sch.nextAfter(time.Now())
+	for !next.IsZero() {
+		at := next
+		if sch.jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(sch.jitter))))
+		}
+		sch.mu.Lock()
+		sch.next = at
+		sch.mu.Unlock()
+		time.Sleep(time.Until(at))
+
+		sch.mu.Lock()
+		paused := sch.paused
+		sch.mu.Unlock()
+		if !paused {
+			sch.invoke()
+		}
+		next = sch.nextAfter(next)
+	}
+	log.Printf("Schedule %s will not fire again", sch.name)
+}
+
+func (sch *schedule) invoke() {
+	config := currentConfig.Load()
+	inv := &invocation{
+		requestID:     newUUID(),
+		clientContext: staticClientContext,
+		config:        config,
+		route:         config.defaultRoute.pick(),
+	}
+	if !disableTraceID {
+		inv.traceID = newTraceID()
+	}
+	payload, err := json.Marshal(&events.CloudWatchEvent{
+		Version:    "0",
+		ID:         newUUID(),
+		DetailType: "Scheduled Event",
+		Source:     "aws.events",
+		AccountID:  accountID,
+		Time:       time.Now().UTC().Truncate(time.Second),
+		Region:     eventRegion,
+		Resources:  []string{fmt.Sprintf("arn:aws:events:%s:%s:rule/%s", eventRegion, accountID, sch.name)},
+		Detail:     sch.detail,
+	})
+	if err == nil {
+		_, err = invokeLambda(inv, payload)
+	}
+
+	sch.mu.Lock()
+	sch.runs++
+	sch.lastRun = time.Now()
+	sch.lastError = ""
+	if err != nil {
+		sch.lastError = err.Error()
+	}
+	sch.mu.Unlock()
+
+	var lambdaErr *lambdaError
+	if errors.As(err, &lambdaErr) {
+		log.Printf("Schedule %s: lambda returned an error (request id %s): %v\n%s", sch.name, inv.requestID, err, lambdaErr.stackTrace())
+	} else if err != nil {
+		log.Printf("Schedule %s: error invoking lambda (request id %s): %v", sch.name, inv.requestID, err)
+	} else {
+		log.Printf("Schedule %s: invoked lambda (request id %s) in %v", sch.name, inv.requestID, inv.invokeDuration.Round(time.Millisecond))
+	}
+}
+
+type adminSchedule struct {
+	Name       string     `json:"name"`
+	Expression string     `json:"expression"`
+	Paused     bool       `json:"paused"`
+	Next       time.Time  `json:"next"`
+	LastRun    *time.Time `json:"lastRun,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	Runs       int        `json:"runs"`
+}
+
+func adminScheduleList() []adminSchedule {
+	list := []adminSchedule{}
+	for _, sch := range schedules {
+		sch.mu.Lock()
+		s := adminSchedule{
+			Name:       sch.name,
+			Expression: sch.expression,
+			Paused:     sch.paused,
+			Next:       sch.next,
+			LastError:  sch.lastError,
+			Runs:       sch.runs,
+		}
+		if !sch.lastRun.IsZero() {
+			lastRun := sch.lastRun
+			s.LastRun = &lastRun
+		}
+		sch.mu.Unlock()
+		list = append(list, s)
+	}
+	return list
+}
+
+// handleAdminSchedules lists the schedules, or pauses or resumes them, e.g.
+// {"name": "daily", "paused": true}. Without a name, every schedule is paused
+// or resumed.
+func handleAdminSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var body struct {
+			Name   string `json:"name"`
+			Paused *bool  `json:"paused"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Paused == nil {
+			writeAdminError(w, http.StatusBadRequest, `Invalid body (expected {"name": "...", "paused": true})`)
+			return
+		}
+		found := false
+		for _, sch := range schedules {
+			if body.Name == "" || body.Name == sch.name {
+				found = true
+				sch.mu.Lock()
+				sch.paused = *body.Paused
+				sch.mu.Unlock()
+				log.Printf("Admin API set schedule %s to paused=%v", sch.name, *body.Paused)
+			}
+		}
+		if !found {
+			writeAdminError(w, http.StatusNotFound, fmt.Sprintf("No schedule named %q", body.Name))
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, adminScheduleList())
+}
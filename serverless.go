@@ -0,0 +1,412 @@
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serverlessCORSHeaders are the headers the Serverless Framework allows when
+// an http event has cors: true.
+const serverlessCORSHeaders = "Content-Type,X-Amz-Date,Authorization,X-Api-Key,X-Amz-Security-Token,X-Amz-User-Agent,X-Amzn-Trace-Id"
+
+// serverlessConfig resolves the variables of a serverless.yml.
+type serverlessConfig struct {
+	doc map[string]interface{}
+
+	// provider.stage usually refers to ${opt:stage}, which refers back to it
+	resolvingStage bool
+}
+
+// loadServerlessConfig imports the http and httpApi events of the functions in
+// a serverless.yml as routes. Other events, and events that can't be imported
+// because the function has no lambda or a variable can't be resolved, are
+// reported and skipped.
+func loadServerlessConfig(path string, hosts map[string]string) ([]*route, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &serverlessConfig{}
+	if err := yaml.Unmarshal(data, &sc.doc); err != nil {
+		return nil, err
+	}
+
+	httpAPIFormat := "2.0"
+	if v, ok := sc.lookup("provider.httpApi.payload"); ok {
+		httpAPIFormat = fmt.Sprint(v)
+	}
+	var httpAPICORS *corsConfig
+	if v, ok := sc.lookup("provider.httpApi.cors"); ok {
+		httpAPICORS, err = sc.parseCORS(v)
+		if err != nil {
+			return nil, fmt.Errorf("provider.httpApi.cors: %v", err)
+		}
+	}
+
+	functions, _ := sc.doc["functions"].(map[string]interface{})
+	var names []string
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var routes []*route
+	authorizers := map[string]*routeAuthorizer{}
+	corsRoutes := map[string][]*route{}
+	for _, name := range names {
+		fn, _ := functions[name].(map[string]interface{})
+		host, hasHost := lookupFunctionHost(hosts, name, "")
+		events, _ := fn["events"].([]interface{})
+		for i, e := range events {
+			event, _ := e.(map[string]interface{})
+			for eventType, properties := range event {
+				skip := func(reason string) {
+					fmt.Fprintf(os.Stderr, "Skipped serverless event %d (%s) of %s: %s\n", i+1, eventType, name, reason)
+				}
+				if eventType != "http" && eventType != "httpApi" {
+					skip("only http and httpApi events are supported")
+					continue
+				}
+				if !hasHost {
+					skip(fmt.Sprintf("no --function-port for %s", name))
+					continue
+				}
+
+				rt := &route{
+					lambdaHost:    host,
+					function:      name,
+					payloadFormat: "1.0",
+				}
+				method, eventPath, props, err := sc.parseEvent(eventType, properties)
+				if err != nil {
+					skip(err.Error())
+					continue
+				}
+				if eventType == "httpApi" {
+					rt.payloadFormat = httpAPIFormat
+					rt.cors = httpAPICORS
+					if props["authorizer"] != nil {
+						fmt.Fprintf(os.Stderr, "Note: the authorizer of serverless event %d (httpApi) of %s is not imported\n", i+1, name)
+					}
+				} else {
+					if v, ok := props["cors"]; ok {
+						rt.cors, err = sc.parseCORS(v)
+						if err != nil {
+							skip(fmt.Sprintf("cors: %v", err))
+							continue
+						}
+					}
+					if v, ok := props["authorizer"]; ok {
+						rt.authorizer, err = sc.parseAuthorizer(v, hosts, authorizers)
+						if err != nil {
+							skip(fmt.Sprintf("authorizer: %v", err))
+							continue
+						}
+					}
+				}
+				rt.method = method
+				if rt.payloadFormat != "1.0" && rt.payloadFormat != "2.0" {
+					skip(fmt.Sprintf("unsupported payload format %s", rt.payloadFormat))
+					continue
+				}
+				if eventFormat != "apigateway" {
+					rt.payloadFormat = ""
+				}
+				rt.resource, err = newResource(eventPath)
+				if err != nil {
+					skip(err.Error())
+					continue
+				}
+				routes = append(routes, rt)
+				if rt.cors != nil {
+					corsRoutes[eventPath] = append(corsRoutes[eventPath], rt)
+				}
+			}
+		}
+	}
+	return append(routes, preflightRoutes(routes, corsRoutes)...), nil
+}
+
+// parseEvent returns the method and the path of an http or httpApi event,
+// which are either a string like "GET /users" or an object with the method
+// and the path.
+func (sc *serverlessConfig) parseEvent(eventType string, properties interface{}) (string, string, map[string]interface{}, error) {
+	props := map[string]interface{}{}
+	var method, eventPath string
+	switch v := properties.(type) {
+	case string:
+		s, err := sc.resolve(v)
+		if err != nil {
+			return "", "", nil, err
+		}
+		if s == "*" {
+			method, eventPath = "*", ""
+		} else if m, p, ok := strings.Cut(s, " "); ok {
+			method, eventPath = m, strings.TrimSpace(p)
+		} else {
+			return "", "", nil, fmt.Errorf("invalid event %q", s)
+		}
+	case map[string]interface{}:
+		props = v
+		for key, dst := range map[string]*string{"method": &method, "path": &eventPath} {
+			if props[key] == nil {
+				continue
+			}
+			s, err := sc.resolve(fmt.Sprint(props[key]))
+			if err != nil {
+				return "", "", nil, err
+			}
+			*dst = s
+		}
+	default:
+		return "", "", nil, fmt.Errorf("invalid event")
+	}
+
+	method = strings.ToUpper(method)
+	if method == "" || method == "*" {
+		method = "ANY"
+	}
+	// An httpApi event without a path is the $default route
+	if eventType == "httpApi" && (eventPath == "" || eventPath == "*") {
+		eventPath = "/{proxy+}"
+	}
+	if !strings.HasPrefix(eventPath, "/") {
+		eventPath = "/" + eventPath
+	}
+	return method, eventPath, props, nil
+}
+
+// parseCORS parses the cors setting of an event, which is either true or an
+// object with origins, headers, allowCredentials and maxAge. The methods are
+// set by preflightRoutes.
+func (sc *serverlessConfig) parseCORS(v interface{}) (*corsConfig, error) {
+	cors := &corsConfig{
+		allowOrigins: []string{"*"},
+		allowHeaders: serverlessCORSHeaders,
+	}
+	switch v := v.(type) {
+	case bool:
+		if !v {
+			return nil, nil
+		}
+	case map[string]interface{}:
+		if origin, ok := v["origin"].(string); ok {
+			cors.allowOrigins = []string{origin}
+		}
+		if origins, ok := v["origins"]; ok {
+			cors.allowOrigins = stringsOf(origins)
+		} else if origins, ok := v["allowedOrigins"]; ok {
+			cors.allowOrigins = stringsOf(origins)
+		}
+		if headers, ok := v["headers"]; ok {
+			cors.allowHeaders = strings.Join(stringsOf(headers), ",")
+		} else if headers, ok := v["allowedHeaders"]; ok {
+			cors.allowHeaders = strings.Join(stringsOf(headers), ",")
+		}
+		if headers, ok := v["exposedResponseHeaders"]; ok {
+			cors.exposeHeaders = strings.Join(stringsOf(headers), ",")
+		}
+		cors.allowCredentials, _ = v["allowCredentials"].(bool)
+		if maxAge, ok := v["maxAge"].(int); ok {
+			cors.maxAge = maxAge
+		}
+	default:
+		return nil, fmt.Errorf("must be true or an object")
+	}
+	return cors, nil
+}
+
+func stringsOf(v interface{}) []string {
+	var list []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			list = append(list, fmt.Sprint(item))
+		}
+	case nil:
+	default:
+		list = append(list, fmt.Sprint(v))
+	}
+	return list
+}
+
+// parseAuthorizer parses the authorizer of an http event, which is the name of
+// another function, or an object with its name, type, identity source and
+// result TTL. Authorizers are shared by the events that use them.
+func (sc *serverlessConfig) parseAuthorizer(v interface{}, hosts map[string]string, authorizers map[string]*routeAuthorizer) (*routeAuthorizer, error) {
+	auth := &routeAuthorizer{
+		authorizerType: "TOKEN",
+		header:         "Authorization",
+		ttl:            300 * time.Second,
+	}
+	var name string
+	switch v := v.(type) {
+	case string:
+		name = v
+	case map[string]interface{}:
+		name, _ = v["name"].(string)
+		if t, ok := v["type"].(string); ok {
+			auth.authorizerType = strings.ToUpper(t)
+		}
+		if source, ok := v["identitySource"].(string); ok {
+			auth.header = strings.TrimPrefix(source, "method.request.header.")
+		}
+		if ttl, ok := v["resultTtlInSeconds"].(int); ok {
+			auth.ttl = time.Duration(ttl) * time.Second
+		}
+	}
+	if name == "" || strings.HasPrefix(name, "arn:") || strings.HasPrefix(name, "${") {
+		return nil, fmt.Errorf("only authorizers that are functions in serverless.yml are supported")
+	}
+	if auth.authorizerType != "TOKEN" && auth.authorizerType != "REQUEST" {
+		return nil, fmt.Errorf("unsupported type %s", auth.authorizerType)
+	}
+	key := fmt.Sprintf("%s %s %s %v", name, auth.authorizerType, auth.header, auth.ttl)
+	if authorizers[key] != nil {
+		return authorizers[key], nil
+	}
+	host, ok := lookupFunctionHost(hosts, name, "")
+	if !ok {
+		return nil, fmt.Errorf("no --function-port for %s", name)
+	}
+	auth.route = &route{lambdaHost: host, function: name}
+	authorizers[key] = auth
+	return auth, nil
+}
+
+// preflightRoutes adds an OPTIONS route for the paths with CORS enabled, which
+// answers preflight requests for the methods of the path, like the OPTIONS
+// method the Serverless Framework creates.
+func preflightRoutes(routes []*route, corsRoutes map[string][]*route) []*route {
+	var paths []string
+	for p := range corsRoutes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var preflight []*route
+	for _, p := range paths {
+		hasOptions := false
+		for _, rt := range routes {
+			if rt.method == "OPTIONS" && rt.resource.template == p {
+				hasOptions = true
+			}
+		}
+		methods := []string{"OPTIONS"}
+		for _, rt := range corsRoutes[p] {
+			if rt.method == "ANY" {
+				methods = []string{"*"}
+				break
+			}
+			methods = append(methods, rt.method)
+		}
+		for _, rt := range corsRoutes[p] {
+			cors := *rt.cors
+			cors.allowMethods = strings.Join(methods, ",")
+			rt.cors = &cors
+		}
+		if hasOptions {
+			continue
+		}
+		rt := *corsRoutes[p][0]
+		rt.method = "OPTIONS"
+		rt.authorizer = nil
+		preflight = append(preflight, &rt)
+	}
+	return preflight
+}
+
+// lookup returns the value at a dotted path like provider.stage.
+func (sc *serverlessConfig) lookup(path string) (interface{}, bool) {
+	var v interface{} = sc.doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+var serverlessVariableRegexp = regexp.MustCompile(`\$\{([^{}]+)\}`)
+
+// resolve replaces the ${self:...}, ${env:...}, ${opt:...} and ${sls:...}
+// variables in s. Variables can have a fallback after a comma, e.g.
+// ${env:STAGE, 'dev'}, and can be nested.
+func (sc *serverlessConfig) resolve(s string) (string, error) {
+	for i := 0; i < 10 && strings.Contains(s, "${"); i++ {
+		var err error
+		resolved := serverlessVariableRegexp.ReplaceAllStringFunc(s, func(m string) string {
+			v, ok := sc.variable(m[2 : len(m)-1])
+			if !ok && err == nil {
+				err = fmt.Errorf("can't resolve %s", m)
+			}
+			return v
+		})
+		if err != nil {
+			return "", err
+		}
+		s = resolved
+	}
+	if strings.Contains(s, "${") {
+		return "", fmt.Errorf("can't resolve %s", s)
+	}
+	return s, nil
+}
+
+func (sc *serverlessConfig) variable(expr string) (string, bool) {
+	for _, source := range strings.Split(expr, ",") {
+		source = strings.TrimSpace(source)
+		if len(source) >= 2 && (source[0] == '\'' || source[0] == '"') && source[len(source)-1] == source[0] {
+			return source[1 : len(source)-1], true
+		} else if n, err := strconv.Atoi(source); err == nil {
+			return strconv.Itoa(n), true
+		}
+
+		kind, name, _ := strings.Cut(source, ":")
+		switch kind {
+		case "self":
+			if v, ok := sc.lookup(name); ok {
+				if _, isMap := v.(map[string]interface{}); !isMap {
+					return fmt.Sprint(v), true
+				}
+			}
+		case "env":
+			if v, ok := os.LookupEnv(name); ok {
+				return v, true
+			}
+		case "opt", "sls":
+			// Without the CLI options, the stage and region are the ones in
+			// the provider section, or the framework's defaults
+			switch name {
+			case "stage":
+				if v, ok := sc.lookup("provider.stage"); ok && !sc.resolvingStage {
+					sc.resolvingStage = true
+					stage, err := sc.resolve(fmt.Sprint(v))
+					sc.resolvingStage = false
+					if err == nil {
+						return stage, true
+					}
+				}
+				return "dev", true
+			case "region":
+				if v, ok := sc.lookup("provider.region"); ok {
+					return fmt.Sprint(v), true
+				}
+				return "us-east-1", true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// slowRequestThreshold is SLOW_REQUEST_THRESHOLD. Requests that take longer
+// are logged with the time they spent in each phase. 0 turns it off.
+var slowRequestThreshold time.Duration
+
+// slowRequests counts the requests over SLOW_REQUEST_THRESHOLD, reported by
+// GET /stats.
+var slowRequests atomic.Int64
+
+// requestPhases is how long a request spent in each phase of the invocation.
+// The rest of the request's time is spent in the gateway, e.g. reading the
+// request body, or in the hooks and authorizers.
+type requestPhases struct {
+	// Marshalling the event to JSON
+	marshal time.Duration
+	// Getting a connection to the lambda, including the wait for a free one
+	dial time.Duration
+	// Waiting for the lambda to respond to Function.Invoke
+	invoke time.Duration
+	// Writing the response to the client
+	write time.Duration
+}
+
+func (p requestPhases) String() string {
+	return fmt.Sprintf("marshal %v, dial %v, invoke %v, write %v", p.marshal, p.dial, p.invoke, p.write)
+}
+
+// logSlowRequest logs the request if it took longer than
+// SLOW_REQUEST_THRESHOLD.
+func logSlowRequest(r *http.Request, inv *invocation, elapsed time.Duration) {
+	if slowRequestThreshold <= 0 || elapsed <= slowRequestThreshold || inv == nil {
+		return
+	}
+	slowRequests.Add(1)
+	log.Printf("Slow request (request id %s): %s %s took %v (%v)", inv.requestID, r.Method, r.URL.Path, elapsed.Round(time.Microsecond), inv.phases)
+}
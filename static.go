@@ -0,0 +1,130 @@
+package gateway
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// staticRoot is the STATIC_DIR directory, whose files are served for the
+// requests that don't go to the lambda. Files can't be opened outside of it,
+// also not through symlinks.
+var staticRoot *os.Root
+
+// staticLambdaPaths are the path prefixes that always go to the lambda when
+// STATIC_DIR is set. Without them, every path is tried in STATIC_DIR first.
+var staticLambdaPaths []string
+
+// staticMiss is what happens to requests that aren't in STATIC_DIR: "lambda"
+// passes them to the lambda, "404" returns a 404, and "spa" returns the
+// index.html to browsers, for single-page apps with client-side routing, and
+// a 404 to other clients.
+var staticMiss = "lambda"
+
+// staticRoute is used in the access log for requests answered with a file.
+var staticRoute = &route{
+	lambdaHost: "static",
+}
+
+// parseStaticLambdaPaths parses a comma-separated list of path prefixes,
+// e.g. /api,/auth.
+func parseStaticLambdaPaths(s string) ([]string, error) {
+	var prefixes []string
+	for _, prefix := range strings.Split(s, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		} else if !strings.HasPrefix(prefix, "/") {
+			return nil, errors.New("prefixes must start with /")
+		}
+		prefixes = append(prefixes, strings.TrimRight(prefix, "/"))
+	}
+	return prefixes, nil
+}
+
+// isStaticLambdaPath reports whether the path is under one of
+// STATIC_LAMBDA_PATHS.
+func isStaticLambdaPath(p string) bool {
+	for _, prefix := range staticLambdaPaths {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// staticFile returns the name of the file in STATIC_DIR for the path, which
+// is the index.html of directories, and whether the path is a directory.
+func staticFile(p string) (name string, dir bool, ok bool) {
+	name = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "."
+	}
+	fsys := staticRoot.FS()
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return "", false, false
+	} else if info.IsDir() {
+		name, dir = path.Join(name, "index.html"), true
+		if info, err = fs.Stat(fsys, name); err != nil {
+			return "", false, false
+		}
+	}
+	return name, dir, info.Mode().IsRegular()
+}
+
+// serveStatic serves the request from STATIC_DIR, and reports whether it
+// did. Only GET and HEAD requests are served, others go to the lambda.
+func serveStatic(w http.ResponseWriter, r *http.Request, inv *invocation) bool {
+	if staticRoot == nil || isStaticLambdaPath(r.URL.Path) {
+		return false
+	} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	name, dir, ok := staticFile(r.URL.Path)
+	if !ok {
+		if staticMiss == "lambda" {
+			return false
+		}
+		inv.route = staticRoute
+		if staticMiss == "spa" && strings.Contains(r.Header.Get("Accept"), "text/html") && serveSPAIndex(w, r) {
+			return true
+		}
+		(&gatewayError{"RESOURCE_NOT_FOUND", http.StatusNotFound, "Not Found"}).write(w, inv)
+		return true
+	}
+	inv.route = staticRoute
+	// Like http.FileServer, directories are redirected to a path with a
+	// trailing slash, and ServeFileFS redirects /index.html to the directory
+	if dir && !strings.HasSuffix(r.URL.Path, "/") {
+		target := path.Base(r.URL.Path) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return true
+	}
+	http.ServeFileFS(w, r, staticRoot.FS(), name)
+	return true
+}
+
+// serveSPAIndex serves the index.html of STATIC_DIR for a path that the
+// single-page app routes itself. It isn't cached, so a rebuilt app is used
+// right away.
+func serveSPAIndex(w http.ResponseWriter, r *http.Request) bool {
+	f, err := staticRoot.Open("index.html")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "index.html", time.Time{}, f)
+	return true
+}
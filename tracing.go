@@ -0,0 +1,332 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer exports OpenTelemetry spans with OTLP over HTTP, using the JSON
+// encoding. It is configured with the standard OTEL_* environment variables
+// and is nil unless an OTLP endpoint is set.
+var tracer *otlpExporter
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+// span is an OpenTelemetry span. The gateway starts a server span for every
+// request, and a client span for every lambda invocation.
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	errMessage string
+	failed     bool
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+var traceparentRegexp = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+var xrayRootRegexp = regexp.MustCompile(`Root=1-([0-9a-f]{8})-([0-9a-f]{24})`)
+
+// startServerSpan starts the span for a request. It continues the trace from
+// the traceparent header, or from the X-Amzn-Trace-Id header so that both
+// trace ids are the same. Otherwise a new trace id is generated, which is also
+// a valid X-Ray trace id.
+func startServerSpan(r *http.Request) *span {
+	s := &span{
+		kind:  spanKindServer,
+		name:  r.Method,
+		start: time.Now(),
+		attributes: map[string]interface{}{
+			"http.request.method": r.Method,
+			"url.path":            r.URL.Path,
+			"server.address":      r.Host,
+		},
+	}
+	randomBytes(s.spanID[:])
+	if m := traceparentRegexp.FindStringSubmatch(r.Header.Get("traceparent")); m != nil && m[1] != strings.Repeat("0", 32) {
+		hex.Decode(s.traceID[:], []byte(m[1]))
+		hex.Decode(s.parentID[:], []byte(m[2]))
+	} else if m := xrayRootRegexp.FindStringSubmatch(r.Header.Get("X-Amzn-Trace-Id")); m != nil {
+		hex.Decode(s.traceID[:], []byte(m[1]+m[2]))
+	} else {
+		randomBytes(s.traceID[4:])
+		epoch := uint32(time.Now().Unix())
+		s.traceID[0], s.traceID[1], s.traceID[2], s.traceID[3] = byte(epoch>>24), byte(epoch>>16), byte(epoch>>8), byte(epoch)
+	}
+	return s
+}
+
+// child returns a new span in the same trace. It is started by the caller.
+func (s *span) child(name string, kind int) *span {
+	c := &span{
+		traceID:    s.traceID,
+		parentID:   s.spanID,
+		name:       name,
+		kind:       kind,
+		attributes: map[string]interface{}{},
+	}
+	randomBytes(c.spanID[:])
+	return c
+}
+
+// traceparent returns the W3C trace context header for the span.
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// xrayTraceID returns the span's trace id in the format of the
+// X-Amzn-Trace-Id header.
+func (s *span) xrayTraceID() string {
+	return fmt.Sprintf("Root=1-%x-%x", s.traceID[:4], s.traceID[4:])
+}
+
+func (s *span) setError(err error) {
+	s.failed = true
+	s.errMessage = err.Error()
+	s.attributes["error.type"] = errorType(err)
+}
+
+// finish ends the span and queues it for export.
+func (s *span) finish() {
+	s.end = time.Now()
+	tracer.export(s)
+}
+
+// otlpExporter sends spans in batches, so exporting doesn't slow down
+// requests. Spans are dropped if the queue is full.
+type otlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	timeout     time.Duration
+	serviceName string
+	resource    map[string]string
+	client      *http.Client
+
+	queue chan *span
+	done  chan struct{}
+	once  sync.Once
+}
+
+// newOTLPExporter configures the exporter from the standard environment
+// variables. It returns nil if tracing is not configured.
+func newOTLPExporter() (*otlpExporter, error) {
+	if b, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); b {
+		return nil, nil
+	}
+	if v := os.Getenv("OTEL_TRACES_EXPORTER"); v != "" && v != "otlp" {
+		return nil, nil
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("Invalid OTLP endpoint: %v", err)
+	}
+	if protocol := otelEnv("PROTOCOL"); protocol != "" && protocol != "http/json" {
+		return nil, fmt.Errorf("Unsupported OTEL_EXPORTER_OTLP_PROTOCOL: %s (must be http/json)", protocol)
+	}
+
+	e := &otlpExporter{
+		endpoint:    endpoint,
+		headers:     parseOTelList(otelEnv("HEADERS")),
+		timeout:     10 * time.Second,
+		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
+		resource:    parseOTelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")),
+		queue:       make(chan *span, 2048),
+		done:        make(chan struct{}),
+	}
+	if v := otelEnv("TIMEOUT"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("Invalid OTEL_EXPORTER_OTLP_TIMEOUT: %s", v)
+		}
+		e.timeout = time.Duration(ms) * time.Millisecond
+	}
+	if e.serviceName == "" {
+		e.serviceName = e.resource["service.name"]
+	}
+	if e.serviceName == "" {
+		e.serviceName = "go-lambda-gateway"
+	}
+	e.client = &http.Client{Timeout: e.timeout}
+	go e.run()
+	return e, nil
+}
+
+// otelEnv returns the traces-specific variable if it is set, e.g.
+// OTEL_EXPORTER_OTLP_TRACES_HEADERS, or else the general one.
+func otelEnv(name string) string {
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_" + name); v != "" {
+		return v
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+}
+
+// parseOTelList parses a list of key=value pairs with URL-encoded values, as
+// used by OTEL_EXPORTER_OTLP_HEADERS and OTEL_RESOURCE_ATTRIBUTES.
+func parseOTelList(s string) map[string]string {
+	m := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+		m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return m
+}
+
+func (e *otlpExporter) export(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.done:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			e.done <- struct{}{}
+			return
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+// shutdown sends the queued spans.
+func (e *otlpExporter) shutdown() {
+	e.once.Do(func() {
+		e.done <- struct{}{}
+		<-e.done
+	})
+}
+
+func (e *otlpExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	var spans []map[string]interface{}
+	for _, s := range batch {
+		o := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			o["status"] = map[string]interface{}{"code": 2, "message": s.errMessage}
+		}
+		spans = append(spans, o)
+	}
+	resource := map[string]interface{}{}
+	for key, value := range e.resource {
+		resource[key] = value
+	}
+	resource["service.name"] = e.serviceName
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "go-lambda-gateway", "version": gatewayVersion()},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("Error encoding spans: %v", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error exporting spans: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("Error exporting spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Error exporting spans: %s returned %s", e.endpoint, resp.Status)
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	list := []interface{}{}
+	for key, value := range attributes {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": v})
+	}
+	return list
+}
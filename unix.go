@@ -0,0 +1,39 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenUnix listens on a unix domain socket. A stale socket file left behind
+// by a previous run is removed first. The socket file is removed again when
+// the listener is closed.
+func listenUnix(path string, mode string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("invalid LISTEN_SOCKET_MODE: %v", err)
+		}
+		if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// usagePlan throttles the requests made with an API key with a token bucket,
+// and limits the number of requests per day if quota is set. A rate of 0
+// disables throttling.
+type usagePlan struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	quota  int
+	tokens float64
+	last   time.Time
+	used   int
+	day    time.Time
+}
+
+var (
+	errTooManyRequests = &gatewayError{"THROTTLED", http.StatusTooManyRequests, "Too Many Requests"}
+	errLimitExceeded   = &gatewayError{"QUOTA_EXCEEDED", http.StatusTooManyRequests, "Limit Exceeded"}
+)
+
+func newUsagePlan(rate float64, burst int, quota int) *usagePlan {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &usagePlan{
+		rate:   rate,
+		burst:  burst,
+		quota:  quota,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket and counts the request against the
+// quota, which is reset at midnight UTC like API Gateway's daily quotas.
+func (p *usagePlan) allow() *gatewayError {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.refill(now)
+	if p.quota > 0 && p.used >= p.quota {
+		return errLimitExceeded
+	}
+	if p.rate > 0 {
+		if p.tokens < 1 {
+			return errTooManyRequests
+		}
+		p.tokens--
+	}
+	p.used++
+	return nil
+}
+
+func (p *usagePlan) refill(now time.Time) {
+	if day := now.UTC().Truncate(24 * time.Hour); !day.Equal(p.day) {
+		p.day = day
+		p.used = 0
+	}
+	p.tokens = math.Min(float64(p.burst), p.tokens+now.Sub(p.last).Seconds()*p.rate)
+	p.last = now
+}
+
+// usageStatus is the state of a usage plan as shown by the usage endpoint.
+type usageStatus struct {
+	RateLimit       float64 `json:"rateLimit"`
+	BurstLimit      int     `json:"burstLimit"`
+	TokensAvailable float64 `json:"tokensAvailable"`
+	Quota           int     `json:"quota,omitempty"`
+	Used            int     `json:"used"`
+	Remaining       *int    `json:"remaining,omitempty"`
+}
+
+func (p *usagePlan) status() usageStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refill(time.Now())
+	status := usageStatus{
+		RateLimit:       p.rate,
+		BurstLimit:      p.burst,
+		TokensAvailable: math.Floor(p.tokens),
+		Quota:           p.quota,
+		Used:            p.used,
+	}
+	if p.quota > 0 {
+		remaining := p.quota - p.used
+		status.Remaining = &remaining
+	}
+	return status
+}
+
+// handleAdminUsage lists the usage of every API key, so tests can assert how
+// much of the quota is left.
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	usage := map[string]usageStatus{}
+	for _, key := range apiKeys {
+		usage[key.id] = key.plan.status()
+	}
+	writeAdminJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestUsagePlanBurst(t *testing.T) {
+	p := newUsagePlan(1, 2, 0)
+	for i := 0; i < 2; i++ {
+		if err := p.allow(); err != nil {
+			t.Fatalf("request %d: %v", i+1, err.message)
+		}
+	}
+	if err := p.allow(); err != errTooManyRequests {
+		t.Errorf("got %v, want Too Many Requests", err)
+	}
+}
+
+func TestUsagePlanQuota(t *testing.T) {
+	lambda := startTestLambda(t, func(payload []byte) (interface{}, error) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	handler := newTestGateway(t, WithLambdaHost(lambda), WithOption("API_KEYS", "secret"), WithOption("USAGE_PLAN_QUOTA", "3"))
+
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("x-api-key", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := request(); w.Code != http.StatusOK {
+			t.Fatalf("request %d got %d", i+1, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleAdminUsage(w, httptest.NewRequest("GET", "/usage", nil))
+	var usage map[string]usageStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	status := usage[apiKeys["secret"].id]
+	if status.Used != 2 || status.Remaining == nil || *status.Remaining != 1 {
+		t.Errorf("got usage %s", w.Body.String())
+	}
+
+	request()
+	if w := request(); w.Code != http.StatusTooManyRequests || w.Body.String() != `{"message":"Limit Exceeded"}` {
+		t.Errorf("the request over the quota got %d %q", w.Code, w.Body.String())
+	}
+
+	// The usage is only on the admin API, the path goes to the lambda
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/_gateway/usage", nil))
+	if strings.Contains(w.Body.String(), "remaining") {
+		t.Errorf("/_gateway/usage shows the usage: %s", w.Body.String())
+	}
+}
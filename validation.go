@@ -0,0 +1,399 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// requestValidator validates the requests of an operation from an OpenAPI
+// document before the lambda is invoked, like an API Gateway request
+// validator.
+type requestValidator struct {
+	method             string
+	resource           *resource
+	doc                *openAPIDocument
+	parameters         []*openAPIParameter
+	body               map[string]interface{}
+	bodyRequired       bool
+	validateBody       bool
+	validateParameters bool
+}
+
+type openAPIParameter struct {
+	name     string
+	in       string
+	required bool
+	schema   map[string]interface{}
+}
+
+// addValidators adds the validators imported from an OpenAPI document.
+func (c *reloadableConfig) addValidators(validators []*requestValidator) {
+	for _, v := range validators {
+		v.resource = c.addResource(v.resource)
+		c.validators = append(c.validators, v)
+		var validated []string
+		if v.validateBody && v.body != nil {
+			validated = append(validated, "body")
+		}
+		if v.validateParameters && len(v.parameters) > 0 {
+			validated = append(validated, "parameters")
+		}
+		if len(validated) > 0 {
+			fmt.Fprintf(os.Stderr, "Request validation: %s %s (%s)\n", v.method, v.resource.template, strings.Join(validated, ", "))
+		}
+	}
+}
+
+// matchValidator finds the validator for the request's method and path, with
+// the same precedence as the imported routes.
+func (c *reloadableConfig) matchValidator(r *http.Request) *requestValidator {
+	var best *requestValidator
+	var bestScore []int
+	for _, v := range c.validators {
+		if v.method != "ANY" && v.method != r.Method {
+			continue
+		}
+		_, score, ok := v.resource.match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		if best == nil || compareScores(score, bestScore) > 0 || (compareScores(score, bestScore) == 0 && best.method == "ANY") {
+			best, bestScore = v, score
+		}
+	}
+	return best
+}
+
+// validate checks the request's parameters and JSON body. The error
+// describes the violation, and the gateway error is what the client gets.
+func (v *requestValidator) validate(r *http.Request, body []byte) (*gatewayError, error) {
+	if v.validateParameters {
+		pathParams, _, _ := v.resource.match(r.URL.EscapedPath())
+		query := parseQuery(r.URL.RawQuery)
+		var missing []string
+		for _, p := range v.parameters {
+			var values []string
+			switch p.in {
+			case "path":
+				if value, ok := pathParams[p.name]; ok {
+					values = []string{value}
+				}
+			case "query":
+				values = query[p.name]
+			case "header":
+				values = r.Header.Values(p.name)
+			}
+			if len(values) == 0 {
+				if p.required {
+					missing = append(missing, p.name)
+				}
+				continue
+			}
+			if p.schema == nil {
+				continue
+			}
+			if err := v.doc.validateSchema(p.schema, parameterValue(v.doc, p.schema, values), p.in+" parameter "+p.name); err != nil {
+				return &gatewayError{"BAD_REQUEST_PARAMETERS", http.StatusBadRequest, "Invalid request parameters"}, err
+			}
+		}
+		if len(missing) > 0 {
+			message := fmt.Sprintf("Missing required request parameters: [%s]", strings.Join(missing, ", "))
+			return &gatewayError{"BAD_REQUEST_PARAMETERS", http.StatusBadRequest, message}, fmt.Errorf("%s", message)
+		}
+	}
+
+	if v.validateBody && v.body != nil {
+		errInvalidBody := &gatewayError{"BAD_REQUEST_BODY", http.StatusBadRequest, "Invalid request body"}
+		if len(body) == 0 {
+			if v.bodyRequired {
+				return errInvalidBody, fmt.Errorf("the body is required")
+			}
+			return nil, nil
+		}
+		// Only JSON bodies can be validated against a schema
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || !isJSONMediaType(mediaType) {
+				return nil, nil
+			}
+		}
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			return errInvalidBody, fmt.Errorf("the body is not valid JSON: %v", err)
+		}
+		if err := v.doc.validateSchema(v.body, value, "body"); err != nil {
+			return errInvalidBody, err
+		}
+	}
+	return nil, nil
+}
+
+// parameterValue converts the values of a parameter to the type of its
+// schema, so they can be validated like JSON. Values that can't be converted
+// are kept as strings and fail the validation.
+func parameterValue(d *openAPIDocument, schema map[string]interface{}, values []string) interface{} {
+	schema, _ = d.resolve(schema).(map[string]interface{})
+	if schemaTypes(schema)["array"] {
+		if len(values) == 1 {
+			values = strings.Split(values[0], ",")
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		list := []interface{}{}
+		for _, value := range values {
+			list = append(list, parameterValue(d, items, []string{value}))
+		}
+		return list
+	}
+	value := values[len(values)-1]
+	types := schemaTypes(schema)
+	if types["integer"] || types["number"] {
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	} else if types["boolean"] {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+// schemaTypes returns the types a schema allows, which is a string or a list
+// of strings.
+func schemaTypes(schema map[string]interface{}) map[string]bool {
+	types := map[string]bool{}
+	switch t := schema["type"].(type) {
+	case string:
+		types[t] = true
+	case []interface{}:
+		for _, t := range t {
+			types[fmt.Sprint(t)] = true
+		}
+	}
+	return types
+}
+
+// validateSchema validates a value against the JSON schema keywords OpenAPI
+// supports. Formats are not checked. The error names the first violation and
+// where it is, e.g. body.items[0].name.
+func (d *openAPIDocument) validateSchema(s interface{}, value interface{}, where string) error {
+	schema, ok := d.resolve(s).(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if value == nil && schema["nullable"] == true {
+		return nil
+	}
+
+	for _, sub := range asList(schema["allOf"]) {
+		if err := d.validateSchema(sub, value, where); err != nil {
+			return err
+		}
+	}
+	if anyOf := asList(schema["anyOf"]); len(anyOf) > 0 {
+		matched := false
+		for _, sub := range anyOf {
+			if d.validateSchema(sub, value, where) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: doesn't match any of the schemas in anyOf", where)
+		}
+	}
+	if oneOf := asList(schema["oneOf"]); len(oneOf) > 0 {
+		matched := 0
+		for _, sub := range oneOf {
+			if d.validateSchema(sub, value, where) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d of the schemas in oneOf instead of exactly one", where, matched)
+		}
+	}
+	if not, ok := schema["not"]; ok && d.validateSchema(not, value, where) == nil {
+		return fmt.Errorf("%s: matches the schema in not", where)
+	}
+
+	if types := schemaTypes(schema); len(types) > 0 {
+		t := jsonType(value)
+		if !types[t] && !(t == "integer" && types["number"]) {
+			var expected []string
+			for t := range types {
+				expected = append(expected, t)
+			}
+			sort.Strings(expected)
+			return fmt.Errorf("%s: expected %s, got %s", where, strings.Join(expected, " or "), jsonTypeName(value))
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if jsonEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %s is not one of the allowed values", where, jsonString(value))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if n, ok := schemaNumber(schema, "minLength"); ok && float64(length) < n {
+			return fmt.Errorf("%s: shorter than %v characters", where, n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && float64(length) > n {
+			return fmt.Errorf("%s: longer than %v characters", where, n)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(value) {
+				return fmt.Errorf("%s: doesn't match the pattern %s", where, pattern)
+			}
+		}
+	case float64:
+		if n, ok := schemaNumber(schema, "minimum"); ok && (value < n || value == n && schema["exclusiveMinimum"] == true) {
+			return fmt.Errorf("%s: %v is less than the minimum %v", where, value, n)
+		}
+		if n, ok := schemaNumber(schema, "maximum"); ok && (value > n || value == n && schema["exclusiveMaximum"] == true) {
+			return fmt.Errorf("%s: %v is greater than the maximum %v", where, value, n)
+		}
+		// OpenAPI 3.1 uses numbers for the exclusive limits
+		if n, ok := schemaNumber(schema, "exclusiveMinimum"); ok && value <= n {
+			return fmt.Errorf("%s: %v is not greater than %v", where, value, n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMaximum"); ok && value >= n {
+			return fmt.Errorf("%s: %v is not less than %v", where, value, n)
+		}
+		if n, ok := schemaNumber(schema, "multipleOf"); ok && n > 0 && math.Abs(math.Remainder(value, n)) > 1e-9 {
+			return fmt.Errorf("%s: %v is not a multiple of %v", where, value, n)
+		}
+	case []interface{}:
+		if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(value)) < n {
+			return fmt.Errorf("%s: fewer than %v items", where, n)
+		}
+		if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(value)) > n {
+			return fmt.Errorf("%s: more than %v items", where, n)
+		}
+		if schema["uniqueItems"] == true {
+			seen := map[string]bool{}
+			for _, item := range value {
+				s := jsonString(item)
+				if seen[s] {
+					return fmt.Errorf("%s: %s is not unique", where, s)
+				}
+				seen[s] = true
+			}
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range value {
+				if err := d.validateSchema(items, item, fmt.Sprintf("%s[%d]", where, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range asList(schema["required"]) {
+			if _, ok := value[fmt.Sprint(name)]; !ok {
+				return fmt.Errorf("%s: missing required property %s", where, name)
+			}
+		}
+		if n, ok := schemaNumber(schema, "minProperties"); ok && float64(len(value)) < n {
+			return fmt.Errorf("%s: fewer than %v properties", where, n)
+		}
+		if n, ok := schemaNumber(schema, "maxProperties"); ok && float64(len(value)) > n {
+			return fmt.Errorf("%s: more than %v properties", where, n)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		var names []string
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if propertySchema, ok := properties[name]; ok {
+				if err := d.validateSchema(propertySchema, value[name], where+"."+name); err != nil {
+					return err
+				}
+			} else if additional, ok := schema["additionalProperties"]; ok {
+				if additional == false {
+					return fmt.Errorf("%s: property %s is not allowed", where, name)
+				} else if err := d.validateSchema(additional, value[name], where+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func asList(v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	return list
+}
+
+// schemaNumber returns a numeric keyword. YAML documents have ints and
+// floats, JSON documents are decoded by the YAML decoder as well.
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	switch n := schema[key].(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// jsonType returns the JSON schema type of a decoded value. Whole numbers are
+// integers.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+func jsonTypeName(v interface{}) string {
+	if t := jsonType(v); t != "integer" {
+		return t
+	}
+	return "number"
+}
+
+func jsonString(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// jsonEqual compares values from the document and the request, which have
+// different number types.
+func jsonEqual(a, b interface{}) bool {
+	return jsonString(a) == jsonString(b)
+}
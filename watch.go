@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lambdaWatcher rebuilds and restarts the lambda when its source changes, or
+// is nil unless --watch is used.
+var lambdaWatcher *sourceWatcher
+
+// watchPollInterval is how often the watched directories are checked for
+// changes. The lambda is rebuilt once the files stop changing, so saving
+// several files at once only causes one build.
+const watchPollInterval = 500 * time.Millisecond
+
+// buildError is returned for requests to the lambda while its last build
+// failed.
+type buildError struct {
+	output string
+}
+
+func (e *buildError) Error() string {
+	return "the lambda failed to build"
+}
+
+// write shows the compiler output, so build errors show up in the browser.
+func (e *buildError) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, "The lambda failed to build:\n\n%s", e.output)
+}
+
+// sourceWatcher polls the lambda's source files, like the config file is
+// polled, and rebuilds the lambda when they change.
+type sourceWatcher struct {
+	dirs    []string
+	command []string
+	binary  string
+	process *lambdaProcess
+	started bool
+	last    uint64
+}
+
+// newSourceWatcher watches the comma-separated directories. The lambda is
+// built with go build into a temporary directory and started from there,
+// unless a build command is configured, which has to be used with --run.
+func newSourceWatcher(dirs string, buildCommand string) (*sourceWatcher, error) {
+	w := &sourceWatcher{}
+	for _, dir := range strings.Split(dirs, ",") {
+		if dir = strings.TrimSpace(dir); dir == "" {
+			continue
+		}
+		if fi, err := os.Stat(dir); err != nil {
+			return nil, err
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", dir)
+		}
+		w.dirs = append(w.dirs, dir)
+	}
+	if len(w.dirs) == 0 {
+		return nil, fmt.Errorf("no directories")
+	}
+
+	if buildCommand != "" {
+		if childLambda == nil {
+			return nil, fmt.Errorf("WATCH_BUILD_COMMAND requires --run")
+		}
+		w.command = strings.Fields(buildCommand)
+		w.process = childLambda
+	} else {
+		if childLambda != nil {
+			return nil, fmt.Errorf("--run requires WATCH_BUILD_COMMAND, the lambda is built and started by the gateway otherwise")
+		}
+		abs, err := filepath.Abs(w.dirs[0])
+		if err != nil {
+			return nil, err
+		}
+		tempDir, err := os.MkdirTemp("", "go-lambda-gateway-")
+		if err != nil {
+			return nil, err
+		}
+		w.binary = filepath.Join(tempDir, filepath.Base(abs))
+		w.command = []string{"go", "build", "-o", w.binary + ".new", "./..."}
+		w.process, err = newLambdaProcess(w.binary)
+		if err != nil {
+			return nil, err
+		}
+		w.process.tempDir = tempDir
+		childLambda = w.process
+	}
+	w.last = w.fingerprint()
+	return w, nil
+}
+
+// fingerprint hashes the names, sizes and modification times of the Go
+// source files. Hidden directories are skipped.
+func (w *sourceWatcher) fingerprint() uint64 {
+	h := fnv.New64a()
+	for _, dir := range w.dirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			name := d.Name()
+			if d.IsDir() {
+				if path != dir && strings.HasPrefix(name, ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(name, ".go") && name != "go.mod" && name != "go.sum" {
+				return nil
+			}
+			if fi, err := d.Info(); err == nil {
+				fmt.Fprintf(h, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+			}
+			return nil
+		})
+	}
+	return h.Sum64()
+}
+
+// watch rebuilds the lambda when the source files changed, and didn't change
+// again since the last check. Requests are held from when the change is
+// noticed, so a request made right after saving a file uses the new build.
+func (w *sourceWatcher) watch() {
+	changed := false
+	for range time.Tick(watchPollInterval) {
+		if w.process.isStopping() {
+			return
+		}
+		if fp := w.fingerprint(); fp != w.last {
+			w.last = fp
+			changed = true
+			w.process.holdRequests()
+		} else if changed {
+			changed = false
+			log.Printf("Source files changed in %s", strings.Join(w.dirs, ", "))
+			w.rebuild()
+		}
+	}
+}
+
+// rebuild builds the lambda and restarts it. Requests wait until the new
+// lambda accepts connections, or get the build output if the build failed.
+// The lambda that is running keeps running in that case, but isn't used.
+func (w *sourceWatcher) rebuild() {
+	p := w.process
+	p.holdRequests()
+	defer p.releaseRequests()
+
+	log.Printf("Building lambda: %s", strings.Join(w.command, " "))
+	start := time.Now()
+	cmd := exec.Command(w.command[0], w.command[1:]...)
+	cmd.Dir = w.dirs[0]
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("Build failed (%v):\n%s", err, output)
+		p.setBuildError(&buildError{string(output)})
+		return
+	}
+	if w.binary != "" {
+		// Renaming the binary doesn't affect the lambda that is running
+		if err := os.Rename(w.binary+".new", w.binary); err != nil {
+			log.Printf("Build failed: %v", err)
+			p.setBuildError(&buildError{err.Error()})
+			return
+		}
+	}
+	p.setBuildError(nil)
+	log.Printf("Built lambda in %v", time.Since(start).Round(time.Millisecond))
+
+	if !w.started {
+		w.started = true
+		go p.run()
+	} else {
+		p.restart()
+	}
+	if err := p.waitReady(childReadyTimeout); err != nil {
+		log.Print(err)
+	}
+}
+
+// holdRequests makes requests to the lambda wait until releaseRequests is
+// called.
+func (p *lambdaProcess) holdRequests() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hold == nil {
+		p.hold = make(chan struct{})
+	}
+}
+
+func (p *lambdaProcess) releaseRequests() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hold != nil {
+		close(p.hold)
+		p.hold = nil
+	}
+}
+
+func (p *lambdaProcess) setBuildError(err *buildError) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buildErr = err
+}
+
+// waitForBuild holds a request while the lambda is rebuilt, for up to the
+// timeout. It returns the build error if the last build failed.
+func (p *lambdaProcess) waitForBuild(timeout time.Duration) error {
+	p.mu.Lock()
+	hold := p.hold
+	p.mu.Unlock()
+	if hold != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-hold:
+		case <-timer.C:
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.buildErr != nil {
+		return p.buildErr
+	}
+	return nil
+}
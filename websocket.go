@@ -0,0 +1,554 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// With EVENT_FORMAT=websocket, the gateway emulates a WebSocket API. Every
+// connection invokes the lambda with a $connect event, every message with
+// the route key selected by the route selection expression, and the closed
+// connection with a $disconnect event. The lambda sends messages to the
+// clients with the @connections API.
+var websocketRouteSelection []string
+var websocketRoutes map[string]bool
+
+// websocketGUID is appended to the client's key in the handshake (RFC 6455).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketMessage is API Gateway's limit for the size of a message.
+const maxWebSocketMessage = 128 * 1024
+
+// The opcodes of WebSocket frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// The status codes of close frames.
+const (
+	closeGoingAway       = 1001
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeNoStatus        = 1005
+	closeAbnormal        = 1006
+	closeMessageTooBig   = 1009
+)
+
+var connectionsPathRegexp = regexp.MustCompile(`^(?:/[^/@]+)?/@connections/([^/]+)$`)
+
+var websocketConnections = struct {
+	sync.Mutex
+	m map[string]*websocketConnection
+}{m: map[string]*websocketConnection{}}
+
+// errWebSocketClosed is returned when a frame is read after the connection
+// was closed by either side.
+var errWebSocketClosed = errors.New("websocket connection closed")
+
+type websocketConnection struct {
+	id             string
+	conn           net.Conn
+	reader         *bufio.Reader
+	writeMu        sync.Mutex
+	route          *route
+	header         http.Header
+	host           string
+	stageVariables map[string]string
+	identity       events.APIGatewayRequestIdentity
+	connectedAt    time.Time
+	lastActiveAt   atomic.Int64
+	closeOnce      sync.Once
+	closeCode      int
+	closeReason    string
+}
+
+// parseRouteSelection parses a route selection expression, which selects the
+// route key from a property of the message, e.g. $request.body.action.
+func parseRouteSelection(expression string) ([]string, error) {
+	path, ok := strings.CutPrefix(expression, "$request.body.")
+	if !ok || path == "" {
+		return nil, errors.New("must be $request.body.<property>")
+	}
+	return strings.Split(path, "."), nil
+}
+
+// selectRouteKey evaluates the route selection expression with the message.
+// Messages that aren't JSON, or that don't select a configured route, use the
+// $default route.
+func selectRouteKey(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "$default"
+	}
+	for _, name := range websocketRouteSelection {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return "$default"
+		}
+		v = object[name]
+	}
+	key, ok := v.(string)
+	if !ok || key == "" || websocketRoutes != nil && !websocketRoutes[key] {
+		return "$default"
+	}
+	return key
+}
+
+func newConnectionID() string {
+	var b [11]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return base64.URLEncoding.EncodeToString(b[:])
+}
+
+// handleWebSocket handles the requests of a WebSocket API: the handshake of
+// new connections, and the @connections API.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if m := connectionsPathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+		handleConnections(w, r, m[1])
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		w.Header().Set("Upgrade", "websocket")
+		(&gatewayError{"DEFAULT_4XX", http.StatusUpgradeRequired, "Upgrade Required"}).write(w, nil)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		(&gatewayError{"DEFAULT_4XX", http.StatusBadRequest, "Unsupported WebSocket version"}).write(w, nil)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		(&gatewayError{"DEFAULT_4XX", http.StatusBadRequest, "WebSockets require HTTP/1.1"}).write(w, nil)
+		return
+	}
+	inv, err := newInvocation(r)
+	if err != nil {
+		(&gatewayError{"BAD_REQUEST_PARAMETERS", http.StatusBadRequest, err.Error()}).write(w, nil)
+		return
+	}
+	inv.route = inv.config.matchRoute(r).pick()
+	setForwardedHeaders(r)
+	r = overrideHost(r)
+
+	c := &websocketConnection{
+		id:             newConnectionID(),
+		route:          inv.route,
+		header:         r.Header.Clone(),
+		host:           r.Host,
+		stageVariables: inv.stageVariables,
+		connectedAt:    time.Now(),
+	}
+	c.identity = staticIdentity
+	c.identity.SourceIP = sourceIP(r)
+	c.identity.UserAgent = r.UserAgent()
+	c.identity.CognitoIdentityID = inv.cognitoIdentityID
+	c.identity.CognitoIdentityPoolID = inv.cognitoIdentityPoolID
+	c.lastActiveAt.Store(c.connectedAt.UnixNano())
+
+	// The connection is only accepted if the $connect route succeeds
+	event := c.newEvent(inv, "CONNECT", "$connect")
+	event.Headers, event.MultiValueHeaders = c.eventHeaders()
+	for key, values := range parseQuery(r.URL.RawQuery) {
+		if event.QueryStringParameters == nil {
+			event.QueryStringParameters = map[string]string{}
+			event.MultiValueQueryStringParameters = map[string][]string{}
+		}
+		event.QueryStringParameters[key] = values[len(values)-1]
+		event.MultiValueQueryStringParameters[key] = values
+	}
+	response, err := c.invoke(inv, event)
+	if err != nil {
+		(&gatewayError{"DEFAULT_5XX", http.StatusBadGateway, "Internal server error"}).write(w, inv)
+		return
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		log.Printf("WebSocket connection %s was rejected with status %d (request id %s)", c.id, response.StatusCode, inv.requestID)
+		w.WriteHeader(response.StatusCode)
+		io.WriteString(w, response.Body)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error accepting WebSocket connection: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c.conn = conn
+	c.reader = rw.Reader
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n"
+	// The $connect route chooses the subprotocol, just like in API Gateway
+	responseHeader := http.Header{}
+	mergeResponseHeaders(responseHeader, response.Headers, response.MultiValueHeaders)
+	if protocol := responseHeader.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		handshake += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	if _, err := io.WriteString(conn, handshake+"\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+
+	websocketConnections.Lock()
+	websocketConnections.m[c.id] = c
+	websocketConnections.Unlock()
+	log.Printf("WebSocket connection %s opened from %s", c.id, c.identity.SourceIP)
+	c.serve()
+}
+
+// serve reads the client's messages until the connection is closed. Every
+// message invokes the lambda separately, so a slow invocation doesn't hold
+// up the next message, like in API Gateway.
+func (c *websocketConnection) serve() {
+	var wg sync.WaitGroup
+	for {
+		opcode, message, err := c.readMessage()
+		if err != nil {
+			break
+		}
+		c.lastActiveAt.Store(time.Now().UnixNano())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.handleMessage(opcode, message)
+		}()
+	}
+	c.close(closeAbnormal, "")
+
+	// The connection is gone before the $disconnect route is invoked, so the
+	// lambda can't send to it anymore
+	websocketConnections.Lock()
+	delete(websocketConnections.m, c.id)
+	websocketConnections.Unlock()
+	wg.Wait()
+
+	inv := c.newInvocation()
+	event := c.newEvent(inv, "DISCONNECT", "$disconnect")
+	event.Headers, event.MultiValueHeaders = c.eventHeaders()
+	event.RequestContext.DisconnectStatusCode = int64(c.closeCode)
+	event.RequestContext.DisconnectReason = &c.closeReason
+	c.invoke(inv, event)
+	log.Printf("WebSocket connection %s closed (%d)", c.id, c.closeCode)
+}
+
+func (c *websocketConnection) handleMessage(opcode byte, message []byte) {
+	inv := c.newInvocation()
+	event := c.newEvent(inv, "MESSAGE", selectRouteKey(message))
+	event.RequestContext.MessageID = newConnectionID()
+	if opcode == opBinary {
+		event.Body = base64.StdEncoding.EncodeToString(message)
+		event.IsBase64Encoded = true
+	} else {
+		event.Body = string(message)
+	}
+	response, err := c.invoke(inv, event)
+	if err != nil {
+		// The connection stays open, the client only gets an error message
+		body, _ := json.Marshal(map[string]string{
+			"message":      "Internal server error",
+			"connectionId": c.id,
+			"requestId":    inv.requestID,
+		})
+		c.writeFrame(opText, body)
+		return
+	}
+	// A body is sent back to the client, like with a route response
+	if response.Body != "" {
+		data := []byte(response.Body)
+		if response.IsBase64Encoded {
+			if data, err = base64.StdEncoding.DecodeString(response.Body); err != nil {
+				log.Printf("Error decoding the lambda response (request id %s): %v", inv.requestID, err)
+				return
+			}
+		}
+		c.send(data)
+	}
+}
+
+// newInvocation returns an invocation for an event of the connection. Only
+// the $connect event belongs to an HTTP request.
+func (c *websocketConnection) newInvocation() *invocation {
+	inv := &invocation{
+		requestID:             newUUID(),
+		clientContext:         staticClientContext,
+		cognitoIdentityID:     c.identity.CognitoIdentityID,
+		cognitoIdentityPoolID: c.identity.CognitoIdentityPoolID,
+		stageVariables:        c.stageVariables,
+		config:                currentConfig.Load(),
+		route:                 c.route,
+	}
+	if !disableTraceID {
+		inv.traceID = newTraceID()
+	}
+	return inv
+}
+
+func (c *websocketConnection) newEvent(inv *invocation, eventType string, routeKey string) *events.APIGatewayWebsocketProxyRequest {
+	now := time.Now()
+	return &events.APIGatewayWebsocketProxyRequest{
+		StageVariables: inv.stageVariables,
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			Stage:             stage,
+			RequestID:         inv.requestID,
+			Identity:          c.identity,
+			APIID:             apiID,
+			ConnectedAt:       c.connectedAt.UnixNano() / int64(time.Millisecond),
+			ConnectionID:      c.id,
+			DomainName:        hostWithoutPort(c.host),
+			EventType:         eventType,
+			ExtendedRequestID: inv.requestID,
+			MessageDirection:  "IN",
+			RequestTime:       now.Format("02/Jan/2006:15:04:05 -0700"),
+			RequestTimeEpoch:  now.UnixNano() / int64(time.Millisecond),
+			RouteKey:          routeKey,
+		},
+	}
+}
+
+// eventHeaders returns the headers of the handshake, which are included in the
+// $connect and $disconnect events.
+func (c *websocketConnection) eventHeaders() (map[string]string, map[string][]string) {
+	headers := map[string]string{"Host": c.host}
+	multiValueHeaders := map[string][]string{"Host": {c.host}}
+	for key, values := range c.header {
+		if key == "Host" {
+			continue
+		}
+		headers[key] = values[len(values)-1]
+		multiValueHeaders[key] = values
+	}
+	return headers, multiValueHeaders
+}
+
+// invoke invokes the lambda with an event of the connection, and logs the
+// errors. A response without a statusCode is a success, since API Gateway
+// only looks at the status code of the $connect route.
+func (c *websocketConnection) invoke(inv *invocation, event *events.APIGatewayWebsocketProxyRequest) (*events.APIGatewayProxyResponse, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	responsePayload, err := invokeLambda(inv, payload)
+	var lambdaErr *lambdaError
+	if errors.As(err, &lambdaErr) {
+		log.Printf("Lambda returned an error (request id %s, %s of WebSocket connection %s): %v\n%s", inv.requestID, event.RequestContext.RouteKey, c.id, err, lambdaErr.stackTrace())
+		return nil, err
+	} else if err != nil {
+		log.Printf("Error invoking lambda (request id %s, %s of WebSocket connection %s): %v", inv.requestID, event.RequestContext.RouteKey, c.id, err)
+		return nil, err
+	}
+	response := &events.APIGatewayProxyResponse{}
+	json.Unmarshal(responsePayload, response)
+	if response.StatusCode == 0 {
+		response.StatusCode = http.StatusOK
+	}
+	return response, nil
+}
+
+// readMessage returns the next data message, answering pings and closing the
+// connection when the client closes it.
+func (c *websocketConnection) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOpcode {
+		case opClose:
+			code, reason := closeNoStatus, ""
+			if len(payload) >= 2 {
+				code, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+			}
+			c.close(code, reason)
+			return 0, nil, errWebSocketClosed
+		case opPing:
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opText, opBinary:
+			if message != nil {
+				c.close(closeProtocolError, "expected a continuation frame")
+				return 0, nil, errWebSocketClosed
+			}
+			opcode, message = frameOpcode, payload
+		case opContinuation:
+			if message == nil {
+				c.close(closeProtocolError, "unexpected continuation frame")
+				return 0, nil, errWebSocketClosed
+			}
+			message = append(message, payload...)
+		default:
+			c.close(closeUnsupportedData, "unsupported opcode")
+			return 0, nil, errWebSocketClosed
+		}
+		if len(message) > maxWebSocketMessage {
+			c.close(closeMessageTooBig, "Message too long")
+			return 0, nil, errWebSocketClosed
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *websocketConnection) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+	if header[0]&0x70 != 0 || header[1]&0x80 == 0 {
+		// Extensions aren't negotiated, and clients have to mask their frames
+		c.close(closeProtocolError, "")
+		return false, 0, nil, errWebSocketClosed
+	}
+	length := uint64(header[1] & 0x7f)
+	if length == 126 {
+		var b [2]byte
+		if _, err := io.ReadFull(c.reader, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	} else if length == 127 {
+		var b [8]byte
+		if _, err := io.ReadFull(c.reader, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if length > maxWebSocketMessage {
+		c.close(closeMessageTooBig, "Message too long")
+		return false, 0, nil, errWebSocketClosed
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (c *websocketConnection) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// send sends a message to the client, as a text message unless it is binary.
+func (c *websocketConnection) send(data []byte) error {
+	if IsBinary(string(data)) {
+		return c.writeFrame(opBinary, data)
+	}
+	return c.writeFrame(opText, data)
+}
+
+// close sends a close frame and closes the connection. The first call
+// decides the status code of the $disconnect event.
+func (c *websocketConnection) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		if code != closeAbnormal && code != closeNoStatus {
+			payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+			c.writeFrame(opClose, append(payload, reason...))
+		}
+		c.conn.Close()
+	})
+}
+
+// handleConnections serves the @connections API, which the lambda uses to
+// send messages to a client (POST), get information about the connection
+// (GET) and disconnect it (DELETE).
+func handleConnections(w http.ResponseWriter, r *http.Request, id string) {
+	websocketConnections.Lock()
+	c := websocketConnections.m[id]
+	websocketConnections.Unlock()
+	if c == nil {
+		w.Header().Set("x-amzn-ErrorType", "GoneException")
+		writeAdminJSON(w, http.StatusGone, map[string]interface{}{"message": nil})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebSocketMessage+1))
+		if err != nil {
+			(&gatewayError{"BAD_REQUEST_BODY", http.StatusBadRequest, "Error reading body"}).write(w, nil)
+			return
+		} else if len(data) > maxWebSocketMessage {
+			w.Header().Set("x-amzn-ErrorType", "PayloadTooLargeException")
+			writeAdminJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{"message": "Message too long"})
+			return
+		}
+		if err := c.send(data); err != nil {
+			w.Header().Set("x-amzn-ErrorType", "GoneException")
+			writeAdminJSON(w, http.StatusGone, map[string]interface{}{"message": nil})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		format := "2006-01-02T15:04:05.000Z"
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{
+			"connectedAt": c.connectedAt.UTC().Format(format),
+			"identity": map[string]string{
+				"sourceIp":  c.identity.SourceIP,
+				"userAgent": c.identity.UserAgent,
+			},
+			"lastActiveAt": time.Unix(0, c.lastActiveAt.Load()).UTC().Format(format),
+		})
+	case http.MethodDelete:
+		c.close(closeGoingAway, "")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		(&gatewayError{"DEFAULT_4XX", http.StatusMethodNotAllowed, fmt.Sprintf("Method %s is not supported by the @connections API", r.Method)}).write(w, nil)
+	}
+}